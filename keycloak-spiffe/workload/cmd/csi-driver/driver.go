@@ -0,0 +1,279 @@
+// driver.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/spire"
+)
+
+const (
+	driverName    = "token.csi.keycloak-spiffe.idyatech.fr"
+	driverVersion = "0.1.0"
+
+	// tokenFile is the name of the access token file in the volumes.
+	tokenFile = "token"
+	// retryInterval is the delay before retrying a failed refresh.
+	retryInterval = 10 * time.Second
+)
+
+// Volume context keys set by the kubelet with podInfoOnMount, and the
+// volume attributes accepted from the pod spec.
+const (
+	contextPodUID    = "csi.storage.k8s.io/pod.uid"
+	contextEphemeral = "csi.storage.k8s.io/ephemeral"
+	attrAudience     = "audience"
+	attrRealm        = "realm"
+)
+
+// driverConfig holds the settings shared by all the volumes.
+type driverConfig struct {
+	NodeID         string
+	KeycloakURL    string
+	Realm          string
+	Audience       string
+	RenewThreshold float64
+}
+
+// driver is a node-only CSI plugin publishing ephemeral volumes that hold
+// a Keycloak access token obtained with the SPIFFE identity of the pod.
+type driver struct {
+	csi.UnimplementedIdentityServer
+	csi.UnimplementedNodeServer
+
+	cfg        driverConfig
+	identities *spire.DelegatedIdentity
+	client     *http.Client
+	paths      *keycloak.PathResolver
+
+	mu         sync.Mutex
+	volumes    map[string]context.CancelFunc
+	publishing map[string]bool
+}
+
+// volumeSpec is what a volume needs to obtain its tokens.
+type volumeSpec struct {
+	id       string
+	target   string
+	podUID   string
+	realm    string
+	audience string
+}
+
+func (d *driver) GetPluginInfo(context.Context, *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	return &csi.GetPluginInfoResponse{Name: driverName, VendorVersion: driverVersion}, nil
+}
+
+func (d *driver) GetPluginCapabilities(context.Context, *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	return &csi.GetPluginCapabilitiesResponse{}, nil
+}
+
+func (d *driver) Probe(context.Context, *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	return &csi.ProbeResponse{}, nil
+}
+
+func (d *driver) NodeGetInfo(context.Context, *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	return &csi.NodeGetInfoResponse{NodeId: d.cfg.NodeID}, nil
+}
+
+func (d *driver) NodeGetCapabilities(context.Context, *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{}, nil
+}
+
+// NodePublishVolume mounts a tmpfs at the target path, writes the first
+// token and keeps it refreshed until the volume is unpublished. The kubelet
+// republishes the volumes periodically, which restarts the refresh of the
+// volumes published before a driver restart.
+func (d *driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	spec, err := d.volumeSpec(req)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if spec.audience == "" {
+		if spec.audience, err = d.paths.RealmURL(ctx, spec.realm); err != nil {
+			return nil, status.Errorf(codes.Unavailable, "detecting the Keycloak paths: %v", err)
+		}
+	}
+
+	// A retry of the kubelet while the volume is being published would
+	// mount a second tmpfs over the first one.
+	d.mu.Lock()
+	_, running := d.volumes[spec.id]
+	pending := d.publishing[spec.id]
+	if !running && !pending {
+		d.publishing[spec.id] = true
+	}
+	d.mu.Unlock()
+	if running {
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+	if pending {
+		return nil, status.Errorf(codes.Aborted, "volume %s is being published", spec.id)
+	}
+	defer func() {
+		d.mu.Lock()
+		delete(d.publishing, spec.id)
+		d.mu.Unlock()
+	}()
+
+	mounted := false
+	if _, err := os.Stat(filepath.Join(spec.target, tokenFile)); err != nil {
+		if err := os.MkdirAll(spec.target, 0o755); err != nil {
+			return nil, status.Errorf(codes.Internal, "creating target path: %v", err)
+		}
+		if err := mountTmpfs(spec.target); err != nil {
+			return nil, status.Errorf(codes.Internal, "mounting tmpfs: %v", err)
+		}
+		mounted = true
+	}
+
+	lifetime, err := d.refreshToken(ctx, spec)
+	if err != nil {
+		// The kubelet retries the publish, which mounts the tmpfs again.
+		if mounted {
+			if err := unmountTmpfs(spec.target); err != nil {
+				slog.Warn("Failed to unmount the token volume", "volume", spec.id, "error", err)
+			}
+		}
+		return nil, status.Errorf(codes.Unavailable, "obtaining the access token: %v", err)
+	}
+
+	refreshCtx, cancel := context.WithCancel(context.Background())
+	d.mu.Lock()
+	d.volumes[spec.id] = cancel
+	d.mu.Unlock()
+	go d.refreshLoop(refreshCtx, spec, lifetime)
+
+	slog.Info("Published token volume", "volume", spec.id, "pod_uid", spec.podUID, "audience", spec.audience)
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// NodeUnpublishVolume stops the refresh and unmounts the volume.
+func (d *driver) NodeUnpublishVolume(_ context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" || req.GetTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID and target path are required")
+	}
+
+	d.mu.Lock()
+	if cancel, ok := d.volumes[req.GetVolumeId()]; ok {
+		cancel()
+		delete(d.volumes, req.GetVolumeId())
+	}
+	d.mu.Unlock()
+
+	if err := unmountTmpfs(req.GetTargetPath()); err != nil {
+		return nil, status.Errorf(codes.Internal, "unmounting: %v", err)
+	}
+	if err := os.Remove(req.GetTargetPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, status.Errorf(codes.Internal, "removing target path: %v", err)
+	}
+	slog.Info("Unpublished token volume", "volume", req.GetVolumeId())
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// volumeSpec validates req and returns the volume it describes.
+func (d *driver) volumeSpec(req *csi.NodePublishVolumeRequest) (volumeSpec, error) {
+	vc := req.GetVolumeContext()
+	spec := volumeSpec{
+		id:       req.GetVolumeId(),
+		target:   req.GetTargetPath(),
+		podUID:   vc[contextPodUID],
+		realm:    d.cfg.Realm,
+		audience: d.cfg.Audience,
+	}
+	switch {
+	case spec.id == "" || spec.target == "":
+		return spec, errors.New("volume ID and target path are required")
+	case vc[contextEphemeral] != "true":
+		return spec, errors.New("only ephemeral inline volumes are supported")
+	case spec.podUID == "":
+		return spec, errors.New("pod UID missing from the volume context, set podInfoOnMount on the CSIDriver")
+	}
+	if realm := vc[attrRealm]; realm != "" {
+		spec.realm = realm
+	}
+	if audience := vc[attrAudience]; audience != "" {
+		spec.audience = audience
+	}
+	return spec, nil
+}
+
+// refreshLoop renews the token of spec once RenewThreshold of its lifetime
+// has elapsed, until ctx is cancelled.
+func (d *driver) refreshLoop(ctx context.Context, spec volumeSpec, lifetime time.Duration) {
+	wait := d.renewAfter(lifetime)
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		lifetime, err := d.refreshToken(ctx, spec)
+		if err != nil {
+			slog.Warn("Token refresh failed", "volume", spec.id, "error", err)
+			wait = retryInterval
+			continue
+		}
+		wait = d.renewAfter(lifetime)
+	}
+}
+
+// renewAfter returns the delay before renewing a token valid for lifetime.
+func (d *driver) renewAfter(lifetime time.Duration) time.Duration {
+	if lifetime <= 0 {
+		return retryInterval
+	}
+	return time.Duration(float64(lifetime) * d.cfg.RenewThreshold)
+}
+
+// refreshToken fetches a JWT-SVID of the pod from the SPIRE Agent Delegated
+// Identity API, exchanges it with Keycloak and writes the access token. It
+// returns the token lifetime.
+func (d *driver) refreshToken(ctx context.Context, spec volumeSpec) (time.Duration, error) {
+	svid, err := d.identities.FetchJWTSVID(ctx, []string{"k8s:pod-uid:" + spec.podUID}, spec.audience)
+	if err != nil {
+		return 0, err
+	}
+
+	tokenEndpoint, err := d.paths.TokenEndpoint(ctx, spec.realm)
+	if err != nil {
+		return 0, fmt.Errorf("detecting the Keycloak paths: %w", err)
+	}
+	token, err := keycloak.Exchange(ctx, d.client, tokenEndpoint, svid.Token)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeFileAtomic(filepath.Join(spec.target, tokenFile), []byte(token.AccessToken)); err != nil {
+		return 0, err
+	}
+	return time.Duration(token.ExpiresIn) * time.Second, nil
+}
+
+// writeFileAtomic replaces path with data through a rename, so that the
+// application never reads a partial token.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("replacing %s: %w", path, err)
+	}
+	return nil
+}
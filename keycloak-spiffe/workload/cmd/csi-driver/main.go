@@ -0,0 +1,111 @@
+// main.go
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/spire"
+)
+
+func main() {
+	cfg := driverConfig{NodeID: os.Getenv("NODE_NAME")}
+	endpoint := flag.String("endpoint", "unix:///csi/csi.sock", "CSI endpoint served to the kubelet")
+	adminSocket := flag.String("admin-socket", "unix:///run/spire/admin/admin.sock", "SPIRE Agent admin socket serving the Delegated Identity API")
+	caFile := flag.String("ca-file", "", "CA certificate verifying Keycloak instead of the system roots")
+	legacyPath := flag.String("legacy-path", "auto", "Keycloak endpoint paths: true for the /auth prefix of Keycloak up to 16, false for Keycloak 17+, auto to detect them")
+	flag.StringVar(&cfg.NodeID, "node-id", cfg.NodeID, "node name reported to the kubelet (env NODE_NAME)")
+	flag.StringVar(&cfg.KeycloakURL, "keycloak-url", "", "Keycloak base URL")
+	flag.StringVar(&cfg.Realm, "realm", "spiffe", "default Keycloak realm of the volumes")
+	flag.StringVar(&cfg.Audience, "audience", "", "default JWT-SVID audience, the realm URL by default")
+	flag.Float64Var(&cfg.RenewThreshold, "renew-threshold", 0.8, "fraction of the token lifetime after which it is renewed")
+	flag.Parse()
+
+	if cfg.KeycloakURL == "" || cfg.NodeID == "" {
+		slog.Error("Both -keycloak-url and -node-id are required")
+		os.Exit(2)
+	}
+	cfg.KeycloakURL = strings.TrimRight(cfg.KeycloakURL, "/")
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if *caFile != "" {
+		pem, err := os.ReadFile(*caFile)
+		if err != nil {
+			slog.Error("Failed to read the CA file", "error", err)
+			os.Exit(1)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			slog.Error("No certificate found in the CA file", "path", *caFile)
+			os.Exit(1)
+		}
+	}
+
+	client := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	paths, err := keycloak.NewPathResolver(client, cfg.KeycloakURL, *legacyPath)
+	if err != nil {
+		slog.Error("Invalid -legacy-path", "error", err)
+		os.Exit(2)
+	}
+
+	identities, err := spire.NewDelegatedIdentity(*adminSocket)
+	if err != nil {
+		slog.Error("Failed to connect to the SPIRE Agent", "error", err)
+		os.Exit(1)
+	}
+	defer identities.Close()
+
+	d := &driver{
+		cfg:        cfg,
+		identities: identities,
+		client:     client,
+		paths:      paths,
+		volumes:    make(map[string]context.CancelFunc),
+		publishing: make(map[string]bool),
+	}
+
+	path := strings.TrimPrefix(*endpoint, "unix://")
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		slog.Error("Failed to remove the stale CSI socket", "error", err)
+		os.Exit(1)
+	}
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		slog.Error("Failed to listen on the CSI endpoint", "error", err)
+		os.Exit(1)
+	}
+
+	srv := grpc.NewServer()
+	csi.RegisterIdentityServer(srv, d)
+	csi.RegisterNodeServer(srv, d)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+	}()
+
+	slog.Info("Serving the CSI driver", "name", driverName, "endpoint", *endpoint, "node", cfg.NodeID)
+	if err := srv.Serve(lis); err != nil {
+		slog.Error("CSI server failed", "error", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+// mount_other.go
+package main
+
+import "errors"
+
+var errUnsupported = errors.New("the CSI driver only runs on Linux nodes")
+
+func mountTmpfs(string) error { return errUnsupported }
+
+func unmountTmpfs(string) error { return errUnsupported }
@@ -0,0 +1,44 @@
+// forwardauth.go
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// handleForwardAuth implements the Traefik ForwardAuth and nginx
+// auth_request protocol: the gateway sends the headers of the original
+// request, a 200 answer lets it through with the identity headers, any
+// other answer is returned to the client.
+func (s *authServer) handleForwardAuth(w http.ResponseWriter, r *http.Request) {
+	// Traefik sends the original method and URI in X-Forwarded headers,
+	// nginx has them in X-Original-* when configured.
+	method, uri := r.Header.Get("X-Forwarded-Method"), r.Header.Get("X-Forwarded-Uri")
+	if uri == "" {
+		method, uri = r.Header.Get("X-Original-Method"), r.Header.Get("X-Original-URI")
+	}
+	log := slog.With("method", method, "path", uri, "remote", r.RemoteAddr)
+
+	headers := make(map[string]string, len(r.Header))
+	for name := range r.Header {
+		headers[strings.ToLower(name)] = r.Header.Get(name)
+	}
+	claims, d := s.authenticate(r.Context(), r.Header.Get("Authorization"), policyInput(method, uri, headers, ""), log)
+	if d != nil {
+		if d.challenge != "" {
+			w.Header().Set("WWW-Authenticate", d.challenge)
+		}
+		http.Error(w, d.message, d.httpStatus)
+		return
+	}
+
+	// No mTLS peer is known behind a gateway, the SPIFFE ID header is
+	// only set by the Envoy API.
+	for name, value := range identity(claims, "") {
+		if value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,192 @@
+// main.go
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/tokenauth"
+)
+
+// pathRetryInterval is the delay before detecting the Keycloak paths again.
+const pathRetryInterval = 5 * time.Second
+
+// listFlag is a repeatable flag also accepting comma-separated values.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(v string) error {
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+func main() {
+	var audiences, realmRoles, scopes, peerIDs listFlag
+	addr := flag.String("addr", ":9191", "gRPC listen address of the authorization service")
+	httpAddr := flag.String("http-addr", "", "listen address of the Traefik ForwardAuth and nginx auth_request endpoint (/auth), disabled when empty")
+	keycloakURL := flag.String("keycloak-url", "", "Keycloak base URL, used to fetch the realm keys")
+	realm := flag.String("realm", "spiffe", "Keycloak realm issuing the tokens")
+	issuer := flag.String("issuer", "", "expected iss claim, the realm URL by default (set it when Keycloak has a public hostname)")
+	caFile := flag.String("ca-file", "", "CA certificate verifying Keycloak instead of the system roots")
+	legacyPath := flag.String("legacy-path", "auto", "Keycloak endpoint paths: true for the /auth prefix of Keycloak up to 16, false for Keycloak 17+, auto to detect them at startup")
+	leeway := flag.Duration("leeway", 30*time.Second, "clock skew tolerated on the token expiry")
+	flag.Var(&audiences, "audience", "accepted aud claim, repeatable, not checked when unset")
+	flag.Var(&realmRoles, "realm-role", "realm role required from the callers, repeatable")
+	flag.Var(&scopes, "scope", "scope required from the callers, repeatable")
+	flag.Var(&peerIDs, "peer-spiffe-id", "glob pattern of the SPIFFE IDs of the mTLS peers allowed to call, repeatable, any peer when unset")
+	opaURL := flag.String("opa-url", "", "OPA decision URL asked about the requests with a valid token, such as http://127.0.0.1:8181/v1/data/envoy/authz/allow, disabled when empty")
+	opaTimeout := flag.Duration("opa-timeout", 2*time.Second, "timeout of the OPA decisions")
+	flag.Parse()
+
+	if *keycloakURL == "" {
+		slog.Error("-keycloak-url is required")
+		os.Exit(2)
+	}
+	for _, pattern := range peerIDs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			slog.Error("Invalid -peer-spiffe-id pattern", "pattern", pattern, "error", err)
+			os.Exit(2)
+		}
+	}
+
+	client, err := keycloakClient(*caFile)
+	if err != nil {
+		slog.Error("Failed to configure the Keycloak client", "error", err)
+		os.Exit(1)
+	}
+	paths, err := keycloak.NewPathResolver(client, strings.TrimRight(*keycloakURL, "/"), *legacyPath)
+	if err != nil {
+		slog.Error("Invalid -legacy-path", "error", err)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	realmURL, err := detectRealmURL(ctx, paths, *realm)
+	if err != nil {
+		return
+	}
+	md := keycloak.StaticRealmMetadata(realmURL)
+	if *issuer == "" {
+		*issuer = md.Issuer
+	}
+	srv := &authServer{
+		verifier: tokenauth.NewVerifier(tokenauth.NewKeySet(client, md.JWKSURI), *issuer,
+			tokenauth.WithAudience(audiences...), tokenauth.WithLeeway(*leeway)),
+		opts:    []tokenauth.Option{tokenauth.RequireRealmRoles(realmRoles...), tokenauth.RequireScopes(scopes...)},
+		peerIDs: peerIDs,
+	}
+	if *opaURL != "" {
+		// The sidecar is reached over plain HTTP on the loopback.
+		opa := tokenauth.NewOPA(&http.Client{Timeout: *opaTimeout}, *opaURL)
+		srv.opts = append(srv.opts, tokenauth.RequirePolicy(opa))
+	}
+
+	lis, err := net.Listen("tcp", *addr)
+	if err != nil {
+		slog.Error("Failed to listen", "addr", *addr, "error", err)
+		os.Exit(1)
+	}
+	grpcServer := grpc.NewServer()
+	authv3.RegisterAuthorizationServer(grpcServer, srv)
+	healthpb.RegisterHealthServer(grpcServer, health.NewServer())
+
+	go func() {
+		<-ctx.Done()
+		grpcServer.GracefulStop()
+	}()
+	if *httpAddr != "" {
+		go serveForwardAuth(ctx, *httpAddr, srv)
+	}
+
+	slog.Info("Serving the external authorization API", "addr", *addr, "issuer", *issuer, "opa_url", *opaURL)
+	if err := grpcServer.Serve(lis); err != nil {
+		slog.Error("Authorization server failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+// serveForwardAuth serves the forward-auth endpoint on addr until ctx is
+// cancelled.
+func serveForwardAuth(ctx context.Context, addr string, s *authServer) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth", s.handleForwardAuth)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("Serving the forward-auth endpoint", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Forward-auth server failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+// keycloakClient returns the HTTP client fetching the realm keys.
+func keycloakClient(caFile string) (*http.Client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport, Timeout: 10 * time.Second}, nil
+}
+
+// detectRealmURL returns the URL of realm, retrying a failed detection of
+// its paths, for instance while Keycloak is starting, until ctx is
+// cancelled: a wrong prefix would deny every token.
+func detectRealmURL(ctx context.Context, paths *keycloak.PathResolver, realm string) (string, error) {
+	for {
+		attemptCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		realmURL, err := paths.RealmURL(attemptCtx, realm)
+		cancel()
+		if err == nil {
+			return realmURL, nil
+		}
+		slog.Warn("Failed to detect the Keycloak paths, retrying (set -legacy-path)", "in", pathRetryInterval, "error", err)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(pathRetryInterval):
+		}
+	}
+}
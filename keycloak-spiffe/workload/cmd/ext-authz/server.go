@@ -0,0 +1,176 @@
+// server.go
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/tokenauth"
+)
+
+// Identity headers added to the allowed requests, and removed from the
+// incoming ones so that callers cannot forge them.
+const (
+	headerSubject  = "x-keycloak-subject"
+	headerClientID = "x-keycloak-client-id"
+	headerRoles    = "x-keycloak-roles"
+	headerScope    = "x-keycloak-scope"
+	headerSPIFFEID = "x-spiffe-id"
+)
+
+var identityHeaders = []string{headerSubject, headerClientID, headerRoles, headerScope, headerSPIFFEID}
+
+// authServer implements the Envoy external authorization API: the access
+// token of the Authorization header is validated against the realm keys
+// and, when peer IDs are configured, the SPIFFE ID of the mTLS peer.
+type authServer struct {
+	authv3.UnimplementedAuthorizationServer
+
+	verifier *tokenauth.Verifier
+	opts     []tokenauth.Option
+	// peerIDs are the glob patterns of the SPIFFE IDs allowed to call,
+	// any peer when empty.
+	peerIDs []string
+}
+
+// denial describes why a request is rejected.
+type denial struct {
+	code       codes.Code
+	httpStatus int
+	challenge  string
+	message    string
+}
+
+func (s *authServer) Check(ctx context.Context, req *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	attrs := req.GetAttributes()
+	httpReq := attrs.GetRequest().GetHttp()
+	peerID := attrs.GetSource().GetPrincipal()
+	log := slog.With("method", httpReq.GetMethod(), "path", httpReq.GetPath(), "peer", peerID)
+
+	if len(s.peerIDs) > 0 && !matchAny(s.peerIDs, peerID) {
+		log.Info("Denied request from unexpected peer")
+		return denied(denial{codes.PermissionDenied, http.StatusForbidden, "", "peer not allowed"}), nil
+	}
+	// Envoy lowercases the header names of the check request.
+	headers := httpReq.GetHeaders()
+	claims, d := s.authenticate(ctx, headers["authorization"], policyInput(httpReq.GetMethod(), httpReq.GetPath(), headers, peerID), log)
+	if d != nil {
+		return denied(*d), nil
+	}
+	return allowed(identity(claims, peerID)), nil
+}
+
+// authenticate validates the Authorization header value of the request
+// described by input.
+func (s *authServer) authenticate(ctx context.Context, header string, input tokenauth.PolicyInput, log *slog.Logger) (*tokenauth.Claims, *denial) {
+	token, ok := tokenauth.BearerToken(header)
+	if !ok {
+		log.Debug("Denied request without bearer token")
+		return nil, &denial{codes.Unauthenticated, http.StatusUnauthorized, `Bearer`, "missing bearer token"}
+	}
+
+	claims, err := tokenauth.AuthenticateRequest(ctx, s.verifier, token, input, s.opts...)
+	switch {
+	case errors.Is(err, tokenauth.ErrInvalidToken):
+		log.Info("Denied request with invalid token", "error", err)
+		return nil, &denial{codes.Unauthenticated, http.StatusUnauthorized, `Bearer error="invalid_token"`, "invalid bearer token"}
+	case errors.Is(err, tokenauth.ErrForbidden):
+		log.Info("Denied request with insufficient permissions", "error", err)
+		return nil, &denial{codes.PermissionDenied, http.StatusForbidden, `Bearer error="insufficient_scope"`, "forbidden"}
+	case err != nil:
+		log.Warn("Token validation failed", "error", err)
+		return nil, &denial{codes.Unavailable, http.StatusServiceUnavailable, "", "token validation unavailable"}
+	}
+	log.Debug("Allowed request", "subject", claims.Subject, "client_id", clientID(claims))
+	return claims, nil
+}
+
+// policyInput describes a request to the policies, by the method, URI
+// and lowercase header names the gateway gives.
+func policyInput(method, uri string, headers map[string]string, peerID string) tokenauth.PolicyInput {
+	in := tokenauth.PolicyInput{Method: method, Headers: make(map[string]string, len(headers)), PeerSPIFFEID: peerID}
+	in.Path, _, _ = strings.Cut(uri, "?")
+	for name, value := range headers {
+		if !tokenauth.SecretHeader(name) {
+			in.Headers[name] = value
+		}
+	}
+	return in
+}
+
+// identity returns the identity header values of claims and peerID, empty
+// for the headers to remove.
+func identity(claims *tokenauth.Claims, peerID string) map[string]string {
+	return map[string]string{
+		headerSubject:  claims.Subject,
+		headerClientID: clientID(claims),
+		headerRoles:    strings.Join(claims.RealmAccess.Roles, ","),
+		headerScope:    claims.Scope,
+		headerSPIFFEID: peerID,
+	}
+}
+
+// allowed returns an OK response replacing the identity headers with
+// values.
+func allowed(values map[string]string) *authv3.CheckResponse {
+	ok := &authv3.OkHttpResponse{}
+	for _, name := range identityHeaders {
+		if values[name] == "" {
+			ok.HeadersToRemove = append(ok.HeadersToRemove, name)
+			continue
+		}
+		ok.Headers = append(ok.Headers, &corev3.HeaderValueOption{
+			Header:       &corev3.HeaderValue{Key: name, Value: values[name]},
+			AppendAction: corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+		})
+	}
+	return &authv3.CheckResponse{
+		Status:       &rpcstatus.Status{Code: int32(codes.OK)},
+		HttpResponse: &authv3.CheckResponse_OkResponse{OkResponse: ok},
+	}
+}
+
+// denied returns a response rejecting the request as described by d.
+func denied(d denial) *authv3.CheckResponse {
+	resp := &authv3.DeniedHttpResponse{
+		Status: &typev3.HttpStatus{Code: typev3.StatusCode(d.httpStatus)},
+		Body:   d.message + "\n",
+	}
+	if d.challenge != "" {
+		resp.Headers = []*corev3.HeaderValueOption{{
+			Header: &corev3.HeaderValue{Key: "www-authenticate", Value: d.challenge},
+		}}
+	}
+	return &authv3.CheckResponse{
+		Status:       &rpcstatus.Status{Code: int32(d.code), Message: d.message},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{DeniedResponse: resp},
+	}
+}
+
+// clientID returns the client the token was issued to.
+func clientID(claims *tokenauth.Claims) string {
+	if claims.ClientID != "" {
+		return claims.ClientID
+	}
+	return claims.AuthorizedParty
+}
+
+// matchAny reports whether id matches one of the glob patterns.
+func matchAny(patterns []string, id string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, id); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,200 @@
+// inject.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+// Pod annotations read and written by the injector.
+const (
+	annotationPrefix   = "keycloak-spiffe.idyatech.fr/"
+	annotationInject   = annotationPrefix + "inject"
+	annotationInjected = annotationPrefix + "injected"
+	annotationAudience = annotationPrefix + "audience"
+	annotationRealm    = annotationPrefix + "realm"
+)
+
+const (
+	sidecarName      = "keycloak-spiffe-workload"
+	socketVolumeName = "spire-agent-socket"
+	tokensVolumeName = "keycloak-tokens"
+	socketMountPath  = "/spiffe-workload-api"
+)
+
+// injectorConfig describes the sidecar added to the annotated pods.
+type injectorConfig struct {
+	Image       string
+	KeycloakURL string
+	Realm       string
+	// SocketHostPath is the host directory of the SPIRE Agent socket, used
+	// unless CSIDriver is set.
+	SocketHostPath string
+	CSIDriver      string
+	SocketName     string
+	TokensPath     string
+	// EnvConfigMap holds additional workload settings, such as TLS_CA_FILE.
+	EnvConfigMap string
+	// NativeSidecar injects the workload as an init container restarting
+	// always (Kubernetes 1.29+), started before the app containers.
+	NativeSidecar bool
+}
+
+// patchOp is a JSON patch (RFC 6902) operation.
+type patchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// review answers an admission review, patching the pod when it asks for
+// injection.
+func (c injectorConfig) review(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	resp := &admissionv1.AdmissionResponse{UID: req.UID, Allowed: true}
+
+	var pod corev1.Pod
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		resp.Allowed = false
+		resp.Result = &metav1.Status{Message: fmt.Sprintf("decoding pod: %v", err)}
+		return resp
+	}
+	if !wantsInjection(&pod) {
+		return resp
+	}
+
+	patch, err := json.Marshal(c.patch(&pod))
+	if err != nil {
+		resp.Allowed = false
+		resp.Result = &metav1.Status{Message: fmt.Sprintf("encoding patch: %v", err)}
+		return resp
+	}
+	resp.Patch = patch
+	resp.PatchType = ptr.To(admissionv1.PatchTypeJSONPatch)
+	return resp
+}
+
+// wantsInjection reports whether pod is annotated for injection and does not
+// have the sidecar yet, which happens when the webhook is reinvoked.
+func wantsInjection(pod *corev1.Pod) bool {
+	if pod.Annotations[annotationInject] != "true" || pod.Annotations[annotationInjected] == "true" {
+		return false
+	}
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, c := range containers {
+			if c.Name == sidecarName {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// patch returns the operations adding the sidecar and its volumes to pod.
+func (c injectorConfig) patch(pod *corev1.Pod) []patchOp {
+	tokensMount := corev1.VolumeMount{Name: tokensVolumeName, MountPath: c.TokensPath, ReadOnly: true}
+	containers := make([]corev1.Container, len(pod.Spec.Containers))
+	for i, container := range pod.Spec.Containers {
+		container.VolumeMounts = append(container.VolumeMounts, tokensMount)
+		containers[i] = container
+	}
+
+	volumes := append(pod.Spec.Volumes, c.socketVolume(), corev1.Volume{
+		Name:         tokensVolumeName,
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory}},
+	})
+
+	ops := []patchOp{
+		{Op: "add", Path: "/spec/volumes", Value: volumes},
+	}
+	sidecar := c.sidecar(pod)
+	if c.NativeSidecar {
+		// The sidecar comes first so that the other init containers get tokens.
+		initContainers := append([]corev1.Container{sidecar}, pod.Spec.InitContainers...)
+		ops = append(ops, patchOp{Op: "add", Path: "/spec/initContainers", Value: initContainers})
+	} else {
+		containers = append(containers, sidecar)
+	}
+	ops = append(ops, patchOp{Op: "add", Path: "/spec/containers", Value: containers})
+
+	if pod.Annotations == nil {
+		ops = append(ops, patchOp{Op: "add", Path: "/metadata/annotations", Value: map[string]string{annotationInjected: "true"}})
+	} else {
+		ops = append(ops, patchOp{Op: "add", Path: "/metadata/annotations/" + escapePointer(annotationInjected), Value: "true"})
+	}
+	return ops
+}
+
+// sidecar returns the workload container running in sidecar mode.
+func (c injectorConfig) sidecar(pod *corev1.Pod) corev1.Container {
+	realm := c.Realm
+	if r := pod.Annotations[annotationRealm]; r != "" {
+		realm = r
+	}
+	env := []corev1.EnvVar{
+		{Name: "SPIFFE_ENDPOINT_SOCKET", Value: "unix://" + socketMountPath + "/" + c.SocketName},
+		{Name: "KEYCLOAK_URL", Value: c.KeycloakURL},
+		{Name: "REALM", Value: realm},
+		{Name: "SIDECAR_DIR", Value: c.TokensPath},
+		// The app containers may run as another user.
+		{Name: "TOKEN_FILE_MODE", Value: "0644"},
+	}
+	if audience := pod.Annotations[annotationAudience]; audience != "" {
+		env = append(env, corev1.EnvVar{Name: "AUDIENCE", Value: audience})
+	}
+
+	container := corev1.Container{
+		Name:  sidecarName,
+		Image: c.Image,
+		Env:   env,
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: socketVolumeName, MountPath: socketMountPath, ReadOnly: true},
+			{Name: tokensVolumeName, MountPath: c.TokensPath},
+		},
+		SecurityContext: &corev1.SecurityContext{
+			AllowPrivilegeEscalation: ptr.To(false),
+			ReadOnlyRootFilesystem:   ptr.To(true),
+		},
+	}
+	if c.EnvConfigMap != "" {
+		container.EnvFrom = []corev1.EnvFromSource{{
+			ConfigMapRef: &corev1.ConfigMapEnvSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: c.EnvConfigMap},
+				Optional:             ptr.To(true),
+			},
+		}}
+	}
+	if c.NativeSidecar {
+		container.RestartPolicy = ptr.To(corev1.ContainerRestartPolicyAlways)
+		container.StartupProbe = &corev1.Probe{
+			ProbeHandler: corev1.ProbeHandler{
+				Exec: &corev1.ExecAction{Command: []string{"test", "-f", c.TokensPath + "/ready"}},
+			},
+			PeriodSeconds:    2,
+			FailureThreshold: 60,
+		}
+	}
+	return container
+}
+
+// socketVolume returns the volume exposing the SPIRE Agent socket, from the
+// SPIFFE CSI driver when configured or from a host directory.
+func (c injectorConfig) socketVolume() corev1.Volume {
+	v := corev1.Volume{Name: socketVolumeName}
+	if c.CSIDriver != "" {
+		v.CSI = &corev1.CSIVolumeSource{Driver: c.CSIDriver, ReadOnly: ptr.To(true)}
+	} else {
+		v.HostPath = &corev1.HostPathVolumeSource{Path: c.SocketHostPath, Type: ptr.To(corev1.HostPathDirectory)}
+	}
+	return v
+}
+
+// escapePointer escapes s for use in a JSON pointer (RFC 6901).
+func escapePointer(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
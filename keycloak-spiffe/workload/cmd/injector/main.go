@@ -0,0 +1,112 @@
+// main.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// maxReviewSize bounds the admission review bodies read by the webhook.
+const maxReviewSize = 4 << 20
+
+func main() {
+	var cfg injectorConfig
+	addr := flag.String("addr", ":8443", "HTTPS listen address of the webhook")
+	certFile := flag.String("tls-cert", "/etc/injector/tls/tls.crt", "webhook TLS certificate")
+	keyFile := flag.String("tls-key", "/etc/injector/tls/tls.key", "webhook TLS private key")
+	flag.StringVar(&cfg.Image, "image", "", "image of the injected workload container")
+	flag.StringVar(&cfg.KeycloakURL, "keycloak-url", "", "KEYCLOAK_URL of the injected workload")
+	flag.StringVar(&cfg.Realm, "realm", "spiffe", "default REALM of the injected workload")
+	flag.StringVar(&cfg.SocketHostPath, "socket-host-path", "/run/spire/sockets", "host directory of the SPIRE Agent socket")
+	flag.StringVar(&cfg.CSIDriver, "csi-driver", "", "mount the socket with this CSI driver (e.g. csi.spiffe.io) instead of a hostPath")
+	flag.StringVar(&cfg.SocketName, "socket-name", "agent.sock", "file name of the SPIRE Agent socket")
+	flag.StringVar(&cfg.TokensPath, "tokens-path", "/var/run/tokens", "mount path of the token volume in every container")
+	flag.StringVar(&cfg.EnvConfigMap, "env-configmap", "", "ConfigMap with additional workload settings, in the pod namespace")
+	flag.BoolVar(&cfg.NativeSidecar, "native-sidecar", true, "inject a native sidecar init container (Kubernetes 1.29+)")
+	flag.Parse()
+
+	if cfg.Image == "" || cfg.KeycloakURL == "" {
+		slog.Error("Both -image and -keycloak-url are required")
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mutate", cfg.handleMutate)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	srv := &http.Server{Addr: *addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("Serving the injection webhook", "addr", *addr, "image", cfg.Image)
+	if err := srv.ListenAndServeTLS(*certFile, *keyFile); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Webhook server failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+// handleMutate decodes an AdmissionReview and answers it with the patch
+// injecting the workload sidecar.
+func (c injectorConfig) handleMutate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxReviewSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("reading request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		http.Error(w, "invalid AdmissionReview", http.StatusBadRequest)
+		return
+	}
+	review.Response = c.review(review.Request)
+	if review.Response.Patch != nil {
+		slog.Info("Injected the workload sidecar", "namespace", review.Request.Namespace, "pod", podName(review.Request))
+	}
+	review.Request = nil
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		slog.Warn("Failed to write the admission response", "error", err)
+	}
+}
+
+// podName returns the name of the reviewed pod, generated pods only have a
+// generateName at admission time.
+func podName(req *admissionv1.AdmissionRequest) string {
+	if req.Name != "" {
+		return req.Name
+	}
+	var meta struct {
+		Metadata struct {
+			GenerateName string `json:"generateName"`
+		} `json:"metadata"`
+	}
+	json.Unmarshal(req.Object.Raw, &meta)
+	return meta.Metadata.GenerateName
+}
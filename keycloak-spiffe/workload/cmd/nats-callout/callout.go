@@ -0,0 +1,160 @@
+// callout.go
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/tokenauth"
+)
+
+// serverXKeyHeader carries the curve key of the server of an encrypted
+// authorization request.
+const serverXKeyHeader = "Nats-Server-Xkey"
+
+// callout answers the authorization requests of the NATS servers: the
+// Keycloak access token or JWT-SVID sent as the token (or password) of a
+// client is validated, and the user JWT issued to the client carries the
+// permissions of the rules matching its identity and expires with the
+// token.
+type callout struct {
+	issuer  nkeys.KeyPair
+	xkey    nkeys.KeyPair
+	account string
+	rules   []rule
+	timeout time.Duration
+
+	keycloakIssuer string
+	keycloak       *tokenauth.Verifier
+	// spiffe validates the JWT-SVIDs, nil when they are not accepted.
+	spiffe *tokenauth.Verifier
+}
+
+// handle answers the authorization request msg.
+func (s *callout) handle(msg *nats.Msg) {
+	data := msg.Data
+	serverXKey := msg.Header.Get(serverXKeyHeader)
+	if serverXKey != "" {
+		if s.xkey == nil {
+			slog.Error("Encrypted authorization request, but no -xkey-seed-file", "server_xkey", serverXKey)
+			return
+		}
+		var err error
+		if data, err = s.xkey.Open(data, serverXKey); err != nil {
+			slog.Error("Failed to decrypt the authorization request", "error", err)
+			return
+		}
+	}
+	req, err := jwt.DecodeAuthorizationRequestClaims(string(data))
+	if err != nil {
+		slog.Error("Invalid authorization request", "error", err)
+		return
+	}
+	if !nkeys.IsValidPublicServerKey(req.Issuer) {
+		slog.Error("Authorization request not issued by a server", "issuer", req.Issuer)
+		return
+	}
+	log := slog.With("server", req.Server.Name, "client_host", req.ClientInformation.Host, "client_name", req.ConnectOptions.Name)
+
+	resp := jwt.NewAuthorizationResponseClaims(req.UserNkey)
+	resp.Audience = req.Server.ID
+	user, err := s.authorize(req)
+	if err != nil {
+		log.Info("Denied NATS connection", "error", err)
+		resp.Error = err.Error()
+	} else {
+		log.Info("Authorized NATS connection", "user", user.Name, "account", user.Audience,
+			"expires", time.Unix(user.Expires, 0).UTC())
+		if resp.Jwt, err = user.Encode(s.issuer); err != nil {
+			log.Error("Failed to sign the user JWT", "error", err)
+			resp.Jwt, resp.Error = "", "internal error"
+		}
+	}
+
+	token, err := resp.Encode(s.issuer)
+	if err != nil {
+		log.Error("Failed to sign the authorization response", "error", err)
+		return
+	}
+	out := []byte(token)
+	if serverXKey != "" {
+		if out, err = s.xkey.Seal(out, serverXKey); err != nil {
+			log.Error("Failed to encrypt the authorization response", "error", err)
+			return
+		}
+	}
+	if err := msg.Respond(out); err != nil {
+		log.Error("Failed to send the authorization response", "error", err)
+	}
+}
+
+// authorize validates the token of req and returns the claims of the user
+// JWT, or the reason the client is denied, sent back to the server.
+func (s *callout) authorize(req *jwt.AuthorizationRequestClaims) (*jwt.UserClaims, error) {
+	token := req.ConnectOptions.Token
+	if token == "" {
+		token = req.ConnectOptions.Password
+	}
+	if token == "" {
+		return nil, errors.New("no token")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	verifier := s.keycloak
+	spiffe := s.spiffe != nil && tokenIssuer(token) != s.keycloakIssuer
+	if spiffe {
+		verifier = s.spiffe
+	}
+	claims, err := verifier.Verify(ctx, token)
+	if err != nil {
+		if !errors.Is(err, tokenauth.ErrInvalidToken) {
+			slog.Warn("Token validation failed", "error", err)
+			return nil, errors.New("token validation unavailable")
+		}
+		return nil, errors.New("invalid token")
+	}
+	identity := claims.Subject
+	if !spiffe {
+		identity = claims.AuthorizedParty
+		if identity == "" {
+			identity = claims.ClientID
+		}
+	}
+
+	user := jwt.NewUserClaims(req.UserNkey)
+	user.Audience = s.account
+	user.Name = identity
+	user.Expires = claims.ExpiresAt
+	if !grant(s.rules, identity, claims, &user.Permissions) {
+		return nil, fmt.Errorf("no permissions for %s", identity)
+	}
+	return user, nil
+}
+
+// tokenIssuer returns the iss claim of token without verifying it.
+func tokenIssuer(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Issuer string `json:"iss"`
+	}
+	json.Unmarshal(payload, &claims)
+	return strings.TrimRight(claims.Issuer, "/")
+}
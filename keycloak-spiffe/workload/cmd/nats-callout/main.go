@@ -0,0 +1,214 @@
+// main.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/tokenauth"
+)
+
+// calloutSubject is the subject the NATS servers send the authorization
+// requests of the auth callout to.
+const calloutSubject = "$SYS.REQ.USER.AUTH"
+
+// pathRetryInterval is the delay before detecting the Keycloak paths again.
+const pathRetryInterval = 5 * time.Second
+
+// listFlag is a repeatable flag also accepting comma-separated values.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(v string) error {
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+func main() {
+	var audiences listFlag
+	natsURL := flag.String("nats-url", nats.DefaultURL, "URL of the NATS servers, comma-separated")
+	natsCreds := flag.String("nats-creds", "", "credentials file of the callout user (an auth_users user otherwise, with NATS_USER and NATS_PASSWORD)")
+	natsCA := flag.String("nats-ca-file", "", "CA certificate verifying the NATS servers instead of the system roots")
+	issuerSeed := flag.String("issuer-seed-file", "", "file of the account nkey seed signing the responses and the user JWTs, the issuer of the auth_callout block")
+	xkeySeed := flag.String("xkey-seed-file", "", "file of the curve key seed decrypting the requests, for an auth_callout block with an xkey")
+	account := flag.String("account", "$G", "account the users are placed in, its name without an operator")
+	permissionsFile := flag.String("permissions", "", "YAML file of the rules granting the NATS permissions")
+	keycloakURL := flag.String("keycloak-url", "", "Keycloak base URL, used to fetch the realm keys")
+	realm := flag.String("realm", "spiffe", "Keycloak realm issuing the tokens")
+	issuer := flag.String("issuer", "", "expected iss claim, the realm URL by default (set it when Keycloak has a public hostname)")
+	caFile := flag.String("ca-file", "", "CA certificate verifying Keycloak and the SPIFFE JWKS instead of the system roots")
+	legacyPath := flag.String("legacy-path", "auto", "Keycloak endpoint paths: true for the /auth prefix of Keycloak up to 16, false for Keycloak 17+, auto to detect them at startup")
+	flag.Var(&audiences, "audience", "accepted aud claim of the Keycloak tokens, repeatable, nats by default (an audience mapper of the Keycloak clients adds it)")
+	spiffeJWKS := flag.String("spiffe-jwks-url", "", "JWKS of the SPIRE JWT keys (workload jwks or the OIDC Discovery Provider) accepting JWT-SVIDs, not accepted when empty")
+	spiffeIssuer := flag.String("spiffe-issuer", "", "iss claim of the JWT-SVIDs, the jwt_issuer of the SPIRE Server, none when empty")
+	spiffeAudience := flag.String("spiffe-audience", "nats", "aud claim required in the JWT-SVIDs")
+	leeway := flag.Duration("leeway", 30*time.Second, "clock skew tolerated on the token expiry")
+	timeout := flag.Duration("timeout", 2*time.Second, "time allowed to validate a token, within the timeout of the auth callout")
+	flag.Parse()
+
+	if *keycloakURL == "" || *issuerSeed == "" || *permissionsFile == "" {
+		slog.Error("-keycloak-url, -issuer-seed-file and -permissions are required")
+		os.Exit(2)
+	}
+	if len(audiences) == 0 {
+		// Any token of the realm would be accepted otherwise.
+		audiences = listFlag{"nats"}
+	}
+
+	s, err := newCallout(*issuerSeed, *xkeySeed, *permissionsFile)
+	if err != nil {
+		slog.Error("Failed to configure the auth callout", "error", err)
+		os.Exit(1)
+	}
+	s.account = *account
+	s.timeout = *timeout
+
+	client, err := httpClient(*caFile)
+	if err != nil {
+		slog.Error("Failed to configure the Keycloak client", "error", err)
+		os.Exit(1)
+	}
+	paths, err := keycloak.NewPathResolver(client, strings.TrimRight(*keycloakURL, "/"), *legacyPath)
+	if err != nil {
+		slog.Error("Invalid -legacy-path", "error", err)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	realmURL, err := detectRealmURL(ctx, paths, *realm)
+	if err != nil {
+		return
+	}
+	md := keycloak.StaticRealmMetadata(realmURL)
+	if *issuer == "" {
+		*issuer = md.Issuer
+	}
+	s.keycloakIssuer = strings.TrimRight(*issuer, "/")
+	s.keycloak = tokenauth.NewVerifier(tokenauth.NewKeySet(client, md.JWKSURI), *issuer,
+		tokenauth.WithAudience(audiences...), tokenauth.WithLeeway(*leeway))
+	if *spiffeJWKS != "" {
+		s.spiffe = tokenauth.NewVerifier(tokenauth.NewKeySet(client, *spiffeJWKS), *spiffeIssuer,
+			tokenauth.WithAudience(*spiffeAudience), tokenauth.WithLeeway(*leeway))
+	}
+
+	opts := []nats.Option{
+		nats.Name("keycloak-spiffe auth callout"),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			slog.Warn("Disconnected from NATS", "error", err)
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			slog.Info("Reconnected to NATS", "url", nc.ConnectedUrl())
+		}),
+	}
+	if *natsCreds != "" {
+		opts = append(opts, nats.UserCredentials(*natsCreds))
+	} else if user := os.Getenv("NATS_USER"); user != "" {
+		opts = append(opts, nats.UserInfo(user, os.Getenv("NATS_PASSWORD")))
+	}
+	if *natsCA != "" {
+		opts = append(opts, nats.RootCAs(*natsCA))
+	}
+	nc, err := nats.Connect(*natsURL, opts...)
+	if err != nil {
+		slog.Error("Failed to connect to NATS", "url", *natsURL, "error", err)
+		os.Exit(1)
+	}
+	// Instances share the requests through the queue group.
+	if _, err := nc.QueueSubscribe(calloutSubject, "keycloak-spiffe", s.handle); err != nil {
+		slog.Error("Failed to subscribe to the auth callout", "error", err)
+		os.Exit(1)
+	}
+
+	slog.Info("Serving the NATS auth callout", "url", nc.ConnectedUrl(), "account", s.account, "issuer", *issuer, "rules", len(s.rules))
+	<-ctx.Done()
+	if err := nc.Drain(); err != nil {
+		nc.Close()
+	}
+}
+
+// newCallout returns the auth callout signing with the seed of issuerFile,
+// decrypting with the one of xkeyFile when set, with the rules of
+// permissionsFile.
+func newCallout(issuerFile, xkeyFile, permissionsFile string) (*callout, error) {
+	seed, err := os.ReadFile(issuerFile)
+	if err != nil {
+		return nil, err
+	}
+	s := &callout{}
+	if s.issuer, err = nkeys.FromSeed(bytes.TrimSpace(seed)); err != nil {
+		return nil, fmt.Errorf("parsing the issuer seed: %w", err)
+	}
+	if xkeyFile != "" {
+		seed, err := os.ReadFile(xkeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if s.xkey, err = nkeys.FromCurveSeed(bytes.TrimSpace(seed)); err != nil {
+			return nil, fmt.Errorf("parsing the xkey seed: %w", err)
+		}
+	}
+	if s.rules, err = loadRules(permissionsFile); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// httpClient returns the HTTP client fetching the realm and SPIFFE keys.
+func httpClient(caFile string) (*http.Client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport, Timeout: 10 * time.Second}, nil
+}
+
+// detectRealmURL returns the URL of realm, retrying a failed detection of
+// its paths, for instance while Keycloak is starting, until ctx is
+// cancelled: a wrong prefix would deny every user.
+func detectRealmURL(ctx context.Context, paths *keycloak.PathResolver, realm string) (string, error) {
+	for {
+		attemptCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		realmURL, err := paths.RealmURL(attemptCtx, realm)
+		cancel()
+		if err == nil {
+			return realmURL, nil
+		}
+		slog.Warn("Failed to detect the Keycloak paths, retrying (set -legacy-path)", "in", pathRetryInterval, "error", err)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(pathRetryInterval):
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// permissions.go
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/nats-io/jwt/v2"
+	"gopkg.in/yaml.v3"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/tokenauth"
+)
+
+// rule grants NATS permissions to the identities it matches: the client ID
+// (azp) of a Keycloak token or the SPIFFE ID of a JWT-SVID matching the
+// glob pattern Identity, holding all RealmRoles. A Keycloak client ID is
+// the SPIFFE ID of its workload, so one pattern covers both.
+type rule struct {
+	Identity   string   `yaml:"identity"`
+	RealmRoles []string `yaml:"realm_roles"`
+	Publish    subjects `yaml:"publish"`
+	Subscribe  subjects `yaml:"subscribe"`
+	// AllowResponses lets the user publish one reply to each request it
+	// receives, the replies of a service.
+	AllowResponses bool `yaml:"allow_responses"`
+}
+
+// subjects are the subjects, with wildcards, allowed and denied to a user.
+type subjects struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// loadRules reads the rules of the YAML file name.
+func loadRules(name string) ([]rule, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var rules []rule
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", name, err)
+	}
+	for i, r := range rules {
+		if _, err := path.Match(r.Identity, ""); err != nil || r.Identity == "" {
+			return nil, fmt.Errorf("%s: rule %d: invalid identity pattern %q", name, i+1, r.Identity)
+		}
+	}
+	return rules, nil
+}
+
+// matches reports whether r applies to identity with the claims.
+func (r rule) matches(identity string, claims *tokenauth.Claims) bool {
+	if ok, _ := path.Match(r.Identity, identity); !ok {
+		return false
+	}
+	for _, role := range r.RealmRoles {
+		if !claims.HasRealmRole(role) {
+			return false
+		}
+	}
+	return true
+}
+
+// grant adds the permissions of the rules matching identity to perms and
+// reports whether any did. Publishing or subscribing is denied when no rule
+// allows any subject.
+func grant(rules []rule, identity string, claims *tokenauth.Claims, perms *jwt.Permissions) bool {
+	matched := false
+	for _, r := range rules {
+		if !r.matches(identity, claims) {
+			continue
+		}
+		matched = true
+		perms.Pub.Allow.Add(r.Publish.Allow...)
+		perms.Pub.Deny.Add(r.Publish.Deny...)
+		perms.Sub.Allow.Add(r.Subscribe.Allow...)
+		perms.Sub.Deny.Add(r.Subscribe.Deny...)
+		if r.AllowResponses && perms.Resp == nil {
+			perms.Resp = &jwt.ResponsePermission{MaxMsgs: 1}
+		}
+	}
+	// NATS allows every subject without an allow list.
+	if len(perms.Pub.Allow) == 0 {
+		perms.Pub.Deny = jwt.StringList{">"}
+	}
+	if len(perms.Sub.Allow) == 0 {
+		perms.Sub.Deny = jwt.StringList{">"}
+	}
+	return matched
+}
@@ -0,0 +1,119 @@
+// api.go
+package main
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/scheme"
+)
+
+// groupVersion is the API group of the KeycloakTokenRequest resource.
+var groupVersion = schema.GroupVersion{Group: "keycloak-spiffe.idyatech.fr", Version: "v1alpha1"}
+
+// conditionReady reports whether the Secret holds a valid token.
+const conditionReady = "Ready"
+
+// KeycloakTokenRequest asks the operator to keep a Keycloak access token,
+// obtained with the SPIFFE identity of a service account, in a Secret.
+type KeycloakTokenRequest struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   KeycloakTokenRequestSpec   `json:"spec,omitempty"`
+	Status KeycloakTokenRequestStatus `json:"status,omitempty"`
+}
+
+// KeycloakTokenRequestSpec identifies the workload and the target Secret.
+type KeycloakTokenRequestSpec struct {
+	// ServiceAccountName is the service account of the workload, in the
+	// namespace of the request, whose SPIFFE identity is exchanged.
+	ServiceAccountName string `json:"serviceAccountName"`
+	// Selectors are added to the k8s:ns and k8s:sa selectors of the
+	// workload, written type:value. Only k8s:pod-label selectors are
+	// accepted: the agent matches every entry whose selectors are a subset
+	// of the request, so another k8s:ns or k8s:sa would name a workload of
+	// another namespace.
+	Selectors []string `json:"selectors,omitempty"`
+	// Audience of the JWT-SVID, the realm URL by default.
+	Audience string `json:"audience,omitempty"`
+	// Realm overrides the default Keycloak realm of the operator.
+	Realm string `json:"realm,omitempty"`
+	// SecretName is the Secret receiving the token in its token key.
+	SecretName string `json:"secretName"`
+}
+
+// KeycloakTokenRequestStatus reports the last exchange.
+type KeycloakTokenRequestStatus struct {
+	ObservedGeneration int64        `json:"observedGeneration,omitempty"`
+	SPIFFEID           string       `json:"spiffeID,omitempty"`
+	IssuedAt           *metav1.Time `json:"issuedAt,omitempty"`
+	ExpiresAt          *metav1.Time `json:"expiresAt,omitempty"`
+	LastError          string       `json:"lastError,omitempty"`
+	// Conditions holds the Ready condition.
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// KeycloakTokenRequestList is a list of KeycloakTokenRequest.
+type KeycloakTokenRequestList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []KeycloakTokenRequest `json:"items"`
+}
+
+// addToScheme registers the KeycloakTokenRequest types.
+var addToScheme = (&scheme.Builder{GroupVersion: groupVersion}).
+	Register(&KeycloakTokenRequest{}, &KeycloakTokenRequestList{}).
+	AddToScheme
+
+// The deep copy functions are written by hand, there are few enough fields.
+
+func (in *KeycloakTokenRequest) DeepCopyInto(out *KeycloakTokenRequest) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
+	out.Spec.Selectors = append([]string(nil), in.Spec.Selectors...)
+	out.Status = in.Status
+	if in.Status.IssuedAt != nil {
+		out.Status.IssuedAt = in.Status.IssuedAt.DeepCopy()
+	}
+	if in.Status.ExpiresAt != nil {
+		out.Status.ExpiresAt = in.Status.ExpiresAt.DeepCopy()
+	}
+	if in.Status.Conditions != nil {
+		out.Status.Conditions = make([]metav1.Condition, len(in.Status.Conditions))
+		for i := range in.Status.Conditions {
+			in.Status.Conditions[i].DeepCopyInto(&out.Status.Conditions[i])
+		}
+	}
+}
+
+func (in *KeycloakTokenRequest) DeepCopy() *KeycloakTokenRequest {
+	if in == nil {
+		return nil
+	}
+	out := new(KeycloakTokenRequest)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *KeycloakTokenRequest) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+func (in *KeycloakTokenRequestList) DeepCopyObject() runtime.Object {
+	if in == nil {
+		return nil
+	}
+	out := new(KeycloakTokenRequestList)
+	*out = *in
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]KeycloakTokenRequest, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+	return out
+}
@@ -0,0 +1,132 @@
+// main.go
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/spire"
+)
+
+func main() {
+	adminSocket := flag.String("admin-socket", "unix:///run/spire/admin/admin.sock", "SPIRE Agent admin socket serving the Delegated Identity API")
+	keycloakURL := flag.String("keycloak-url", "", "Keycloak base URL")
+	realm := flag.String("realm", "spiffe", "default Keycloak realm of the token requests")
+	caFile := flag.String("ca-file", "", "CA certificate verifying Keycloak instead of the system roots")
+	legacyPath := flag.String("legacy-path", "auto", "Keycloak endpoint paths: true for the /auth prefix of Keycloak up to 16, false for Keycloak 17+, auto to detect them")
+	renewThreshold := flag.Float64("renew-threshold", 0.8, "fraction of the token lifetime after which it is renewed")
+	metricsAddr := flag.String("metrics-addr", ":8080", "address of the /metrics endpoint, 0 to disable")
+	probeAddr := flag.String("health-addr", ":8081", "address of the /healthz and /readyz endpoints")
+	leaderElect := flag.Bool("leader-elect", false, "elect a leader so that several replicas can run")
+	flag.Parse()
+
+	ctrl.SetLogger(logr.FromSlogHandler(slog.Default().Handler()))
+	if *keycloakURL == "" {
+		fatal("-keycloak-url is required")
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if *caFile != "" {
+		pem, err := os.ReadFile(*caFile)
+		if err != nil {
+			fatal("Failed to read the CA file", "error", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			fatal("No certificate found in the CA file", "path", *caFile)
+		}
+	}
+
+	httpClient := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	paths, err := keycloak.NewPathResolver(httpClient, strings.TrimRight(*keycloakURL, "/"), *legacyPath)
+	if err != nil {
+		fatal("Invalid -legacy-path", "error", err)
+	}
+
+	identities, err := spire.NewDelegatedIdentity(*adminSocket)
+	if err != nil {
+		fatal("Failed to connect to the SPIRE Agent", "error", err)
+	}
+	defer identities.Close()
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		fatal("Failed to register the Kubernetes types", "error", err)
+	}
+	if err := addToScheme(scheme); err != nil {
+		fatal("Failed to register the KeycloakTokenRequest type", "error", err)
+	}
+
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+		Scheme:                 scheme,
+		Metrics:                metricsserver.Options{BindAddress: *metricsAddr},
+		HealthProbeBindAddress: *probeAddr,
+		LeaderElection:         *leaderElect,
+		LeaderElectionID:       "keycloak-token-operator." + groupVersion.Group,
+	})
+	if err != nil {
+		fatal("Failed to create the manager", "error", err)
+	}
+
+	r := &reconciler{
+		Client:         mgr.GetClient(),
+		identities:     identities,
+		http:           httpClient,
+		paths:          paths,
+		keycloakURL:    strings.TrimRight(*keycloakURL, "/"),
+		realm:          *realm,
+		renewThreshold: *renewThreshold,
+	}
+	err = ctrl.NewControllerManagedBy(mgr).
+		// Status updates do not change the generation and must not trigger
+		// a new exchange.
+		For(&KeycloakTokenRequest{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		// Only a deleted Secret needs a new token before the renewal.
+		Owns(&corev1.Secret{}, builder.WithPredicates(predicate.Funcs{
+			CreateFunc:  func(event.CreateEvent) bool { return false },
+			UpdateFunc:  func(event.UpdateEvent) bool { return false },
+			GenericFunc: func(event.GenericEvent) bool { return false },
+		})).
+		Complete(r)
+	if err != nil {
+		fatal("Failed to create the controller", "error", err)
+	}
+	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
+		fatal("Failed to add the health check", "error", err)
+	}
+	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
+		fatal("Failed to add the ready check", "error", err)
+	}
+
+	slog.Info("Starting the KeycloakTokenRequest operator", "keycloak_url", r.keycloakURL)
+	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+		fatal("Operator stopped", "error", err)
+	}
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
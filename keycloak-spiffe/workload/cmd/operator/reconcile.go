@@ -0,0 +1,176 @@
+// reconcile.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/spire"
+)
+
+const (
+	secretTokenKey = "token"
+	// retryInterval is the delay before retrying a failed exchange.
+	retryInterval = 30 * time.Second
+	// podLabelSelector prefixes the only selectors a request may add.
+	podLabelSelector = "k8s:pod-label:"
+)
+
+// reconciler keeps the Secret of each KeycloakTokenRequest filled with a
+// token renewed once RenewThreshold of its lifetime has elapsed.
+type reconciler struct {
+	client.Client
+	identities     *spire.DelegatedIdentity
+	http           *http.Client
+	paths          *keycloak.PathResolver
+	keycloakURL    string
+	realm          string
+	renewThreshold float64
+}
+
+func (r *reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var tr KeycloakTokenRequest
+	if err := r.Get(ctx, req.NamespacedName, &tr); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if wait := r.renewAfter(&tr); wait > 0 && r.secretExists(ctx, &tr) {
+		return ctrl.Result{RequeueAfter: wait}, nil
+	}
+
+	issuedAt := time.Now()
+	svid, token, err := r.exchange(ctx, &tr)
+	if err == nil {
+		err = r.writeSecret(ctx, &tr, token, issuedAt)
+	}
+
+	tr.Status.ObservedGeneration = tr.Generation
+	if err != nil {
+		slog.Warn("Token request failed", "namespace", tr.Namespace, "name", tr.Name, "error", err)
+		tr.Status.LastError = err.Error()
+		meta.SetStatusCondition(&tr.Status.Conditions, metav1.Condition{
+			Type:               conditionReady,
+			Status:             metav1.ConditionFalse,
+			Reason:             "ExchangeFailed",
+			Message:            err.Error(),
+			ObservedGeneration: tr.Generation,
+		})
+		if err := r.Status().Update(ctx, &tr); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: retryInterval}, nil
+	}
+
+	tr.Status.SPIFFEID = svid.SPIFFEID
+	tr.Status.IssuedAt = &metav1.Time{Time: issuedAt}
+	tr.Status.ExpiresAt = nil
+	if token.ExpiresIn > 0 {
+		tr.Status.ExpiresAt = &metav1.Time{Time: issuedAt.Add(time.Duration(token.ExpiresIn) * time.Second)}
+	}
+	tr.Status.LastError = ""
+	meta.SetStatusCondition(&tr.Status.Conditions, metav1.Condition{
+		Type:               conditionReady,
+		Status:             metav1.ConditionTrue,
+		Reason:             "TokenIssued",
+		Message:            fmt.Sprintf("token written to secret %s", tr.Spec.SecretName),
+		ObservedGeneration: tr.Generation,
+	})
+	if err := r.Status().Update(ctx, &tr); err != nil {
+		return ctrl.Result{}, err
+	}
+	slog.Info("Token issued", "namespace", tr.Namespace, "name", tr.Name, "spiffe_id", svid.SPIFFEID, "expires_in", token.ExpiresIn)
+	return ctrl.Result{RequeueAfter: r.renewAfter(&tr)}, nil
+}
+
+// renewAfter returns the delay before the token of tr must be renewed, zero
+// when it must be renewed now or the spec changed since it was issued.
+func (r *reconciler) renewAfter(tr *KeycloakTokenRequest) time.Duration {
+	s := tr.Status
+	if s.ObservedGeneration != tr.Generation || s.LastError != "" || s.IssuedAt == nil || s.ExpiresAt == nil {
+		return 0
+	}
+	lifetime := s.ExpiresAt.Sub(s.IssuedAt.Time)
+	return time.Until(s.IssuedAt.Add(time.Duration(float64(lifetime) * r.renewThreshold)))
+}
+
+// secretExists reports whether the target Secret of tr exists, so that a
+// deleted Secret is written again before the renewal.
+func (r *reconciler) secretExists(ctx context.Context, tr *KeycloakTokenRequest) bool {
+	var secret corev1.Secret
+	err := r.Get(ctx, client.ObjectKey{Namespace: tr.Namespace, Name: tr.Spec.SecretName}, &secret)
+	return !apierrors.IsNotFound(err)
+}
+
+// exchange fetches a JWT-SVID of the workload of tr and exchanges it with
+// Keycloak.
+func (r *reconciler) exchange(ctx context.Context, tr *KeycloakTokenRequest) (*spire.DelegatedJWTSVID, *keycloak.TokenResponse, error) {
+	if tr.Spec.ServiceAccountName == "" || tr.Spec.SecretName == "" {
+		return nil, nil, fmt.Errorf("serviceAccountName and secretName are required")
+	}
+	realm := r.realm
+	if tr.Spec.Realm != "" {
+		realm = tr.Spec.Realm
+	}
+	realmURL, err := r.paths.RealmURL(ctx, realm)
+	if err != nil {
+		return nil, nil, fmt.Errorf("detecting the Keycloak paths: %w", err)
+	}
+	audience := tr.Spec.Audience
+	if audience == "" {
+		audience = realmURL
+	}
+	for _, selector := range tr.Spec.Selectors {
+		if !strings.HasPrefix(selector, podLabelSelector) {
+			return nil, nil, fmt.Errorf("selector %q is not a k8s:pod-label selector", selector)
+		}
+	}
+	selectors := append([]string{"k8s:ns:" + tr.Namespace, "k8s:sa:" + tr.Spec.ServiceAccountName}, tr.Spec.Selectors...)
+
+	svid, err := r.identities.FetchJWTSVID(ctx, selectors, audience)
+	if err != nil {
+		return nil, nil, err
+	}
+	token, err := keycloak.Exchange(ctx, r.http, keycloak.StaticRealmMetadata(realmURL).TokenEndpoint, svid.Token)
+	if err != nil {
+		return nil, nil, err
+	}
+	return svid, token, nil
+}
+
+// writeSecret creates or updates the target Secret of tr, owned by tr so
+// that it is deleted along with it.
+func (r *reconciler) writeSecret(ctx context.Context, tr *KeycloakTokenRequest, token *keycloak.TokenResponse, issuedAt time.Time) error {
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: tr.Namespace, Name: tr.Spec.SecretName}}
+	_, err := controllerutil.CreateOrUpdate(ctx, r.Client, secret, func() error {
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		secret.Data[secretTokenKey] = []byte(token.AccessToken)
+		if secret.Annotations == nil {
+			secret.Annotations = map[string]string{}
+		}
+		secret.Annotations[groupVersion.Group+"/issued-at"] = issuedAt.UTC().Format(time.RFC3339)
+		if token.ExpiresIn > 0 {
+			expiry := issuedAt.Add(time.Duration(token.ExpiresIn) * time.Second)
+			secret.Annotations[groupVersion.Group+"/expires-at"] = expiry.UTC().Format(time.RFC3339)
+		}
+		return controllerutil.SetControllerReference(tr, secret, r.Scheme())
+	})
+	if err != nil {
+		return fmt.Errorf("writing secret %s: %w", tr.Spec.SecretName, err)
+	}
+	return nil
+}
@@ -0,0 +1,388 @@
+// admin.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/retry"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/spire"
+)
+
+// adminAudiencePrefix names the audience mappers managed by
+// bootstrap-client, the other mappers of the client being left alone.
+const adminAudiencePrefix = "spiffe-audience "
+
+// adminCommands maps the admin subcommands to their entry points.
+var adminCommands = map[string]func(args []string) error{
+	"apply":            runApply,
+	"bootstrap-client": runBootstrapClient,
+	"create-entry":     runCreateEntry,
+	"sync-bundle":      runSyncBundle,
+}
+
+// runAdmin implements the admin subcommand, which configures the realm
+// through the Keycloak Admin REST API: admin <command> [flags].
+func runAdmin(args []string) error {
+	names := make([]string, 0, len(adminCommands))
+	for n := range adminCommands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return fmt.Errorf("missing admin command (available: %s)", strings.Join(names, ", "))
+	}
+	cmd, ok := adminCommands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown admin command %q (available: %s)", args[0], strings.Join(names, ", "))
+	}
+	return cmd(args[1:])
+}
+
+// adminSession logs in the administrator of cfg and returns the Admin REST
+// API client of the realm. The Keycloak paths are detected first when cfg
+// asks for it.
+func adminSession(ctx context.Context, cfg *Config) (*keycloak.AdminClient, error) {
+	client, err := httpClient(*cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	resolveKeycloakPath(ctx, cfg, client)
+
+	a := cfg.Admin
+	tokenEndpoint := keycloak.PrefixedRealmURL(cfg.KeycloakURL, cfg.pathPrefix(), a.Realm) + "/protocol/openid-connect/token"
+	auth := keycloak.WithClientSecret(a.ClientID, a.ClientSecret)
+	if a.Username == "" && a.ClientSecret == "" {
+		return nil, errors.New("admin credentials missing: set ADMIN_USERNAME and ADMIN_PASSWORD, or ADMIN_CLIENT_SECRET")
+	}
+	slog.Info("Logging in to the Admin REST API", "realm", a.Realm, "client_id", a.ClientID, "username", a.Username)
+
+	var token *keycloak.TokenResponse
+	err = withPhaseTimeout(ctx, phaseTokenRequest, cfg.Timeouts.TokenRequest, func(ctx context.Context) error {
+		return cfg.retryPolicy("Admin login").Do(ctx, func(ctx context.Context) error {
+			var err error
+			if a.Username != "" {
+				token, err = keycloak.PasswordToken(ctx, client, tokenEndpoint, auth, a.Username, a.Password)
+			} else {
+				token, err = keycloak.ClientCredentials(ctx, client, tokenEndpoint, auth)
+			}
+			return keycloakRetry(err)
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("admin login: %w", err)
+	}
+	return keycloak.NewAdminClient(client, keycloak.AdminURL(cfg.KeycloakURL, cfg.pathPrefix(), cfg.Realm), token.AccessToken), nil
+}
+
+// runBootstrapClient implements admin bootstrap-client: it creates the
+// client of the workload SPIFFE ID, or updates it, so that it
+// authenticates with its JWT-SVIDs through the SPIFFE identity provider,
+// and adds the configured audiences to its access tokens. It is safe to
+// run again, the client converging to the configuration.
+func runBootstrapClient(args []string) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	setupLogging(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		return err
+	}
+	defer flushTraces(shutdownTracing)
+
+	spiffeID, err := bootstrapSPIFFEID(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	admin, err := adminSession(ctx, &cfg)
+	if err != nil {
+		return err
+	}
+
+	b := cfg.Admin.BootstrapClient
+	want := spiffeClient(spiffeID, cfg.IDPAlias)
+
+	ctx, span := startSpan(ctx, "keycloak.BootstrapClient")
+	var id string
+	err = cfg.retryPolicy("Client bootstrap").Do(ctx, func(ctx context.Context) error {
+		var err error
+		id, err = upsertClient(ctx, admin, want)
+		if err != nil {
+			return keycloakRetry(err)
+		}
+		if len(b.Scopes) > 0 {
+			if err := syncClientScopes(ctx, admin, id, keycloak.ScopeDefault, b.Scopes); err != nil {
+				return keycloakRetry(err)
+			}
+		}
+		return keycloakRetry(syncAudienceMappers(ctx, admin, id, b.Audience))
+	})
+	endSpan(span, err)
+	var adminErr *keycloak.AdminError
+	if errors.As(err, &adminErr) {
+		slog.Debug("Admin API response", "status", adminErr.StatusCode, "body", adminErr.Body)
+		if adminErr.StatusCode == http.StatusForbidden {
+			return fmt.Errorf("%w: the administrator needs the manage-clients role of realm-management in realm %s", err, cfg.Realm)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("Client bootstrapped", "client_id", spiffeID, "uuid", id, "idp_alias", cfg.IDPAlias, "audiences", []string(b.Audience))
+	return nil
+}
+
+// runCreateEntry implements admin create-entry: it registers the SPIFFE ID
+// of the client bootstrapped by bootstrap-client with the SPIRE Server, for
+// the workloads matching the entry selectors, so that the SPIRE entry and
+// the Keycloak client are set up together. An identical entry is left as
+// it is.
+func runCreateEntry(args []string) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	setupLogging(cfg)
+
+	e := cfg.Admin.Entry
+	spiffeID := cfg.Admin.BootstrapClient.SPIFFEID
+	if spiffeID == "" {
+		spiffeID = cfg.exactSPIFFEID()
+	}
+	switch {
+	case spiffeID == "":
+		return errors.New("missing SPIFFE ID of the entry: set BOOTSTRAP_SPIFFE_ID")
+	case e.ParentID == "":
+		return errors.New("missing parent ID of the entry: set ENTRY_PARENT_ID to the SPIFFE ID of the agent")
+	case len(e.Selectors) == 0:
+		return errors.New("missing selectors of the entry: set ENTRY_SELECTORS")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		return err
+	}
+	defer flushTraces(shutdownTracing)
+
+	entries, err := spire.NewEntryClient(e.ServerSocket)
+	if err != nil {
+		return err
+	}
+	defer entries.Close()
+
+	ctx, span := startSpan(ctx, "spire.CreateEntry")
+	var id string
+	var created bool
+	err = cfg.retryPolicy("Entry creation").Do(ctx, func(ctx context.Context) error {
+		var err error
+		id, created, err = entries.CreateEntry(ctx, spire.Entry{
+			SPIFFEID:    spiffeID,
+			ParentID:    e.ParentID,
+			Selectors:   e.Selectors,
+			X509SVIDTTL: e.X509SVIDTTL,
+			JWTSVIDTTL:  e.JWTSVIDTTL,
+		})
+		// The server socket may not be up yet when started together.
+		if err != nil && status.Code(err) != codes.Unavailable {
+			return retry.Permanent(err)
+		}
+		return err
+	})
+	endSpan(span, err)
+	if err != nil {
+		return err
+	}
+	if created {
+		slog.Info("Registration entry created", "entry_id", id, "spiffe_id", spiffeID, "parent_id", e.ParentID, "selectors", []string(e.Selectors))
+	} else {
+		slog.Info("Registration entry already exists", "entry_id", id, "spiffe_id", spiffeID, "parent_id", e.ParentID)
+	}
+	return nil
+}
+
+// spiffeClient returns the confidential client of spiffeID authenticating
+// with its JWT-SVIDs through the identity provider idpAlias.
+func spiffeClient(spiffeID, idpAlias string) keycloak.ClientRepresentation {
+	return keycloak.ClientRepresentation{
+		ClientID:                  spiffeID,
+		Description:               "Workload authenticating with its JWT-SVIDs",
+		Enabled:                   ptr(true),
+		Protocol:                  "openid-connect",
+		PublicClient:              ptr(false),
+		ServiceAccountsEnabled:    ptr(true),
+		StandardFlowEnabled:       ptr(false),
+		DirectAccessGrantsEnabled: ptr(false),
+		ClientAuthenticatorType:   keycloak.ClientAuthenticatorFederatedJWT,
+		Attributes: map[string]string{
+			keycloak.AttributeCredentialIssuer:  idpAlias,
+			keycloak.AttributeCredentialSubject: spiffeID,
+		},
+	}
+}
+
+// bootstrapSPIFFEID returns the SPIFFE ID of the client to bootstrap: the
+// configured one, else the SPIFFE ID selected by SPIFFE_ID when it is not a
+// pattern, else the one of the X509-SVID of the workload.
+func bootstrapSPIFFEID(ctx context.Context, cfg Config) (string, error) {
+	if id := cfg.Admin.BootstrapClient.SPIFFEID; id != "" {
+		return id, nil
+	}
+	if id := cfg.exactSPIFFEID(); id != "" {
+		return id, nil
+	}
+	source, err := newX509Source(ctx, cfg)
+	if err != nil {
+		return "", fmt.Errorf("finding the SPIFFE ID of the workload, or set BOOTSTRAP_SPIFFE_ID: %w", err)
+	}
+	defer source.Close()
+	svid, err := source.GetX509SVID()
+	if err != nil {
+		return "", fmt.Errorf("finding the SPIFFE ID of the workload: %w", err)
+	}
+	return svid.ID.String(), nil
+}
+
+// upsertClient creates the client want, or updates the existing client of
+// the same client ID, and returns its ID.
+func upsertClient(ctx context.Context, admin *keycloak.AdminClient, want keycloak.ClientRepresentation) (string, error) {
+	current, err := admin.FindClient(ctx, want.ClientID)
+	if err != nil {
+		return "", err
+	}
+	if current == nil {
+		id, err := admin.CreateClient(ctx, want)
+		if err != nil {
+			return "", err
+		}
+		slog.Info("Client created", "client_id", want.ClientID, "uuid", id)
+		return id, nil
+	}
+
+	// The other attributes, such as the token lifetimes set by hand, stay.
+	if current.Attributes == nil {
+		current.Attributes = map[string]string{}
+	}
+	for k, v := range want.Attributes {
+		current.Attributes[k] = v
+	}
+	want.ID, want.Attributes, want.Raw = current.ID, current.Attributes, current.Raw
+	if err := admin.UpdateClient(ctx, want); err != nil {
+		return "", err
+	}
+	slog.Info("Client updated", "client_id", want.ClientID, "uuid", want.ID)
+	return want.ID, nil
+}
+
+// syncClientScopes makes the client scopes named names exactly the client
+// scopes of kind of the client of ID id.
+func syncClientScopes(ctx context.Context, admin *keycloak.AdminClient, id, kind string, names []string) error {
+	scopes, err := admin.ClientScopes(ctx)
+	if err != nil {
+		return err
+	}
+	ids := make(map[string]string, len(scopes))
+	for _, s := range scopes {
+		ids[s.Name] = s.ID
+	}
+	current, err := admin.ClientScopesOf(ctx, id, kind)
+	if err != nil {
+		return err
+	}
+	present := map[string]bool{}
+	for _, s := range current {
+		if slices.Contains(names, s.Name) {
+			present[s.Name] = true
+			continue
+		}
+		if err := admin.RemoveClientScope(ctx, id, kind, s.ID); err != nil {
+			return err
+		}
+		slog.Info("Client scope removed", "kind", kind, "scope", s.Name)
+	}
+	for _, name := range names {
+		if present[name] {
+			continue
+		}
+		scopeID, ok := ids[name]
+		if !ok {
+			return fmt.Errorf("client scope %q does not exist in the realm", name)
+		}
+		if err := admin.AddClientScope(ctx, id, kind, scopeID); err != nil {
+			return err
+		}
+		present[name] = true
+		slog.Info("Client scope added", "kind", kind, "scope", name)
+	}
+	return nil
+}
+
+// syncAudienceMappers makes the audience mappers managed on the client of
+// ID id add exactly the audiences to its access tokens.
+func syncAudienceMappers(ctx context.Context, admin *keycloak.AdminClient, id string, audiences []string) error {
+	mappers, err := admin.ProtocolMappers(ctx, id)
+	if err != nil {
+		return err
+	}
+	present := map[string]bool{}
+	for _, m := range mappers {
+		if m.ProtocolMapper != keycloak.AudienceMapper || !strings.HasPrefix(m.Name, adminAudiencePrefix) {
+			continue
+		}
+		audience := m.Config["included.custom.audience"]
+		if slices.Contains(audiences, audience) && !present[audience] {
+			present[audience] = true
+			continue
+		}
+		if err := admin.DeleteProtocolMapper(ctx, id, m.ID); err != nil {
+			return err
+		}
+		slog.Info("Audience removed", "audience", audience)
+	}
+	for _, audience := range audiences {
+		if present[audience] {
+			continue
+		}
+		err := admin.CreateProtocolMapper(ctx, id, keycloak.ProtocolMapperRepresentation{
+			Name:           adminAudiencePrefix + audience,
+			Protocol:       "openid-connect",
+			ProtocolMapper: keycloak.AudienceMapper,
+			Config: map[string]string{
+				"included.custom.audience":  audience,
+				"access.token.claim":        "true",
+				"introspection.token.claim": "true",
+				"id.token.claim":            "false",
+			},
+		})
+		if err != nil {
+			return err
+		}
+		present[audience] = true
+		slog.Info("Audience added", "audience", audience)
+	}
+	return nil
+}
+
+// ptr returns a pointer to v, for the optional fields of the Keycloak
+// representations.
+func ptr[T any](v T) *T {
+	return &v
+}
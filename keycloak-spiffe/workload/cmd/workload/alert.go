@@ -0,0 +1,159 @@
+// alert.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Alerts sent to the webhook.
+const (
+	alertRefreshFailing = "refresh_failing"
+	alertTokenExpiring  = "token_expiring"
+)
+
+// Statuses of the alerts.
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// alertEvent is the JSON body posted to the alert webhook.
+type alertEvent struct {
+	Time      time.Time  `json:"time"`
+	Alert     string     `json:"alert"`
+	Status    string     `json:"status"`
+	Host      string     `json:"host,omitempty"`
+	RequestID string     `json:"request_id,omitempty"`
+	Realm     string     `json:"realm"`
+	Audience  string     `json:"audience"`
+	Failures  int        `json:"failures"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Message   string     `json:"message"`
+}
+
+// alerts tracks the failed refreshes of the daemon per audience, and the
+// alerts firing, each sent once when it fires and once when the next
+// successful refresh resolves it.
+type alerts struct {
+	failures map[string]int
+	firing   map[string]map[string]bool
+}
+
+// refreshFailed records the failed refresh of audience, the token held
+// expiring at expiry, zero when there is none or it does not expire, and
+// fires the alerts whose condition is met.
+func (a *alerts) refreshFailed(ctx context.Context, cfg Config, audience string, expiry time.Time, err error) {
+	if a.failures == nil {
+		a.failures = make(map[string]int)
+		a.firing = make(map[string]map[string]bool)
+	}
+	a.failures[audience]++
+	ev := alertEvent{
+		Status:   alertFiring,
+		Audience: audience,
+		Failures: a.failures[audience],
+		Error:    err.Error(),
+	}
+	if !expiry.IsZero() {
+		expiresAt := expiry.UTC()
+		ev.ExpiresAt = &expiresAt
+	}
+	if cfg.Alert.Failures > 0 && ev.Failures >= cfg.Alert.Failures {
+		ev.Alert = alertRefreshFailing
+		ev.Message = fmt.Sprintf("%d consecutive token refreshes failed for %s", ev.Failures, audience)
+		a.fire(ctx, cfg, ev)
+	}
+	if !expiry.IsZero() && cfg.Alert.ExpiryWindow > 0 && time.Until(expiry) <= cfg.Alert.ExpiryWindow {
+		ev.Alert = alertTokenExpiring
+		ev.Message = fmt.Sprintf("the token for %s expires at %s and could not be renewed", audience, ev.ExpiresAt.Format(time.RFC3339))
+		if time.Now().After(expiry) {
+			ev.Message = fmt.Sprintf("the token for %s expired at %s and could not be renewed", audience, ev.ExpiresAt.Format(time.RFC3339))
+		}
+		a.fire(ctx, cfg, ev)
+	}
+}
+
+// refreshed records the successful refresh of audience and resolves its
+// alerts.
+func (a *alerts) refreshed(ctx context.Context, cfg Config, audience string) {
+	failures := a.failures[audience]
+	delete(a.failures, audience)
+	for alert := range a.firing[audience] {
+		sendAlert(ctx, cfg, alertEvent{
+			Alert:    alert,
+			Status:   alertResolved,
+			Audience: audience,
+			Failures: failures,
+			Message:  fmt.Sprintf("the token for %s was renewed", audience),
+		})
+	}
+	delete(a.firing, audience)
+}
+
+// fire sends ev unless its alert is already firing for its audience.
+func (a *alerts) fire(ctx context.Context, cfg Config, ev alertEvent) {
+	if a.firing[ev.Audience][ev.Alert] {
+		return
+	}
+	if a.firing[ev.Audience] == nil {
+		a.firing[ev.Audience] = make(map[string]bool)
+	}
+	a.firing[ev.Audience][ev.Alert] = true
+	slog.ErrorContext(ctx, "Alert firing", "alert", ev.Alert, "audience", ev.Audience, "failures", ev.Failures)
+	sendAlert(ctx, cfg, ev)
+}
+
+// sendAlert posts ev to the alert webhook of cfg, if any, within the alert
+// timeout. A failed delivery is logged and counted, not retried: the
+// daemon keeps refreshing meanwhile.
+func sendAlert(ctx context.Context, cfg Config, ev alertEvent) {
+	if cfg.Alert.Webhook == "" {
+		return
+	}
+	ev.Time = time.Now().UTC()
+	ev.Host, _ = os.Hostname()
+	ev.RequestID = requestID(ctx)
+	ev.Realm = cfg.Realm
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Alert.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.Alert.Webhook, bytes.NewReader(body))
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to send the alert", "alert", ev.Alert, "error", err)
+		failures.WithLabelValues("alert").Inc()
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		// The webhook URL often embeds a secret.
+		err = urlErr.Err
+	}
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			err = fmt.Errorf("webhook answered %s", resp.Status)
+		}
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to send the alert", "alert", ev.Alert, "status", ev.Status, "error", err)
+		failures.WithLabelValues("alert").Inc()
+		return
+	}
+	alertsSent.WithLabelValues(ev.Alert, ev.Status).Inc()
+}
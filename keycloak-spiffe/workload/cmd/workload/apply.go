@@ -0,0 +1,645 @@
+// apply.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+)
+
+// realmSpec is the declarative description of a realm applied by admin
+// apply. Only the objects and fields it describes are managed: the others
+// are left as they are in Keycloak, and nothing is deleted except the
+// client scopes and audiences missing from the lists of a client.
+type realmSpec struct {
+	// Realm is the realm described, REALM when empty.
+	Realm             string                 `yaml:"realm"`
+	IdentityProviders []identityProviderSpec `yaml:"identity_providers"`
+	ClientScopes      []clientScopeSpec      `yaml:"client_scopes"`
+	Clients           []clientSpec           `yaml:"clients"`
+}
+
+// identityProviderSpec is an identity provider, the trust settings of the
+// SPIFFE identity provider: trustDomain and bundleEndpoint in Config.
+type identityProviderSpec struct {
+	Alias string `yaml:"alias"`
+	// ProviderID is spiffe by default.
+	ProviderID string            `yaml:"provider_id"`
+	Enabled    *bool             `yaml:"enabled"`
+	Config     map[string]string `yaml:"config"`
+}
+
+// clientScopeSpec is a client scope and its protocol mappers.
+type clientScopeSpec struct {
+	Name            string            `yaml:"name"`
+	Description     string            `yaml:"description"`
+	Attributes      map[string]string `yaml:"attributes"`
+	ProtocolMappers []mapperSpec      `yaml:"protocol_mappers"`
+}
+
+// mapperSpec is a protocol mapper, identified by its name.
+type mapperSpec struct {
+	Name           string            `yaml:"name"`
+	ProtocolMapper string            `yaml:"protocol_mapper"`
+	Config         map[string]string `yaml:"config"`
+}
+
+// clientSpec is a client. With SPIFFE it is the client of the SPIFFE ID
+// ClientID, authenticating with its JWT-SVIDs as after admin
+// bootstrap-client. The client scope and audience lists, when set, are the
+// exact lists of the client.
+type clientSpec struct {
+	ClientID string `yaml:"client_id"`
+	SPIFFE   bool   `yaml:"spiffe"`
+	// IDPAlias is the identity provider of a SPIFFE client, IDP_ALIAS when
+	// empty.
+	IDPAlias                string            `yaml:"idp_alias"`
+	Description             string            `yaml:"description"`
+	Enabled                 *bool             `yaml:"enabled"`
+	ServiceAccountsEnabled  *bool             `yaml:"service_accounts_enabled"`
+	ClientAuthenticatorType string            `yaml:"client_authenticator_type"`
+	Attributes              map[string]string `yaml:"attributes"`
+	DefaultClientScopes     []string          `yaml:"default_client_scopes"`
+	OptionalClientScopes    []string          `yaml:"optional_client_scopes"`
+	Audiences               []string          `yaml:"audiences"`
+	ProtocolMappers         []mapperSpec      `yaml:"protocol_mappers"`
+}
+
+// realmChange is a change of an object of the realm, made by apply.
+type realmChange struct {
+	// create is set for the objects missing from the realm.
+	create  bool
+	kind    string
+	name    string
+	details []string
+	apply   func(ctx context.Context) error
+}
+
+// runApply implements admin apply: it compares the realm description of
+// -f with the realm, prints the differences, and makes the changes unless
+// -dry-run is set. Applying the same description again changes nothing.
+func runApply(args []string) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	setupLogging(cfg)
+
+	spec, err := readRealmSpec(cfg.Admin.ApplyFile)
+	if err != nil {
+		return err
+	}
+	if spec.Realm != "" {
+		cfg.Realm = spec.Realm
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		return err
+	}
+	defer flushTraces(shutdownTracing)
+
+	admin, err := adminSession(ctx, &cfg)
+	if err != nil {
+		return err
+	}
+
+	var changes []realmChange
+	err = cfg.retryPolicy("Realm comparison").Do(ctx, func(ctx context.Context) error {
+		var err error
+		changes, err = planRealm(ctx, cfg, admin, spec)
+		return keycloakRetry(err)
+	})
+	if err != nil {
+		return adminFailure(cfg, err)
+	}
+	printChanges(os.Stdout, cfg.Realm, changes)
+	if cfg.DryRun || len(changes) == 0 {
+		return nil
+	}
+
+	ctx, span := startSpan(ctx, "keycloak.ApplyRealm")
+	defer func() { endSpan(span, err) }()
+	for _, c := range changes {
+		// The changes are not retried as a whole: a failure after a
+		// partial change is fixed by applying the description again.
+		if err = c.apply(ctx); err != nil {
+			return adminFailure(cfg, fmt.Errorf("%s %s: %w", c.kind, c.name, err))
+		}
+		slog.Info("Realm object applied", "kind", c.kind, "name", c.name, "created", c.create)
+	}
+	slog.Info("Realm applied", "realm", cfg.Realm, "changes", len(changes))
+	return nil
+}
+
+// readRealmSpec reads the realm description of file, - for the standard
+// input.
+func readRealmSpec(file string) (realmSpec, error) {
+	var spec realmSpec
+	if file == "" {
+		return spec, errors.New("missing realm description: admin apply -f realm.yaml")
+	}
+	var data []byte
+	var err error
+	if file == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return spec, fmt.Errorf("reading the realm description: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&spec); err != nil && !errors.Is(err, io.EOF) {
+		return spec, fmt.Errorf("parsing the realm description %s: %w", file, err)
+	}
+	return spec, nil
+}
+
+// adminFailure adds the missing role to the error of a forbidden admin
+// call.
+func adminFailure(cfg Config, err error) error {
+	var adminErr *keycloak.AdminError
+	if errors.As(err, &adminErr) {
+		slog.Debug("Admin API response", "status", adminErr.StatusCode, "body", adminErr.Body)
+		if adminErr.StatusCode == http.StatusForbidden {
+			return fmt.Errorf("%w: the administrator needs the manage-realm and manage-clients roles of realm-management in realm %s", err, cfg.Realm)
+		}
+	}
+	return err
+}
+
+// planRealm returns the changes making the realm match spec, in the order
+// they apply: identity providers, client scopes, then the clients using
+// them.
+func planRealm(ctx context.Context, cfg Config, admin *keycloak.AdminClient, spec realmSpec) ([]realmChange, error) {
+	var changes []realmChange
+	for _, idp := range spec.IdentityProviders {
+		c, err := planIdentityProvider(ctx, admin, idp)
+		if err != nil {
+			return nil, err
+		}
+		changes = appendChange(changes, c)
+	}
+
+	var scopes []map[string]any
+	if _, err := admin.Do(ctx, http.MethodGet, "/client-scopes", nil, &scopes); err != nil {
+		return nil, err
+	}
+	for _, s := range spec.ClientScopes {
+		c, err := planClientScope(ctx, admin, scopes, s)
+		if err != nil {
+			return nil, err
+		}
+		changes = appendChange(changes, c)
+	}
+
+	for _, client := range spec.Clients {
+		c, err := planClient(ctx, cfg, admin, client)
+		if err != nil {
+			return nil, err
+		}
+		changes = appendChange(changes, c)
+	}
+	return changes, nil
+}
+
+// appendChange appends c to changes unless it changes nothing.
+func appendChange(changes []realmChange, c realmChange) []realmChange {
+	if c.create || len(c.details) > 0 {
+		return append(changes, c)
+	}
+	return changes
+}
+
+func planIdentityProvider(ctx context.Context, admin *keycloak.AdminClient, spec identityProviderSpec) (realmChange, error) {
+	if spec.Alias == "" {
+		return realmChange{}, errors.New("identity provider without alias")
+	}
+	providerID := spec.ProviderID
+	if providerID == "" {
+		providerID = "spiffe"
+	}
+	want := representation(map[string]any{
+		"alias":      spec.Alias,
+		"providerId": providerID,
+		"enabled":    spec.Enabled,
+		"config":     spec.Config,
+	})
+	c := realmChange{kind: "identity_provider", name: spec.Alias}
+	path := "/identity-provider/instances/" + url.PathEscape(spec.Alias)
+
+	var have map[string]any
+	_, err := admin.Do(ctx, http.MethodGet, path, nil, &have)
+	var adminErr *keycloak.AdminError
+	switch {
+	case errors.As(err, &adminErr) && adminErr.StatusCode == http.StatusNotFound:
+		c.create = true
+		c.apply = func(ctx context.Context) error {
+			_, err := admin.Do(ctx, http.MethodPost, "/identity-provider/instances", want, nil)
+			return err
+		}
+		return c, nil
+	case err != nil:
+		return c, err
+	}
+	c.details = diffObject("", want, have)
+	c.apply = func(ctx context.Context) error {
+		_, err := admin.Do(ctx, http.MethodPut, path, mergeObject(have, want), nil)
+		return err
+	}
+	return c, nil
+}
+
+func planClientScope(ctx context.Context, admin *keycloak.AdminClient, scopes []map[string]any, spec clientScopeSpec) (realmChange, error) {
+	if spec.Name == "" {
+		return realmChange{}, errors.New("client scope without name")
+	}
+	want := representation(map[string]any{
+		"name":        spec.Name,
+		"description": spec.Description,
+		"protocol":    "openid-connect",
+		"attributes":  spec.Attributes,
+	})
+	c := realmChange{kind: "client_scope", name: spec.Name}
+
+	var have map[string]any
+	for _, s := range scopes {
+		if s["name"] == spec.Name {
+			have = s
+		}
+	}
+	if have == nil {
+		c.create = true
+		c.details = mapperNames(spec.ProtocolMappers)
+		c.apply = func(ctx context.Context) error {
+			resp, err := admin.Do(ctx, http.MethodPost, "/client-scopes", want, nil)
+			if err != nil {
+				return err
+			}
+			parent := "/client-scopes/" + locationID(resp)
+			return applyMappers(ctx, admin, parent, nil, spec.ProtocolMappers)
+		}
+		return c, nil
+	}
+
+	id, _ := have["id"].(string)
+	parent := "/client-scopes/" + url.PathEscape(id)
+	current, err := protocolMappers(ctx, admin, parent)
+	if err != nil {
+		return c, err
+	}
+	c.details = append(diffObject("", want, have), diffMappers(current, spec.ProtocolMappers)...)
+	c.apply = func(ctx context.Context) error {
+		if _, err := admin.Do(ctx, http.MethodPut, parent, mergeObject(have, want), nil); err != nil {
+			return err
+		}
+		return applyMappers(ctx, admin, parent, current, spec.ProtocolMappers)
+	}
+	return c, nil
+}
+
+func planClient(ctx context.Context, cfg Config, admin *keycloak.AdminClient, spec clientSpec) (realmChange, error) {
+	if spec.ClientID == "" {
+		return realmChange{}, errors.New("client without client_id")
+	}
+	base := keycloak.ClientRepresentation{ClientID: spec.ClientID, Protocol: "openid-connect"}
+	if spec.SPIFFE {
+		idpAlias := spec.IDPAlias
+		if idpAlias == "" {
+			idpAlias = cfg.IDPAlias
+		}
+		base = spiffeClient(spec.ClientID, idpAlias)
+	}
+	want := representation(base)
+	for k, v := range representation(map[string]any{
+		"description":             spec.Description,
+		"enabled":                 spec.Enabled,
+		"serviceAccountsEnabled":  spec.ServiceAccountsEnabled,
+		"clientAuthenticatorType": spec.ClientAuthenticatorType,
+		"attributes":              spec.Attributes,
+	}) {
+		if attrs, ok := v.(map[string]any); ok && want[k] != nil {
+			v = mergeObject(want[k].(map[string]any), attrs)
+		}
+		want[k] = v
+	}
+	c := realmChange{kind: "client", name: spec.ClientID}
+
+	current, err := admin.FindClient(ctx, spec.ClientID)
+	if err != nil {
+		return c, err
+	}
+	if current == nil {
+		c.create = true
+		c.details = append(mapperNames(spec.ProtocolMappers), listDiff("default_client_scopes", nil, spec.DefaultClientScopes)...)
+		c.details = append(c.details, listDiff("optional_client_scopes", nil, spec.OptionalClientScopes)...)
+		c.details = append(c.details, listDiff("audiences", nil, spec.Audiences)...)
+		c.apply = func(ctx context.Context) error {
+			// Keycloak adds the realm default scopes to a new client.
+			resp, err := admin.Do(ctx, http.MethodPost, "/clients", want, nil)
+			if err != nil {
+				return err
+			}
+			return applyClientLists(ctx, admin, locationID(resp), nil, spec)
+		}
+		return c, nil
+	}
+
+	var have map[string]any
+	if err := json.Unmarshal(current.Raw, &have); err != nil {
+		return c, fmt.Errorf("decoding client: %w", err)
+	}
+	parent := "/clients/" + url.PathEscape(current.ID)
+	mappers, err := protocolMappers(ctx, admin, parent)
+	if err != nil {
+		return c, err
+	}
+	c.details = append(diffObject("", want, have), diffMappers(mappers, spec.ProtocolMappers)...)
+	for _, kind := range []string{keycloak.ScopeDefault, keycloak.ScopeOptional} {
+		names := clientScopeList(spec, kind)
+		if names == nil {
+			continue
+		}
+		scopes, err := admin.ClientScopesOf(ctx, current.ID, kind)
+		if err != nil {
+			return c, err
+		}
+		var have []string
+		for _, s := range scopes {
+			have = append(have, s.Name)
+		}
+		c.details = append(c.details, listDiff(kind+"_client_scopes", have, names)...)
+	}
+	if spec.Audiences != nil {
+		var have []string
+		for _, m := range mappers {
+			if m.ProtocolMapper == keycloak.AudienceMapper && strings.HasPrefix(m.Name, adminAudiencePrefix) {
+				have = append(have, m.Config["included.custom.audience"])
+			}
+		}
+		c.details = append(c.details, listDiff("audiences", have, spec.Audiences)...)
+	}
+	c.apply = func(ctx context.Context) error {
+		if _, err := admin.Do(ctx, http.MethodPut, parent, mergeObject(have, want), nil); err != nil {
+			return err
+		}
+		return applyClientLists(ctx, admin, current.ID, mappers, spec)
+	}
+	return c, nil
+}
+
+// applyClientLists applies the protocol mappers, client scopes and
+// audiences of spec to the client of ID id, whose protocol mappers are
+// current.
+func applyClientLists(ctx context.Context, admin *keycloak.AdminClient, id string, current []keycloak.ProtocolMapperRepresentation, spec clientSpec) error {
+	if err := applyMappers(ctx, admin, "/clients/"+url.PathEscape(id), current, spec.ProtocolMappers); err != nil {
+		return err
+	}
+	for _, kind := range []string{keycloak.ScopeDefault, keycloak.ScopeOptional} {
+		if names := clientScopeList(spec, kind); names != nil {
+			if err := syncClientScopes(ctx, admin, id, kind, names); err != nil {
+				return err
+			}
+		}
+	}
+	if spec.Audiences != nil {
+		return syncAudienceMappers(ctx, admin, id, spec.Audiences)
+	}
+	return nil
+}
+
+// clientScopeList returns the client scopes of kind of spec, nil when they
+// are not managed.
+func clientScopeList(spec clientSpec, kind string) []string {
+	if kind == keycloak.ScopeDefault {
+		return spec.DefaultClientScopes
+	}
+	return spec.OptionalClientScopes
+}
+
+// protocolMappers returns the protocol mappers of the client or client
+// scope at parent.
+func protocolMappers(ctx context.Context, admin *keycloak.AdminClient, parent string) ([]keycloak.ProtocolMapperRepresentation, error) {
+	var mappers []keycloak.ProtocolMapperRepresentation
+	_, err := admin.Do(ctx, http.MethodGet, parent+"/protocol-mappers/models", nil, &mappers)
+	return mappers, err
+}
+
+// applyMappers creates the mappers of want missing from current, and
+// updates those that differ, on the client or client scope at parent.
+func applyMappers(ctx context.Context, admin *keycloak.AdminClient, parent string, current []keycloak.ProtocolMapperRepresentation, want []mapperSpec) error {
+	for _, m := range want {
+		rep := keycloak.ProtocolMapperRepresentation{Name: m.Name, Protocol: "openid-connect", ProtocolMapper: m.ProtocolMapper, Config: m.Config}
+		i := slices.IndexFunc(current, func(c keycloak.ProtocolMapperRepresentation) bool { return c.Name == m.Name })
+		if i < 0 {
+			if _, err := admin.Do(ctx, http.MethodPost, parent+"/protocol-mappers/models", rep, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(diffMapper(current[i], m)) == 0 {
+			continue
+		}
+		rep.ID = current[i].ID
+		rep.Config = mergeConfig(current[i].Config, m.Config)
+		if _, err := admin.Do(ctx, http.MethodPut, parent+"/protocol-mappers/models/"+url.PathEscape(rep.ID), rep, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffMappers describes how the mappers of want differ from current.
+func diffMappers(current []keycloak.ProtocolMapperRepresentation, want []mapperSpec) []string {
+	var details []string
+	for _, m := range want {
+		i := slices.IndexFunc(current, func(c keycloak.ProtocolMapperRepresentation) bool { return c.Name == m.Name })
+		if i < 0 {
+			details = append(details, "+ protocol_mapper "+m.Name)
+			continue
+		}
+		for _, d := range diffMapper(current[i], m) {
+			details = append(details, "protocol_mapper "+m.Name+": "+d)
+		}
+	}
+	return details
+}
+
+// diffMapper describes how the mapper want differs from have.
+func diffMapper(have keycloak.ProtocolMapperRepresentation, want mapperSpec) []string {
+	var details []string
+	if have.ProtocolMapper != want.ProtocolMapper {
+		details = append(details, fmt.Sprintf("protocol_mapper %q -> %q", have.ProtocolMapper, want.ProtocolMapper))
+	}
+	for _, k := range sortedKeys(want.Config) {
+		if have.Config[k] != want.Config[k] {
+			details = append(details, fmt.Sprintf("config.%s %q -> %q", k, have.Config[k], want.Config[k]))
+		}
+	}
+	return details
+}
+
+// mapperNames describes the mappers created with a new object.
+func mapperNames(mappers []mapperSpec) []string {
+	var details []string
+	for _, m := range mappers {
+		details = append(details, "+ protocol_mapper "+m.Name)
+	}
+	return details
+}
+
+// listDiff describes the values of want missing from have and the values
+// of have missing from want.
+func listDiff(name string, have, want []string) []string {
+	var details []string
+	for _, v := range want {
+		if !slices.Contains(have, v) {
+			details = append(details, fmt.Sprintf("%s: + %s", name, v))
+		}
+	}
+	for _, v := range have {
+		if !slices.Contains(want, v) {
+			details = append(details, fmt.Sprintf("%s: - %s", name, v))
+		}
+	}
+	return details
+}
+
+// representation returns v as the JSON object sent to the Admin REST API,
+// without the unset fields.
+func representation(v any) map[string]any {
+	data, _ := json.Marshal(v)
+	var m map[string]any
+	json.Unmarshal(data, &m)
+	for k, v := range m {
+		switch v := v.(type) {
+		case nil:
+			delete(m, k)
+		case string:
+			if v == "" {
+				delete(m, k)
+			}
+		case map[string]any:
+			if len(v) == 0 {
+				delete(m, k)
+			}
+		}
+	}
+	return m
+}
+
+// diffObject describes the fields of want that differ in have, the nested
+// objects being compared field by field.
+func diffObject(prefix string, want, have map[string]any) []string {
+	var details []string
+	for _, k := range sortedKeys(want) {
+		w, h := want[k], have[k]
+		wm, wok := w.(map[string]any)
+		hm, hok := h.(map[string]any)
+		switch {
+		case wok && (hok || h == nil):
+			details = append(details, diffObject(prefix+k+".", wm, hm)...)
+		case !reflect.DeepEqual(w, h):
+			details = append(details, fmt.Sprintf("%s%s %s -> %s", prefix, k, jsonValue(h), jsonValue(w)))
+		}
+	}
+	return details
+}
+
+// mergeObject returns have with the fields of want, the nested objects
+// being merged field by field so that the fields want does not describe
+// are kept.
+func mergeObject(have, want map[string]any) map[string]any {
+	merged := make(map[string]any, len(have)+len(want))
+	for k, v := range have {
+		merged[k] = v
+	}
+	for k, w := range want {
+		wm, wok := w.(map[string]any)
+		hm, hok := merged[k].(map[string]any)
+		if wok && hok {
+			merged[k] = mergeObject(hm, wm)
+			continue
+		}
+		merged[k] = w
+	}
+	return merged
+}
+
+// mergeConfig returns have with the entries of want.
+func mergeConfig(have, want map[string]string) map[string]string {
+	merged := make(map[string]string, len(have)+len(want))
+	for k, v := range have {
+		merged[k] = v
+	}
+	for k, v := range want {
+		merged[k] = v
+	}
+	return merged
+}
+
+// locationID returns the ID of the object created by a POST, the last
+// element of its Location.
+func locationID(resp *http.Response) string {
+	location := resp.Header.Get("Location")
+	return location[strings.LastIndex(location, "/")+1:]
+}
+
+func jsonValue(v any) string {
+	if v == nil {
+		return "(unset)"
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// printChanges prints the changes to w: + for the objects created, ~ for
+// the objects updated, with their differences.
+func printChanges(w io.Writer, realm string, changes []realmChange) {
+	if len(changes) == 0 {
+		fmt.Fprintf(w, "realm %s is up to date\n", realm)
+		return
+	}
+	created := 0
+	for _, c := range changes {
+		mark := "~"
+		if c.create {
+			mark = "+"
+			created++
+		}
+		fmt.Fprintf(w, "%s %s %s\n", mark, c.kind, c.name)
+		for _, d := range c.details {
+			fmt.Fprintf(w, "    %s\n", d)
+		}
+	}
+	fmt.Fprintf(w, "realm %s: %d to create, %d to update\n", realm, created, len(changes)-created)
+}
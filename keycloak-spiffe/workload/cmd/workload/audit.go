@@ -0,0 +1,172 @@
+// audit.go
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+)
+
+// auditSyslogLocal sends the audit records to the local syslog daemon.
+const auditSyslogLocal = "local"
+
+// auditSyslogTag is the syslog tag of the audit records.
+const auditSyslogTag = "keycloak-spiffe-workload"
+
+// Audited events.
+const (
+	auditClientCredentials = "client_credentials"
+	auditTokenExchange     = "token_exchange"
+	auditRPT               = "uma_ticket"
+)
+
+// auditEvent is an audit record of a token request, written as one JSON
+// line. It identifies the token by the hash of its jti, never the token
+// itself.
+type auditEvent struct {
+	Time       time.Time  `json:"time"`
+	Event      string     `json:"event"`
+	Result     string     `json:"result"`
+	RequestID  string     `json:"request_id,omitempty"`
+	SPIFFEID   string     `json:"spiffe_id,omitempty"`
+	ClientID   string     `json:"client_id,omitempty"`
+	AuthMethod string     `json:"auth_method"`
+	Realm      string     `json:"realm"`
+	Audience   string     `json:"audience"`
+	Scope      string     `json:"scope,omitempty"`
+	JTIHash    string     `json:"jti_sha256,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LatencyMS  int64      `json:"latency_ms"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// auditor writes the audit records of the process to the sinks of the
+// last AuditConfig, opened on the first record.
+var auditor struct {
+	sync.Mutex
+	config AuditConfig
+	sinks  []io.Writer
+	opened bool
+}
+
+// newAuditEvent returns the record of an event of cfg for audience, with
+// the request ID of ctx, that started at start, completed with token or
+// err.
+func newAuditEvent(ctx context.Context, cfg Config, event, spiffeID, clientID, audience string, start time.Time, token *keycloak.TokenResponse, err error) auditEvent {
+	now := time.Now()
+	ev := auditEvent{
+		Time:       now.UTC(),
+		Event:      event,
+		Result:     resultSuccess,
+		RequestID:  requestID(ctx),
+		SPIFFEID:   spiffeID,
+		ClientID:   clientID,
+		AuthMethod: cfg.AuthMethod,
+		Realm:      cfg.Realm,
+		Audience:   audience,
+		Scope:      cfg.Scope,
+		LatencyMS:  now.Sub(start).Milliseconds(),
+	}
+	if err != nil {
+		ev.Result = resultFailure
+		ev.Error = err.Error()
+		return ev
+	}
+	if token.ExpiresIn > 0 {
+		expiresAt := now.Add(time.Duration(token.ExpiresIn) * time.Second).UTC()
+		ev.ExpiresAt = &expiresAt
+	}
+	if jti := tokenJTI(token.AccessToken); jti != "" {
+		sum := sha256.Sum256([]byte(jti))
+		ev.JTIHash = hex.EncodeToString(sum[:])
+	}
+	return ev
+}
+
+// tokenJTI returns the unverified jti claim of a JWT access token, empty
+// for opaque tokens.
+func tokenJTI(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := decodeSegment(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		JTI string `json:"jti"`
+	}
+	if json.Unmarshal(payload, &claims) != nil {
+		return ""
+	}
+	return claims.JTI
+}
+
+// audit writes ev to the audit sinks of c, if any. A failed write is
+// logged and counted, the token being issued anyway.
+func audit(c AuditConfig, ev auditEvent) {
+	if c.File == "" && c.Syslog == "" {
+		return
+	}
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	auditor.Lock()
+	defer auditor.Unlock()
+	if !auditor.opened || auditor.config != c {
+		closeAudit()
+		auditor.config, auditor.opened = c, true
+		if err := openAudit(c); err != nil {
+			slog.Error("Failed to open the audit log", "error", err)
+			failures.WithLabelValues("audit").Inc()
+		}
+	}
+	for _, sink := range auditor.sinks {
+		if _, err := sink.Write(line); err != nil {
+			slog.Error("Failed to write the audit record", "event", ev.Event, "spiffe_id", ev.SPIFFEID, "error", err)
+			failures.WithLabelValues("audit").Inc()
+		}
+	}
+}
+
+// openAudit opens the sinks of c. The file is only ever appended to.
+func openAudit(c AuditConfig) error {
+	if c.File != "" {
+		f, err := os.OpenFile(c.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return err
+		}
+		auditor.sinks = append(auditor.sinks, f)
+	}
+	if c.Syslog != "" {
+		w, err := dialSyslog(c.Syslog)
+		if err != nil {
+			return err
+		}
+		auditor.sinks = append(auditor.sinks, w)
+	}
+	return nil
+}
+
+// closeAudit closes the open sinks.
+func closeAudit() {
+	for _, sink := range auditor.sinks {
+		if closer, ok := sink.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	auditor.sinks = nil
+}
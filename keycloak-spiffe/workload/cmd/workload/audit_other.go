@@ -0,0 +1,28 @@
+//go:build !windows
+
+// audit_other.go
+package main
+
+import (
+	"io"
+	"log/syslog"
+	"net/url"
+)
+
+// dialSyslog connects to the syslog daemon at addr, local or a udp://,
+// tcp:// or unix:// URL, logging the audit records with the auth facility.
+func dialSyslog(addr string) (io.Writer, error) {
+	const priority = syslog.LOG_INFO | syslog.LOG_AUTH
+	if addr == auditSyslogLocal {
+		return syslog.New(priority, auditSyslogTag)
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	raddr := u.Host
+	if u.Scheme == "unix" {
+		raddr = u.Path
+	}
+	return syslog.Dial(u.Scheme, raddr, priority, auditSyslogTag)
+}
@@ -0,0 +1,15 @@
+//go:build windows
+
+// audit_windows.go
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// dialSyslog is not available on Windows, which has no log/syslog: write
+// the audit records to a file instead.
+func dialSyslog(string) (io.Writer, error) {
+	return nil, errors.New("audit syslog is not supported on Windows, set AUDIT_FILE instead")
+}
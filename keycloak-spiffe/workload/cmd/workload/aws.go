@@ -0,0 +1,212 @@
+// aws.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/aws"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/retry"
+)
+
+// runAWSLogin implements the aws-login subcommand: it exchanges the JWT-SVID
+// or the Keycloak access token for temporary AWS credentials with STS
+// AssumeRoleWithWebIdentity, and writes them to the profile of the shared
+// credentials file or prints them. In daemon mode the credentials are
+// renewed before they expire.
+func runAWSLogin(args []string) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	setupLogging(cfg)
+	if cfg.AWS.RoleARN == "" {
+		return errors.New("missing AWS role: set AWS_ROLE_ARN")
+	}
+	if err := checkOutput(cfg.Output, outputAWSCredentialProcess); err != nil {
+		return &configError{err}
+	}
+	if cfg.Output == "" {
+		cfg.Output = outputEnv
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		return err
+	}
+	defer flushTraces(shutdownTracing)
+	if cfg.Daemon {
+		serveOps(ctx, cfg, nil)
+	}
+
+	bootCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	s, err := openSession(bootCtx, &cfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	client, err := serviceClient(cfg, "")
+	if err != nil {
+		return err
+	}
+
+	a := cfg.AWS
+	endpoint := a.STSEndpoint
+	if endpoint == "" {
+		endpoint = aws.DefaultSTSEndpoint
+		if a.Region != "" {
+			endpoint = aws.RegionalSTSEndpoint(a.Region)
+		}
+	}
+	sessionName := a.SessionName
+	if sessionName == "" {
+		if sessionName, err = s.roleSessionName(); err != nil {
+			return err
+		}
+	}
+
+	return keepLoggedIn(ctx, cfg, "AWS STS AssumeRoleWithWebIdentity", func(ctx context.Context) (time.Duration, error) {
+		ctx, span := startSpan(ctx, "aws.AssumeRoleWithWebIdentity")
+		var result *aws.AssumeRoleResult
+		err := cfg.retryPolicyContext(ctx, "AWS STS AssumeRoleWithWebIdentity").Do(ctx, func(ctx context.Context) error {
+			token, err := s.credential(ctx, a.Credential, a.Audience)
+			if err != nil {
+				return err
+			}
+			result, err = aws.AssumeRoleWithWebIdentity(ctx, client, endpoint, aws.AssumeRoleRequest{
+				RoleARN:          a.RoleARN,
+				RoleSessionName:  sessionName,
+				WebIdentityToken: token,
+				Duration:         a.Duration,
+			})
+			if err != nil && !aws.IsTransient(err) {
+				return retry.Permanent(err)
+			}
+			return err
+		})
+		endSpan(span, err)
+		if err != nil {
+			failures.WithLabelValues("aws").Inc()
+			return 0, fmt.Errorf("assuming AWS role %s failed: %w", a.RoleARN, err)
+		}
+		expiration := result.Credentials.Expiration
+		slog.InfoContext(ctx, "Assumed the AWS role",
+			"role_arn", a.RoleARN,
+			"assumed_role", result.AssumedRoleARN,
+			"subject", result.Subject,
+			"expiration", expiration.UTC())
+		return time.Until(expiration), writeAWSCredentials(cfg, a.CredentialsFile, a.Profile, result.Credentials)
+	})
+}
+
+// roleSessionName returns the role session name of the workload identity,
+// from the SPIFFE ID of its X509-SVID or the subject of its Nomad workload
+// identity.
+func (s *session) roleSessionName() (string, error) {
+	if s.x509Source == nil {
+		sub, err := nomadSubject(s.ex.cfg.Nomad)
+		if err != nil {
+			return "", err
+		}
+		return awsSessionName(sub), nil
+	}
+	svid, err := s.x509Source.GetX509SVID()
+	if err != nil {
+		return "", fmt.Errorf("getting the X509-SVID: %w", err)
+	}
+	return awsSessionName(svid.ID.String()), nil
+}
+
+// unsafeSessionChars matches the characters not allowed in the name of a
+// role session.
+var unsafeSessionChars = regexp.MustCompile(`[^\w+=,.@-]+`)
+
+// awsSessionName returns the role session name of the workload spiffeID,
+// shown in CloudTrail: its trust domain and path, such as
+// localhost.idyatech.fr-mcp-client.
+func awsSessionName(spiffeID string) string {
+	name := unsafeSessionChars.ReplaceAllString(strings.TrimPrefix(spiffeID, "spiffe://"), "-")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// writeAWSCredentials writes the credentials to profile of the shared
+// credentials file, keeping the other profiles, or prints them when file is
+// empty: as the AWS_* variables of the SDKs with the env output, as the
+// credential_process document with json or yaml. The aws-credential-process
+// output prints the document for the SDK running the workload as its
+// credential_process, whatever the file.
+func writeAWSCredentials(cfg Config, file, profile string, c aws.Credentials) error {
+	expiration := c.Expiration.UTC().Format(time.RFC3339)
+	if file == "" || cfg.Output == outputAWSCredentialProcess {
+		vars := [][2]string{
+			{"AWS_ACCESS_KEY_ID", c.AccessKeyID},
+			{"AWS_SECRET_ACCESS_KEY", c.SecretAccessKey},
+			{"AWS_SESSION_TOKEN", c.SessionToken},
+			{"AWS_CREDENTIAL_EXPIRATION", expiration},
+		}
+		doc := map[string]any{
+			"Version":         1,
+			"AccessKeyId":     c.AccessKeyID,
+			"SecretAccessKey": c.SecretAccessKey,
+			"SessionToken":    c.SessionToken,
+			"Expiration":      expiration,
+		}
+		format := cfg.Output
+		if format == outputAWSCredentialProcess {
+			format = outputJSON
+		}
+		return writeCredential(os.Stdout, format, vars, doc)
+	}
+
+	existing, err := os.ReadFile(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("reading the AWS credentials file: %w", err)
+	}
+	var b bytes.Buffer
+	b.Write(withoutINISection(existing, profile))
+	fmt.Fprintf(&b, "[%s]\n", profile)
+	fmt.Fprintf(&b, "aws_access_key_id = %s\n", c.AccessKeyID)
+	fmt.Fprintf(&b, "aws_secret_access_key = %s\n", c.SecretAccessKey)
+	fmt.Fprintf(&b, "aws_session_token = %s\n", c.SessionToken)
+	fmt.Fprintf(&b, "# expires %s\n", expiration)
+	return writeFileAtomic(file, b.Bytes(), 0o600)
+}
+
+// withoutINISection returns data without the section name, ending with a
+// blank line when other sections remain.
+func withoutINISection(data []byte, name string) []byte {
+	var b bytes.Buffer
+	skip := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if trimmed := strings.TrimSpace(line); strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			skip = strings.TrimSpace(trimmed[1:len(trimmed)-1]) == name
+		}
+		if !skip {
+			b.WriteString(line + "\n")
+		}
+	}
+	out := bytes.TrimRight(b.Bytes(), "\n")
+	if len(out) == 0 {
+		return nil
+	}
+	return append(out, '\n', '\n')
+}
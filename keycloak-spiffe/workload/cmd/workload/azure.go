@@ -0,0 +1,103 @@
+// azure.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/azure"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/retry"
+)
+
+// runAzureLogin implements the azure-login subcommand: it presents the
+// JWT-SVID or the Keycloak access token as the federated client assertion of
+// an Entra ID app registration and prints the Azure access token. With a
+// federated token file it writes the assertion there instead, for the
+// workload identity credential of the Azure SDKs. In daemon mode the token
+// is renewed before it expires.
+func runAzureLogin(args []string) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	setupLogging(cfg)
+	if cfg.Azure.TenantID == "" || cfg.Azure.ClientID == "" {
+		return errors.New("missing Entra ID app registration: set AZURE_TENANT_ID and AZURE_CLIENT_ID")
+	}
+	if err := checkOutput(cfg.Output, ""); err != nil {
+		return &configError{err}
+	}
+	if cfg.Output == "" {
+		cfg.Output = outputRaw
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		return err
+	}
+	defer flushTraces(shutdownTracing)
+	if cfg.Daemon {
+		serveOps(ctx, cfg, nil)
+	}
+
+	bootCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	s, err := openSession(bootCtx, &cfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	client, err := serviceClient(cfg, "")
+	if err != nil {
+		return err
+	}
+
+	a := cfg.Azure
+	return keepLoggedIn(ctx, cfg, "Entra ID federated login", func(ctx context.Context) (time.Duration, error) {
+		ctx, span := startSpan(ctx, "azure.ClientAssertionToken")
+		var assertion string
+		var token *azure.Token
+		err := cfg.retryPolicyContext(ctx, "Entra ID federated login").Do(ctx, func(ctx context.Context) error {
+			var err error
+			if assertion, err = s.credential(ctx, a.Credential, a.Audience); err != nil {
+				return err
+			}
+			token, err = azure.ClientAssertionToken(ctx, client, a.AuthorityHost, a.TenantID, a.ClientID, assertion, a.Scopes)
+			if err != nil && !azure.IsTransient(err) {
+				return retry.Permanent(err)
+			}
+			return err
+		})
+		endSpan(span, err)
+		if err != nil {
+			failures.WithLabelValues("azure").Inc()
+			return 0, fmt.Errorf("entra ID federated login failed: %w", err)
+		}
+		slog.InfoContext(ctx, "Obtained an Entra ID access token",
+			"tenant_id", a.TenantID,
+			"client_id", a.ClientID,
+			"expiry", token.Expiry.UTC())
+
+		lifetime := time.Until(token.Expiry)
+		if a.TokenFile == "" {
+			return lifetime, writeCredential(os.Stdout, cfg.Output,
+				[][2]string{{"AZURE_ACCESS_TOKEN", token.AccessToken}},
+				map[string]any{
+					"access_token": token.AccessToken,
+					"token_type":   token.TokenType,
+					"expires_on":   token.Expiry.Unix(),
+				})
+		}
+		// The SDKs read the assertion again for each token they get.
+		return assertionLifetime(lifetime, assertion), writeFileAtomic(a.TokenFile, []byte(assertion), 0o600)
+	})
+}
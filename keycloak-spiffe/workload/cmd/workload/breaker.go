@@ -0,0 +1,126 @@
+// breaker.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// States of the circuit breaker, the values of workload_keycloak_circuit_state.
+const (
+	circuitClosed   = 0
+	circuitHalfOpen = 1
+	circuitOpen     = 2
+)
+
+// errCircuitOpen fails the token requests while the circuit breaker is
+// open.
+var errCircuitOpen = errors.New("Keycloak circuit breaker open")
+
+// circuitBreaker stops the token requests of the process after Threshold
+// consecutive failures showing that Keycloak is down or overloaded
+// (timeouts, network errors, 429 and 5xx answers): the requests fail at
+// once with errCircuitOpen for OpenDuration, the daemon and the broker
+// serving the tokens they hold meanwhile, then a single probe request is let
+// through. Its success closes the breaker, its failure opens it again.
+// Other answers, including 4xx, show that Keycloak is up.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	lastErr  error
+}
+
+// tokenBreaker guards the token requests of the whole process, shared like
+// tokenLimiter by all the exchangers.
+var tokenBreaker circuitBreaker
+
+// allow returns errCircuitOpen while the breaker is open, or while the
+// probe of a half-open breaker is in flight. Each allowed request must be
+// followed by record.
+func (b *circuitBreaker) allow(c CircuitBreakerConfig) error {
+	if c.Threshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < c.OpenDuration {
+			return fmt.Errorf("%w since %s after %d failures, last: %v", errCircuitOpen, b.openedAt.UTC().Format(time.RFC3339), b.failures, b.lastErr)
+		}
+		slog.Info("Probing Keycloak after the circuit breaker opened", "open_for", time.Since(b.openedAt).Round(time.Second))
+		b.setState(circuitHalfOpen)
+		return nil
+	case circuitHalfOpen:
+		return fmt.Errorf("%w, probing Keycloak", errCircuitOpen)
+	}
+	return nil
+}
+
+// record records the result of an allowed token request.
+func (b *circuitBreaker) record(c CircuitBreakerConfig, err error) {
+	if c.Threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if errors.Is(err, context.Canceled) {
+		// The probe did not complete: the next request probes again.
+		if b.state == circuitHalfOpen {
+			b.setState(circuitOpen)
+		}
+		return
+	}
+	if !breakerFailure(err) {
+		if b.state != circuitClosed {
+			slog.Info("Keycloak circuit breaker closed", "open_for", time.Since(b.openedAt).Round(time.Second))
+		}
+		b.failures = 0
+		b.setState(circuitClosed)
+		return
+	}
+	b.failures++
+	b.lastErr = err
+	if b.state == circuitHalfOpen || b.failures >= c.Threshold {
+		if b.state != circuitOpen {
+			slog.Warn("Keycloak circuit breaker open, failing the token requests fast", "failures", b.failures, "open_duration", c.OpenDuration, "error", err)
+			keycloakCircuitOpens.Inc()
+		}
+		b.openedAt = time.Now()
+		b.setState(circuitOpen)
+	}
+}
+
+// degradation returns why the token requests fail fast, nil while the
+// breaker is closed.
+func (b *circuitBreaker) degradation() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitClosed {
+		return nil
+	}
+	return fmt.Errorf("%w since %s", errCircuitOpen, b.openedAt.UTC().Format(time.RFC3339))
+}
+
+func (b *circuitBreaker) setState(state int) {
+	b.state = state
+	keycloakCircuitState.Set(float64(state))
+}
+
+// breakerFailure reports whether err shows Keycloak down or overloaded.
+func breakerFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch errorClass(err) {
+	case "timeout", "network", "server_error", "rate_limited":
+		return true
+	}
+	return false
+}
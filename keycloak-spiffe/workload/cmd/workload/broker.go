@@ -0,0 +1,366 @@
+// broker.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloakspiffe"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/spire"
+)
+
+// peerCred identifies the process at the other end of a Unix socket.
+type peerCred struct {
+	pid, uid, gid int
+}
+
+type peerCredKey struct{}
+
+// peerAllowlist holds the uids and gids allowed to get tokens from the
+// broker.
+type peerAllowlist struct {
+	uids, gids map[int]bool
+}
+
+// parsePeerAllowlist parses uid:N and gid:N entries. An empty list allows
+// the user running the broker only.
+func parsePeerAllowlist(entries []string) (peerAllowlist, error) {
+	allow := peerAllowlist{uids: map[int]bool{}, gids: map[int]bool{}}
+	if len(entries) == 0 {
+		allow.uids[os.Getuid()] = true
+		return allow, nil
+	}
+	for _, entry := range entries {
+		kind, id, ok := strings.Cut(entry, ":")
+		n, err := strconv.Atoi(id)
+		if !ok || err != nil || n < 0 {
+			return allow, fmt.Errorf("broker allow entry %q must be uid:N or gid:N", entry)
+		}
+		switch kind {
+		case "uid":
+			allow.uids[n] = true
+		case "gid":
+			allow.gids[n] = true
+		default:
+			return allow, fmt.Errorf("broker allow entry %q must be uid:N or gid:N", entry)
+		}
+	}
+	return allow, nil
+}
+
+func (a peerAllowlist) allows(cred peerCred) bool {
+	return a.uids[cred.uid] || a.gids[cred.gid]
+}
+
+// tokenBroker vends the access tokens of the configured audiences to the
+// allowed local processes.
+type tokenBroker struct {
+	cfg   Config
+	s     *session
+	ex    *exchanger
+	cache *keycloakspiffe.Cache
+	allow peerAllowlist
+}
+
+// brokerToken is the response of the broker.
+type brokerToken struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Audience    string `json:"audience"`
+	SPIFFEID    string `json:"spiffe_id,omitempty"`
+}
+
+// runBroker implements the broker subcommand: it serves GET /token on a
+// Unix socket to the processes allowed by their peer credentials and, when
+// configured, on a loopback address.
+func runBroker(args []string) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	setupLogging(cfg)
+	allow, err := parsePeerAllowlist(cfg.Broker.Allow)
+	if err != nil {
+		return err
+	}
+	activated, err := activatedListener("broker")
+	if err != nil {
+		return err
+	}
+	if tcp, ok := activated.(*net.TCPListener); ok && !tcp.Addr().(*net.TCPAddr).IP.IsLoopback() {
+		return fmt.Errorf("activated broker address %s must be a loopback address", tcp.Addr())
+	}
+	if activated == nil && cfg.Broker.Socket == "" && cfg.Broker.Addr == "" {
+		return errors.New("the broker needs a socket or a loopback address")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		return err
+	}
+	defer flushTraces(shutdownTracing)
+	serveOps(ctx, cfg, nil)
+
+	bootCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	s, err := openSession(bootCtx, &cfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	b := &tokenBroker{cfg: cfg, s: s, ex: s.ex, cache: keycloakspiffe.NewCache(0), allow: allow}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", b.handleToken)
+
+	errc := make(chan error, 2)
+	servers := 0
+	if _, ok := activated.(*net.UnixListener); ok || (activated == nil && cfg.Broker.Socket != "") {
+		lis := activated
+		if lis == nil {
+			if lis, err = listenUnix(cfg.Broker.Socket); err != nil {
+				return err
+			}
+		}
+		srv := &http.Server{
+			Handler:           b.requirePeer(mux),
+			ReadHeaderTimeout: 10 * time.Second,
+			ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+				if cred, err := unixPeerCred(c); err == nil {
+					ctx = context.WithValue(ctx, peerCredKey{}, cred)
+				} else {
+					slog.Warn("Failed to read the broker peer credentials", "error", err)
+				}
+				return ctx
+			},
+		}
+		go func() { errc <- serveBroker(ctx, srv, lis) }()
+		servers++
+		slog.Info("Serving tokens on the broker socket", "socket", lis.Addr().String(), "activated", activated != nil)
+	}
+	if _, ok := activated.(*net.TCPListener); ok || (activated == nil && cfg.Broker.Addr != "") {
+		lis := activated
+		if lis == nil {
+			if lis, err = net.Listen("tcp", cfg.Broker.Addr); err != nil {
+				return fmt.Errorf("listening on broker address: %w", err)
+			}
+		}
+		srv := &http.Server{Handler: requireLocalRequest(mux), ReadHeaderTimeout: 10 * time.Second}
+		go func() { errc <- serveBroker(ctx, srv, lis) }()
+		servers++
+		slog.Info("Serving tokens on the broker address", "addr", lis.Addr().String(), "activated", activated != nil)
+	}
+	if servers == 0 {
+		return fmt.Errorf("unsupported activated broker socket %s", activated.Addr())
+	}
+	if err := sdNotify("READY=1\nSTATUS=Serving tokens"); err != nil {
+		slog.Warn("Failed to notify systemd", "error", err)
+	}
+
+	for ; servers > 0; servers-- {
+		if err := <-errc; err != nil {
+			stop()
+			return err
+		}
+	}
+	return nil
+}
+
+// listenUnix listens on the Unix socket path, replacing a stale socket.
+func listenUnix(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("removing stale broker socket: %w", err)
+	}
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("listening on broker socket: %w", err)
+	}
+	// Callers are authorized by their credentials, not by the file mode.
+	if err := os.Chmod(path, 0o666); err != nil {
+		lis.Close()
+		return nil, fmt.Errorf("setting broker socket permissions: %w", err)
+	}
+	return lis, nil
+}
+
+// serveBroker serves srv on lis until ctx is cancelled.
+func serveBroker(ctx context.Context, srv *http.Server, lis net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	if err := srv.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// requirePeer rejects the requests of the processes not in the allowlist.
+func (b *tokenBroker) requirePeer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cred, ok := r.Context().Value(peerCredKey{}).(peerCred)
+		if !ok || !b.allow.allows(cred) {
+			slog.Warn("Broker request denied", "pid", cred.pid, "uid", cred.uid, "gid", cred.gid)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireLocalRequest rejects the requests over loopback TCP that a web
+// page or a server-side request forgery could send: those without the
+// Metadata: true header, which a browser only sends to another origin after
+// a CORS preflight the broker never answers, and those whose Host is not a
+// loopback name, as after a DNS rebinding.
+func requireLocalRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !isLoopback(strings.Trim(host, "[]")) {
+			slog.Warn("Broker request denied", "host", r.Host)
+			http.Error(w, "host not allowed", http.StatusForbidden)
+			return
+		}
+		if r.Header.Get("Metadata") != "true" {
+			http.Error(w, "missing Metadata: true header", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowedAudience reports whether callers may ask for audience.
+func (b *tokenBroker) allowedAudience(audience string) bool {
+	patterns := b.cfg.Broker.Audiences
+	if len(patterns) == 0 {
+		patterns = b.cfg.Audience
+	}
+	for _, pattern := range patterns {
+		// validate already rejected malformed patterns.
+		if ok, _ := path.Match(pattern, audience); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// identityExchanger returns the exchanger authenticating with the JWT-SVID
+// of spiffeID, one of the other identities of the workload, and whether
+// callers may ask for it.
+func (b *tokenBroker) identityExchanger(spiffeID string) (*exchanger, bool, error) {
+	id, err := spiffeid.FromString(spiffeID)
+	if err != nil {
+		return nil, false, nil
+	}
+	allowed := false
+	for _, pattern := range b.cfg.Broker.Identities {
+		allowed = allowed || spire.MatchID(pattern, id)
+	}
+	if !allowed {
+		return nil, false, nil
+	}
+	// Without SPIRE the exchanger would authenticate as the default
+	// identity whatever the SPIFFE ID asked for.
+	if b.s.jwtSource == nil {
+		return nil, true, fmt.Errorf("no JWT-SVID of %s without a SPIRE Agent", id)
+	}
+	// The expected SPIFFE ID is the one of the default identity.
+	svids := spire.ExpectIdentity(spire.SelectIdentity(b.s.jwtSource, id.String()), spire.ExpectedIdentity{TrustDomain: b.cfg.TrustDomain})
+	ex, err := newExchanger(b.cfg, b.s.client, b.s.endpoints, svids, x509SVIDSource(b.s.x509Source))
+	return ex, true, err
+}
+
+// handleToken returns the token of the audience query parameter, the first
+// configured audience by default, fetching a JWT-SVID for that audience and
+// exchanging it when no cached token is fresh. The spiffe_id parameter
+// selects another identity of the workload, the client of the token.
+func (b *tokenBroker) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	audience := r.URL.Query().Get("audience")
+	if audience == "" {
+		audience = b.cfg.primaryAudience()
+	}
+	if !b.allowedAudience(audience) {
+		http.Error(w, "audience not allowed by this broker", http.StatusForbidden)
+		return
+	}
+
+	// The client's request ID, if any, follows the exchange to Keycloak.
+	header := b.cfg.requestIDHeader()
+	ctx, id := withClientRequestID(r.Context(), header, r)
+	if header != "" {
+		w.Header().Set(header, id)
+	}
+
+	ex, key := b.ex, keycloakspiffe.CacheKey{Audience: audience, Realm: b.cfg.Realm, ClientID: b.ex.clientID, Scope: b.cfg.Scope, Resource: strings.Join(b.cfg.Resource, " ")}
+	spiffeID := r.URL.Query().Get("spiffe_id")
+	if spiffeID != "" {
+		idEx, ok, err := b.identityExchanger(spiffeID)
+		switch {
+		case !ok:
+			http.Error(w, "SPIFFE ID not allowed by this broker", http.StatusForbidden)
+			return
+		case err != nil:
+			slog.WarnContext(ctx, "Broker identity unavailable", "spiffe_id", spiffeID, "error", err)
+			http.Error(w, "token unavailable", http.StatusBadGateway)
+			return
+		}
+		// The jwt-spiffe client is the SPIFFE ID of the JWT-SVID.
+		ex, key.ClientID = idEx, spiffeID
+	}
+
+	token, err := b.cache.Get(ctx, key, func(ctx context.Context) (*keycloak.TokenResponse, error) {
+		return ex.exchangeAudience(ctx, audience)
+	})
+	if errors.Is(err, errCircuitOpen) {
+		// Keycloak is down: the token being renewed is still valid.
+		if cached, ok := b.cache.Unexpired(key); ok {
+			slog.DebugContext(ctx, "Broker serving the cached token while the circuit breaker is open", "audience", audience, "spiffe_id", spiffeID)
+			token, err = cached, nil
+		}
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "Broker token exchange failed", "audience", audience, "spiffe_id", spiffeID, "error", err)
+		http.Error(w, "token unavailable", http.StatusBadGateway)
+		return
+	}
+	cred, _ := r.Context().Value(peerCredKey{}).(peerCred)
+	slog.DebugContext(ctx, "Broker token vended", "audience", audience, "spiffe_id", spiffeID, "pid", cred.pid, "uid", cred.uid, "remote", r.RemoteAddr)
+
+	resp := brokerToken{AccessToken: token.AccessToken, TokenType: token.TokenType, Audience: audience, SPIFFEID: spiffeID}
+	if !token.Expiry.IsZero() {
+		resp.ExpiresIn = int(time.Until(token.Expiry).Seconds())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
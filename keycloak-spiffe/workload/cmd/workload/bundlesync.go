@@ -0,0 +1,161 @@
+// bundlesync.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/spire"
+)
+
+// bundleSync pushes the JWT bundle of a trust domain to Keycloak whenever
+// the SPIRE Server rotates its keys.
+type bundleSync struct {
+	cfg     Config
+	bundles jwtbundle.Source
+	td      spiffeid.TrustDomain
+	// pushed is the JWKS last pushed, nil until the first push succeeds.
+	pushed []byte
+}
+
+// runSyncBundle implements admin sync-bundle: it checks the JWT bundle of
+// TRUST_DOMAIN every bundle sync interval and, when the keys changed, writes
+// them to the JWKS of the bundle sync clients and clears the public key
+// cache of the realm, so that Keycloak accepts the JWT-SVIDs signed with a
+// new key as soon as SPIRE publishes it rather than when its cache expires.
+func runSyncBundle(args []string) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	setupLogging(cfg)
+	td, err := jwksTrustDomain(cfg)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		return err
+	}
+	defer flushTraces(shutdownTracing)
+	serveOps(ctx, cfg, nil)
+
+	bootCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	if err := waitForSocket(bootCtx, cfg); err != nil {
+		return err
+	}
+	source, err := spire.NewBundleSource(bootCtx, cfg.SocketPath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	s := &bundleSync{cfg: cfg, bundles: source, td: td}
+	slog.Info("Syncing the JWT bundle to Keycloak", "trust_domain", td.Name(), "realm", cfg.Realm, "interval", cfg.Admin.BundleSync.Interval, "clients", []string(cfg.Admin.BundleSync.Clients))
+	if err := sdNotify("READY=1\nSTATUS=Syncing the JWT bundle"); err != nil {
+		slog.Warn("Failed to notify systemd", "error", err)
+	}
+
+	ticker := time.NewTicker(cfg.Admin.BundleSync.Interval)
+	defer ticker.Stop()
+	for {
+		s.sync(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// sync pushes the JWT bundle if it changed since the last push. A failed
+// push is retried at the next check.
+func (s *bundleSync) sync(ctx context.Context) {
+	bundle, err := s.bundles.GetJWTBundleForTrustDomain(s.td)
+	if err != nil {
+		slog.Error("JWT bundle unavailable", "trust_domain", s.td.Name(), "error", err)
+		failures.WithLabelValues("spire").Inc()
+		return
+	}
+	jwks, err := spire.JWKS(bundle)
+	if err != nil {
+		slog.Error("Failed to convert the JWT bundle", "trust_domain", s.td.Name(), "error", err)
+		return
+	}
+	if bytes.Equal(jwks, s.pushed) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+	defer cancel()
+	ctx, span := startSpan(ctx, "keycloak.SyncBundle")
+	err = s.push(ctx, jwks)
+	endSpan(span, err)
+	sum := sha256.Sum256(jwks)
+	if err != nil {
+		slog.Error("Failed to push the JWT bundle to Keycloak", "trust_domain", s.td.Name(), "error", adminFailure(s.cfg, err))
+		bundleSyncs.WithLabelValues("failure").Inc()
+		return
+	}
+	s.pushed = jwks
+	bundleSyncs.WithLabelValues("success").Inc()
+	slog.Info("JWT bundle pushed to Keycloak", "trust_domain", s.td.Name(), "keys", len(bundle.JWTAuthorities()), "sha256", hex.EncodeToString(sum[:8]))
+}
+
+// push logs in again, the admin tokens being short-lived, writes jwks to
+// the clients and clears the realm key cache.
+func (s *bundleSync) push(ctx context.Context, jwks []byte) error {
+	cfg := s.cfg
+	admin, err := adminSession(ctx, &cfg)
+	if err != nil {
+		return err
+	}
+	return cfg.retryPolicy("Bundle push").Do(ctx, func(ctx context.Context) error {
+		for _, clientID := range cfg.Admin.BundleSync.Clients {
+			if err := setClientJWKS(ctx, admin, clientID, jwks); err != nil {
+				return keycloakRetry(fmt.Errorf("client %s: %w", clientID, err))
+			}
+		}
+		// The SPIFFE identity provider refetches its bundle endpoint.
+		return keycloakRetry(admin.ClearKeysCache(ctx))
+	})
+}
+
+// setClientJWKS makes jwks the keys validating the JWTs of the client
+// clientID.
+func setClientJWKS(ctx context.Context, admin *keycloak.AdminClient, clientID string, jwks []byte) error {
+	client, err := admin.FindClient(ctx, clientID)
+	if err != nil {
+		return err
+	}
+	if client == nil {
+		return fmt.Errorf("client %s does not exist in the realm", clientID)
+	}
+	if client.Attributes[keycloak.AttributeJWKSString] == string(jwks) && client.Attributes[keycloak.AttributeUseJWKSString] == "true" {
+		return nil
+	}
+	if client.Attributes == nil {
+		client.Attributes = map[string]string{}
+	}
+	client.Attributes[keycloak.AttributeUseJWKSString] = "true"
+	client.Attributes[keycloak.AttributeUseJWKSURL] = "false"
+	client.Attributes[keycloak.AttributeJWKSString] = string(jwks)
+	return admin.UpdateClient(ctx, *client)
+}
@@ -0,0 +1,106 @@
+// commands.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/spire"
+)
+
+// commands maps subcommand names to their entry points. Without a
+// subcommand the workload runs the registration and authentication test.
+var commands = map[string]func(args []string) error{
+	"admin":             runAdmin,
+	"aws-login":         runAWSLogin,
+	"azure-login":       runAzureLogin,
+	"broker":            runBroker,
+	"consul-login":      runConsulLogin,
+	"docker-credential": runDockerCredential,
+	"doctor":            runDoctor,
+	"downstream-token":  runDownstreamToken,
+	"exec":              runExec,
+	"gcp-login":         runGCPLogin,
+	"git-credential":    runGitCredential,
+	"inspect":           runInspect,
+	"introspect":        runIntrospect,
+	"jwks":              runJWKS,
+	"proxy":             runProxy,
+	"revoke":            runRevoke,
+	"rpt":               runRPT,
+	"service":           runService,
+	"sts":               runSTS,
+	"token-exchange":    runTokenExchange,
+	"vault-login":       runVaultLogin,
+}
+
+// runCommand runs the subcommand name with args.
+func runCommand(name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for n := range commands {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command %q (available: %s)", name, strings.Join(names, ", "))
+	}
+	return cmd(args)
+}
+
+// session holds the SPIRE sources and the Keycloak client used by subcommands.
+type session struct {
+	jwtSource  *workloadapi.JWTSource
+	x509Source *workloadapi.X509Source
+	// svids are the JWT-SVIDs of the selected identity from jwtSource.
+	svids     spire.JWTSVIDSource
+	client    *http.Client
+	endpoints *keycloak.ProviderMetadata
+	ex        *exchanger
+}
+
+// openSession connects to the SPIRE Agent and prepares the Keycloak client.
+// The Keycloak paths are detected first when cfg asks for it. With the nomad
+// auth method the SPIRE Agent is not used: the session has no SVIDs.
+func openSession(ctx context.Context, cfg *Config) (*session, error) {
+	s := &session{}
+	var err error
+
+	if cfg.AuthMethod != authMethodNomad {
+		if s.x509Source, err = newX509Source(ctx, *cfg); err != nil {
+			return nil, err
+		}
+		if s.jwtSource, err = newJWTSource(ctx, *cfg); err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.svids = jwtSVIDs(*cfg, s.jwtSource)
+	}
+	if s.client, err = httpClient(*cfg, s.x509Source); err != nil {
+		s.Close()
+		return nil, err
+	}
+	resolveKeycloakPath(ctx, cfg, s.client)
+	s.endpoints = discoverEndpoints(ctx, *cfg, s.client)
+	if s.ex, err = newExchanger(*cfg, s.client, s.endpoints, s.svids, x509SVIDSource(s.x509Source)); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close releases the SPIRE sources.
+func (s *session) Close() {
+	if s.jwtSource != nil {
+		s.jwtSource.Close()
+	}
+	if s.x509Source != nil {
+		s.x509Source.Close()
+	}
+}
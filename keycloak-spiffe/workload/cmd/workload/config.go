@@ -0,0 +1,2246 @@
+// config.go
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"gopkg.in/yaml.v3"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/azure"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/consul"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/gcp"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/spire"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/vault"
+)
+
+const (
+	defaultKeycloakURL = "https://keycloak:8443"
+	defaultRealm       = "spiffe"
+	defaultIDPAlias    = "spiffe"
+)
+
+// Config holds the workload settings.
+//
+// Values are resolved in the following order, the first one set wins:
+// command-line flags, environment variables, configuration file, defaults.
+type Config struct {
+	SocketPath string `yaml:"socket_path"`
+	// SPIFFEID selects the SVIDs used when the workload has several
+	// identities: an exact SPIFFE ID or a glob pattern, the default SVID of
+	// the agent when empty.
+	SPIFFEID string `yaml:"spiffe_id"`
+	// ExpectSPIFFEID and TrustDomain, when set, are checked against the
+	// SPIFFE ID of every fetched JWT-SVID.
+	ExpectSPIFFEID string `yaml:"expect_spiffe_id"`
+	TrustDomain    string `yaml:"trust_domain"`
+	KeycloakURL    string `yaml:"keycloak_url"`
+	Realm          string `yaml:"realm"`
+	// TrustDomains maps the trust domains of a SPIFFE federation to their
+	// Keycloak realm. The entry of the selected trust domain, TrustDomain or
+	// the one of SPIFFEID, overrides the Keycloak settings it sets.
+	TrustDomains map[string]TrustDomainRealm `yaml:"trust_domains"`
+	// Audience lists the JWT-SVID audiences, one Keycloak token is obtained
+	// per audience. The first one is used for client registration.
+	Audience    stringList      `yaml:"audience"`
+	IDPAlias    string          `yaml:"idp_alias"`
+	Timeout     time.Duration   `yaml:"timeout"`
+	HTTPTimeout time.Duration   `yaml:"http_timeout"`
+	Timeouts    TimeoutsConfig  `yaml:"timeouts"`
+	TLS         TLSConfig       `yaml:"tls"`
+	Retry       RetryConfig     `yaml:"retry"`
+	RateLimit   RateLimitConfig `yaml:"rate_limit"`
+	// CircuitBreaker stops the token requests while Keycloak is failing.
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+	Audit          AuditConfig          `yaml:"audit"`
+	Alert          AlertConfig          `yaml:"alert"`
+	// RequestIDHeader carries the request ID of each exchange to Keycloak,
+	// none to not send it.
+	RequestIDHeader string           `yaml:"request_id_header"`
+	SocketWait      SocketWaitConfig `yaml:"socket_wait"`
+	Log             LogConfig        `yaml:"log"`
+	// Discovery reads the realm endpoints from its OpenID Connect discovery
+	// document instead of the conventional Keycloak paths.
+	Discovery bool `yaml:"discovery"`
+	// LegacyPath selects the Keycloak endpoint paths: true for the /auth
+	// prefix of Keycloak up to 16, false for the Keycloak 17+ root paths,
+	// auto to detect them with the discovery document.
+	LegacyPath string `yaml:"legacy_path"`
+	// Failover lists other entry points of the Keycloak cluster the
+	// requests fail over to when KeycloakURL is unreachable.
+	Failover FailoverConfig `yaml:"failover"`
+	// Resolve lists host:port:addr overrides of the Keycloak host names, as
+	// curl --resolve, for hosts resolving differently or not at all.
+	Resolve stringList `yaml:"resolve"`
+	// DNSServer is the host:port of the DNS server resolving the Keycloak
+	// host names, the system resolver when empty.
+	DNSServer string `yaml:"dns_server"`
+	// KeycloakProxy is the URL of the HTTP proxy of the Keycloak requests,
+	// http:// or https:// for a TLS connection to the proxy; direct ignores
+	// the proxies of the environment (HTTPS_PROXY, HTTP_PROXY, NO_PROXY),
+	// used when empty.
+	KeycloakProxy string `yaml:"keycloak_proxy"`
+	// KeycloakProxyCAFile verifies the certificate of an https:// proxy
+	// instead of the system roots.
+	KeycloakProxyCAFile string `yaml:"keycloak_proxy_ca_file"`
+	// VerifyToken checks the issued access tokens against the realm JWKS
+	// before they are used.
+	VerifyToken VerifyTokenConfig `yaml:"verify_token"`
+	// Scope is the space-separated scope of the token requests, the
+	// default client scopes when empty.
+	Scope string `yaml:"scope"`
+	// Resource lists the RFC 8707 resource indicators of the token
+	// requests, the resource servers the tokens are restricted to.
+	Resource stringList `yaml:"resource"`
+	// DPoP binds the tokens to a DPoP key (RFC 9449): memory for a key
+	// generated at startup, x509-svid for the X509-SVID key. Disabled when
+	// empty.
+	DPoP string `yaml:"dpop"`
+	// MetricsAddr is the listen address of the Prometheus /metrics
+	// endpoint, disabled when empty.
+	MetricsAddr string `yaml:"metrics_addr"`
+	// HealthAddr is the listen address of the /healthz and /readyz endpoints
+	// in daemon mode, disabled when empty. It may equal MetricsAddr.
+	HealthAddr string `yaml:"health_addr"`
+
+	// AuthMethod is the client authentication method at the token endpoint:
+	// jwt-spiffe (JWT-SVID client assertion), tls_client_auth (X509-SVID),
+	// private_key_jwt (assertion signed with the X509-SVID key) or nomad
+	// (Nomad workload identity assertion, without SPIRE).
+	AuthMethod string `yaml:"auth_method"`
+	// ClientID is the Keycloak client used with tls_client_auth and
+	// private_key_jwt, defaulting to the SPIFFE ID of the X509-SVID, and
+	// with nomad.
+	ClientID  string          `yaml:"client_id"`
+	Assertion AssertionConfig `yaml:"assertion"`
+
+	// TokenExchange configures the token-exchange subcommand.
+	TokenExchange TokenExchangeConfig `yaml:"token_exchange"`
+	// Revoke configures the revoke subcommand.
+	Revoke RevokeConfig `yaml:"revoke"`
+	// Introspect configures the introspect subcommand.
+	Introspect IntrospectConfig `yaml:"introspect"`
+	// Inspect configures the inspect subcommand.
+	Inspect InspectConfig `yaml:"inspect"`
+	// Admin configures the admin subcommands.
+	Admin AdminConfig `yaml:"admin"`
+
+	// Daemon keeps the workload running and refreshes the access token
+	// once RenewThreshold of its lifetime has elapsed.
+	Daemon         bool          `yaml:"daemon"`
+	RenewThreshold float64       `yaml:"renew_threshold"`
+	RetryInterval  time.Duration `yaml:"retry_interval"`
+	// SPIREGracePeriod is how long the daemon keeps serving its cached
+	// tokens while the SPIRE Agent is unreachable before it fails, until
+	// they expire when zero.
+	SPIREGracePeriod time.Duration `yaml:"spire_grace_period"`
+	// RevokeOnExit revokes the tokens held by the daemon at Keycloak when
+	// it stops, so that they do not outlive the workload.
+	RevokeOnExit bool `yaml:"revoke_on_exit"`
+	// ReloadInterval is how often the daemon checks ConfigFile for changes
+	// to reload, SIGHUP only when zero.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+	// ConfigFile is the YAML file the configuration was loaded from.
+	ConfigFile string `yaml:"-"`
+	// TokenAPIAddr is the unix:// address serving the gRPC token API in
+	// daemon mode.
+	TokenAPIAddr string `yaml:"token_api_addr"`
+	// SDSAddr is the unix:// address serving the X509-SVID and trust
+	// bundles to Envoy with SDS in daemon mode.
+	SDSAddr string `yaml:"sds_addr"`
+	// Sidecar runs the daemon as a Kubernetes sidecar sharing its tokens
+	// through a volume.
+	Sidecar SidecarConfig `yaml:"sidecar"`
+	// TokenFile writes the access tokens to files.
+	TokenFile TokenFileConfig `yaml:"token_file"`
+	// KubeSecret stores the access tokens in Kubernetes Secrets.
+	KubeSecret KubeSecretConfig `yaml:"kube_secret"`
+	// RenewHook is a shell command run after each token is obtained.
+	RenewHook string `yaml:"renew_hook"`
+	// Output prints each token obtained on the standard output as json,
+	// yaml, env, raw or the ExecCredential of a kubectl credential plugin
+	// (exec-credential), nothing when empty. aws-credential-process prints
+	// the AWS credentials of aws-login and sts assume for credential_process.
+	Output string `yaml:"output"`
+	// Quiet only logs errors and prints the raw access token unless Output
+	// selects another format, for TOKEN=$(fetcher -quiet).
+	Quiet bool `yaml:"quiet"`
+	// DryRun fetches the JWT-SVIDs and prints the token requests instead
+	// of registering the client and sending them to Keycloak. For admin
+	// apply, it prints the realm changes without making them.
+	DryRun bool `yaml:"dry_run"`
+	// ShowSecrets prints the client assertions of a dry run unredacted.
+	ShowSecrets bool `yaml:"show_secrets"`
+	// TraceHTTP logs the DNS lookups, connections, TLS handshakes, requests
+	// and responses of the calls to Keycloak, with the secrets redacted.
+	TraceHTTP bool `yaml:"trace_http"`
+	// TokenCache persists the daemon tokens across restarts.
+	TokenCache TokenCacheConfig `yaml:"token_cache"`
+	// Exec configures the exec subcommand.
+	Exec ExecConfig `yaml:"exec"`
+	// Broker configures the broker subcommand.
+	Broker BrokerConfig `yaml:"broker"`
+	// Proxy configures the proxy subcommand.
+	Proxy ProxyConfig `yaml:"proxy"`
+	// JWKS configures the jwks subcommand.
+	JWKS JWKSConfig `yaml:"jwks"`
+	// Downstream configures the downstream-token subcommand.
+	Downstream DownstreamConfig `yaml:"downstream"`
+	// Vault configures the vault-login subcommand.
+	Vault VaultConfig `yaml:"vault"`
+	// AWS configures the aws-login subcommand.
+	AWS AWSConfig `yaml:"aws"`
+	// GCP configures the gcp-login subcommand.
+	GCP GCPConfig `yaml:"gcp"`
+	// Azure configures the azure-login subcommand.
+	Azure AzureConfig `yaml:"azure"`
+	// STS configures the sts assume subcommand.
+	STS STSConfig `yaml:"sts"`
+	// Docker configures the docker-credential subcommand.
+	Docker DockerConfig `yaml:"docker"`
+	// Git configures the git-credential subcommand.
+	Git GitConfig `yaml:"git"`
+	// Consul configures the consul-login subcommand.
+	Consul ConsulConfig `yaml:"consul"`
+	// Nomad locates the Nomad workload identity of the nomad auth method
+	// and token exchange subject.
+	Nomad NomadConfig `yaml:"nomad"`
+	// UMA configures the rpt subcommand.
+	UMA UMAConfig `yaml:"uma"`
+
+	// defaultAudience is set when Audience defaults to the realm URL, which
+	// follows the detected Keycloak paths.
+	defaultAudience bool
+}
+
+// TrustDomainRealm holds the Keycloak realm trusting a trust domain. Empty
+// fields keep the top-level setting.
+type TrustDomainRealm struct {
+	KeycloakURL      string     `yaml:"keycloak_url"`
+	KeycloakSPIFFEID string     `yaml:"keycloak_spiffe_id"`
+	Realm            string     `yaml:"realm"`
+	IDPAlias         string     `yaml:"idp_alias"`
+	Audience         stringList `yaml:"audience"`
+}
+
+// ProxyConfig holds the reverse proxy settings: the loopback address the
+// local application calls, and the upstream URL receiving its requests with
+// the access token of the primary audience.
+type ProxyConfig struct {
+	Listen   string `yaml:"listen"`
+	Upstream string `yaml:"upstream"`
+}
+
+// JWKSConfig holds the JWKS endpoint settings: the address and path
+// serving the JWT bundle of TrustDomain as a JWKS, and how long clients may
+// cache it, shorter than the JWT key rotation of the SPIRE Server.
+type JWKSConfig struct {
+	Addr   string        `yaml:"addr"`
+	Path   string        `yaml:"path"`
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+// DownstreamConfig holds the token exchanged for the workload access token
+// by the downstream-token subcommand: the client IDs of the services it is
+// intended for and its scope.
+type DownstreamConfig struct {
+	Audience stringList `yaml:"audience"`
+	Scope    string     `yaml:"scope"`
+}
+
+// VaultConfig holds the Vault login of the vault-login subcommand: the
+// JWT/OIDC auth method enabled at Mount of the server at Addr, the role
+// logged in as, and the Credential presented, a JWT-SVID for Audience (a
+// bound audience of the role) or the Keycloak access token. The Vault
+// token is written to TokenFile, printed when empty.
+type VaultConfig struct {
+	Addr       string `yaml:"addr"`
+	Namespace  string `yaml:"namespace"`
+	CACert     string `yaml:"ca_cert"`
+	Mount      string `yaml:"mount"`
+	Role       string `yaml:"role"`
+	Credential string `yaml:"credential"`
+	Audience   string `yaml:"audience"`
+	TokenFile  string `yaml:"token_file"`
+}
+
+// AWSConfig holds the AWS STS AssumeRoleWithWebIdentity call of the
+// aws-login subcommand: the role assumed as SessionName, the SPIFFE ID of
+// the workload when empty, for Duration, and the Credential presented, a
+// JWT-SVID for Audience (the audience of the IAM OIDC identity provider) or
+// the Keycloak access token. STSEndpoint defaults to the regional endpoint
+// of Region. The credentials are written to Profile of CredentialsFile,
+// printed when empty.
+type AWSConfig struct {
+	RoleARN         string        `yaml:"role_arn"`
+	SessionName     string        `yaml:"session_name"`
+	Duration        time.Duration `yaml:"duration"`
+	Region          string        `yaml:"region"`
+	STSEndpoint     string        `yaml:"sts_endpoint"`
+	Credential      string        `yaml:"credential"`
+	Audience        string        `yaml:"audience"`
+	CredentialsFile string        `yaml:"credentials_file"`
+	Profile         string        `yaml:"profile"`
+}
+
+// GCPConfig holds the workload identity federation of the gcp-login
+// subcommand: the Credential presented to the workload identity pool
+// Provider, a JWT-SVID for Audience (the default audience of the provider
+// when empty) or the Keycloak access token, is exchanged at STS for a token
+// with Scopes, impersonating ServiceAccount for Lifetime when it is set.
+// CredentialsFile is the external account configuration written for the
+// client libraries, reading the token from TokenFile.
+type GCPConfig struct {
+	Provider        string        `yaml:"provider"`
+	ServiceAccount  string        `yaml:"service_account"`
+	Scopes          stringList    `yaml:"scopes"`
+	Lifetime        time.Duration `yaml:"lifetime"`
+	Credential      string        `yaml:"credential"`
+	Audience        string        `yaml:"audience"`
+	CredentialsFile string        `yaml:"credentials_file"`
+	TokenFile       string        `yaml:"token_file"`
+}
+
+// AzureConfig holds the Entra ID login of the azure-login subcommand: the
+// Credential presented as the client assertion of the app registration
+// ClientID of TenantID, a JWT-SVID for Audience or the Keycloak access
+// token, for a token with Scopes from AuthorityHost. TokenFile receives the
+// assertion for the Azure SDKs instead.
+type AzureConfig struct {
+	TenantID      string     `yaml:"tenant_id"`
+	ClientID      string     `yaml:"client_id"`
+	Scopes        stringList `yaml:"scopes"`
+	AuthorityHost string     `yaml:"authority_host"`
+	Credential    string     `yaml:"credential"`
+	Audience      string     `yaml:"audience"`
+	TokenFile     string     `yaml:"token_file"`
+}
+
+// STSConfig holds the AssumeRoleWithWebIdentity call of sts assume to the
+// STS of an S3-compatible store at Endpoint, verified with the CAs of
+// CACert: the Credential presented, the Keycloak access token or a
+// JWT-SVID for Audience, the optional RoleARN and session Policy, and the
+// Duration of the credentials. They are written to Profile of
+// CredentialsFile, printed when empty.
+type STSConfig struct {
+	Endpoint        string        `yaml:"endpoint"`
+	CACert          string        `yaml:"ca_cert"`
+	RoleARN         string        `yaml:"role_arn"`
+	Duration        time.Duration `yaml:"duration"`
+	Policy          string        `yaml:"policy"`
+	Credential      string        `yaml:"credential"`
+	Audience        string        `yaml:"audience"`
+	CredentialsFile string        `yaml:"credentials_file"`
+	Profile         string        `yaml:"profile"`
+}
+
+// DockerConfig holds the answers of the docker-credential helper: the
+// Credential, the Keycloak access token or a JWT-SVID for Audience, is the
+// password of Username for the Registries, glob patterns of registry
+// hosts, none when empty.
+type DockerConfig struct {
+	Registries stringList `yaml:"registries"`
+	Username   string     `yaml:"username"`
+	Credential string     `yaml:"credential"`
+	Audience   string     `yaml:"audience"`
+}
+
+// GitConfig holds the answers of the git-credential helper: the
+// Credential, the Keycloak access token or a JWT-SVID for Audience, is the
+// password of Username for the Hosts, glob patterns of the HTTPS hosts and
+// ports, required.
+type GitConfig struct {
+	Hosts      stringList `yaml:"hosts"`
+	Username   string     `yaml:"username"`
+	Credential string     `yaml:"credential"`
+	Audience   string     `yaml:"audience"`
+}
+
+// ConsulConfig holds the Consul login of the consul-login subcommand: the
+// Credential presented to AuthMethod of the Consul agent at Addr, verified
+// with the CAs of CACert, is a JWT-SVID for Audience (the bound audience of
+// the auth method) or the Keycloak access token. Namespace and Partition
+// are those of Consul Enterprise. The ACL token is written to TokenFile,
+// printed when empty.
+type ConsulConfig struct {
+	Addr       string `yaml:"addr"`
+	CACert     string `yaml:"ca_cert"`
+	Namespace  string `yaml:"namespace"`
+	Partition  string `yaml:"partition"`
+	AuthMethod string `yaml:"auth_method"`
+	Credential string `yaml:"credential"`
+	Audience   string `yaml:"audience"`
+	TokenFile  string `yaml:"token_file"`
+}
+
+// NomadConfig locates the Nomad workload identity of the task: the token
+// of the identity block named Identity, the default identity when empty,
+// from the task environment or secrets directory, or the one of TokenFile.
+type NomadConfig struct {
+	Identity  string `yaml:"identity"`
+	TokenFile string `yaml:"token_file"`
+}
+
+// UMAConfig holds the UMA 2.0 request of the rpt subcommand: the
+// permissions asked of the resource server client Audience, as
+// resource#scope, a resource alone or #scope (one scope per item, repeat
+// the resource for several), or the permission Ticket a resource server
+// answered. SubmitRequest asks the resource owners for the permissions of
+// the ticket that the policies deny.
+type UMAConfig struct {
+	Audience      string     `yaml:"audience"`
+	Permissions   stringList `yaml:"permissions"`
+	Ticket        string     `yaml:"ticket"`
+	SubmitRequest bool       `yaml:"submit_request"`
+}
+
+// BrokerConfig holds the local token broker settings. Allow lists the
+// uid:N and gid:N entries of the processes allowed to get tokens on Socket,
+// the user running the broker when empty. Addr is a loopback address
+// serving any local process. Audiences are the glob patterns of the
+// audiences callers may ask for, the configured audiences when empty.
+// Identities are the glob patterns of the other workload SPIFFE IDs
+// callers may get tokens for with the spiffe_id parameter.
+type BrokerConfig struct {
+	Socket     string     `yaml:"socket"`
+	Allow      stringList `yaml:"allow"`
+	Addr       string     `yaml:"addr"`
+	Audiences  stringList `yaml:"audiences"`
+	Identities stringList `yaml:"identities"`
+}
+
+// ExecConfig holds how the exec subcommand reacts when the access token
+// rotates: nothing, restarting the command with the new token in its
+// environment, or sending it Signal so it rereads the token file.
+type ExecConfig struct {
+	OnRotate string `yaml:"on_rotate"`
+	Signal   string `yaml:"signal"`
+}
+
+// SidecarConfig holds the sidecar mode settings. Setting Dir enables daemon
+// mode and writes the access token, the JWT-SVID and a ready file to Dir.
+type SidecarConfig struct {
+	Dir string `yaml:"dir"`
+}
+
+// TokenFileConfig holds the token file outputs, rewritten atomically on
+// every refresh. With several audiences the paths must contain {audience}.
+type TokenFileConfig struct {
+	// Path receives the bare access token.
+	Path string `yaml:"path"`
+	// ResponsePath receives the raw token response JSON.
+	ResponsePath string `yaml:"response_path"`
+	// Mode is the octal permission of the files.
+	Mode string `yaml:"mode"`
+}
+
+// KubeSecretConfig holds the Kubernetes Secret output. Name may contain
+// {audience}, which is required with several audiences. Namespace defaults
+// to the namespace of the pod, so that a namespaced Role is enough.
+type KubeSecretConfig struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace"`
+}
+
+// TokenCacheConfig holds the encrypted token cache file settings. The AES
+// key is read from the TOKEN_CACHE_KEY environment variable or KeyFile, for
+// instance a secret decrypted by a KMS and mounted into the container.
+type TokenCacheConfig struct {
+	File    string `yaml:"file"`
+	KeyFile string `yaml:"key_file"`
+}
+
+// TLSConfig holds the TLS settings used to reach Keycloak. The workload
+// always presents its X509-SVID as client certificate.
+type TLSConfig struct {
+	// CAFile and CADir, a directory of PEM files, verify the Keycloak
+	// certificate instead of the system roots.
+	CAFile     string `yaml:"ca_file"`
+	CADir      string `yaml:"ca_dir"`
+	ServerName string `yaml:"server_name"`
+	// MinVersion is the lowest TLS version accepted, 1.2 or 1.3.
+	MinVersion string `yaml:"min_version"`
+	// KeycloakSPIFFEID, when set, requires Keycloak to present an X509-SVID
+	// with this SPIFFE ID, verified against the SPIFFE trust bundle.
+	KeycloakSPIFFEID string `yaml:"keycloak_spiffe_id"`
+	// InsecureSkipVerify accepts any Keycloak certificate. It exposes the
+	// client assertions and tokens to anyone on the path, for development
+	// only.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+}
+
+// TimeoutsConfig holds the timeouts of the phases of a run, within the
+// overall Timeout: SVIDFetch bounds connecting to the SPIRE Agent and each
+// JWT-SVID fetch, Discovery the Keycloak path detection and discovery
+// document, and TokenRequest the client registration and each token
+// request, retries included. Zero leaves a phase bounded by Timeout only.
+type TimeoutsConfig struct {
+	SVIDFetch    time.Duration `yaml:"svid_fetch"`
+	Discovery    time.Duration `yaml:"discovery"`
+	TokenRequest time.Duration `yaml:"token_request"`
+}
+
+// FailoverConfig holds the Keycloak failover settings. URLs are other base
+// URLs of the same Keycloak cluster, such as the ingress points of other
+// zones, tried in order after KeycloakURL on connection errors and 5xx
+// answers; KeycloakURL still names the issuer. A failed endpoint is skipped
+// for Cooldown. Failback is primary to return to the first endpoints once
+// they cooled down, or sticky to stay on the endpoint in use until it fails.
+type FailoverConfig struct {
+	URLs     stringList    `yaml:"urls"`
+	Failback string        `yaml:"failback"`
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+// LogConfig holds the logging settings. JWT-SVIDs, client assertions and
+// access tokens are always redacted from the logs.
+type LogConfig struct {
+	// Level is debug, info, warn or error. Request and response bodies are
+	// only logged at debug level.
+	Level string `yaml:"level"`
+	// Format is text or json.
+	Format string `yaml:"format"`
+}
+
+// SocketWaitConfig holds how long the workload polls for the SPIRE Agent
+// socket at startup, the agent DaemonSet often starting after the
+// application pods. A zero Timeout disables the wait.
+type SocketWaitConfig struct {
+	Timeout  time.Duration `yaml:"timeout"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// RetryConfig holds the retry policy applied to transient failures of the
+// SPIRE Agent and Keycloak calls, such as a missing Workload API socket or a
+// 5xx answer. Keycloak 4xx answers are never retried.
+type RetryConfig struct {
+	// MaxAttempts is the total number of attempts, 1 disables retries.
+	MaxAttempts int           `yaml:"max_attempts"`
+	BaseDelay   time.Duration `yaml:"base_delay"`
+	MaxDelay    time.Duration `yaml:"max_delay"`
+	// Jitter randomizes each delay by up to this fraction.
+	Jitter float64 `yaml:"jitter"`
+	// AttemptTimeout bounds each attempt, so that waiting for the SPIRE
+	// Agent socket does not consume the whole run timeout.
+	AttemptTimeout time.Duration `yaml:"attempt_timeout"`
+}
+
+// RateLimitConfig paces the token requests of the process to Keycloak, the
+// retries and the broker requests included, so that a misbehaving client or
+// a hot refresh loop cannot overload the token endpoint. Requests beyond
+// Burst wait for their turn at RPS per second; RPS 0 disables the limit.
+type RateLimitConfig struct {
+	RPS   float64 `yaml:"rps"`
+	Burst int     `yaml:"burst"`
+}
+
+// CircuitBreakerConfig holds the circuit breaker of the token requests: it
+// opens after Threshold consecutive failures of Keycloak and fails them
+// fast for OpenDuration before probing Keycloak again. Threshold 0
+// disables it.
+type CircuitBreakerConfig struct {
+	Threshold    int           `yaml:"threshold"`
+	OpenDuration time.Duration `yaml:"open_duration"`
+}
+
+// AuditConfig holds the audit log of the token requests: one JSON record
+// per client_credentials or token exchange request, appended to File and
+// sent to Syslog, which is local for the local daemon or a udp://, tcp://
+// or unix:// address.
+type AuditConfig struct {
+	File   string `yaml:"file"`
+	Syslog string `yaml:"syslog"`
+}
+
+// AlertConfig holds the alert webhook of the daemon, posted a JSON alert
+// once Failures consecutive refreshes of a token failed, and once the
+// token held is within ExpiryWindow of its expiry without being renewed,
+// then again when the next refresh resolves it. Failures or ExpiryWindow 0
+// disables that alert.
+type AlertConfig struct {
+	Webhook      string        `yaml:"webhook"`
+	Failures     int           `yaml:"failures"`
+	ExpiryWindow time.Duration `yaml:"expiry_window"`
+	Timeout      time.Duration `yaml:"timeout"`
+}
+
+// AssertionConfig holds the claims of the private_key_jwt client assertion.
+type AssertionConfig struct {
+	// Issuer and Subject default to the client ID.
+	Issuer  string `yaml:"issuer"`
+	Subject string `yaml:"subject"`
+	// Audience defaults to the realm issuer URL.
+	Audience string `yaml:"audience"`
+	// ID is a fixed jti, a random one is generated per assertion when empty.
+	ID       string        `yaml:"jti"`
+	Lifetime time.Duration `yaml:"lifetime"`
+}
+
+// TokenExchangeConfig holds the RFC 8693 token exchange parameters.
+type TokenExchangeConfig struct {
+	// Subject is the token submitted as subject_token: jwt-svid,
+	// access-token, nomad (the Nomad workload identity) or file, the token
+	// or token response read from File, such as the access token of an end
+	// user.
+	Subject string `yaml:"subject"`
+	File    string `yaml:"file"`
+	// SubjectIssuer is the alias of the identity provider of a subject
+	// token issued outside the realm, such as the Nomad workload identity.
+	SubjectIssuer      string   `yaml:"subject_issuer"`
+	RequestedTokenType string   `yaml:"requested_token_type"`
+	Audience           []string `yaml:"audience"`
+	Scope              string   `yaml:"scope"`
+	// Actor is the identity of the workload submitted as actor_token, so
+	// that it acts on behalf of the subject: jwt-svid, access-token or
+	// empty for none.
+	Actor string `yaml:"actor"`
+}
+
+// VerifyTokenConfig enables the validation of the access tokens returned by
+// Keycloak: signature, issuer and expiry and, when Audience is set, an aud
+// claim among Audience, so that a misconfigured client scope or mapper is
+// reported when the token is issued rather than by the first API called.
+type VerifyTokenConfig struct {
+	Enabled  bool       `yaml:"enabled"`
+	Audience stringList `yaml:"audience"`
+}
+
+// RevokeConfig holds the token revoked by the revoke subcommand: File
+// holds a bare token, or a token response whose refresh and access tokens
+// are both revoked, "-" for the standard input. TokenTypeHint is
+// access_token, refresh_token or empty for a bare token.
+type RevokeConfig struct {
+	File          string `yaml:"file"`
+	TokenTypeHint string `yaml:"token_type_hint"`
+}
+
+// IntrospectConfig holds the token introspected by the introspect
+// subcommand, read as for RevokeConfig: the access token of a token
+// response.
+type IntrospectConfig struct {
+	File          string `yaml:"file"`
+	TokenTypeHint string `yaml:"token_type_hint"`
+}
+
+// InspectConfig holds the file of the token decoded by the inspect
+// subcommand, "-" for the standard input.
+type InspectConfig struct {
+	File string `yaml:"file"`
+}
+
+// AdminConfig holds the administrator of the admin subcommands, who logs
+// in to Realm as ClientID: with the password grant when Username is set,
+// as for admin-cli in the master realm, with the ClientSecret of a service
+// account holding the manage-clients role otherwise.
+type AdminConfig struct {
+	Realm        string `yaml:"realm"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	// ApplyFile is the realm description applied by admin apply, - for
+	// the standard input.
+	ApplyFile string `yaml:"apply_file"`
+	// BootstrapClient configures admin bootstrap-client.
+	BootstrapClient BootstrapClientConfig `yaml:"bootstrap_client"`
+	// Entry configures admin create-entry.
+	Entry EntryConfig `yaml:"entry"`
+	// BundleSync configures admin sync-bundle.
+	BundleSync BundleSyncConfig `yaml:"bundle_sync"`
+}
+
+// BootstrapClientConfig holds the client created by admin
+// bootstrap-client: SPIFFEID is its client ID, the SPIFFE ID of the
+// workload by default, Audience the audiences added to its access tokens
+// and Scopes its default client scopes, those of the realm when empty.
+type BootstrapClientConfig struct {
+	SPIFFEID string     `yaml:"spiffe_id"`
+	Audience stringList `yaml:"audience"`
+	Scopes   stringList `yaml:"scopes"`
+}
+
+// EntryConfig holds the registration entry created by admin create-entry
+// through the SPIRE Server API at ServerSocket: the workloads matching
+// Selectors under the agent ParentID get the SPIFFE ID of the bootstrapped
+// client, with the SVID lifetimes of the server unless X509SVIDTTL or
+// JWTSVIDTTL is set.
+type EntryConfig struct {
+	ServerSocket string        `yaml:"server_socket"`
+	ParentID     string        `yaml:"parent_id"`
+	Selectors    stringList    `yaml:"selectors"`
+	X509SVIDTTL  time.Duration `yaml:"x509_svid_ttl"`
+	JWTSVIDTTL   time.Duration `yaml:"jwt_svid_ttl"`
+}
+
+// BundleSyncConfig holds the trust bundle sync of admin sync-bundle: every
+// Interval the JWT bundle of TrustDomain is compared with the one last
+// pushed and, when it changed, written to the JWKS of the Clients and the
+// public key cache of the realm cleared.
+type BundleSyncConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	Clients  stringList    `yaml:"clients"`
+}
+
+// defaultConfig returns the configuration used when nothing else is set.
+func defaultConfig() Config {
+	return Config{
+		SocketPath:      spire.DefaultSocketPath,
+		KeycloakURL:     defaultKeycloakURL,
+		Realm:           defaultRealm,
+		IDPAlias:        defaultIDPAlias,
+		LegacyPath:      legacyPathAuto,
+		AuthMethod:      authMethodJWTSpiffe,
+		Assertion:       AssertionConfig{Lifetime: time.Minute},
+		Failover:        FailoverConfig{Failback: failbackPrimary, Cooldown: 30 * time.Second},
+		TLS:             TLSConfig{MinVersion: "1.2"},
+		Timeout:         100 * time.Second,
+		HTTPTimeout:     30 * time.Second,
+		Timeouts:        TimeoutsConfig{SVIDFetch: 30 * time.Second, Discovery: 15 * time.Second, TokenRequest: 60 * time.Second},
+		RequestIDHeader: defaultRequestIDHeader,
+		Log: LogConfig{
+			Level:  "info",
+			Format: logFormatText,
+		},
+		Retry: RetryConfig{
+			MaxAttempts:    5,
+			BaseDelay:      500 * time.Millisecond,
+			MaxDelay:       30 * time.Second,
+			Jitter:         0.2,
+			AttemptTimeout: 30 * time.Second,
+		},
+		RateLimit:      RateLimitConfig{RPS: 10, Burst: 20},
+		CircuitBreaker: CircuitBreakerConfig{Threshold: 5, OpenDuration: 30 * time.Second},
+		Alert:          AlertConfig{Failures: 3, ExpiryWindow: time.Minute, Timeout: 10 * time.Second},
+		Admin:          AdminConfig{Realm: "master", ClientID: "admin-cli", Entry: EntryConfig{ServerSocket: spire.DefaultServerSocketPath}, BundleSync: BundleSyncConfig{Interval: time.Minute}},
+		SocketWait: SocketWaitConfig{
+			Timeout:  60 * time.Second,
+			Interval: time.Second,
+		},
+		RenewThreshold: 0.8,
+		RetryInterval:  10 * time.Second,
+		TokenFile:      TokenFileConfig{Mode: "0600"},
+		Exec:           ExecConfig{OnRotate: rotateNone, Signal: "SIGHUP"},
+		Broker:         BrokerConfig{Socket: defaultBrokerSocket},
+		Proxy:          ProxyConfig{Listen: "127.0.0.1:8081"},
+		JWKS:           JWKSConfig{Addr: ":8082", Path: "/keys", MaxAge: 5 * time.Minute},
+		TokenExchange:  TokenExchangeConfig{Subject: subjectJWTSVID, File: "-"},
+		Revoke:         RevokeConfig{File: "-"},
+		Introspect:     IntrospectConfig{File: "-"},
+		Inspect:        InspectConfig{File: "-"},
+		Vault:          VaultConfig{Mount: vault.DefaultMount, Credential: credentialJWTSVID, Audience: "vault"},
+		AWS:            AWSConfig{Credential: credentialJWTSVID, Audience: "sts.amazonaws.com", Profile: "default"},
+		GCP:            GCPConfig{Scopes: stringList{gcp.CloudPlatformScope}, Credential: credentialJWTSVID},
+		Azure: AzureConfig{
+			Scopes:        stringList{azure.ManagementScope},
+			AuthorityHost: azure.DefaultAuthorityHost,
+			Credential:    credentialJWTSVID,
+			Audience:      azure.DefaultAudience,
+		},
+		STS:    STSConfig{Credential: credentialAccessToken, Audience: "minio", Profile: "default"},
+		Docker: DockerConfig{Username: "oauth2accesstoken", Credential: credentialAccessToken, Audience: "registry"},
+		Git:    GitConfig{Username: "oauth2", Credential: credentialAccessToken, Audience: "git"},
+		Consul: ConsulConfig{Addr: "127.0.0.1:8500", Credential: credentialJWTSVID, Audience: "consul"},
+	}
+}
+
+// loadConfig resolves the configuration from args, the environment and an
+// optional YAML file, then validates it.
+func loadConfig(args []string) (Config, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("workload", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML configuration file (env CONFIG_FILE)")
+	flagCfg := Config{}
+	fs.StringVar(&flagCfg.SocketPath, "socket-path", "", "SPIRE Agent Workload API address (env SPIFFE_ENDPOINT_SOCKET)")
+	fs.StringVar(&flagCfg.SPIFFEID, "spiffe-id", "", "SPIFFE ID or glob pattern selecting the SVID when the workload has several identities (env SPIFFE_ID)")
+	fs.StringVar(&flagCfg.ExpectSPIFFEID, "expect-spiffe-id", "", "fail unless the JWT-SVID has this SPIFFE ID (env EXPECT_SPIFFE_ID)")
+	fs.StringVar(&flagCfg.TrustDomain, "trust-domain", "", "fail unless the JWT-SVID belongs to this trust domain (env TRUST_DOMAIN)")
+	fs.StringVar(&flagCfg.KeycloakURL, "keycloak-url", "", "Keycloak base URL, followed by the failover URLs when comma-separated (env KEYCLOAK_URL)")
+	fs.Var(&flagCfg.Resolve, "resolve", "connect to addr for the Keycloak host:port, as host:port:addr (port * for any), repeatable (env RESOLVE)")
+	fs.StringVar(&flagCfg.DNSServer, "dns-server", "", "host:port of the DNS server resolving the Keycloak host names (env DNS_SERVER)")
+	fs.StringVar(&flagCfg.KeycloakProxy, "keycloak-proxy", "", "URL of the HTTP proxy of the Keycloak requests, or direct to ignore HTTPS_PROXY (env KEYCLOAK_PROXY)")
+	fs.StringVar(&flagCfg.KeycloakProxyCAFile, "keycloak-proxy-ca-file", "", "PEM file with the CA used to verify an https:// proxy (env KEYCLOAK_PROXY_CA_FILE)")
+	fs.Var(&flagCfg.Failover.URLs, "keycloak-failover-url", "other base URL of the Keycloak cluster to fail over to, repeatable (env KEYCLOAK_FAILOVER_URLS)")
+	fs.StringVar(&flagCfg.Failover.Failback, "keycloak-failback", "", "return to the first Keycloak URLs once recovered (primary) or stay on the one in use (sticky) (env KEYCLOAK_FAILBACK)")
+	fs.DurationVar(&flagCfg.Failover.Cooldown, "keycloak-failover-cooldown", 0, "how long a failed Keycloak URL is skipped (env KEYCLOAK_FAILOVER_COOLDOWN)")
+	fs.StringVar(&flagCfg.Realm, "realm", "", "Keycloak realm (env REALM)")
+	fs.Var(&flagCfg.Audience, "audience", "JWT-SVID audience, repeatable or comma-separated, defaults to the realm issuer URL (env AUDIENCE)")
+	fs.StringVar(&flagCfg.IDPAlias, "idp-alias", "", "Keycloak SPIFFE identity provider alias (env IDP_ALIAS)")
+	fs.Var(&flagCfg.Resource, "resource", "RFC 8707 resource indicator of the token requests, repeatable or comma-separated (env RESOURCE)")
+	fs.StringVar(&flagCfg.DPoP, "dpop", "", "bind the tokens to a DPoP key: memory or x509-svid (env DPOP)")
+	fs.StringVar(&flagCfg.Scope, "scope", "", "space-separated scope of the token requests, e.g. \"profile email custom:read\" (env SCOPE)")
+	fs.DurationVar(&flagCfg.Timeout, "timeout", 0, "overall run timeout (env TIMEOUT)")
+	fs.DurationVar(&flagCfg.HTTPTimeout, "http-timeout", 0, "timeout of each HTTP request to Keycloak (env HTTP_TIMEOUT)")
+	fs.DurationVar(&flagCfg.Timeouts.SVIDFetch, "svid-fetch-timeout", 0, "timeout of connecting to the SPIRE Agent and of each JWT-SVID fetch, 0 for the overall one (env SVID_FETCH_TIMEOUT)")
+	fs.DurationVar(&flagCfg.Timeouts.Discovery, "discovery-timeout", 0, "timeout of the Keycloak path detection and discovery, 0 for the overall one (env DISCOVERY_TIMEOUT)")
+	fs.DurationVar(&flagCfg.Timeouts.TokenRequest, "token-request-timeout", 0, "timeout of the registration and of each token request with its retries, 0 for the overall one (env TOKEN_REQUEST_TIMEOUT)")
+	fs.StringVar(&flagCfg.Log.Level, "log-level", "", "log level: debug, info, warn or error (env LOG_LEVEL)")
+	fs.StringVar(&flagCfg.Log.Format, "log-format", "", "log format: text or json (env LOG_FORMAT)")
+	fs.IntVar(&flagCfg.Retry.MaxAttempts, "retry-max-attempts", 0, "attempts for SPIRE and Keycloak calls, 1 disables retries (env RETRY_MAX_ATTEMPTS)")
+	fs.DurationVar(&flagCfg.Retry.BaseDelay, "retry-base-delay", 0, "delay after the first failed attempt, doubled after each failure (env RETRY_BASE_DELAY)")
+	fs.DurationVar(&flagCfg.Retry.MaxDelay, "retry-max-delay", 0, "maximum delay between attempts (env RETRY_MAX_DELAY)")
+	fs.Float64Var(&flagCfg.Retry.Jitter, "retry-jitter", 0, "fraction by which retry delays are randomized (env RETRY_JITTER)")
+	fs.DurationVar(&flagCfg.Retry.AttemptTimeout, "retry-attempt-timeout", 0, "timeout of each attempt (env RETRY_ATTEMPT_TIMEOUT)")
+	fs.Float64Var(&flagCfg.RateLimit.RPS, "rate-limit", 0, "token requests per second sent to Keycloak, 0 disables the limit (env RATE_LIMIT)")
+	fs.IntVar(&flagCfg.RateLimit.Burst, "rate-limit-burst", 0, "token requests sent at once before the rate limit applies (env RATE_LIMIT_BURST)")
+	fs.IntVar(&flagCfg.CircuitBreaker.Threshold, "circuit-breaker-threshold", 0, "consecutive Keycloak failures opening the circuit breaker, 0 disables it (env CIRCUIT_BREAKER_THRESHOLD)")
+	fs.StringVar(&flagCfg.Audit.File, "audit-file", "", "file the audit records of the token requests are appended to, as JSON lines (env AUDIT_FILE)")
+	fs.StringVar(&flagCfg.Audit.Syslog, "audit-syslog", "", "syslog the audit records are sent to: local, or a udp://, tcp:// or unix:// address (env AUDIT_SYSLOG)")
+	fs.StringVar(&flagCfg.Alert.Webhook, "alert-webhook", "", "URL the daemon posts a JSON alert to when the token refreshes fail (env ALERT_WEBHOOK)")
+	fs.IntVar(&flagCfg.Alert.Failures, "alert-failures", 0, "consecutive failed refreshes of a token firing an alert, 0 disables it (env ALERT_FAILURES)")
+	fs.DurationVar(&flagCfg.Alert.ExpiryWindow, "alert-expiry-window", 0, "time before the expiry of a token not renewed firing an alert, 0 disables it (env ALERT_EXPIRY_WINDOW)")
+	fs.DurationVar(&flagCfg.Alert.Timeout, "alert-timeout", 0, "timeout of each alert webhook request (env ALERT_TIMEOUT)")
+	fs.StringVar(&flagCfg.RequestIDHeader, "request-id-header", "", "header carrying the request ID of each exchange to Keycloak, none to not send it (env REQUEST_ID_HEADER)")
+	fs.DurationVar(&flagCfg.CircuitBreaker.OpenDuration, "circuit-breaker-open-duration", 0, "how long the open circuit breaker fails the token requests before probing Keycloak (env CIRCUIT_BREAKER_OPEN_DURATION)")
+	fs.DurationVar(&flagCfg.SocketWait.Timeout, "socket-wait-timeout", 0, "how long to wait for the SPIRE Agent socket at startup, 0 disables the wait (env SOCKET_WAIT_TIMEOUT)")
+	fs.DurationVar(&flagCfg.SocketWait.Interval, "socket-wait-interval", 0, "delay between checks of the SPIRE Agent socket at startup (env SOCKET_WAIT_INTERVAL)")
+	fs.StringVar(&flagCfg.TLS.CAFile, "tls-ca-file", "", "PEM file with the CA used to verify Keycloak (env TLS_CA_FILE)")
+	fs.StringVar(&flagCfg.TLS.CADir, "tls-ca-dir", "", "directory of PEM files with the CAs used to verify Keycloak (env TLS_CA_DIR)")
+	fs.StringVar(&flagCfg.TLS.ServerName, "tls-server-name", "", "server name expected in the Keycloak certificate (env TLS_SERVER_NAME)")
+	fs.StringVar(&flagCfg.TLS.MinVersion, "tls-min-version", "", "lowest TLS version accepted from Keycloak, 1.2 or 1.3 (env TLS_MIN_VERSION)")
+	fs.BoolVar(&flagCfg.TLS.InsecureSkipVerify, "tls-insecure-skip-verify", false, "INSECURE: accept any Keycloak certificate, for development only (env TLS_INSECURE_SKIP_VERIFY)")
+	fs.StringVar(&flagCfg.TLS.KeycloakSPIFFEID, "tls-keycloak-spiffe-id", "", "verify Keycloak against the SPIFFE bundle with this SPIFFE ID (env TLS_KEYCLOAK_SPIFFE_ID)")
+	fs.BoolVar(&flagCfg.Discovery, "discovery", false, "read the realm endpoints from its OIDC discovery document (env DISCOVERY)")
+	fs.StringVar(&flagCfg.LegacyPath, "legacy-path", "", "Keycloak endpoint paths: true for the /auth prefix of Keycloak up to 16, false for Keycloak 17+, auto to detect them (env LEGACY_PATH)")
+	fs.BoolVar(&flagCfg.VerifyToken.Enabled, "verify-token", false, "verify the issued access tokens against the realm JWKS (env VERIFY_TOKEN)")
+	fs.Var(&flagCfg.VerifyToken.Audience, "verify-token-audience", "aud claim the issued access tokens must have, repeatable (env VERIFY_TOKEN_AUDIENCE)")
+	fs.StringVar(&flagCfg.MetricsAddr, "metrics-addr", "", "listen address of the Prometheus /metrics endpoint, e.g. :9090 (env METRICS_ADDR)")
+	fs.StringVar(&flagCfg.HealthAddr, "health-addr", "", "listen address of the daemon /healthz and /readyz endpoints, e.g. :8080 (env HEALTH_ADDR)")
+	fs.StringVar(&flagCfg.AuthMethod, "auth-method", "", "client authentication method: jwt-spiffe, tls_client_auth, private_key_jwt or nomad (env AUTH_METHOD)")
+	fs.StringVar(&flagCfg.ClientID, "client-id", "", "Keycloak client ID for tls_client_auth and private_key_jwt, defaults to the X509-SVID SPIFFE ID, required for nomad (env CLIENT_ID)")
+	fs.StringVar(&flagCfg.Assertion.Issuer, "assertion-issuer", "", "iss of the private_key_jwt assertion, defaults to the client ID (env ASSERTION_ISSUER)")
+	fs.StringVar(&flagCfg.Assertion.Subject, "assertion-subject", "", "sub of the private_key_jwt assertion, defaults to the client ID (env ASSERTION_SUBJECT)")
+	fs.StringVar(&flagCfg.Assertion.Audience, "assertion-audience", "", "aud of the private_key_jwt assertion, defaults to the realm issuer URL (env ASSERTION_AUDIENCE)")
+	fs.StringVar(&flagCfg.Assertion.ID, "assertion-jti", "", "fixed jti of the private_key_jwt assertion, random when empty (env ASSERTION_JTI)")
+	fs.DurationVar(&flagCfg.Assertion.Lifetime, "assertion-lifetime", 0, "validity of the private_key_jwt assertion (env ASSERTION_LIFETIME)")
+	fs.StringVar(&flagCfg.TokenExchange.Subject, "subject", "", "token-exchange subject token: jwt-svid, access-token, nomad or file (env TOKEN_EXCHANGE_SUBJECT)")
+	fs.StringVar(&flagCfg.TokenExchange.SubjectIssuer, "subject-issuer", "", "token-exchange: alias of the identity provider of an external subject token, such as nomad (env TOKEN_EXCHANGE_SUBJECT_ISSUER)")
+	fs.StringVar(&flagCfg.TokenExchange.File, "exchange-file", "", "token-exchange: file holding the subject token or token response with -subject file, - for stdin (env TOKEN_EXCHANGE_FILE)")
+	fs.StringVar(&flagCfg.TokenExchange.Actor, "actor", "", "token-exchange actor token: jwt-svid or access-token, none when empty (env TOKEN_EXCHANGE_ACTOR)")
+	fs.StringVar(&flagCfg.TokenExchange.RequestedTokenType, "requested-token-type", "", "token-exchange requested_token_type (env TOKEN_EXCHANGE_REQUESTED_TOKEN_TYPE)")
+	exchangeAudience := fs.String("exchange-audience", "", "comma-separated token-exchange audiences (env TOKEN_EXCHANGE_AUDIENCE)")
+	fs.StringVar(&flagCfg.TokenExchange.Scope, "exchange-scope", "", "token-exchange scope (env TOKEN_EXCHANGE_SCOPE)")
+	fs.StringVar(&flagCfg.Revoke.File, "revoke-file", "", "revoke: file holding the token or token response to revoke, - for stdin (env REVOKE_FILE)")
+	fs.StringVar(&flagCfg.Revoke.TokenTypeHint, "revoke-token-type-hint", "", "revoke: access_token or refresh_token (env REVOKE_TOKEN_TYPE_HINT)")
+	fs.StringVar(&flagCfg.Introspect.File, "introspect-file", "", "introspect: file holding the token or token response to introspect, - for stdin (env INTROSPECT_FILE)")
+	fs.StringVar(&flagCfg.Introspect.TokenTypeHint, "introspect-token-type-hint", "", "introspect: access_token or refresh_token (env INTROSPECT_TOKEN_TYPE_HINT)")
+	fs.StringVar(&flagCfg.Admin.Realm, "admin-realm", "", "admin: realm the administrator logs in to (env ADMIN_REALM)")
+	fs.StringVar(&flagCfg.Admin.ClientID, "admin-client-id", "", "admin: client the administrator logs in with (env ADMIN_CLIENT_ID)")
+	fs.StringVar(&flagCfg.Admin.Username, "admin-username", "", "admin: administrator user, the service account of the client when empty (env ADMIN_USERNAME)")
+	fs.StringVar(&flagCfg.Admin.ApplyFile, "apply-file", "", "admin apply: realm description to apply, - for stdin (env APPLY_FILE)")
+	fs.StringVar(&flagCfg.Admin.ApplyFile, "f", "", "admin apply: shorthand for -apply-file")
+	fs.StringVar(&flagCfg.Admin.BootstrapClient.SPIFFEID, "bootstrap-spiffe-id", "", "admin bootstrap-client: SPIFFE ID of the client, the one of the workload by default (env BOOTSTRAP_SPIFFE_ID)")
+	fs.Var(&flagCfg.Admin.BootstrapClient.Audience, "bootstrap-audience", "admin bootstrap-client: audience of the access tokens of the client, repeatable or comma-separated (env BOOTSTRAP_AUDIENCE)")
+	fs.Var(&flagCfg.Admin.BootstrapClient.Scopes, "bootstrap-scope", "admin bootstrap-client: default client scope of the client, repeatable or comma-separated (env BOOTSTRAP_SCOPES)")
+	fs.DurationVar(&flagCfg.Admin.BundleSync.Interval, "bundle-sync-interval", 0, "admin sync-bundle: interval between the checks of the JWT bundle (env BUNDLE_SYNC_INTERVAL)")
+	fs.Var(&flagCfg.Admin.BundleSync.Clients, "bundle-sync-client", "admin sync-bundle: client ID whose JWKS is the JWT bundle, repeatable or comma-separated (env BUNDLE_SYNC_CLIENTS)")
+	fs.StringVar(&flagCfg.Admin.Entry.ServerSocket, "spire-server-socket", "", "admin create-entry: SPIRE Server API socket, a unix:// address (env SPIRE_SERVER_SOCKET)")
+	fs.StringVar(&flagCfg.Admin.Entry.ParentID, "entry-parent-id", "", "admin create-entry: SPIFFE ID of the agent attesting the workload (env ENTRY_PARENT_ID)")
+	fs.Var(&flagCfg.Admin.Entry.Selectors, "entry-selector", "admin create-entry: type:value selector of the workload, repeatable or comma-separated (env ENTRY_SELECTORS)")
+	fs.DurationVar(&flagCfg.Admin.Entry.X509SVIDTTL, "entry-x509-svid-ttl", 0, "admin create-entry: lifetime of the X509-SVIDs, the server default when 0 (env ENTRY_X509_SVID_TTL)")
+	fs.DurationVar(&flagCfg.Admin.Entry.JWTSVIDTTL, "entry-jwt-svid-ttl", 0, "admin create-entry: lifetime of the JWT-SVIDs, the server default when 0 (env ENTRY_JWT_SVID_TTL)")
+	fs.StringVar(&flagCfg.Inspect.File, "inspect-file", "", "inspect: file holding the JWT or token response to decode, - for stdin (env INSPECT_FILE)")
+	fs.BoolVar(&flagCfg.Daemon, "daemon", false, "keep running and refresh the access token before it expires (env DAEMON)")
+	fs.Float64Var(&flagCfg.RenewThreshold, "renew-threshold", 0, "fraction of the token lifetime after which it is renewed (env RENEW_THRESHOLD)")
+	fs.DurationVar(&flagCfg.RetryInterval, "retry-interval", 0, "delay before retrying a failed refresh in daemon mode (env RETRY_INTERVAL)")
+	fs.DurationVar(&flagCfg.SPIREGracePeriod, "spire-grace-period", 0, "how long the daemon serves its cached tokens while the SPIRE Agent is unreachable, until they expire when 0 (env SPIRE_GRACE_PERIOD)")
+	fs.BoolVar(&flagCfg.RevokeOnExit, "revoke-on-exit", false, "revoke the tokens held by the daemon at Keycloak when it stops (env REVOKE_ON_EXIT)")
+	fs.DurationVar(&flagCfg.ReloadInterval, "reload-interval", 0, "how often the daemon checks the configuration file for changes, on SIGHUP only when 0 (env RELOAD_INTERVAL)")
+	fs.StringVar(&flagCfg.TokenAPIAddr, "token-api-addr", "", "unix:// address serving the gRPC token API in daemon mode (env TOKEN_API_ADDR)")
+	fs.StringVar(&flagCfg.SDSAddr, "sds-addr", "", "unix:// address serving the X509-SVID and bundles to Envoy (SDS) in daemon mode (env SDS_ADDR)")
+	fs.StringVar(&flagCfg.Sidecar.Dir, "sidecar-dir", "", "run as a sidecar writing the tokens and a ready file to this directory (env SIDECAR_DIR)")
+	fs.StringVar(&flagCfg.TokenFile.Path, "token-file", "", "file receiving the access token, {audience} is replaced by the audience (env TOKEN_FILE)")
+	fs.StringVar(&flagCfg.TokenFile.ResponsePath, "token-response-file", "", "file receiving the raw token response JSON (env TOKEN_RESPONSE_FILE)")
+	fs.StringVar(&flagCfg.TokenFile.Mode, "token-file-mode", "", "octal permissions of the token files (env TOKEN_FILE_MODE)")
+	fs.StringVar(&flagCfg.KubeSecret.Name, "kube-secret", "", "Kubernetes Secret receiving the access token, {audience} is replaced by the audience (env KUBE_SECRET)")
+	fs.StringVar(&flagCfg.KubeSecret.Namespace, "kube-secret-namespace", "", "namespace of the Kubernetes Secret, the pod namespace by default (env KUBE_SECRET_NAMESPACE)")
+	fs.StringVar(&flagCfg.RenewHook, "renew-hook", "", "shell command run after each token refresh, with the token metadata in TOKEN_* variables (env RENEW_HOOK)")
+	fs.StringVar(&flagCfg.Output, "output", "", "print each token on stdout as json, yaml, env, raw or exec-credential, the AWS credentials of aws-login and sts assume as aws-credential-process (env OUTPUT)")
+	fs.BoolVar(&flagCfg.Quiet, "quiet", false, "only log errors and print the access token on stdout (env QUIET)")
+	fs.BoolVar(&flagCfg.DryRun, "dry-run", false, "print the token requests without sending them to Keycloak, or the realm changes of admin apply without making them (env DRY_RUN)")
+	fs.BoolVar(&flagCfg.ShowSecrets, "show-secrets", false, "print the client assertions of a dry run unredacted (env SHOW_SECRETS)")
+	fs.BoolVar(&flagCfg.TraceHTTP, "trace-http", false, "log the DNS, TLS, requests and responses of the Keycloak calls, secrets redacted (env TRACE_HTTP)")
+	fs.StringVar(&flagCfg.TokenCache.File, "token-cache-file", "", "encrypted file persisting the daemon tokens across restarts (env TOKEN_CACHE_FILE)")
+	fs.StringVar(&flagCfg.TokenCache.KeyFile, "token-cache-key-file", "", "file holding the AES key of the token cache, or set TOKEN_CACHE_KEY (env TOKEN_CACHE_KEY_FILE)")
+	fs.StringVar(&flagCfg.Exec.OnRotate, "on-rotate", "", "exec: none, restart or signal the command when the token rotates (env EXEC_ON_ROTATE)")
+	fs.StringVar(&flagCfg.Exec.Signal, "rotate-signal", "", "exec: signal sent to the command with -on-rotate=signal (env EXEC_ROTATE_SIGNAL)")
+	fs.StringVar(&flagCfg.Broker.Socket, "broker-socket", "", "broker: Unix socket serving the tokens (env BROKER_SOCKET)")
+	fs.StringVar(&flagCfg.Broker.Addr, "broker-addr", "", "broker: loopback address also serving the tokens, without caller authentication, to the requests with Metadata: true (env BROKER_ADDR)")
+	fs.Var(&flagCfg.Broker.Audiences, "broker-audience", "broker: glob pattern of the audiences callers may ask for, repeatable (env BROKER_AUDIENCES)")
+	fs.Var(&flagCfg.Broker.Identities, "broker-spiffe-id", "broker: glob pattern of the workload SPIFFE IDs callers may ask tokens for, repeatable (env BROKER_SPIFFE_IDS)")
+	fs.Var(&flagCfg.Broker.Allow, "broker-allow", "broker: uid:N or gid:N allowed to get tokens, repeatable (env BROKER_ALLOW)")
+	fs.StringVar(&flagCfg.Proxy.Listen, "proxy-listen", "", "proxy: loopback address the application calls (env PROXY_LISTEN)")
+	fs.StringVar(&flagCfg.Proxy.Upstream, "proxy-upstream", "", "proxy: URL the requests are forwarded to with the token (env PROXY_UPSTREAM)")
+	fs.StringVar(&flagCfg.JWKS.Addr, "jwks-addr", "", "jwks: listen address of the JWKS endpoint (env JWKS_ADDR)")
+	fs.StringVar(&flagCfg.JWKS.Path, "jwks-path", "", "jwks: path of the JWKS document (env JWKS_PATH)")
+	fs.DurationVar(&flagCfg.JWKS.MaxAge, "jwks-max-age", 0, "jwks: Cache-Control max-age of the JWKS document (env JWKS_MAX_AGE)")
+	fs.Var(&flagCfg.Downstream.Audience, "downstream-audience", "downstream-token: client ID the token is intended for, repeatable or comma-separated (env DOWNSTREAM_AUDIENCE)")
+	fs.StringVar(&flagCfg.Downstream.Scope, "downstream-scope", "", "downstream-token: scope of the token (env DOWNSTREAM_SCOPE)")
+	fs.StringVar(&flagCfg.Vault.Addr, "vault-addr", "", "vault-login: address of the Vault server (env VAULT_ADDR)")
+	fs.StringVar(&flagCfg.Vault.Namespace, "vault-namespace", "", "vault-login: Vault Enterprise namespace (env VAULT_NAMESPACE)")
+	fs.StringVar(&flagCfg.Vault.CACert, "vault-ca-cert", "", "vault-login: CA file verifying Vault, the system roots when empty (env VAULT_CACERT)")
+	fs.StringVar(&flagCfg.Vault.Mount, "vault-mount", "", "vault-login: path of the JWT/OIDC auth method (env VAULT_AUTH_MOUNT)")
+	fs.StringVar(&flagCfg.Vault.Role, "vault-role", "", "vault-login: role of the JWT/OIDC auth method (env VAULT_ROLE)")
+	fs.StringVar(&flagCfg.Vault.Credential, "vault-credential", "", "vault-login: jwt-svid or access-token (env VAULT_CREDENTIAL)")
+	fs.StringVar(&flagCfg.Vault.Audience, "vault-audience", "", "vault-login: audience of the JWT-SVID, bound by the role (env VAULT_SVID_AUDIENCE)")
+	fs.StringVar(&flagCfg.Vault.TokenFile, "vault-token-file", "", "vault-login: file the Vault token is written to, stdout when empty (env VAULT_TOKEN_FILE)")
+	fs.StringVar(&flagCfg.AWS.RoleARN, "aws-role-arn", "", "aws-login: ARN of the IAM role assumed (env AWS_ROLE_ARN)")
+	fs.StringVar(&flagCfg.AWS.SessionName, "aws-session-name", "", "aws-login: role session name, from the SPIFFE ID when empty (env AWS_ROLE_SESSION_NAME)")
+	fs.DurationVar(&flagCfg.AWS.Duration, "aws-duration", 0, "aws-login: lifetime of the credentials, the role maximum when 0 (env AWS_SESSION_DURATION)")
+	fs.StringVar(&flagCfg.AWS.Region, "aws-region", "", "aws-login: region of the STS endpoint, the global endpoint when empty (env AWS_REGION)")
+	fs.StringVar(&flagCfg.AWS.STSEndpoint, "aws-sts-endpoint", "", "aws-login: URL of the STS endpoint (env AWS_STS_ENDPOINT)")
+	fs.StringVar(&flagCfg.AWS.Credential, "aws-credential", "", "aws-login: jwt-svid or access-token (env AWS_CREDENTIAL)")
+	fs.StringVar(&flagCfg.AWS.Audience, "aws-audience", "", "aws-login: audience of the JWT-SVID, an audience of the IAM OIDC provider (env AWS_SVID_AUDIENCE)")
+	fs.StringVar(&flagCfg.AWS.CredentialsFile, "aws-credentials-file", "", "aws-login: shared credentials file written, stdout when empty (env AWS_SHARED_CREDENTIALS_FILE)")
+	fs.StringVar(&flagCfg.AWS.Profile, "aws-profile", "", "aws-login: profile of the credentials file (env AWS_PROFILE)")
+	fs.StringVar(&flagCfg.GCP.Provider, "gcp-provider", "", "gcp-login: resource name of the workload identity pool provider (env GCP_WORKLOAD_IDENTITY_PROVIDER)")
+	fs.StringVar(&flagCfg.GCP.ServiceAccount, "gcp-service-account", "", "gcp-login: email of the service account impersonated, none when empty (env GCP_SERVICE_ACCOUNT)")
+	fs.Var(&flagCfg.GCP.Scopes, "gcp-scopes", "gcp-login: comma-separated OAuth scopes of the access token (env GCP_SCOPES)")
+	fs.DurationVar(&flagCfg.GCP.Lifetime, "gcp-lifetime", 0, "gcp-login: lifetime of the service account token, 1h when 0 (env GCP_TOKEN_LIFETIME)")
+	fs.StringVar(&flagCfg.GCP.Credential, "gcp-credential", "", "gcp-login: jwt-svid or access-token (env GCP_CREDENTIAL)")
+	fs.StringVar(&flagCfg.GCP.Audience, "gcp-audience", "", "gcp-login: audience of the JWT-SVID, the default audience of the provider when empty (env GCP_SVID_AUDIENCE)")
+	fs.StringVar(&flagCfg.GCP.CredentialsFile, "gcp-credentials-file", "", "gcp-login: external account configuration written for the client libraries (env GOOGLE_APPLICATION_CREDENTIALS)")
+	fs.StringVar(&flagCfg.GCP.TokenFile, "gcp-token-file", "", "gcp-login: file of the subject token read by the client libraries, next to the credentials file when empty (env GCP_SUBJECT_TOKEN_FILE)")
+	fs.StringVar(&flagCfg.Azure.TenantID, "azure-tenant-id", "", "azure-login: Entra ID tenant of the app registration (env AZURE_TENANT_ID)")
+	fs.StringVar(&flagCfg.Azure.ClientID, "azure-client-id", "", "azure-login: application ID of the app registration (env AZURE_CLIENT_ID)")
+	fs.Var(&flagCfg.Azure.Scopes, "azure-scopes", "azure-login: comma-separated scopes of the access token, of one resource (env AZURE_SCOPES)")
+	fs.StringVar(&flagCfg.Azure.AuthorityHost, "azure-authority-host", "", "azure-login: Entra ID authority of the Azure cloud (env AZURE_AUTHORITY_HOST)")
+	fs.StringVar(&flagCfg.Azure.Credential, "azure-credential", "", "azure-login: jwt-svid or access-token (env AZURE_CREDENTIAL)")
+	fs.StringVar(&flagCfg.Azure.Audience, "azure-audience", "", "azure-login: audience of the JWT-SVID set in the federated credential (env AZURE_SVID_AUDIENCE)")
+	fs.StringVar(&flagCfg.Azure.TokenFile, "azure-token-file", "", "azure-login: file the assertion is written to for the Azure SDKs, stdout gets the access token when empty (env AZURE_FEDERATED_TOKEN_FILE)")
+	fs.StringVar(&flagCfg.STS.Endpoint, "sts-endpoint", "", "sts assume: URL of the STS of the S3-compatible store, such as MinIO (env STS_ENDPOINT)")
+	fs.StringVar(&flagCfg.STS.CACert, "sts-ca-cert", "", "sts assume: CA file verifying the STS endpoint, the system roots when empty (env STS_CA_CERT)")
+	fs.StringVar(&flagCfg.STS.RoleARN, "sts-role-arn", "", "sts assume: ARN of the role assumed, the claim-based policies when empty (env STS_ROLE_ARN)")
+	fs.DurationVar(&flagCfg.STS.Duration, "sts-duration", 0, "sts assume: lifetime of the credentials, the store default when 0 (env STS_DURATION)")
+	fs.StringVar(&flagCfg.STS.Policy, "sts-policy", "", "sts assume: JSON session policy restricting the credentials (env STS_POLICY)")
+	fs.StringVar(&flagCfg.STS.Credential, "sts-credential", "", "sts assume: access-token or jwt-svid (env STS_CREDENTIAL)")
+	fs.StringVar(&flagCfg.STS.Audience, "sts-audience", "", "sts assume: audience of the JWT-SVID, the client ID of the store's OpenID provider (env STS_SVID_AUDIENCE)")
+	fs.StringVar(&flagCfg.STS.CredentialsFile, "sts-credentials-file", "", "sts assume: shared credentials file written, stdout when empty (env STS_CREDENTIALS_FILE)")
+	fs.StringVar(&flagCfg.STS.Profile, "sts-profile", "", "sts assume: profile of the credentials file (env STS_PROFILE)")
+	fs.Var(&flagCfg.Docker.Registries, "docker-registries", "docker-credential: comma-separated glob patterns of the registry hosts answered, required (env DOCKER_REGISTRIES)")
+	fs.StringVar(&flagCfg.Docker.Username, "docker-username", "", "docker-credential: username sent with the token (env DOCKER_USERNAME)")
+	fs.StringVar(&flagCfg.Docker.Credential, "docker-credential", "", "docker-credential: access-token or jwt-svid (env DOCKER_CREDENTIAL)")
+	fs.StringVar(&flagCfg.Docker.Audience, "docker-audience", "", "docker-credential: audience of the JWT-SVID, expected by the registry token service (env DOCKER_SVID_AUDIENCE)")
+	fs.Var(&flagCfg.Git.Hosts, "git-hosts", "git-credential: comma-separated glob patterns of the HTTPS hosts answered, required (env GIT_HOSTS)")
+	fs.StringVar(&flagCfg.Git.Username, "git-username", "", "git-credential: username sent with the token (env GIT_USERNAME)")
+	fs.StringVar(&flagCfg.Git.Credential, "git-credential", "", "git-credential: access-token or jwt-svid (env GIT_CREDENTIAL)")
+	fs.StringVar(&flagCfg.Git.Audience, "git-audience", "", "git-credential: audience of the JWT-SVID, expected by the Git server or its proxy (env GIT_SVID_AUDIENCE)")
+	fs.StringVar(&flagCfg.Consul.Addr, "consul-addr", "", "consul-login: address of the Consul agent, a URL or host:port over HTTP (env CONSUL_HTTP_ADDR)")
+	fs.StringVar(&flagCfg.Consul.CACert, "consul-ca-cert", "", "consul-login: CA file verifying Consul, the system roots when empty (env CONSUL_CACERT)")
+	fs.StringVar(&flagCfg.Consul.Namespace, "consul-namespace", "", "consul-login: Consul Enterprise namespace (env CONSUL_NAMESPACE)")
+	fs.StringVar(&flagCfg.Consul.Partition, "consul-partition", "", "consul-login: Consul Enterprise admin partition (env CONSUL_PARTITION)")
+	fs.StringVar(&flagCfg.Consul.AuthMethod, "consul-auth-method", "", "consul-login: name of the JWT or OIDC auth method (env CONSUL_AUTH_METHOD)")
+	fs.StringVar(&flagCfg.Consul.Credential, "consul-credential", "", "consul-login: jwt-svid or access-token (env CONSUL_CREDENTIAL)")
+	fs.StringVar(&flagCfg.Consul.Audience, "consul-audience", "", "consul-login: audience of the JWT-SVID, bound by the auth method (env CONSUL_SVID_AUDIENCE)")
+	fs.StringVar(&flagCfg.Consul.TokenFile, "consul-token-file", "", "consul-login: file the ACL token is written to, stdout when empty (env CONSUL_HTTP_TOKEN_FILE)")
+	fs.StringVar(&flagCfg.Nomad.Identity, "nomad-identity", "", "nomad: name of the identity block of the task, the default identity when empty (env NOMAD_IDENTITY)")
+	fs.StringVar(&flagCfg.Nomad.TokenFile, "nomad-identity-file", "", "nomad: file of the workload identity, found in the task environment when empty (env NOMAD_IDENTITY_FILE)")
+	fs.StringVar(&flagCfg.UMA.Audience, "uma-audience", "", "rpt: client ID of the resource server evaluating the permissions (env UMA_AUDIENCE)")
+	fs.Var(&flagCfg.UMA.Permissions, "uma-permission", "rpt: permission asked for, as resource#scope, resource or #scope, repeatable, all when unset (env UMA_PERMISSIONS)")
+	fs.StringVar(&flagCfg.UMA.Ticket, "uma-ticket", "", "rpt: permission ticket answered by the resource server (env UMA_TICKET)")
+	fs.BoolVar(&flagCfg.UMA.SubmitRequest, "uma-submit-request", false, "rpt: ask the resource owners for the denied permissions of the ticket (env UMA_SUBMIT_REQUEST)")
+	if err := fs.Parse(args); err != nil {
+		return Config{}, &configError{err}
+	}
+
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			return Config{}, &configError{err}
+		}
+		cfg.ConfigFile = *configFile
+	}
+
+	if err := cfg.loadEnv(); err != nil {
+		return Config{}, &configError{err}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "socket-path":
+			cfg.SocketPath = flagCfg.SocketPath
+		case "spiffe-id":
+			cfg.SPIFFEID = flagCfg.SPIFFEID
+		case "expect-spiffe-id":
+			cfg.ExpectSPIFFEID = flagCfg.ExpectSPIFFEID
+		case "trust-domain":
+			cfg.TrustDomain = flagCfg.TrustDomain
+		case "keycloak-url":
+			cfg.KeycloakURL = flagCfg.KeycloakURL
+		case "resolve":
+			cfg.Resolve = flagCfg.Resolve
+		case "dns-server":
+			cfg.DNSServer = flagCfg.DNSServer
+		case "keycloak-proxy":
+			cfg.KeycloakProxy = flagCfg.KeycloakProxy
+		case "keycloak-proxy-ca-file":
+			cfg.KeycloakProxyCAFile = flagCfg.KeycloakProxyCAFile
+		case "keycloak-failover-url":
+			cfg.Failover.URLs = flagCfg.Failover.URLs
+		case "keycloak-failback":
+			cfg.Failover.Failback = flagCfg.Failover.Failback
+		case "keycloak-failover-cooldown":
+			cfg.Failover.Cooldown = flagCfg.Failover.Cooldown
+		case "realm":
+			cfg.Realm = flagCfg.Realm
+		case "audience":
+			cfg.Audience = flagCfg.Audience
+		case "idp-alias":
+			cfg.IDPAlias = flagCfg.IDPAlias
+		case "scope":
+			cfg.Scope = flagCfg.Scope
+		case "resource":
+			cfg.Resource = flagCfg.Resource
+		case "dpop":
+			cfg.DPoP = flagCfg.DPoP
+		case "timeout":
+			cfg.Timeout = flagCfg.Timeout
+		case "http-timeout":
+			cfg.HTTPTimeout = flagCfg.HTTPTimeout
+		case "svid-fetch-timeout":
+			cfg.Timeouts.SVIDFetch = flagCfg.Timeouts.SVIDFetch
+		case "discovery-timeout":
+			cfg.Timeouts.Discovery = flagCfg.Timeouts.Discovery
+		case "token-request-timeout":
+			cfg.Timeouts.TokenRequest = flagCfg.Timeouts.TokenRequest
+		case "log-level":
+			cfg.Log.Level = flagCfg.Log.Level
+		case "log-format":
+			cfg.Log.Format = flagCfg.Log.Format
+		case "retry-max-attempts":
+			cfg.Retry.MaxAttempts = flagCfg.Retry.MaxAttempts
+		case "retry-base-delay":
+			cfg.Retry.BaseDelay = flagCfg.Retry.BaseDelay
+		case "retry-max-delay":
+			cfg.Retry.MaxDelay = flagCfg.Retry.MaxDelay
+		case "retry-jitter":
+			cfg.Retry.Jitter = flagCfg.Retry.Jitter
+		case "rate-limit":
+			cfg.RateLimit.RPS = flagCfg.RateLimit.RPS
+		case "rate-limit-burst":
+			cfg.RateLimit.Burst = flagCfg.RateLimit.Burst
+		case "circuit-breaker-threshold":
+			cfg.CircuitBreaker.Threshold = flagCfg.CircuitBreaker.Threshold
+		case "circuit-breaker-open-duration":
+			cfg.CircuitBreaker.OpenDuration = flagCfg.CircuitBreaker.OpenDuration
+		case "audit-file":
+			cfg.Audit.File = flagCfg.Audit.File
+		case "audit-syslog":
+			cfg.Audit.Syslog = flagCfg.Audit.Syslog
+		case "alert-webhook":
+			cfg.Alert.Webhook = flagCfg.Alert.Webhook
+		case "alert-failures":
+			cfg.Alert.Failures = flagCfg.Alert.Failures
+		case "alert-expiry-window":
+			cfg.Alert.ExpiryWindow = flagCfg.Alert.ExpiryWindow
+		case "alert-timeout":
+			cfg.Alert.Timeout = flagCfg.Alert.Timeout
+		case "request-id-header":
+			cfg.RequestIDHeader = flagCfg.RequestIDHeader
+		case "retry-attempt-timeout":
+			cfg.Retry.AttemptTimeout = flagCfg.Retry.AttemptTimeout
+		case "socket-wait-timeout":
+			cfg.SocketWait.Timeout = flagCfg.SocketWait.Timeout
+		case "socket-wait-interval":
+			cfg.SocketWait.Interval = flagCfg.SocketWait.Interval
+		case "tls-ca-file":
+			cfg.TLS.CAFile = flagCfg.TLS.CAFile
+		case "tls-server-name":
+			cfg.TLS.ServerName = flagCfg.TLS.ServerName
+		case "tls-ca-dir":
+			cfg.TLS.CADir = flagCfg.TLS.CADir
+		case "tls-min-version":
+			cfg.TLS.MinVersion = flagCfg.TLS.MinVersion
+		case "tls-insecure-skip-verify":
+			cfg.TLS.InsecureSkipVerify = flagCfg.TLS.InsecureSkipVerify
+		case "tls-keycloak-spiffe-id":
+			cfg.TLS.KeycloakSPIFFEID = flagCfg.TLS.KeycloakSPIFFEID
+		case "discovery":
+			cfg.Discovery = flagCfg.Discovery
+		case "legacy-path":
+			cfg.LegacyPath = flagCfg.LegacyPath
+		case "verify-token":
+			cfg.VerifyToken.Enabled = flagCfg.VerifyToken.Enabled
+		case "verify-token-audience":
+			cfg.VerifyToken.Audience = flagCfg.VerifyToken.Audience
+		case "metrics-addr":
+			cfg.MetricsAddr = flagCfg.MetricsAddr
+		case "health-addr":
+			cfg.HealthAddr = flagCfg.HealthAddr
+		case "auth-method":
+			cfg.AuthMethod = flagCfg.AuthMethod
+		case "client-id":
+			cfg.ClientID = flagCfg.ClientID
+		case "assertion-issuer":
+			cfg.Assertion.Issuer = flagCfg.Assertion.Issuer
+		case "assertion-subject":
+			cfg.Assertion.Subject = flagCfg.Assertion.Subject
+		case "assertion-audience":
+			cfg.Assertion.Audience = flagCfg.Assertion.Audience
+		case "assertion-jti":
+			cfg.Assertion.ID = flagCfg.Assertion.ID
+		case "assertion-lifetime":
+			cfg.Assertion.Lifetime = flagCfg.Assertion.Lifetime
+		case "subject":
+			cfg.TokenExchange.Subject = flagCfg.TokenExchange.Subject
+		case "exchange-file":
+			cfg.TokenExchange.File = flagCfg.TokenExchange.File
+		case "subject-issuer":
+			cfg.TokenExchange.SubjectIssuer = flagCfg.TokenExchange.SubjectIssuer
+		case "actor":
+			cfg.TokenExchange.Actor = flagCfg.TokenExchange.Actor
+		case "requested-token-type":
+			cfg.TokenExchange.RequestedTokenType = flagCfg.TokenExchange.RequestedTokenType
+		case "exchange-audience":
+			cfg.TokenExchange.Audience = splitList(*exchangeAudience)
+		case "exchange-scope":
+			cfg.TokenExchange.Scope = flagCfg.TokenExchange.Scope
+		case "revoke-file":
+			cfg.Revoke.File = flagCfg.Revoke.File
+		case "revoke-token-type-hint":
+			cfg.Revoke.TokenTypeHint = flagCfg.Revoke.TokenTypeHint
+		case "introspect-file":
+			cfg.Introspect.File = flagCfg.Introspect.File
+		case "introspect-token-type-hint":
+			cfg.Introspect.TokenTypeHint = flagCfg.Introspect.TokenTypeHint
+		case "inspect-file":
+			cfg.Inspect.File = flagCfg.Inspect.File
+		case "admin-realm":
+			cfg.Admin.Realm = flagCfg.Admin.Realm
+		case "admin-client-id":
+			cfg.Admin.ClientID = flagCfg.Admin.ClientID
+		case "admin-username":
+			cfg.Admin.Username = flagCfg.Admin.Username
+		case "apply-file", "f":
+			cfg.Admin.ApplyFile = flagCfg.Admin.ApplyFile
+		case "bootstrap-spiffe-id":
+			cfg.Admin.BootstrapClient.SPIFFEID = flagCfg.Admin.BootstrapClient.SPIFFEID
+		case "bootstrap-audience":
+			cfg.Admin.BootstrapClient.Audience = flagCfg.Admin.BootstrapClient.Audience
+		case "bootstrap-scope":
+			cfg.Admin.BootstrapClient.Scopes = flagCfg.Admin.BootstrapClient.Scopes
+		case "bundle-sync-interval":
+			cfg.Admin.BundleSync.Interval = flagCfg.Admin.BundleSync.Interval
+		case "bundle-sync-client":
+			cfg.Admin.BundleSync.Clients = flagCfg.Admin.BundleSync.Clients
+		case "spire-server-socket":
+			cfg.Admin.Entry.ServerSocket = flagCfg.Admin.Entry.ServerSocket
+		case "entry-parent-id":
+			cfg.Admin.Entry.ParentID = flagCfg.Admin.Entry.ParentID
+		case "entry-selector":
+			cfg.Admin.Entry.Selectors = flagCfg.Admin.Entry.Selectors
+		case "entry-x509-svid-ttl":
+			cfg.Admin.Entry.X509SVIDTTL = flagCfg.Admin.Entry.X509SVIDTTL
+		case "entry-jwt-svid-ttl":
+			cfg.Admin.Entry.JWTSVIDTTL = flagCfg.Admin.Entry.JWTSVIDTTL
+		case "daemon":
+			cfg.Daemon = flagCfg.Daemon
+		case "renew-threshold":
+			cfg.RenewThreshold = flagCfg.RenewThreshold
+		case "retry-interval":
+			cfg.RetryInterval = flagCfg.RetryInterval
+		case "spire-grace-period":
+			cfg.SPIREGracePeriod = flagCfg.SPIREGracePeriod
+		case "revoke-on-exit":
+			cfg.RevokeOnExit = flagCfg.RevokeOnExit
+		case "reload-interval":
+			cfg.ReloadInterval = flagCfg.ReloadInterval
+		case "token-api-addr":
+			cfg.TokenAPIAddr = flagCfg.TokenAPIAddr
+		case "sds-addr":
+			cfg.SDSAddr = flagCfg.SDSAddr
+		case "sidecar-dir":
+			cfg.Sidecar.Dir = flagCfg.Sidecar.Dir
+		case "token-file":
+			cfg.TokenFile.Path = flagCfg.TokenFile.Path
+		case "token-response-file":
+			cfg.TokenFile.ResponsePath = flagCfg.TokenFile.ResponsePath
+		case "token-file-mode":
+			cfg.TokenFile.Mode = flagCfg.TokenFile.Mode
+		case "kube-secret":
+			cfg.KubeSecret.Name = flagCfg.KubeSecret.Name
+		case "kube-secret-namespace":
+			cfg.KubeSecret.Namespace = flagCfg.KubeSecret.Namespace
+		case "renew-hook":
+			cfg.RenewHook = flagCfg.RenewHook
+		case "output":
+			cfg.Output = flagCfg.Output
+		case "quiet":
+			cfg.Quiet = flagCfg.Quiet
+		case "dry-run":
+			cfg.DryRun = flagCfg.DryRun
+		case "show-secrets":
+			cfg.ShowSecrets = flagCfg.ShowSecrets
+		case "trace-http":
+			cfg.TraceHTTP = flagCfg.TraceHTTP
+		case "token-cache-file":
+			cfg.TokenCache.File = flagCfg.TokenCache.File
+		case "token-cache-key-file":
+			cfg.TokenCache.KeyFile = flagCfg.TokenCache.KeyFile
+		case "on-rotate":
+			cfg.Exec.OnRotate = flagCfg.Exec.OnRotate
+		case "rotate-signal":
+			cfg.Exec.Signal = flagCfg.Exec.Signal
+		case "broker-socket":
+			cfg.Broker.Socket = flagCfg.Broker.Socket
+		case "broker-allow":
+			cfg.Broker.Allow = flagCfg.Broker.Allow
+		case "broker-addr":
+			cfg.Broker.Addr = flagCfg.Broker.Addr
+		case "broker-audience":
+			cfg.Broker.Audiences = flagCfg.Broker.Audiences
+		case "broker-spiffe-id":
+			cfg.Broker.Identities = flagCfg.Broker.Identities
+		case "proxy-listen":
+			cfg.Proxy.Listen = flagCfg.Proxy.Listen
+		case "proxy-upstream":
+			cfg.Proxy.Upstream = flagCfg.Proxy.Upstream
+		case "jwks-addr":
+			cfg.JWKS.Addr = flagCfg.JWKS.Addr
+		case "jwks-path":
+			cfg.JWKS.Path = flagCfg.JWKS.Path
+		case "jwks-max-age":
+			cfg.JWKS.MaxAge = flagCfg.JWKS.MaxAge
+		case "downstream-audience":
+			cfg.Downstream.Audience = flagCfg.Downstream.Audience
+		case "downstream-scope":
+			cfg.Downstream.Scope = flagCfg.Downstream.Scope
+		case "vault-addr":
+			cfg.Vault.Addr = flagCfg.Vault.Addr
+		case "vault-namespace":
+			cfg.Vault.Namespace = flagCfg.Vault.Namespace
+		case "vault-ca-cert":
+			cfg.Vault.CACert = flagCfg.Vault.CACert
+		case "vault-mount":
+			cfg.Vault.Mount = flagCfg.Vault.Mount
+		case "vault-role":
+			cfg.Vault.Role = flagCfg.Vault.Role
+		case "vault-credential":
+			cfg.Vault.Credential = flagCfg.Vault.Credential
+		case "vault-audience":
+			cfg.Vault.Audience = flagCfg.Vault.Audience
+		case "vault-token-file":
+			cfg.Vault.TokenFile = flagCfg.Vault.TokenFile
+		case "aws-role-arn":
+			cfg.AWS.RoleARN = flagCfg.AWS.RoleARN
+		case "aws-session-name":
+			cfg.AWS.SessionName = flagCfg.AWS.SessionName
+		case "aws-duration":
+			cfg.AWS.Duration = flagCfg.AWS.Duration
+		case "aws-region":
+			cfg.AWS.Region = flagCfg.AWS.Region
+		case "aws-sts-endpoint":
+			cfg.AWS.STSEndpoint = flagCfg.AWS.STSEndpoint
+		case "aws-credential":
+			cfg.AWS.Credential = flagCfg.AWS.Credential
+		case "aws-audience":
+			cfg.AWS.Audience = flagCfg.AWS.Audience
+		case "aws-credentials-file":
+			cfg.AWS.CredentialsFile = flagCfg.AWS.CredentialsFile
+		case "aws-profile":
+			cfg.AWS.Profile = flagCfg.AWS.Profile
+		case "gcp-provider":
+			cfg.GCP.Provider = flagCfg.GCP.Provider
+		case "gcp-service-account":
+			cfg.GCP.ServiceAccount = flagCfg.GCP.ServiceAccount
+		case "gcp-scopes":
+			cfg.GCP.Scopes = flagCfg.GCP.Scopes
+		case "gcp-lifetime":
+			cfg.GCP.Lifetime = flagCfg.GCP.Lifetime
+		case "gcp-credential":
+			cfg.GCP.Credential = flagCfg.GCP.Credential
+		case "gcp-audience":
+			cfg.GCP.Audience = flagCfg.GCP.Audience
+		case "gcp-credentials-file":
+			cfg.GCP.CredentialsFile = flagCfg.GCP.CredentialsFile
+		case "gcp-token-file":
+			cfg.GCP.TokenFile = flagCfg.GCP.TokenFile
+		case "azure-tenant-id":
+			cfg.Azure.TenantID = flagCfg.Azure.TenantID
+		case "azure-client-id":
+			cfg.Azure.ClientID = flagCfg.Azure.ClientID
+		case "azure-scopes":
+			cfg.Azure.Scopes = flagCfg.Azure.Scopes
+		case "azure-authority-host":
+			cfg.Azure.AuthorityHost = flagCfg.Azure.AuthorityHost
+		case "azure-credential":
+			cfg.Azure.Credential = flagCfg.Azure.Credential
+		case "azure-audience":
+			cfg.Azure.Audience = flagCfg.Azure.Audience
+		case "azure-token-file":
+			cfg.Azure.TokenFile = flagCfg.Azure.TokenFile
+		case "sts-endpoint":
+			cfg.STS.Endpoint = flagCfg.STS.Endpoint
+		case "sts-ca-cert":
+			cfg.STS.CACert = flagCfg.STS.CACert
+		case "sts-role-arn":
+			cfg.STS.RoleARN = flagCfg.STS.RoleARN
+		case "sts-duration":
+			cfg.STS.Duration = flagCfg.STS.Duration
+		case "sts-policy":
+			cfg.STS.Policy = flagCfg.STS.Policy
+		case "sts-credential":
+			cfg.STS.Credential = flagCfg.STS.Credential
+		case "sts-audience":
+			cfg.STS.Audience = flagCfg.STS.Audience
+		case "sts-credentials-file":
+			cfg.STS.CredentialsFile = flagCfg.STS.CredentialsFile
+		case "sts-profile":
+			cfg.STS.Profile = flagCfg.STS.Profile
+		case "docker-registries":
+			cfg.Docker.Registries = flagCfg.Docker.Registries
+		case "docker-username":
+			cfg.Docker.Username = flagCfg.Docker.Username
+		case "docker-credential":
+			cfg.Docker.Credential = flagCfg.Docker.Credential
+		case "docker-audience":
+			cfg.Docker.Audience = flagCfg.Docker.Audience
+		case "git-hosts":
+			cfg.Git.Hosts = flagCfg.Git.Hosts
+		case "git-username":
+			cfg.Git.Username = flagCfg.Git.Username
+		case "git-credential":
+			cfg.Git.Credential = flagCfg.Git.Credential
+		case "git-audience":
+			cfg.Git.Audience = flagCfg.Git.Audience
+		case "consul-addr":
+			cfg.Consul.Addr = flagCfg.Consul.Addr
+		case "consul-ca-cert":
+			cfg.Consul.CACert = flagCfg.Consul.CACert
+		case "consul-namespace":
+			cfg.Consul.Namespace = flagCfg.Consul.Namespace
+		case "consul-partition":
+			cfg.Consul.Partition = flagCfg.Consul.Partition
+		case "consul-auth-method":
+			cfg.Consul.AuthMethod = flagCfg.Consul.AuthMethod
+		case "consul-credential":
+			cfg.Consul.Credential = flagCfg.Consul.Credential
+		case "consul-audience":
+			cfg.Consul.Audience = flagCfg.Consul.Audience
+		case "consul-token-file":
+			cfg.Consul.TokenFile = flagCfg.Consul.TokenFile
+		case "nomad-identity":
+			cfg.Nomad.Identity = flagCfg.Nomad.Identity
+		case "nomad-identity-file":
+			cfg.Nomad.TokenFile = flagCfg.Nomad.TokenFile
+		case "uma-audience":
+			cfg.UMA.Audience = flagCfg.UMA.Audience
+		case "uma-permission":
+			cfg.UMA.Permissions = flagCfg.UMA.Permissions
+		case "uma-ticket":
+			cfg.UMA.Ticket = flagCfg.UMA.Ticket
+		case "uma-submit-request":
+			cfg.UMA.SubmitRequest = flagCfg.UMA.SubmitRequest
+		}
+	})
+
+	cfg.applyTrustDomain()
+	if urls := splitList(cfg.KeycloakURL); len(urls) > 1 {
+		cfg.KeycloakURL = urls[0]
+		cfg.Failover.URLs = append(urls[1:], cfg.Failover.URLs...)
+	}
+	cfg.KeycloakURL = strings.TrimRight(cfg.KeycloakURL, "/")
+	for i, u := range cfg.Failover.URLs {
+		cfg.Failover.URLs[i] = strings.TrimRight(u, "/")
+	}
+	if cfg.Sidecar.Dir != "" {
+		cfg.Daemon = true
+	}
+	if cfg.Quiet {
+		cfg.Log.Level = "error"
+		if cfg.Output == "" {
+			cfg.Output = outputRaw
+		}
+	}
+	if b, err := strconv.ParseBool(cfg.LegacyPath); err == nil {
+		cfg.LegacyPath = strconv.FormatBool(b)
+	}
+	if len(cfg.Audience) == 0 {
+		cfg.Audience = stringList{cfg.realmURL()}
+		cfg.defaultAudience = true
+	}
+
+	if err := cfg.validate(); err != nil {
+		return Config{}, &configError{err}
+	}
+	return cfg, nil
+}
+
+// loadFile overlays the settings found in the YAML file at path.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// loadEnv overlays the settings found in environment variables.
+func (c *Config) loadEnv() error {
+	setString := func(dst *string, key string) {
+		if v := os.Getenv(key); v != "" {
+			*dst = v
+		}
+	}
+	setString(&c.SocketPath, "SPIFFE_ENDPOINT_SOCKET")
+	setString(&c.SPIFFEID, "SPIFFE_ID")
+	setString(&c.ExpectSPIFFEID, "EXPECT_SPIFFE_ID")
+	setString(&c.TrustDomain, "TRUST_DOMAIN")
+	if v := os.Getenv("TRUST_DOMAIN_REALMS"); v != "" {
+		if c.TrustDomains == nil {
+			c.TrustDomains = map[string]TrustDomainRealm{}
+		}
+		for _, entry := range splitList(v) {
+			td, realm, _ := strings.Cut(entry, "=")
+			r := c.TrustDomains[td]
+			r.Realm = realm
+			c.TrustDomains[td] = r
+		}
+	}
+	setString(&c.KeycloakURL, "KEYCLOAK_URL")
+	setString(&c.Failover.Failback, "KEYCLOAK_FAILBACK")
+	if v := os.Getenv("KEYCLOAK_FAILOVER_URLS"); v != "" {
+		c.Failover.URLs = splitList(v)
+	}
+	setString(&c.DNSServer, "DNS_SERVER")
+	setString(&c.KeycloakProxy, "KEYCLOAK_PROXY")
+	setString(&c.KeycloakProxyCAFile, "KEYCLOAK_PROXY_CA_FILE")
+	if v := os.Getenv("RESOLVE"); v != "" {
+		c.Resolve = splitList(v)
+	}
+	setString(&c.Realm, "REALM")
+	setString(&c.IDPAlias, "IDP_ALIAS")
+	setString(&c.Scope, "SCOPE")
+	setString(&c.DPoP, "DPOP")
+	setString(&c.LegacyPath, "LEGACY_PATH")
+	setString(&c.Log.Level, "LOG_LEVEL")
+	setString(&c.Log.Format, "LOG_FORMAT")
+	setString(&c.TLS.CAFile, "TLS_CA_FILE")
+	setString(&c.TLS.CADir, "TLS_CA_DIR")
+	setString(&c.Audit.File, "AUDIT_FILE")
+	setString(&c.Audit.Syslog, "AUDIT_SYSLOG")
+	setString(&c.Alert.Webhook, "ALERT_WEBHOOK")
+	setString(&c.RequestIDHeader, "REQUEST_ID_HEADER")
+	setString(&c.TLS.ServerName, "TLS_SERVER_NAME")
+	setString(&c.TLS.MinVersion, "TLS_MIN_VERSION")
+	setString(&c.TLS.KeycloakSPIFFEID, "TLS_KEYCLOAK_SPIFFE_ID")
+	setString(&c.MetricsAddr, "METRICS_ADDR")
+	setString(&c.HealthAddr, "HEALTH_ADDR")
+	setString(&c.TokenAPIAddr, "TOKEN_API_ADDR")
+	setString(&c.SDSAddr, "SDS_ADDR")
+	setString(&c.Sidecar.Dir, "SIDECAR_DIR")
+	setString(&c.TokenFile.Path, "TOKEN_FILE")
+	setString(&c.TokenFile.ResponsePath, "TOKEN_RESPONSE_FILE")
+	setString(&c.TokenFile.Mode, "TOKEN_FILE_MODE")
+	setString(&c.KubeSecret.Name, "KUBE_SECRET")
+	setString(&c.KubeSecret.Namespace, "KUBE_SECRET_NAMESPACE")
+	setString(&c.RenewHook, "RENEW_HOOK")
+	setString(&c.Output, "OUTPUT")
+	setString(&c.TokenCache.File, "TOKEN_CACHE_FILE")
+	setString(&c.TokenCache.KeyFile, "TOKEN_CACHE_KEY_FILE")
+	setString(&c.Exec.OnRotate, "EXEC_ON_ROTATE")
+	setString(&c.Exec.Signal, "EXEC_ROTATE_SIGNAL")
+	setString(&c.Broker.Socket, "BROKER_SOCKET")
+	setString(&c.Broker.Addr, "BROKER_ADDR")
+	setString(&c.Proxy.Listen, "PROXY_LISTEN")
+	setString(&c.Proxy.Upstream, "PROXY_UPSTREAM")
+	setString(&c.JWKS.Addr, "JWKS_ADDR")
+	setString(&c.JWKS.Path, "JWKS_PATH")
+	setString(&c.Downstream.Scope, "DOWNSTREAM_SCOPE")
+	setString(&c.Vault.Addr, "VAULT_ADDR")
+	setString(&c.Vault.Namespace, "VAULT_NAMESPACE")
+	setString(&c.Vault.CACert, "VAULT_CACERT")
+	setString(&c.Vault.Mount, "VAULT_AUTH_MOUNT")
+	setString(&c.Vault.Role, "VAULT_ROLE")
+	setString(&c.Vault.Credential, "VAULT_CREDENTIAL")
+	setString(&c.Vault.Audience, "VAULT_SVID_AUDIENCE")
+	setString(&c.Vault.TokenFile, "VAULT_TOKEN_FILE")
+	setString(&c.AWS.RoleARN, "AWS_ROLE_ARN")
+	setString(&c.AWS.SessionName, "AWS_ROLE_SESSION_NAME")
+	setString(&c.AWS.Region, "AWS_REGION")
+	setString(&c.AWS.STSEndpoint, "AWS_STS_ENDPOINT")
+	setString(&c.AWS.Credential, "AWS_CREDENTIAL")
+	setString(&c.AWS.Audience, "AWS_SVID_AUDIENCE")
+	setString(&c.AWS.CredentialsFile, "AWS_SHARED_CREDENTIALS_FILE")
+	setString(&c.AWS.Profile, "AWS_PROFILE")
+	setString(&c.GCP.Provider, "GCP_WORKLOAD_IDENTITY_PROVIDER")
+	setString(&c.GCP.ServiceAccount, "GCP_SERVICE_ACCOUNT")
+	if v := os.Getenv("GCP_SCOPES"); v != "" {
+		c.GCP.Scopes = splitList(v)
+	}
+	setString(&c.GCP.Credential, "GCP_CREDENTIAL")
+	setString(&c.GCP.Audience, "GCP_SVID_AUDIENCE")
+	setString(&c.GCP.CredentialsFile, "GOOGLE_APPLICATION_CREDENTIALS")
+	setString(&c.GCP.TokenFile, "GCP_SUBJECT_TOKEN_FILE")
+	setString(&c.Azure.TenantID, "AZURE_TENANT_ID")
+	setString(&c.Azure.ClientID, "AZURE_CLIENT_ID")
+	if v := os.Getenv("AZURE_SCOPES"); v != "" {
+		c.Azure.Scopes = splitList(v)
+	}
+	setString(&c.Azure.AuthorityHost, "AZURE_AUTHORITY_HOST")
+	setString(&c.Azure.Credential, "AZURE_CREDENTIAL")
+	setString(&c.Azure.Audience, "AZURE_SVID_AUDIENCE")
+	setString(&c.Azure.TokenFile, "AZURE_FEDERATED_TOKEN_FILE")
+	setString(&c.STS.Endpoint, "STS_ENDPOINT")
+	setString(&c.STS.CACert, "STS_CA_CERT")
+	setString(&c.STS.RoleARN, "STS_ROLE_ARN")
+	setString(&c.STS.Policy, "STS_POLICY")
+	setString(&c.STS.Credential, "STS_CREDENTIAL")
+	setString(&c.STS.Audience, "STS_SVID_AUDIENCE")
+	setString(&c.STS.CredentialsFile, "STS_CREDENTIALS_FILE")
+	setString(&c.STS.Profile, "STS_PROFILE")
+	if v := os.Getenv("DOCKER_REGISTRIES"); v != "" {
+		c.Docker.Registries = splitList(v)
+	}
+	setString(&c.Docker.Username, "DOCKER_USERNAME")
+	setString(&c.Docker.Credential, "DOCKER_CREDENTIAL")
+	setString(&c.Docker.Audience, "DOCKER_SVID_AUDIENCE")
+	if v := os.Getenv("GIT_HOSTS"); v != "" {
+		c.Git.Hosts = splitList(v)
+	}
+	setString(&c.Git.Username, "GIT_USERNAME")
+	setString(&c.Git.Credential, "GIT_CREDENTIAL")
+	setString(&c.Git.Audience, "GIT_SVID_AUDIENCE")
+	setString(&c.Consul.Addr, "CONSUL_HTTP_ADDR")
+	setString(&c.Consul.CACert, "CONSUL_CACERT")
+	setString(&c.Consul.Namespace, "CONSUL_NAMESPACE")
+	setString(&c.Consul.Partition, "CONSUL_PARTITION")
+	setString(&c.Consul.AuthMethod, "CONSUL_AUTH_METHOD")
+	setString(&c.Consul.Credential, "CONSUL_CREDENTIAL")
+	setString(&c.Consul.Audience, "CONSUL_SVID_AUDIENCE")
+	setString(&c.Consul.TokenFile, "CONSUL_HTTP_TOKEN_FILE")
+	setString(&c.Nomad.Identity, "NOMAD_IDENTITY")
+	setString(&c.Nomad.TokenFile, "NOMAD_IDENTITY_FILE")
+	setString(&c.UMA.Audience, "UMA_AUDIENCE")
+	if v := os.Getenv("UMA_PERMISSIONS"); v != "" {
+		c.UMA.Permissions = splitList(v)
+	}
+	setString(&c.UMA.Ticket, "UMA_TICKET")
+	setString(&c.AuthMethod, "AUTH_METHOD")
+	setString(&c.ClientID, "CLIENT_ID")
+	setString(&c.Assertion.Issuer, "ASSERTION_ISSUER")
+	setString(&c.Assertion.Subject, "ASSERTION_SUBJECT")
+	setString(&c.Assertion.Audience, "ASSERTION_AUDIENCE")
+	setString(&c.Assertion.ID, "ASSERTION_JTI")
+	setString(&c.TokenExchange.Subject, "TOKEN_EXCHANGE_SUBJECT")
+	setString(&c.TokenExchange.File, "TOKEN_EXCHANGE_FILE")
+	setString(&c.TokenExchange.SubjectIssuer, "TOKEN_EXCHANGE_SUBJECT_ISSUER")
+	setString(&c.TokenExchange.Actor, "TOKEN_EXCHANGE_ACTOR")
+	setString(&c.TokenExchange.RequestedTokenType, "TOKEN_EXCHANGE_REQUESTED_TOKEN_TYPE")
+	setString(&c.TokenExchange.Scope, "TOKEN_EXCHANGE_SCOPE")
+	setString(&c.Revoke.File, "REVOKE_FILE")
+	setString(&c.Revoke.TokenTypeHint, "REVOKE_TOKEN_TYPE_HINT")
+	setString(&c.Introspect.File, "INTROSPECT_FILE")
+	setString(&c.Introspect.TokenTypeHint, "INTROSPECT_TOKEN_TYPE_HINT")
+	setString(&c.Inspect.File, "INSPECT_FILE")
+	setString(&c.Admin.Realm, "ADMIN_REALM")
+	setString(&c.Admin.ClientID, "ADMIN_CLIENT_ID")
+	setString(&c.Admin.ClientSecret, "ADMIN_CLIENT_SECRET")
+	setString(&c.Admin.Username, "ADMIN_USERNAME")
+	setString(&c.Admin.Password, "ADMIN_PASSWORD")
+	setString(&c.Admin.ApplyFile, "APPLY_FILE")
+	setString(&c.Admin.BootstrapClient.SPIFFEID, "BOOTSTRAP_SPIFFE_ID")
+	if v := os.Getenv("BOOTSTRAP_AUDIENCE"); v != "" {
+		c.Admin.BootstrapClient.Audience = splitList(v)
+	}
+	if v := os.Getenv("BOOTSTRAP_SCOPES"); v != "" {
+		c.Admin.BootstrapClient.Scopes = splitList(v)
+	}
+	if v := os.Getenv("BUNDLE_SYNC_CLIENTS"); v != "" {
+		c.Admin.BundleSync.Clients = splitList(v)
+	}
+	setString(&c.Admin.Entry.ServerSocket, "SPIRE_SERVER_SOCKET")
+	setString(&c.Admin.Entry.ParentID, "ENTRY_PARENT_ID")
+	if v := os.Getenv("ENTRY_SELECTORS"); v != "" {
+		c.Admin.Entry.Selectors = splitList(v)
+	}
+	if v := os.Getenv("AUDIENCE"); v != "" {
+		c.Audience = splitList(v)
+	}
+	if v := os.Getenv("RESOURCE"); v != "" {
+		c.Resource = splitList(v)
+	}
+	if v := os.Getenv("TOKEN_EXCHANGE_AUDIENCE"); v != "" {
+		c.TokenExchange.Audience = splitList(v)
+	}
+	if v := os.Getenv("DOWNSTREAM_AUDIENCE"); v != "" {
+		c.Downstream.Audience = splitList(v)
+	}
+	if v := os.Getenv("BROKER_ALLOW"); v != "" {
+		c.Broker.Allow = splitList(v)
+	}
+	if v := os.Getenv("VERIFY_TOKEN_AUDIENCE"); v != "" {
+		c.VerifyToken.Audience = splitList(v)
+	}
+	if v := os.Getenv("BROKER_AUDIENCES"); v != "" {
+		c.Broker.Audiences = splitList(v)
+	}
+	if v := os.Getenv("BROKER_SPIFFE_IDS"); v != "" {
+		c.Broker.Identities = splitList(v)
+	}
+
+	durations := map[string]*time.Duration{
+		"TIMEOUT":                       &c.Timeout,
+		"HTTP_TIMEOUT":                  &c.HTTPTimeout,
+		"SVID_FETCH_TIMEOUT":            &c.Timeouts.SVIDFetch,
+		"DISCOVERY_TIMEOUT":             &c.Timeouts.Discovery,
+		"TOKEN_REQUEST_TIMEOUT":         &c.Timeouts.TokenRequest,
+		"CIRCUIT_BREAKER_OPEN_DURATION": &c.CircuitBreaker.OpenDuration,
+		"ALERT_EXPIRY_WINDOW":           &c.Alert.ExpiryWindow,
+		"ALERT_TIMEOUT":                 &c.Alert.Timeout,
+		"ENTRY_X509_SVID_TTL":           &c.Admin.Entry.X509SVIDTTL,
+		"ENTRY_JWT_SVID_TTL":            &c.Admin.Entry.JWTSVIDTTL,
+		"JWKS_MAX_AGE":                  &c.JWKS.MaxAge,
+		"AWS_SESSION_DURATION":          &c.AWS.Duration,
+		"GCP_TOKEN_LIFETIME":            &c.GCP.Lifetime,
+		"STS_DURATION":                  &c.STS.Duration,
+		"BUNDLE_SYNC_INTERVAL":          &c.Admin.BundleSync.Interval,
+		"RETRY_INTERVAL":                &c.RetryInterval,
+		"SPIRE_GRACE_PERIOD":            &c.SPIREGracePeriod,
+		"RELOAD_INTERVAL":               &c.ReloadInterval,
+		"ASSERTION_LIFETIME":            &c.Assertion.Lifetime,
+		"RETRY_BASE_DELAY":              &c.Retry.BaseDelay,
+		"RETRY_MAX_DELAY":               &c.Retry.MaxDelay,
+		"RETRY_ATTEMPT_TIMEOUT":         &c.Retry.AttemptTimeout,
+		"SOCKET_WAIT_TIMEOUT":           &c.SocketWait.Timeout,
+		"SOCKET_WAIT_INTERVAL":          &c.SocketWait.Interval,
+		"KEYCLOAK_FAILOVER_COOLDOWN":    &c.Failover.Cooldown,
+	}
+	for key, dst := range durations {
+		if v := os.Getenv(key); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", key, err)
+			}
+			*dst = d
+		}
+	}
+
+	bools := map[string]*bool{
+		"DISCOVERY":                &c.Discovery,
+		"VERIFY_TOKEN":             &c.VerifyToken.Enabled,
+		"DAEMON":                   &c.Daemon,
+		"REVOKE_ON_EXIT":           &c.RevokeOnExit,
+		"QUIET":                    &c.Quiet,
+		"DRY_RUN":                  &c.DryRun,
+		"SHOW_SECRETS":             &c.ShowSecrets,
+		"TRACE_HTTP":               &c.TraceHTTP,
+		"TLS_INSECURE_SKIP_VERIFY": &c.TLS.InsecureSkipVerify,
+		"UMA_SUBMIT_REQUEST":       &c.UMA.SubmitRequest,
+	}
+	for key, dst := range bools {
+		if v := os.Getenv(key); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", key, err)
+			}
+			*dst = b
+		}
+	}
+
+	floats := map[string]*float64{
+		"RENEW_THRESHOLD": &c.RenewThreshold,
+		"RETRY_JITTER":    &c.Retry.Jitter,
+		"RATE_LIMIT":      &c.RateLimit.RPS,
+	}
+	for key, dst := range floats {
+		if v := os.Getenv(key); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", key, err)
+			}
+			*dst = f
+		}
+	}
+
+	if v := os.Getenv("RETRY_MAX_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid RETRY_MAX_ATTEMPTS: %w", err)
+		}
+		c.Retry.MaxAttempts = n
+	}
+	if v := os.Getenv("RATE_LIMIT_BURST"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid RATE_LIMIT_BURST: %w", err)
+		}
+		c.RateLimit.Burst = n
+	}
+	if v := os.Getenv("CIRCUIT_BREAKER_THRESHOLD"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid CIRCUIT_BREAKER_THRESHOLD: %w", err)
+		}
+		c.CircuitBreaker.Threshold = n
+	}
+	if v := os.Getenv("ALERT_FAILURES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid ALERT_FAILURES: %w", err)
+		}
+		c.Alert.Failures = n
+	}
+	return nil
+}
+
+// validate reports all configuration problems at once.
+func (c *Config) validate() error {
+	var errs []error
+
+	if !strings.HasPrefix(c.SocketPath, "unix://") && !strings.HasPrefix(c.SocketPath, "tcp://") && !spire.IsNamedPipe(c.SocketPath) {
+		errs = append(errs, fmt.Errorf("socket path %q must start with unix://, tcp:// or npipe://", c.SocketPath))
+	}
+	if _, err := path.Match(c.SPIFFEID, ""); err != nil {
+		errs = append(errs, fmt.Errorf("SPIFFE ID pattern %q: %w", c.SPIFFEID, err))
+	}
+	if c.ExpectSPIFFEID != "" {
+		if _, err := spiffeid.FromString(c.ExpectSPIFFEID); err != nil {
+			errs = append(errs, fmt.Errorf("expected SPIFFE ID %q: %w", c.ExpectSPIFFEID, err))
+		}
+	}
+	for td, r := range c.TrustDomains {
+		if _, err := spiffeid.TrustDomainFromString(td); err != nil || strings.HasPrefix(td, "spiffe://") {
+			errs = append(errs, fmt.Errorf("trust domain %q of the federation must be a trust domain name", td))
+		}
+		if r.KeycloakURL == "" && r.KeycloakSPIFFEID == "" && r.Realm == "" && r.IDPAlias == "" && len(r.Audience) == 0 {
+			errs = append(errs, fmt.Errorf("trust domain %q of the federation has no realm: use td=realm", td))
+		}
+	}
+	if c.TrustDomain != "" {
+		if _, err := spiffeid.TrustDomainFromString(c.TrustDomain); err != nil {
+			errs = append(errs, fmt.Errorf("trust domain %q: %w", c.TrustDomain, err))
+		}
+	}
+	if u, err := url.Parse(c.KeycloakURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("keycloak URL %q must be an absolute http(s) URL", c.KeycloakURL))
+	}
+	for _, failover := range c.Failover.URLs {
+		if u, err := url.Parse(failover); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("keycloak failover URL %q must be an absolute http(s) URL", failover))
+		}
+	}
+	for _, entry := range c.Resolve {
+		if _, _, _, err := parseResolve(entry); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.DNSServer != "" {
+		if _, _, err := net.SplitHostPort(c.DNSServer); err != nil {
+			errs = append(errs, fmt.Errorf("DNS server %q must be host:port: %w", c.DNSServer, err))
+		}
+	}
+	if c.KeycloakProxy != "" && c.KeycloakProxy != proxyDirect {
+		if u, err := url.Parse(c.KeycloakProxy); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("Keycloak proxy must be an http or https URL, or %s", proxyDirect))
+		}
+	}
+	if c.KeycloakProxyCAFile != "" {
+		if _, err := os.Stat(c.KeycloakProxyCAFile); err != nil {
+			errs = append(errs, fmt.Errorf("Keycloak proxy CA file: %w", err))
+		}
+	}
+	switch c.Failover.Failback {
+	case failbackPrimary, failbackSticky:
+	default:
+		errs = append(errs, fmt.Errorf("keycloak failback %q must be %s or %s", c.Failover.Failback, failbackPrimary, failbackSticky))
+	}
+	if c.Failover.Cooldown <= 0 {
+		errs = append(errs, errors.New("keycloak failover cooldown must be positive"))
+	}
+	if c.Realm == "" {
+		errs = append(errs, errors.New("realm must not be empty"))
+	}
+	if c.IDPAlias == "" {
+		errs = append(errs, errors.New("identity provider alias must not be empty"))
+	}
+	if c.Timeout <= 0 {
+		errs = append(errs, errors.New("timeout must be positive"))
+	}
+	if c.HTTPTimeout <= 0 {
+		errs = append(errs, errors.New("HTTP timeout must be positive"))
+	}
+	if c.Timeouts.SVIDFetch < 0 || c.Timeouts.Discovery < 0 || c.Timeouts.TokenRequest < 0 {
+		errs = append(errs, errors.New("phase timeouts must not be negative"))
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		errs = append(errs, fmt.Errorf("log level %q must be debug, info, warn or error", c.Log.Level))
+	}
+	if c.Log.Format != logFormatText && c.Log.Format != logFormatJSON {
+		errs = append(errs, fmt.Errorf("log format %q must be %s or %s", c.Log.Format, logFormatText, logFormatJSON))
+	}
+	if c.Retry.MaxAttempts < 1 {
+		errs = append(errs, errors.New("retry max attempts must be at least 1"))
+	}
+	if c.Retry.BaseDelay <= 0 || c.Retry.MaxDelay < c.Retry.BaseDelay {
+		errs = append(errs, errors.New("retry base delay must be positive and not exceed the max delay"))
+	}
+	if c.Retry.Jitter < 0 || c.Retry.Jitter > 1 {
+		errs = append(errs, fmt.Errorf("retry jitter %v must be between 0 and 1", c.Retry.Jitter))
+	}
+	if c.RateLimit.RPS < 0 {
+		errs = append(errs, fmt.Errorf("rate limit %v must not be negative", c.RateLimit.RPS))
+	}
+	if c.RateLimit.RPS > 0 && c.RateLimit.Burst < 1 {
+		errs = append(errs, errors.New("rate limit burst must be at least 1"))
+	}
+	if c.Audit.Syslog != "" && c.Audit.Syslog != auditSyslogLocal {
+		if u, err := url.Parse(c.Audit.Syslog); err != nil || (u.Scheme != "udp" && u.Scheme != "tcp" && u.Scheme != "unix") {
+			errs = append(errs, fmt.Errorf("audit syslog %q must be %s or a udp://, tcp:// or unix:// address", c.Audit.Syslog, auditSyslogLocal))
+		}
+	}
+	if h := c.RequestIDHeader; h != "" && h != requestIDHeaderNone && !headerNamePattern.MatchString(h) {
+		errs = append(errs, fmt.Errorf("request ID header %q is not a valid header name", h))
+	}
+	if c.Alert.Webhook != "" {
+		if u, err := url.Parse(c.Alert.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, errors.New("alert webhook must be an http:// or https:// URL"))
+		}
+		if c.Alert.Failures < 0 || c.Alert.ExpiryWindow < 0 {
+			errs = append(errs, errors.New("alert failures and expiry window must not be negative"))
+		}
+		if c.Alert.Timeout <= 0 {
+			errs = append(errs, errors.New("alert timeout must be positive"))
+		}
+	}
+	if !strings.HasPrefix(c.Admin.Entry.ServerSocket, "unix://") {
+		errs = append(errs, fmt.Errorf("SPIRE Server socket %q must start with unix://", c.Admin.Entry.ServerSocket))
+	}
+	for _, s := range c.Admin.Entry.Selectors {
+		if typ, value, ok := strings.Cut(s, ":"); !ok || typ == "" || value == "" {
+			errs = append(errs, fmt.Errorf("entry selector %q must be type:value", s))
+		}
+	}
+	if c.Admin.BundleSync.Interval <= 0 {
+		errs = append(errs, errors.New("bundle sync interval must be positive"))
+	}
+	if c.Admin.Entry.X509SVIDTTL < 0 || c.Admin.Entry.JWTSVIDTTL < 0 {
+		errs = append(errs, errors.New("entry SVID lifetimes must not be negative"))
+	}
+	if c.CircuitBreaker.Threshold < 0 {
+		errs = append(errs, fmt.Errorf("circuit breaker threshold %d must not be negative", c.CircuitBreaker.Threshold))
+	}
+	if c.CircuitBreaker.Threshold > 0 && c.CircuitBreaker.OpenDuration <= 0 {
+		errs = append(errs, errors.New("circuit breaker open duration must be positive"))
+	}
+	if c.Retry.AttemptTimeout <= 0 {
+		errs = append(errs, errors.New("retry attempt timeout must be positive"))
+	}
+	if c.SocketWait.Timeout < 0 {
+		errs = append(errs, errors.New("socket wait timeout must not be negative"))
+	}
+	if c.SocketWait.Timeout > 0 && c.SocketWait.Interval <= 0 {
+		errs = append(errs, errors.New("socket wait interval must be positive"))
+	}
+	if len(c.Audience) > 1 && c.AuthMethod != authMethodJWTSpiffe {
+		errs = append(errs, fmt.Errorf("multiple audiences require auth method %s, the audience only selects the JWT-SVID", authMethodJWTSpiffe))
+	}
+	switch c.AuthMethod {
+	case authMethodJWTSpiffe, authMethodTLSClientAuth, authMethodPrivateKeyJWT:
+	case authMethodNomad:
+		// Without an X509-SVID to name the client after.
+		if c.ClientID == "" {
+			errs = append(errs, fmt.Errorf("auth method %s requires a client ID", authMethodNomad))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("auth method %q must be %s, %s, %s or %s", c.AuthMethod,
+			authMethodJWTSpiffe, authMethodTLSClientAuth, authMethodPrivateKeyJWT, authMethodNomad))
+	}
+	for _, h := range []struct{ command, hint string }{
+		{"revoke", c.Revoke.TokenTypeHint},
+		{"introspect", c.Introspect.TokenTypeHint},
+	} {
+		switch h.hint {
+		case "", keycloak.TokenTypeHintAccessToken, keycloak.TokenTypeHintRefreshToken:
+		default:
+			errs = append(errs, fmt.Errorf("%s token type hint %q must be %s or %s", h.command, h.hint, keycloak.TokenTypeHintAccessToken, keycloak.TokenTypeHintRefreshToken))
+		}
+	}
+	switch c.TokenExchange.Subject {
+	case subjectJWTSVID, subjectAccessToken, subjectFile, subjectNomad:
+	default:
+		errs = append(errs, fmt.Errorf("token exchange subject %q must be %s, %s, %s or %s", c.TokenExchange.Subject,
+			subjectJWTSVID, subjectAccessToken, subjectNomad, subjectFile))
+	}
+	switch c.TokenExchange.Actor {
+	case "", subjectJWTSVID, subjectAccessToken:
+	default:
+		errs = append(errs, fmt.Errorf("token exchange actor %q must be %s or %s", c.TokenExchange.Actor, subjectJWTSVID, subjectAccessToken))
+	}
+	if strings.ContainsAny(c.Nomad.Identity, "/\\") {
+		errs = append(errs, fmt.Errorf("invalid nomad identity %q", c.Nomad.Identity))
+	}
+	if c.Assertion.Lifetime <= 0 {
+		errs = append(errs, errors.New("assertion lifetime must be positive"))
+	}
+	if c.RenewThreshold <= 0 || c.RenewThreshold >= 1 {
+		errs = append(errs, fmt.Errorf("renew threshold %v must be between 0 and 1 (exclusive)", c.RenewThreshold))
+	}
+	if c.RetryInterval <= 0 {
+		errs = append(errs, errors.New("retry interval must be positive"))
+	}
+	if c.SPIREGracePeriod < 0 {
+		errs = append(errs, errors.New("SPIRE grace period must not be negative"))
+	}
+	if c.ReloadInterval < 0 {
+		errs = append(errs, errors.New("reload interval must not be negative"))
+	}
+	if _, err := parseFileMode(c.TokenFile.Mode); err != nil {
+		errs = append(errs, fmt.Errorf("token file: %w", err))
+	}
+	for _, path := range []string{c.TokenFile.Path, c.TokenFile.ResponsePath} {
+		if path != "" && len(c.Audience) > 1 && !strings.Contains(path, audiencePlaceholder) {
+			errs = append(errs, fmt.Errorf("token file %q must contain %s with several audiences", path, audiencePlaceholder))
+		}
+	}
+	if err := validateScope(c.Scope); err != nil {
+		errs = append(errs, err)
+	}
+	for _, resource := range c.Resource {
+		if u, err := url.Parse(resource); err != nil || !u.IsAbs() || u.Fragment != "" {
+			errs = append(errs, fmt.Errorf("resource %q must be an absolute URI without fragment", resource))
+		}
+	}
+	switch c.LegacyPath {
+	case legacyPathAuto, "true", "false":
+	default:
+		errs = append(errs, fmt.Errorf("legacy path %q must be %s, true or false", c.LegacyPath, legacyPathAuto))
+	}
+	switch c.DPoP {
+	case "", dpopMemory, dpopX509SVID:
+	default:
+		errs = append(errs, fmt.Errorf("dpop %q must be %s or %s", c.DPoP, dpopMemory, dpopX509SVID))
+	}
+	if c.DPoP == dpopX509SVID && c.AuthMethod == authMethodNomad {
+		errs = append(errs, fmt.Errorf("dpop %s requires an X509-SVID, not available with the %s auth method", dpopX509SVID, authMethodNomad))
+	}
+	if c.ShowSecrets && !c.DryRun {
+		errs = append(errs, errors.New("show secrets only applies to dry runs"))
+	}
+	switch c.Output {
+	case "", outputJSON, outputYAML, outputEnv, outputRaw, outputExecCredential, outputAWSCredentialProcess:
+	default:
+		errs = append(errs, fmt.Errorf("output %q must be %s, %s, %s, %s, %s or %s", c.Output,
+			outputJSON, outputYAML, outputEnv, outputRaw, outputExecCredential, outputAWSCredentialProcess))
+	}
+	// The AWS SDKs wait for the credential process to exit.
+	if c.Output == outputAWSCredentialProcess && c.Daemon {
+		errs = append(errs, fmt.Errorf("output %s does not run in daemon mode", outputAWSCredentialProcess))
+	}
+	// kubectl reads a single ExecCredential and exits.
+	if c.Output == outputExecCredential && (c.Daemon || len(c.Audience) > 1) {
+		errs = append(errs, fmt.Errorf("output %s prints one token, without daemon mode", outputExecCredential))
+	}
+	if c.TokenAPIAddr != "" && !strings.HasPrefix(c.TokenAPIAddr, "unix://") {
+		errs = append(errs, fmt.Errorf("token API address %q must start with unix://", c.TokenAPIAddr))
+	}
+	if c.SDSAddr != "" && !strings.HasPrefix(c.SDSAddr, "unix://") {
+		errs = append(errs, fmt.Errorf("SDS address %q must start with unix://", c.SDSAddr))
+	}
+	if c.KubeSecret.Name != "" && len(c.Audience) > 1 && !strings.Contains(c.KubeSecret.Name, audiencePlaceholder) {
+		errs = append(errs, fmt.Errorf("kube secret %q must contain %s with several audiences", c.KubeSecret.Name, audiencePlaceholder))
+	}
+	if c.TokenCache.File != "" && c.TokenCache.KeyFile == "" && os.Getenv("TOKEN_CACHE_KEY") == "" {
+		errs = append(errs, errors.New("token cache file requires TOKEN_CACHE_KEY or a key file"))
+	}
+	switch c.Exec.OnRotate {
+	case rotateNone, rotateRestart, rotateSignal:
+	default:
+		errs = append(errs, fmt.Errorf("exec on_rotate %q must be %s, %s or %s", c.Exec.OnRotate, rotateNone, rotateRestart, rotateSignal))
+	}
+	if _, ok := rotateSignals[c.Exec.Signal]; !ok {
+		errs = append(errs, fmt.Errorf("exec signal %q is not supported", c.Exec.Signal))
+	}
+	if _, err := parsePeerAllowlist(c.Broker.Allow); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Broker.Addr != "" {
+		if host, _, err := net.SplitHostPort(c.Broker.Addr); err != nil || !isLoopback(host) {
+			errs = append(errs, fmt.Errorf("broker address %q must be a loopback host:port", c.Broker.Addr))
+		}
+	}
+	if !strings.HasPrefix(c.JWKS.Path, "/") {
+		errs = append(errs, fmt.Errorf("JWKS path %q must start with /", c.JWKS.Path))
+	}
+	if c.JWKS.MaxAge < 0 {
+		errs = append(errs, errors.New("JWKS max age must not be negative"))
+	}
+	if err := validCredential("Vault", c.Vault.Credential); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validCredential("AWS", c.AWS.Credential); err != nil {
+		errs = append(errs, err)
+	}
+	if c.AWS.Duration != 0 && (c.AWS.Duration < 15*time.Minute || c.AWS.Duration > 12*time.Hour) {
+		errs = append(errs, fmt.Errorf("AWS session duration %s must be between 15m and 12h", c.AWS.Duration))
+	}
+	if c.AWS.Profile == "" || strings.ContainsAny(c.AWS.Profile, "[]\n") {
+		errs = append(errs, fmt.Errorf("invalid AWS profile %q", c.AWS.Profile))
+	}
+	if err := validCredential("GCP", c.GCP.Credential); err != nil {
+		errs = append(errs, err)
+	}
+	if c.GCP.Lifetime < 0 || c.GCP.Lifetime > 12*time.Hour {
+		errs = append(errs, fmt.Errorf("GCP token lifetime %s must be at most 12h", c.GCP.Lifetime))
+	}
+	if len(c.GCP.Scopes) == 0 {
+		errs = append(errs, errors.New("GCP scopes must not be empty"))
+	}
+	if err := validCredential("Azure", c.Azure.Credential); err != nil {
+		errs = append(errs, err)
+	}
+	if len(c.Azure.Scopes) == 0 {
+		errs = append(errs, errors.New("azure scopes must not be empty"))
+	}
+	if u, err := url.Parse(c.Azure.AuthorityHost); err != nil || u.Scheme != "https" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("azure authority host %q must be an https URL", c.Azure.AuthorityHost))
+	}
+	if err := validCredential("STS", c.STS.Credential); err != nil {
+		errs = append(errs, err)
+	}
+	if c.STS.Endpoint != "" {
+		if u, err := url.Parse(c.STS.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("STS endpoint %q must be an http or https URL", c.STS.Endpoint))
+		}
+	}
+	if c.STS.Duration != 0 && c.STS.Duration < 15*time.Minute {
+		errs = append(errs, fmt.Errorf("STS duration %s must be at least 15m", c.STS.Duration))
+	}
+	if c.STS.Profile == "" || strings.ContainsAny(c.STS.Profile, "[]\n") {
+		errs = append(errs, fmt.Errorf("invalid STS profile %q", c.STS.Profile))
+	}
+	if err := validCredential("Docker", c.Docker.Credential); err != nil {
+		errs = append(errs, err)
+	}
+	for _, pattern := range c.Docker.Registries {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("docker registry pattern %q: %w", pattern, err))
+		}
+	}
+	// Docker takes the secret of the username <token> for a refresh token.
+	if c.Docker.Username == "" || c.Docker.Username == "<token>" {
+		errs = append(errs, fmt.Errorf("invalid docker username %q", c.Docker.Username))
+	}
+	if err := validCredential("Git", c.Git.Credential); err != nil {
+		errs = append(errs, err)
+	}
+	for _, pattern := range c.Git.Hosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("git host pattern %q: %w", pattern, err))
+		}
+	}
+	if c.Git.Username == "" || strings.ContainsAny(c.Git.Username, "\n") {
+		errs = append(errs, fmt.Errorf("invalid git username %q", c.Git.Username))
+	}
+	if err := validCredential("Consul", c.Consul.Credential); err != nil {
+		errs = append(errs, err)
+	}
+	if u, err := url.Parse(consul.Address(c.Consul.Addr)); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("consul address %q must be an http or https URL or a host:port", c.Consul.Addr))
+	}
+	for _, permission := range c.UMA.Permissions {
+		if resource, scope, _ := strings.Cut(permission, "#"); resource == "" && scope == "" {
+			errs = append(errs, fmt.Errorf("uma permission %q must name a resource or a scope", permission))
+		}
+	}
+	if c.UMA.SubmitRequest && c.UMA.Ticket == "" {
+		errs = append(errs, errors.New("uma submit request requires a permission ticket"))
+	}
+	for _, pattern := range c.Broker.Audiences {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("broker audience pattern %q: %w", pattern, err))
+		}
+	}
+	if len(c.Broker.Audiences) > 0 && c.AuthMethod != authMethodJWTSpiffe {
+		errs = append(errs, fmt.Errorf("broker audiences require the %s auth method", authMethodJWTSpiffe))
+	}
+	for _, pattern := range c.Broker.Identities {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("broker SPIFFE ID pattern %q: %w", pattern, err))
+		}
+	}
+	// The X509-SVID of the mTLS connection is the selected one only.
+	if len(c.Broker.Identities) > 0 && c.AuthMethod != authMethodJWTSpiffe {
+		errs = append(errs, fmt.Errorf("broker identities require the %s auth method", authMethodJWTSpiffe))
+	}
+	// Anyone reaching the proxy calls the upstream with the workload token.
+	if host, _, err := net.SplitHostPort(c.Proxy.Listen); err != nil || !isLoopback(host) {
+		errs = append(errs, fmt.Errorf("proxy listen address %q must be a loopback host:port", c.Proxy.Listen))
+	}
+	if c.Proxy.Upstream != "" {
+		if u, err := url.Parse(c.Proxy.Upstream); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("proxy upstream %q must be an http or https URL", c.Proxy.Upstream))
+		}
+	}
+	if c.TLS.KeycloakSPIFFEID != "" {
+		if c.TLS.CAFile != "" || c.TLS.CADir != "" {
+			errs = append(errs, errors.New("TLS CA file or directory and Keycloak SPIFFE ID are mutually exclusive"))
+		}
+		if c.TLS.InsecureSkipVerify {
+			errs = append(errs, errors.New("TLS insecure skip verify and Keycloak SPIFFE ID are mutually exclusive"))
+		}
+		if !strings.HasPrefix(c.TLS.KeycloakSPIFFEID, "spiffe://") {
+			errs = append(errs, fmt.Errorf("keycloak SPIFFE ID %q must start with spiffe://", c.TLS.KeycloakSPIFFEID))
+		}
+	}
+	if c.TLS.CAFile != "" {
+		if _, err := os.Stat(c.TLS.CAFile); err != nil {
+			errs = append(errs, fmt.Errorf("TLS CA file: %w", err))
+		}
+	}
+	if c.TLS.CADir != "" {
+		if info, err := os.Stat(c.TLS.CADir); err != nil {
+			errs = append(errs, fmt.Errorf("TLS CA directory: %w", err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("TLS CA directory %s is not a directory", c.TLS.CADir))
+		}
+	}
+	if _, err := tlsVersion(c.TLS.MinVersion); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// isLoopback reports whether host is localhost or a loopback IP.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// expectedIdentity returns the identity the JWT-SVIDs are checked against.
+func (c Config) expectedIdentity() spire.ExpectedIdentity {
+	return spire.ExpectedIdentity{ID: c.ExpectSPIFFEID, TrustDomain: c.TrustDomain}
+}
+
+// primaryAudience returns the audience used for client registration.
+func (c Config) primaryAudience() string {
+	return c.Audience[0]
+}
+
+// selectedTrustDomain returns the trust domain of the workload identity as
+// configured: TrustDomain, else the trust domain of SPIFFEID unless it is a
+// pattern there, else "".
+func (c Config) selectedTrustDomain() string {
+	if c.TrustDomain != "" {
+		return strings.TrimPrefix(c.TrustDomain, "spiffe://")
+	}
+	rest, ok := strings.CutPrefix(c.SPIFFEID, "spiffe://")
+	td, _, _ := strings.Cut(rest, "/")
+	if !ok || strings.ContainsAny(td, "*?[") {
+		return ""
+	}
+	return td
+}
+
+// exactSPIFFEID returns SPIFFEID when it selects a single SPIFFE ID rather
+// than a pattern or a trust domain, else "".
+func (c Config) exactSPIFFEID() string {
+	if strings.ContainsAny(c.SPIFFEID, "*?[") {
+		return ""
+	}
+	if id, err := spiffeid.FromString(c.SPIFFEID); err != nil || id.Path() == "" {
+		return ""
+	}
+	return c.SPIFFEID
+}
+
+// applyTrustDomain applies the Keycloak realm of the selected trust domain,
+// and selects the SVIDs of this trust domain unless SPIFFEID is set.
+func (c *Config) applyTrustDomain() {
+	td := c.selectedTrustDomain()
+	r, ok := c.TrustDomains[td]
+	if !ok {
+		return
+	}
+	if r.KeycloakURL != "" {
+		c.KeycloakURL = r.KeycloakURL
+	}
+	if r.KeycloakSPIFFEID != "" {
+		c.TLS.KeycloakSPIFFEID = r.KeycloakSPIFFEID
+	}
+	if r.Realm != "" {
+		c.Realm = r.Realm
+	}
+	if r.IDPAlias != "" {
+		c.IDPAlias = r.IDPAlias
+	}
+	if len(r.Audience) > 0 {
+		c.Audience = r.Audience
+	}
+	if c.SPIFFEID == "" {
+		c.SPIFFEID = "spiffe://" + td
+	}
+}
+
+// stringList is a list setting given as a comma-separated string or, in
+// YAML, as a sequence. As a flag it may be repeated.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set appends the comma-separated items of v.
+func (l *stringList) Set(v string) error {
+	*l = append(*l, splitList(v)...)
+	return nil
+}
+
+// UnmarshalYAML accepts a single string as well as a sequence.
+func (l *stringList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*l = splitList(node.Value)
+		return nil
+	}
+	var items []string
+	if err := node.Decode(&items); err != nil {
+		return err
+	}
+	*l = items
+	return nil
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// validateScope checks that scope is a space-separated list of RFC 6749
+// scope tokens.
+func validateScope(scope string) error {
+	for _, token := range strings.Fields(scope) {
+		for _, r := range token {
+			if r < 0x21 || r > 0x7e || r == '"' || r == '\\' {
+				return fmt.Errorf("scope %q contains the invalid character %q", token, r)
+			}
+		}
+	}
+	return nil
+}
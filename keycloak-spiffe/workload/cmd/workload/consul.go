@@ -0,0 +1,130 @@
+// consul.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/consul"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/retry"
+)
+
+// runConsulLogin implements the consul-login subcommand: it logs in to a
+// JWT auth method of Consul with the JWT-SVID or the Keycloak access token,
+// and prints the ACL token or writes it to CONSUL_HTTP_TOKEN_FILE. Consul
+// does not renew the tokens of a login, so in daemon mode it logs in again
+// before the token expires and logs the previous token out, and the last
+// one out on exit. A one-shot login leaves the token to its caller.
+func runConsulLogin(args []string) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	setupLogging(cfg)
+	if cfg.Consul.AuthMethod == "" {
+		return errors.New("missing Consul auth method: set CONSUL_AUTH_METHOD")
+	}
+	if err := checkOutput(cfg.Output, ""); err != nil {
+		return &configError{err}
+	}
+	if cfg.Output == "" {
+		cfg.Output = outputRaw
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		return err
+	}
+	defer flushTraces(shutdownTracing)
+	if cfg.Daemon {
+		serveOps(ctx, cfg, nil)
+	}
+
+	bootCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	s, err := openSession(bootCtx, &cfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	client, err := serviceClient(cfg, cfg.Consul.CACert)
+	if err != nil {
+		return err
+	}
+
+	c := cfg.Consul
+	scope := consul.Scope{Namespace: c.Namespace, Partition: c.Partition}
+	var previous string
+	err = keepLoggedIn(ctx, cfg, "Consul login", func(ctx context.Context) (time.Duration, error) {
+		ctx, span := startSpan(ctx, "consul.Login")
+		var token *consul.Token
+		err := cfg.retryPolicyContext(ctx, "Consul login").Do(ctx, func(ctx context.Context) error {
+			jwt, err := s.credential(ctx, c.Credential, c.Audience)
+			if err != nil {
+				return err
+			}
+			token, err = consul.Login(ctx, client, c.Addr, scope, c.AuthMethod, jwt)
+			if err != nil && !consul.IsTransient(err) {
+				return retry.Permanent(err)
+			}
+			return err
+		})
+		endSpan(span, err)
+		if err != nil {
+			failures.WithLabelValues("consul").Inc()
+			return 0, fmt.Errorf("consul login failed: %w", err)
+		}
+		slog.InfoContext(ctx, "Logged in to Consul",
+			"addr", c.Addr,
+			"auth_method", c.AuthMethod,
+			"accessor_id", token.AccessorID,
+			"grants", token.Names(),
+			"lifetime", token.Lifetime().Round(time.Second))
+		if err := writeConsulToken(cfg, token); err != nil {
+			return 0, err
+		}
+
+		// The readers of the token file use the new token from now on.
+		if previous != "" {
+			if err := consul.Logout(ctx, client, c.Addr, scope, previous); err != nil {
+				slog.WarnContext(ctx, "Failed to log the previous Consul token out", "error", err)
+			}
+		}
+		previous = token.SecretID
+		return token.Lifetime(), nil
+	})
+	// The token of a daemon, which may not expire, lives as long as it.
+	if cfg.Daemon && previous != "" {
+		logoutCtx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+		defer cancel()
+		if err := consul.Logout(logoutCtx, client, c.Addr, scope, previous); err != nil {
+			slog.Warn("Failed to log the Consul token out", "error", err)
+		} else {
+			slog.Info("Logged the Consul token out")
+		}
+	}
+	return err
+}
+
+// writeConsulToken writes the ACL token to the token file, replaced
+// atomically, or prints it in the output format.
+func writeConsulToken(cfg Config, token *consul.Token) error {
+	if cfg.Consul.TokenFile != "" {
+		return writeFileAtomic(cfg.Consul.TokenFile, []byte(token.SecretID), 0o600)
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(token.Raw, &doc); err != nil {
+		return fmt.Errorf("decoding the consul token: %w", err)
+	}
+	return writeCredential(os.Stdout, cfg.Output, [][2]string{{"CONSUL_HTTP_TOKEN", token.SecretID}}, doc)
+}
@@ -0,0 +1,182 @@
+// credentials.go
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"gopkg.in/yaml.v3"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/retry"
+)
+
+// Credentials the workload presents to the services it logs in to.
+const (
+	// credentialJWTSVID presents a JWT-SVID for the audience the service
+	// expects.
+	credentialJWTSVID = "jwt-svid"
+	// credentialAccessToken presents the Keycloak access token, for the
+	// services trusting the realm rather than the SPIFFE trust domain.
+	credentialAccessToken = "access-token"
+)
+
+// credential returns the JWT presented to a service: a JWT-SVID for
+// audience, or the Keycloak access token of the workload. The access token
+// exchange retries on its own, so that its failures are permanent for the
+// retries of the login.
+func (s *session) credential(ctx context.Context, kind, audience string) (string, error) {
+	if kind == credentialAccessToken {
+		token, err := s.ex.exchange(ctx)
+		if err != nil {
+			return "", retry.Permanent(fmt.Errorf("obtaining the Keycloak access token: %w", err))
+		}
+		return token.AccessToken, nil
+	}
+	svid, err := fetchJWTSVID(ctx, s.svids, audience)
+	if err != nil {
+		return "", err
+	}
+	return svid.Marshal(), nil
+}
+
+// validCredential checks the credential presented to the service name.
+func validCredential(name, kind string) error {
+	switch kind {
+	case credentialJWTSVID, credentialAccessToken:
+		return nil
+	}
+	return fmt.Errorf("%s credential %q must be %s or %s", name, kind, credentialJWTSVID, credentialAccessToken)
+}
+
+// assertionLifetime returns lifetime, or the time left before the JWT token
+// expires when it is shorter: the lifetime of a login whose credential file
+// holds the token the clients present again.
+func assertionLifetime(lifetime time.Duration, token string) time.Duration {
+	if claims, ok := peekClaims(token); ok && claims.ExpiresAt > 0 {
+		if until := time.Until(time.Unix(claims.ExpiresAt, 0)); until < lifetime {
+			return until
+		}
+	}
+	return lifetime
+}
+
+// hostAllowed reports whether host matches one of the glob patterns, none
+// when there is none: the hosts a credential helper answers for.
+func hostAllowed(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceClient returns the HTTP client of the services the workload logs
+// in to: the system roots, and the CAs of caFile when set, verify them. It
+// presents no client certificate and uses the HTTPS_PROXY and NO_PROXY
+// environment variables.
+func serviceClient(cfg Config, caFile string) (*http.Client, error) {
+	roots, err := keycloakRoots(TLSConfig{CAFile: caFile})
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{RootCAs: roots}
+	if tlsConfig.MinVersion, err = tlsVersion(cfg.TLS.MinVersion); err != nil {
+		return nil, err
+	}
+	var transport http.RoundTripper = &http.Transport{
+		TLSClientConfig: tlsConfig,
+		Proxy:           http.ProxyFromEnvironment,
+	}
+	if cfg.TraceHTTP {
+		transport = &traceTransport{next: transport}
+	}
+	return &http.Client{
+		Timeout:   cfg.HTTPTimeout,
+		Transport: otelhttp.NewTransport(transport),
+	}, nil
+}
+
+// writeCredential prints a credential obtained from a service on w in the
+// output format: doc as json or yaml, vars as dotenv variables, or the value
+// of the first variable alone for raw.
+func writeCredential(w io.Writer, format string, vars [][2]string, doc any) error {
+	var data []byte
+	switch format {
+	case outputJSON:
+		b, err := json.Marshal(doc)
+		if err != nil {
+			return fmt.Errorf("encoding the credential output: %w", err)
+		}
+		data = append(b, '\n')
+	case outputYAML:
+		b, err := yaml.Marshal(doc)
+		if err != nil {
+			return fmt.Errorf("encoding the credential output: %w", err)
+		}
+		data = append([]byte("---\n"), b...)
+	case outputEnv:
+		var b strings.Builder
+		for _, v := range vars {
+			fmt.Fprintf(&b, "%s='%s'\n", v[0], strings.ReplaceAll(v[1], "'", `'\''`))
+		}
+		data = []byte(b.String())
+	default:
+		data = []byte(vars[0][1] + "\n")
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("writing the credential output: %w", err)
+	}
+	return nil
+}
+
+// keepLoggedIn runs login and, in daemon mode, runs it again once the
+// renew threshold of the lifetime it returns has elapsed, the retry
+// interval after a failure, until ctx is cancelled. Each login is bounded
+// by the timeout. Without daemon mode a failed login is returned.
+func keepLoggedIn(ctx context.Context, cfg Config, what string, login func(ctx context.Context) (time.Duration, error)) error {
+	run := func() (time.Duration, error) {
+		ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+		ctx, _ = withRequestID(ctx)
+		return login(ctx)
+	}
+	lifetime, err := run()
+	if !cfg.Daemon || err != nil {
+		return err
+	}
+	if err := sdNotify("READY=1\nSTATUS=" + what + " done"); err != nil {
+		slog.Warn("Failed to notify systemd", "error", err)
+	}
+	for {
+		wait := cfg.RetryInterval
+		switch {
+		case err != nil:
+			slog.Warn(what+" failed, retrying", "in", wait, "error", err)
+		case lifetime <= 0:
+			slog.Info("The credential does not expire, no renewal needed", "what", what)
+			<-ctx.Done()
+			return nil
+		default:
+			wait = time.Duration(float64(lifetime) * cfg.RenewThreshold)
+			slog.Info("Next renewal scheduled", "what", what, "in", wait.Round(time.Second))
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+		lifetime, err = run()
+	}
+}
@@ -0,0 +1,258 @@
+// daemon.go
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/spire"
+)
+
+// shutdownTimeout bounds the revocation of the tokens when the daemon
+// stops.
+const shutdownTimeout = 10 * time.Second
+
+// issuedToken is an access token, the time it was issued and why.
+type issuedToken struct {
+	*keycloak.TokenResponse
+	issuedAt time.Time
+	// reason is reasonInitial, reasonCached, reasonRenewal or the kind of
+	// the SVID rotation the token was obtained after.
+	reason string
+}
+
+// daemon keeps a valid access token per audience by authenticating again
+// to Keycloak before the current tokens expire.
+type daemon struct {
+	cfg   Config
+	ex    *exchanger
+	state *daemonState
+	cache *tokenCache
+	// sinks are the configured token outputs, replaced on reload.
+	sinks []tokenSink
+	// servers are the sinks of the APIs serving the tokens, kept across
+	// reloads.
+	servers []tokenSink
+	// tokens holds the current token per audience, missing the audiences
+	// without a valid token.
+	tokens map[string]issuedToken
+	// rotations renews every token when the SPIRE Agent rotates the SVIDs
+	// or the trust bundles, nil to renew on schedule only.
+	rotations <-chan spire.Rotation
+	// reloads applies the reloaded configurations, nil when the
+	// configuration is not reloaded.
+	reloads <-chan Config
+	// notified is set once systemd is told the daemon is ready.
+	notified bool
+	// alerts tracks the failed refreshes for the alert webhook.
+	alerts alerts
+}
+
+// setToken records token as the current token for audience and hands it
+// to the sinks.
+func (d *daemon) setToken(ctx context.Context, audience string, token issuedToken) {
+	d.tokens[audience] = token
+	d.state.setToken(audience, token.TokenResponse, token.issuedAt)
+	d.cache.store(audience, token)
+	d.writeToken(ctx, audience, token)
+	if !d.notified {
+		d.notified = true
+		if err := sdNotify("READY=1\nSTATUS=Serving access tokens"); err != nil {
+			slog.Warn("Failed to notify systemd", "error", err)
+		}
+	}
+}
+
+// writeToken hands the token of audience to the sinks, the renew hook last
+// so that it runs once the output and sidecar sinks of the servers have the
+// token too.
+func (d *daemon) writeToken(ctx context.Context, audience string, token issuedToken) {
+	write := func(sink tokenSink) {
+		if err := sink.writeToken(ctx, audience, token); err != nil {
+			failures.WithLabelValues("sink").Inc()
+			slog.Warn("Failed to write the token", "audience", audience, "error", err)
+		}
+	}
+	var hooks []tokenSink
+	for _, sinks := range [][]tokenSink{d.sinks, d.servers} {
+		for _, sink := range sinks {
+			if _, ok := sink.(*hookSink); ok {
+				hooks = append(hooks, sink)
+				continue
+			}
+			write(sink)
+		}
+	}
+	for _, hook := range hooks {
+		write(hook)
+	}
+}
+
+// run refreshes the tokens until ctx is cancelled. It fails once the SPIRE
+// Agent has been unreachable for longer than the grace period.
+//
+// A refresh in progress when ctx is cancelled completes, so that the sinks
+// are not left half written; the tokens are then revoked when configured.
+func (d *daemon) run(ctx context.Context) error {
+	work := context.WithoutCancel(ctx)
+	slog.Info("Daemon mode: refreshing the access tokens before expiry",
+		"renew_threshold", d.cfg.RenewThreshold,
+		"audiences", len(d.cfg.Audience))
+
+	wait := d.nextRefresh()
+	for {
+		slog.Info("Next token refresh scheduled", "in", wait.Round(time.Second))
+		d.state.scheduled(wait, d.cfg.Timeout)
+		timer := time.NewTimer(wait)
+		reason := reasonRenewal
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			d.stop()
+			return nil
+		case <-timer.C:
+		case r := <-d.rotations:
+			timer.Stop()
+			// Tokens bound to the previous X509-SVID are unusable, and
+			// the others were issued for superseded credentials.
+			slog.Info("Renewing the tokens after a rotation", "kind", r.Kind, "id", r.ID)
+			reason = r.Kind + "-rotation"
+		case next := <-d.reloads:
+			timer.Stop()
+			if err := d.reload(work, next); err != nil {
+				configReloads.WithLabelValues("failed").Inc()
+				slog.Warn("Failed to apply the reloaded configuration, keeping the current one", "error", err)
+			} else {
+				configReloads.WithLabelValues("applied").Inc()
+			}
+			reason = reasonReload
+		}
+
+		d.retryKeycloakPath(work)
+		for _, audience := range d.cfg.Audience {
+			if ctx.Err() != nil {
+				break
+			}
+			if (reason == reasonRenewal || reason == reasonReload) && d.renewAfter(audience) > 0 {
+				continue
+			}
+			rctx, _ := withRequestID(work)
+			token, err := d.refreshToken(rctx, audience, reason)
+			if err != nil {
+				d.keepToken(rctx, audience, err)
+				continue
+			}
+			slog.InfoContext(rctx, "Token refreshed", "audience", audience, "expires_in", token.ExpiresIn)
+			d.alerts.refreshed(rctx, d.cfg, audience)
+			d.setToken(work, audience, token)
+			if d.state.degradation() != nil {
+				d.state.checkSPIRE(work)
+			}
+		}
+		if err := d.state.failed(); err != nil {
+			return err
+		}
+		wait = d.nextRefresh()
+	}
+}
+
+// stop notifies systemd and, with RevokeOnExit, revokes the tokens held.
+func (d *daemon) stop() {
+	sdNotify("STOPPING=1")
+	if d.cfg.RevokeOnExit {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		d.revokeTokens(ctx)
+		cancel()
+	}
+	slog.Info("Daemon stopped")
+}
+
+// revokeTokens revokes the tokens held at Keycloak so that they do not
+// outlive the workload, and drops them from the token cache so that a
+// restarted daemon does not resume with them.
+func (d *daemon) revokeTokens(ctx context.Context) {
+	for audience, token := range d.tokens {
+		if err := d.ex.revoke(ctx, audience, token.TokenResponse); err != nil {
+			failures.WithLabelValues(errorClass(err)).Inc()
+			slog.Warn("Failed to revoke the token", "audience", audience, "error", err)
+			continue
+		}
+		delete(d.tokens, audience)
+		d.cache.remove(audience)
+		slog.Info("Token revoked", "audience", audience)
+	}
+}
+
+// keepToken handles the failed refresh of the token of audience: the
+// token is kept until it expires, so that an outage of the SPIRE Agent
+// does not interrupt the callers. The logs carry the request ID of rctx.
+func (d *daemon) keepToken(rctx context.Context, audience string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	d.state.checkSPIRE(ctx)
+	cancel()
+	token, ok := d.tokens[audience]
+	var expiry time.Time
+	if ok && token.ExpiresIn > 0 {
+		expiry = token.issuedAt.Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	d.alerts.refreshFailed(rctx, d.cfg, audience, expiry, err)
+	if !ok {
+		slog.WarnContext(rctx, "Token refresh failed", "audience", audience, "error", err)
+		return
+	}
+	if !expiry.IsZero() {
+		if time.Now().After(expiry) {
+			slog.WarnContext(rctx, "Token refresh failed, the previous token expired", "audience", audience, "expired_at", expiry.UTC(), "error", err)
+			delete(d.tokens, audience)
+			return
+		}
+		slog.WarnContext(rctx, "Token refresh failed, keeping the previous token", "audience", audience, "expires_at", expiry.UTC(), "error", err)
+		return
+	}
+	slog.WarnContext(rctx, "Token refresh failed, keeping the previous token", "audience", audience, "error", err)
+}
+
+// refreshToken obtains a new access token for audience within the
+// configured timeout.
+func (d *daemon) refreshToken(ctx context.Context, audience, reason string) (issuedToken, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.cfg.Timeout)
+	defer cancel()
+	issuedAt := time.Now()
+	token, err := d.ex.exchangeAudience(ctx, audience)
+	return issuedToken{TokenResponse: token, issuedAt: issuedAt, reason: reason}, err
+}
+
+// nextRefresh returns how long to wait before renewing the earliest token,
+// the retry interval when an audience has no token.
+func (d *daemon) nextRefresh() time.Duration {
+	var wait time.Duration
+	for i, audience := range d.cfg.Audience {
+		if w := d.renewAfter(audience); i == 0 || w < wait {
+			wait = w
+		}
+	}
+	if wait <= 0 {
+		return d.cfg.RetryInterval
+	}
+	return wait
+}
+
+// renewAfter returns how long to wait before renewing the token of
+// audience, zero when it is due or missing.
+func (d *daemon) renewAfter(audience string) time.Duration {
+	token, ok := d.tokens[audience]
+	if !ok {
+		return 0
+	}
+	lifetime := time.Duration(token.ExpiresIn) * time.Second
+	if lifetime <= 0 {
+		return d.cfg.RetryInterval
+	}
+	renewAt := token.issuedAt.Add(time.Duration(float64(lifetime) * d.cfg.RenewThreshold))
+	if wait := time.Until(renewAt); wait > 0 {
+		return wait
+	}
+	return 0
+}
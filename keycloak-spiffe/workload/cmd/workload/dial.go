@@ -0,0 +1,100 @@
+// dial.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dialer opens the connections to Keycloak. Resolve overrides, written as
+// curl --resolve host:port:addr, send the connections for host:port, or
+// host:* for any port, to addr without resolving host; the TLS server name
+// and the Host header are unchanged. DNSServer, when set, resolves the other
+// host names instead of the system resolver.
+type dialer struct {
+	net.Dialer
+	// overrides maps host:port and host:* to the addresses dialed instead.
+	overrides map[string][]string
+}
+
+// newDialer returns the dialer of the Keycloak connections of cfg.
+func newDialer(cfg Config) (*dialer, error) {
+	d := &dialer{
+		Dialer:    net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+		overrides: map[string][]string{},
+	}
+	if cfg.DNSServer != "" {
+		server := cfg.DNSServer
+		d.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var nd net.Dialer
+				return nd.DialContext(ctx, network, server)
+			},
+		}
+	}
+	for _, entry := range cfg.Resolve {
+		host, port, addr, err := parseResolve(entry)
+		if err != nil {
+			return nil, err
+		}
+		key := net.JoinHostPort(host, port)
+		d.overrides[key] = append(d.overrides[key], addr)
+	}
+	return d, nil
+}
+
+// parseResolve splits a host:port:addr resolve entry. port is a number or
+// * for any port, addr an IP address, bracketed for IPv6, or a host name.
+func parseResolve(entry string) (host, port, addr string, err error) {
+	host, rest, ok := strings.Cut(entry, ":")
+	if ok {
+		port, addr, ok = strings.Cut(rest, ":")
+	}
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	if !ok || host == "" || addr == "" {
+		return "", "", "", fmt.Errorf("resolve %q must be host:port:addr", entry)
+	}
+	if n, err := strconv.Atoi(port); port != "*" && (err != nil || n < 1 || n > 65535) {
+		return "", "", "", fmt.Errorf("resolve %q: port %q must be a number or *", entry, port)
+	}
+	return strings.ToLower(host), port, addr, nil
+}
+
+// lookup returns the override addresses of address, nil when it is not
+// overridden.
+func (d *dialer) lookup(address string) []string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil
+	}
+	host = strings.ToLower(host)
+	if addrs, ok := d.overrides[net.JoinHostPort(host, port)]; ok {
+		return addrs
+	}
+	return d.overrides[net.JoinHostPort(host, "*")]
+}
+
+// DialContext connects to the override addresses of address in turn, or to
+// address itself when it is not overridden.
+func (d *dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	addrs := d.lookup(address)
+	if addrs == nil {
+		return d.Dialer.DialContext(ctx, network, address)
+	}
+	_, port, _ := net.SplitHostPort(address)
+	var errs []error
+	for _, addr := range addrs {
+		conn, err := d.Dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, fmt.Errorf("dialing the resolve overrides of %s: %w", address, errors.Join(errs...))
+}
@@ -0,0 +1,131 @@
+// docker.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// dockerHelperPrefix is the prefix of the names Docker runs the
+// credential helpers of credHelpers and credsStore under: the workload
+// run as docker-credential-keycloak is the helper keycloak.
+const dockerHelperPrefix = "docker-credential-"
+
+// errDockerNotFound is the message Docker reads as no credentials for the
+// registry, falling back to anonymous access.
+const errDockerNotFound = "credentials not found in native keychain"
+
+// dockerCredentials is the answer of get in the credential helper protocol.
+type dockerCredentials struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// runDockerCredential implements the docker-credential subcommand, the
+// Docker credential helper protocol: docker-credential <get|store|erase|list>
+// with the request on stdin. get answers the Keycloak access token, or a
+// JWT-SVID, of the workload as the password of the configured registries.
+// The credentials come from the SPIFFE identity, so store and erase keep
+// nothing. The configuration comes from CONFIG_FILE and the environment,
+// Docker passing no flags. A failure is written on stdout, where Docker
+// reads it.
+func runDockerCredential(args []string) error {
+	if err := dockerCredential(args, os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stdout, err)
+		return &exitCodeError{code: exitFailure}
+	}
+	return nil
+}
+
+func dockerCredential(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return errors.New("missing docker-credential action: get, store, erase or list")
+	}
+	action := args[0]
+	cfg, err := loadConfig(args[1:])
+	if err != nil {
+		return err
+	}
+	setupLogging(cfg)
+	dc := cfg.Docker
+
+	switch action {
+	case "store", "erase":
+		// docker login and logout succeed without changing anything.
+		_, err := io.Copy(io.Discard, stdin)
+		return err
+	case "list":
+		registries := make(map[string]string, len(dc.Registries))
+		for _, r := range dc.Registries {
+			registries[r] = dc.Username
+		}
+		return json.NewEncoder(stdout).Encode(registries)
+	case "get":
+	default:
+		return fmt.Errorf("unknown docker-credential action %q (available: get, store, erase, list)", action)
+	}
+
+	data, err := io.ReadAll(stdin)
+	if err != nil {
+		return err
+	}
+	serverURL := strings.TrimSpace(string(data))
+	if len(dc.Registries) == 0 {
+		// Installed as credsStore, the helper is asked about every
+		// registry: the token only goes to those named.
+		slog.Warn("No registry configured, no credentials (set DOCKER_REGISTRIES)", "server_url", serverURL)
+		return errors.New(errDockerNotFound)
+	}
+	if !dockerRegistryAllowed(dc.Registries, serverURL) {
+		slog.Debug("Registry not configured, no credentials", "server_url", serverURL)
+		return errors.New(errDockerNotFound)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+	s, err := openSession(ctx, &cfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	token, err := s.credential(ctx, dc.Credential, dc.Audience)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(stdout).Encode(dockerCredentials{
+		ServerURL: serverURL,
+		Username:  dc.Username,
+		Secret:    token,
+	})
+}
+
+// dockerRegistryAllowed reports whether the host of serverURL matches one
+// of the glob patterns of registries.
+func dockerRegistryAllowed(registries []string, serverURL string) bool {
+	patterns := make([]string, len(registries))
+	for i, r := range registries {
+		patterns[i] = dockerRegistryHost(r)
+	}
+	return hostAllowed(patterns, dockerRegistryHost(serverURL))
+}
+
+// dockerRegistryHost returns the host of a registry given as Docker does,
+// a host with or without a scheme and a path: https://index.docker.io/v1/
+// or registry.example.com:5000.
+func dockerRegistryHost(registry string) string {
+	if strings.Contains(registry, "://") {
+		if u, err := url.Parse(registry); err == nil {
+			return strings.ToLower(u.Host)
+		}
+	}
+	host, _, _ := strings.Cut(registry, "/")
+	return strings.ToLower(host)
+}
@@ -0,0 +1,262 @@
+// doctor.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/spire"
+)
+
+// doctorCheckTimeout bounds each check, so that an agent issuing no SVID
+// does not leave the checks after it without time.
+const doctorCheckTimeout = 15 * time.Second
+
+// runDoctor implements the doctor subcommand: it checks each step the
+// workload depends on, from the SPIRE Agent socket to a token exchange with
+// Keycloak, and prints a pass/fail report with remediation hints. The token
+// obtained is discarded. It fails with the class of the first failed check.
+func runDoctor(args []string) error {
+	r := &doctorReport{w: os.Stdout}
+	cfg, err := loadConfig(args)
+	if !r.check("Configuration", true, func(context.Context) (string, error) {
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("keycloak %s, realm %s, auth method %s", cfg.KeycloakURL, cfg.Realm, cfg.AuthMethod), nil
+	}, func(error) string {
+		return "fix the flag, environment variable or configuration file setting named above, see -h"
+	}) {
+		return r.result()
+	}
+	setupLogging(cfg)
+
+	socketOK := r.check("SPIRE Agent socket", true, func(ctx context.Context) (string, error) {
+		if err := spire.CheckSocket(ctx, cfg.SocketPath); err != nil {
+			return "", &spireError{err}
+		}
+		return cfg.SocketPath + " accepts connections", nil
+	}, func(error) string {
+		return "start the SPIRE Agent, or point SPIFFE_ENDPOINT_SOCKET (-socket-path) at its Workload API socket and check that the socket is mounted in the container"
+	})
+
+	var x509Source *workloadapi.X509Source
+	x509OK := r.check("X509-SVID", socketOK, func(ctx context.Context) (string, error) {
+		var err error
+		if x509Source, err = spire.NewX509Source(ctx, cfg.SocketPath, cfg.SPIFFEID); err != nil {
+			return "", &svidError{err}
+		}
+		svid, err := x509Source.GetX509SVID()
+		if err != nil {
+			return "", &svidError{err}
+		}
+		return fmt.Sprintf("%s, expires %s", svid.ID, svid.Certificates[0].NotAfter.UTC().Format(time.RFC3339)), nil
+	}, svidHint(cfg))
+	if x509Source != nil {
+		defer x509Source.Close()
+	}
+
+	var jwtSource *workloadapi.JWTSource
+	var svids spire.JWTSVIDSource
+	jwtOK := r.check("JWT-SVID", socketOK, func(ctx context.Context) (string, error) {
+		var err error
+		if jwtSource, err = spire.NewJWTSource(ctx, cfg.SocketPath); err != nil {
+			return "", &svidError{err}
+		}
+		svids = jwtSVIDs(cfg, jwtSource)
+		svid, err := fetchJWTSVID(ctx, svids, cfg.primaryAudience())
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s for audience %s, expires %s", svid.ID, cfg.primaryAudience(), svid.Expiry.UTC().Format(time.RFC3339)), nil
+	}, svidHint(cfg))
+	if jwtSource != nil {
+		defer jwtSource.Close()
+	}
+
+	u, _ := url.Parse(cfg.KeycloakURL) // validate already parsed it.
+	// Through a proxy, the network checks are those of the proxy.
+	target, via := u, ""
+	if egress, err := newEgressProxy(cfg); err == nil {
+		if proxyURL, err := egress.Proxy(&http.Request{URL: u}); err == nil && proxyURL != nil {
+			target, via = proxyURL, " (proxy)"
+		}
+	}
+	host, port := target.Hostname(), target.Port()
+	if port == "" {
+		port = "443"
+		if target.Scheme == "http" {
+			port = "80"
+		}
+	}
+	d, _ := newDialer(cfg) // validate already parsed the overrides.
+	d.Timeout = cfg.HTTPTimeout
+	resolved := r.check("Keycloak DNS", true, func(ctx context.Context) (string, error) {
+		if addrs := d.lookup(net.JoinHostPort(host, port)); addrs != nil {
+			return host + via + " overridden to " + strings.Join(addrs, ", ") + " by RESOLVE", nil
+		}
+		resolver := net.DefaultResolver
+		if d.Resolver != nil {
+			resolver = d.Resolver
+		}
+		addrs, err := resolver.LookupHost(ctx, host)
+		if err != nil {
+			return "", err
+		}
+		return host + via + " resolves to " + strings.Join(addrs, ", "), nil
+	}, func(error) string {
+		return "check the host of KEYCLOAK_URL (-keycloak-url) and the DNS configuration of this host or pod, or map it with RESOLVE=host:port:addr"
+	})
+
+	connected := r.check("Keycloak connection", resolved, func(ctx context.Context) (string, error) {
+		conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			return "", err
+		}
+		conn.Close()
+		return net.JoinHostPort(host, port) + via + " accepts connections", nil
+	}, func(error) string {
+		if via != "" {
+			return "check KEYCLOAK_PROXY or HTTPS_PROXY, and that no firewall or network policy blocks the proxy"
+		}
+		return "check that Keycloak is running and listening on this port, and that no firewall or network policy blocks the workload, or set the egress proxy with KEYCLOAK_PROXY"
+	})
+
+	var client *http.Client
+	var endpoints *keycloak.ProviderMetadata
+	r.check("Realm discovery document", connected && x509OK, func(ctx context.Context) (string, error) {
+		var err error
+		if client, err = httpClient(cfg, x509Source); err != nil {
+			return "", err
+		}
+		resolveKeycloakPath(ctx, &cfg, client)
+		issuer := cfg.realmURL()
+		md, err := keycloak.Discover(ctx, client, issuer)
+		if err != nil {
+			return "", err
+		}
+		if md.Issuer != issuer {
+			return "", fmt.Errorf("issuer %s, want %s", md.Issuer, issuer)
+		}
+		if md.JWKSURI == "" {
+			return "", errors.New("discovery document has no jwks_uri")
+		}
+		endpoints = md
+		return "token endpoint " + md.TokenEndpoint, nil
+	}, discoveryHint)
+
+	// The workload falls back to the conventional paths without discovery.
+	r.check("Token exchange", client != nil && jwtOK, func(ctx context.Context) (string, error) {
+		if endpoints == nil || !cfg.Discovery {
+			endpoints = keycloak.StaticRealmMetadata(cfg.realmURL())
+		}
+		ex, err := newExchanger(cfg, client, endpoints, svids, x509SVIDSource(x509Source))
+		if err != nil {
+			return "", err
+		}
+		token, err := ex.exchange(ctx)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s token for %s, expires in %ds, scope %q (discarded)", token.TokenType, cfg.primaryAudience(), token.ExpiresIn, token.Scope), nil
+	}, exchangeHint(cfg))
+
+	return r.result()
+}
+
+// doctorReport prints the result of each check as it runs.
+type doctorReport struct {
+	w      io.Writer
+	failed int
+	// first is the error of the first failed check.
+	first error
+}
+
+// check runs the check name unless one it depends on failed, as reported
+// by ready, and prints its result. It reports whether the check passed.
+func (r *doctorReport) check(name string, ready bool, run func(ctx context.Context) (string, error), hint func(error) string) bool {
+	if !ready {
+		fmt.Fprintf(r.w, "[SKIP] %s: a check it depends on failed\n", name)
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), doctorCheckTimeout)
+	defer cancel()
+	detail, err := run(ctx)
+	if err != nil {
+		r.failed++
+		if r.first == nil {
+			r.first = err
+		}
+		fmt.Fprintf(r.w, "[FAIL] %s: %v\n       hint: %s\n", name, err, hint(err))
+		return false
+	}
+	fmt.Fprintf(r.w, "[PASS] %s: %s\n", name, detail)
+	return true
+}
+
+// result returns nil when every check passed.
+func (r *doctorReport) result() error {
+	if r.failed == 0 {
+		fmt.Fprintln(r.w, "All checks passed")
+		return nil
+	}
+	return fmt.Errorf("%d check(s) failed: %w", r.failed, r.first)
+}
+
+// svidHint returns the remediation of a failed SVID fetch.
+func svidHint(cfg Config) func(error) string {
+	return func(err error) string {
+		switch {
+		case errors.Is(err, spire.ErrUnexpectedIdentity):
+			return "the SVID does not have the identity set by EXPECT_SPIFFE_ID or TRUST_DOMAIN, check the registration entries matching this workload"
+		case errors.Is(err, spire.ErrNoMatchingSVID):
+			return "no SVID of this workload matches SPIFFE_ID " + cfg.SPIFFEID + ", check the pattern and the registration entries"
+		}
+		return "the agent issued no SVID to this workload: check that a registration entry matches its selectors (spire-server entry show) and that the agent is attested"
+	}
+}
+
+// discoveryHint returns the remediation of a failed discovery.
+func discoveryHint(err error) string {
+	switch {
+	case isTLSError(err):
+		return "the TLS handshake failed: set TLS_CA_FILE to the CA of the Keycloak certificate, TLS_SERVER_NAME to a name it holds, or TLS_KEYCLOAK_SPIFFE_ID for an X509-SVID"
+	case strings.Contains(err.Error(), "HTTP 404"):
+		return "the realm does not exist at this path, check REALM (-realm) and LEGACY_PATH (-legacy-path, true for the /auth prefix of Keycloak up to 16)"
+	case strings.Contains(err.Error(), "issuer"):
+		return "Keycloak advertises another issuer than KEYCLOAK_URL: align KC_HOSTNAME and KEYCLOAK_URL, or the issued tokens will not validate"
+	}
+	return "check that KEYCLOAK_URL points at Keycloak and not at a proxy answering for it"
+}
+
+// exchangeHint returns the remediation of a failed token exchange.
+func exchangeHint(cfg Config) func(error) string {
+	return func(err error) string {
+		var tokenErr *keycloak.TokenError
+		if errors.As(err, &tokenErr) {
+			switch {
+			case tokenErr.Code == "invalid_client":
+				return "Keycloak does not know the client or rejected its credentials: run the workload once to register it, and check the " + cfg.IDPAlias + " identity provider and the JWT-SVID audience (AUDIENCE)"
+			case tokenErr.Code == "unauthorized_client":
+				return "enable the service accounts (client credentials grant) of the client"
+			case tokenErr.StatusCode >= 500:
+				return "Keycloak failed to process the request, check its logs"
+			}
+		}
+		if isTLSError(err) {
+			return "Keycloak refused the client certificate: check that the realm trusts the SPIRE bundle for mutual TLS"
+		}
+		return "run the workload with LOG_LEVEL=debug to see the Keycloak response"
+	}
+}
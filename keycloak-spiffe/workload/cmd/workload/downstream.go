@@ -0,0 +1,74 @@
+// downstream.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+)
+
+// runDownstreamToken implements the downstream-token subcommand: it obtains
+// the access token of the workload and exchanges it for a token intended for
+// the clients DOWNSTREAM_AUDIENCE, printed on stdout, so that service A calls
+// service B with a token whose aud is B.
+func runDownstreamToken(args []string) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	setupLogging(cfg)
+	if len(cfg.Downstream.Audience) == 0 {
+		return errors.New("missing audience of the downstream token: set DOWNSTREAM_AUDIENCE")
+	}
+	if err := checkOutput(cfg.Output, outputExecCredential); err != nil {
+		return &configError{err}
+	}
+	if cfg.Output == "" {
+		cfg.Output = outputRaw
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	ctx, _ = withRequestID(ctx)
+	defer cancel()
+
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		return err
+	}
+	defer flushTraces(shutdownTracing)
+
+	s, err := openSession(ctx, &cfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	subject, err := s.ex.exchange(ctx)
+	if err != nil {
+		return fmt.Errorf("obtaining subject access token: %w", err)
+	}
+	token, spiffeID, err := s.tokenExchange(ctx, cfg, keycloak.TokenExchangeRequest{
+		SubjectToken:       subject.AccessToken,
+		SubjectTokenType:   keycloak.TokenTypeAccessToken,
+		RequestedTokenType: keycloak.TokenTypeAccessToken,
+		Audience:           cfg.Downstream.Audience,
+		Scope:              cfg.Downstream.Scope,
+	})
+	if err != nil {
+		return err
+	}
+
+	audience := strings.Join(cfg.Downstream.Audience, " ")
+	slog.InfoContext(ctx, "Downstream token issued",
+		"audience", audience,
+		"expires_in", token.ExpiresIn,
+		"scope", token.Scope)
+	issued := issuedToken{TokenResponse: token, issuedAt: time.Now(), reason: reasonInitial}
+	return newOutputSink(cfg, os.Stdout, spiffeID).writeToken(ctx, audience, issued)
+}
@@ -0,0 +1,83 @@
+// dryrun.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/spire"
+)
+
+// dryRun writes to w the token request of each audience as the workload
+// would send it, without calling Keycloak: the endpoint is the
+// conventional one, discovery being a Keycloak call too. The client
+// assertions are redacted unless ShowSecrets is set; their claims, which
+// are not secret, are printed decoded.
+func dryRun(ctx context.Context, w io.Writer, cfg Config, client *http.Client, jwtSource spire.JWTSVIDSource, x509Source x509svid.Source) error {
+	endpoints := keycloak.StaticRealmMetadata(cfg.realmURL())
+	ex, err := newExchanger(cfg, client, endpoints, jwtSource, x509Source)
+	if err != nil {
+		return err
+	}
+	if cfg.ShowSecrets {
+		slog.Warn("Printing the client assertions: they authenticate the workload until they expire")
+	}
+
+	for _, audience := range cfg.Audience {
+		auth, err := ex.clientAuth(ctx, audience)
+		if err != nil {
+			return err
+		}
+		form := keycloak.ClientCredentialsForm(auth, ex.tokenParams()...)
+
+		fmt.Fprintf(w, "# Token request for audience %s (auth method %s, not sent)\n", audience, cfg.AuthMethod)
+		fmt.Fprintf(w, "POST %s\n", endpoints.TokenEndpoint)
+		fmt.Fprintln(w, "Content-Type: application/x-www-form-urlencoded")
+		fmt.Fprintln(w, "Accept: application/json")
+		if cfg.DPoP != "" {
+			dpop, err := ex.dpopTransport()
+			if err != nil {
+				return err
+			}
+			proof, err := dpop.Key().Proof(http.MethodPost, endpoints.TokenEndpoint, "", "")
+			if err != nil {
+				return err
+			}
+			if !cfg.ShowSecrets {
+				proof = redact(proof)
+			}
+			fmt.Fprintf(w, "DPoP: %s\n", proof)
+		}
+		fmt.Fprintln(w)
+		keys := make([]string, 0, len(form))
+		for key := range form {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := form.Get(key)
+			if secretKeys[key] && !cfg.ShowSecrets {
+				value = redact(value)
+			}
+			fmt.Fprintf(w, "%s=%s\n", key, value)
+		}
+		if assertion := form.Get("client_assertion"); assertion != "" {
+			if parts := strings.Split(assertion, "."); len(parts) == 3 {
+				if payload, err := decodeSegment(parts[1]); err == nil {
+					fmt.Fprintln(w, "\n# Client assertion claims")
+					writeIndented(w, payload)
+				}
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
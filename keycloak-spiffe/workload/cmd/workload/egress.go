@@ -0,0 +1,110 @@
+// egress.go
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// proxyDirect disables the proxies of the environment.
+const proxyDirect = "direct"
+
+// egressProxy selects the HTTP proxy of the Keycloak requests: KeycloakProxy
+// when set, else HTTPS_PROXY, HTTP_PROXY and NO_PROXY. The connection to an
+// https:// proxy is secured by its dial function rather than by the
+// transport, whose TLS configuration only trusts Keycloak: the transport
+// sees a plain proxy and tunnels the Keycloak TLS session with CONNECT over
+// the TLS connection to the proxy.
+type egressProxy struct {
+	proxy     func(*http.Request) (*url.URL, error)
+	tlsConfig *tls.Config
+
+	mu sync.Mutex
+	// tlsAddrs holds the host:port of the https:// proxies seen.
+	tlsAddrs map[string]bool
+}
+
+// newEgressProxy returns the proxy selection of cfg.
+func newEgressProxy(cfg Config) (*egressProxy, error) {
+	p := &egressProxy{proxy: http.ProxyFromEnvironment, tlsAddrs: map[string]bool{}}
+	switch cfg.KeycloakProxy {
+	case "":
+	case proxyDirect:
+		p.proxy = nil
+	default:
+		u, err := url.Parse(cfg.KeycloakProxy)
+		if err != nil {
+			return nil, fmt.Errorf("parsing Keycloak proxy URL: %w", err)
+		}
+		p.proxy = http.ProxyURL(u)
+	}
+	p.tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.KeycloakProxyCAFile != "" {
+		pem, err := os.ReadFile(cfg.KeycloakProxyCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading Keycloak proxy CA file: %w", err)
+		}
+		p.tlsConfig.RootCAs = x509.NewCertPool()
+		if !p.tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", cfg.KeycloakProxyCAFile)
+		}
+	}
+	return p, nil
+}
+
+// Proxy returns the proxy of req, an https:// one being returned as http://
+// with its port and remembered for dial.
+func (p *egressProxy) Proxy(req *http.Request) (*url.URL, error) {
+	if p.proxy == nil {
+		return nil, nil
+	}
+	u, err := p.proxy(req)
+	if err != nil || u == nil || u.Scheme != "https" {
+		return u, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	plain := *u
+	plain.Scheme = "http"
+	plain.Host = net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+	p.mu.Lock()
+	p.tlsAddrs[plain.Host] = true
+	p.mu.Unlock()
+	return &plain, nil
+}
+
+// dial returns the dial function of the transport: next, with a TLS
+// handshake on the connections to an https:// proxy.
+func (p *egressProxy) dial(next func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := next(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		p.mu.Lock()
+		secure := p.tlsAddrs[address]
+		p.mu.Unlock()
+		if !secure {
+			return conn, nil
+		}
+		host, _, _ := net.SplitHostPort(address)
+		cfg := p.tlsConfig.Clone()
+		cfg.ServerName = host
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with the proxy %s: %w", address, err)
+		}
+		return tlsConn, nil
+	}
+}
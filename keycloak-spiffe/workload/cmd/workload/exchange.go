@@ -0,0 +1,370 @@
+// exchange.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/retry"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/spire"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/tokenauth"
+)
+
+const (
+	// authMethodJWTSpiffe authenticates with a JWT-SVID client assertion.
+	authMethodJWTSpiffe = "jwt-spiffe"
+	// authMethodTLSClientAuth authenticates with the X509-SVID of the mTLS
+	// connection (RFC 8705) and obtains certificate-bound tokens.
+	authMethodTLSClientAuth = "tls_client_auth"
+	// authMethodPrivateKeyJWT authenticates with an RFC 7523 client assertion
+	// signed with the X509-SVID private key.
+	authMethodPrivateKeyJWT = "private_key_jwt"
+	// authMethodNomad authenticates with the Nomad workload identity of the
+	// task as RFC 7523 client assertion, for Nomad tasks without SPIRE.
+	authMethodNomad = "nomad"
+)
+
+const (
+	// dpopMemory binds the tokens to a DPoP key generated at startup.
+	dpopMemory = "memory"
+	// dpopX509SVID binds the tokens to the X509-SVID key, which the other
+	// processes of the workload can sign proofs with too.
+	dpopX509SVID = "x509-svid"
+)
+
+// exchanger obtains access tokens with the configured client authentication method.
+type exchanger struct {
+	cfg           Config
+	client        *http.Client
+	jwtSource     spire.JWTSVIDSource
+	x509Source    x509svid.Source
+	tokenEndpoint string
+	// endpoints are the realm endpoints tokenEndpoint was taken from.
+	endpoints *keycloak.ProviderMetadata
+	clientID  string
+	// verifier checks the issued access tokens, nil unless VerifyToken is
+	// enabled.
+	verifier *tokenauth.Verifier
+
+	// dpop signs the DPoP proofs of the token requests, nil unless DPoP is
+	// enabled. With x509-svid it follows the SVID rotations.
+	dpopMu sync.Mutex
+	dpop   *keycloak.DPoPTransport
+}
+
+// verifyLeeway tolerates the clock skew between the workload and Keycloak
+// when the issued tokens are verified.
+const verifyLeeway = 30 * time.Second
+
+// x509SVIDSource returns source as an x509svid.Source, nil without a
+// source rather than an interface holding a nil pointer.
+func x509SVIDSource(source *workloadapi.X509Source) x509svid.Source {
+	if source == nil {
+		return nil
+	}
+	return source
+}
+
+// newExchanger prepares an exchanger for the configured authentication
+// method. jwtSource is only used by jwt-spiffe, x509Source by
+// tls_client_auth and private_key_jwt to default the client ID.
+func newExchanger(cfg Config, client *http.Client, endpoints *keycloak.ProviderMetadata, jwtSource spire.JWTSVIDSource, x509Source x509svid.Source) (*exchanger, error) {
+	e := &exchanger{
+		cfg:           cfg,
+		client:        client,
+		jwtSource:     jwtSource,
+		x509Source:    x509Source,
+		tokenEndpoint: endpoints.TokenEndpoint,
+		endpoints:     endpoints,
+		clientID:      cfg.ClientID,
+	}
+	if e.clientID == "" && cfg.AuthMethod != authMethodJWTSpiffe {
+		if x509Source == nil {
+			return nil, errors.New("no X509-SVID to name the client after: set CLIENT_ID")
+		}
+		svid, err := x509Source.GetX509SVID()
+		if err != nil {
+			return nil, fmt.Errorf("getting X509-SVID: %w", err)
+		}
+		e.clientID = svid.ID.String()
+	}
+	if cfg.DPoP == dpopMemory {
+		key, err := keycloak.GenerateDPoPKey()
+		if err != nil {
+			return nil, err
+		}
+		e.dpop = keycloak.NewDPoPTransport(key, client.Transport)
+	}
+	if cfg.VerifyToken.Enabled {
+		e.verifier = tokenauth.NewVerifier(tokenauth.NewKeySet(client, endpoints.JWKSURI), endpoints.Issuer,
+			tokenauth.WithAudience(cfg.VerifyToken.Audience...), tokenauth.WithLeeway(verifyLeeway))
+	}
+	return e, nil
+}
+
+// exchange obtains an access token for the primary audience.
+func (e *exchanger) exchange(ctx context.Context) (*keycloak.TokenResponse, error) {
+	return e.exchangeAudience(ctx, e.cfg.primaryAudience())
+}
+
+// exchangeAudience performs a client_credentials exchange with Keycloak
+// using a JWT-SVID for audience, retrying transient failures with fresh
+// client credentials.
+func (e *exchanger) exchangeAudience(ctx context.Context, audience string) (_ *keycloak.TokenResponse, err error) {
+	ctx, _ = withRequestID(ctx)
+	ctx, span := startSpan(ctx, "keycloak.ClientCredentials",
+		attribute.String("oauth.auth_method", e.cfg.AuthMethod),
+		attribute.String("spiffe.audience", audience))
+	defer func() { endSpan(span, err) }()
+
+	var token *keycloak.TokenResponse
+	var spiffeID string
+	start := time.Now()
+	defer func() {
+		audit(e.cfg.Audit, newAuditEvent(ctx, e.cfg, auditClientCredentials, spiffeID, e.clientID, audience, start, token, err))
+		if err == nil {
+			expiries.setToken(audience, spiffeID, time.Now(), token.ExpiresIn)
+		}
+	}()
+	err = withPhaseTimeout(ctx, phaseTokenRequest, e.cfg.Timeouts.TokenRequest, func(ctx context.Context) error {
+		return e.cfg.retryPolicyContext(ctx, "Token request").Do(ctx, func(ctx context.Context) error {
+			if err := waitTokenRequest(ctx, e.cfg.RateLimit); err != nil {
+				return err
+			}
+			auth, id, err := e.clientAuthIdentity(ctx, audience)
+			if err != nil {
+				return err
+			}
+			spiffeID = id
+			client, err := e.tokenClient()
+			if err != nil {
+				return err
+			}
+			if err := tokenBreaker.allow(e.cfg.CircuitBreaker); err != nil {
+				return retry.Permanent(err)
+			}
+			start := time.Now()
+			token, err = keycloak.ClientCredentials(ctx, client, e.tokenEndpoint, auth, e.tokenParams()...)
+			tokenBreaker.record(e.cfg.CircuitBreaker, err)
+			if err == nil {
+				err = e.verify(ctx, token)
+			}
+			observeExchange(e.cfg.AuthMethod, start, token, err)
+			if errors.Is(err, tokenauth.ErrInvalidToken) {
+				// Keycloak issues the same token until its configuration changes.
+				return retry.Permanent(err)
+			}
+			return keycloakRetry(err)
+		})
+	})
+	return token, err
+}
+
+// tokenParams returns the optional parameters of the token requests.
+func (e *exchanger) tokenParams() []keycloak.TokenParameter {
+	return []keycloak.TokenParameter{keycloak.WithScope(e.cfg.Scope), keycloak.WithResource(e.cfg.Resource...)}
+}
+
+// tokenClient returns the client of the token requests, which sends DPoP
+// proofs when DPoP is enabled.
+func (e *exchanger) tokenClient() (*http.Client, error) {
+	if e.cfg.DPoP == "" {
+		return e.client, nil
+	}
+	dpop, err := e.dpopTransport()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: dpop, Timeout: e.client.Timeout}, nil
+}
+
+// dpopTransport returns the transport signing the DPoP proofs with the
+// current key, nil unless DPoP is enabled. With x509-svid a new one is
+// created when the SVID key changes.
+func (e *exchanger) dpopTransport() (*keycloak.DPoPTransport, error) {
+	e.dpopMu.Lock()
+	defer e.dpopMu.Unlock()
+	if e.cfg.DPoP != dpopX509SVID {
+		return e.dpop, nil
+	}
+	if e.x509Source == nil {
+		return nil, errors.New("dpop x509-svid requires an X509-SVID")
+	}
+	svid, err := e.x509Source.GetX509SVID()
+	if err != nil {
+		return nil, fmt.Errorf("getting X509-SVID: %w", err)
+	}
+	key, err := keycloak.NewDPoPKey(svid.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("using the X509-SVID key for DPoP: %w", err)
+	}
+	if e.dpop == nil || e.dpop.Key().Thumbprint() != key.Thumbprint() {
+		e.dpop = keycloak.NewDPoPTransport(key, e.client.Transport)
+	}
+	return e.dpop, nil
+}
+
+// verify checks token against the realm JWKS when VerifyToken is enabled.
+func (e *exchanger) verify(ctx context.Context, token *keycloak.TokenResponse) error {
+	if e.verifier == nil {
+		return nil
+	}
+	claims, err := e.verifier.Verify(ctx, token.AccessToken)
+	if err != nil {
+		return fmt.Errorf("verifying the issued access token: %w", err)
+	}
+	slog.Debug("Access token verified", "issuer", claims.Issuer, "audience", []string(claims.Audience), "expires_at", time.Unix(claims.ExpiresAt, 0).UTC())
+	return nil
+}
+
+// clientAuth returns fresh client credentials for the configured method.
+// audience is the JWT-SVID audience used by jwt-spiffe.
+func (e *exchanger) clientAuth(ctx context.Context, audience string) (keycloak.ClientAuthentication, error) {
+	auth, _, err := e.clientAuthIdentity(ctx, audience)
+	return auth, err
+}
+
+// clientAuthIdentity returns fresh client credentials like clientAuth, and
+// the SPIFFE ID they authenticate, for the audit log.
+func (e *exchanger) clientAuthIdentity(ctx context.Context, audience string) (keycloak.ClientAuthentication, string, error) {
+	switch e.cfg.AuthMethod {
+	case authMethodTLSClientAuth, authMethodPrivateKeyJWT:
+		var id string
+		if e.x509Source != nil {
+			if svid, err := e.x509Source.GetX509SVID(); err == nil {
+				id = svid.ID.String()
+			}
+		}
+		if e.cfg.AuthMethod == authMethodTLSClientAuth {
+			return keycloak.WithClientID(e.clientID), id, nil
+		}
+		assertion, err := e.signAssertion()
+		if err != nil {
+			return nil, "", err
+		}
+		return keycloak.WithClientAssertion(keycloak.ClientAssertionTypeJWTBearer, assertion), id, nil
+	case authMethodNomad:
+		token, err := nomadIdentityToken(e.cfg.Nomad)
+		if err != nil {
+			return nil, "", retry.Permanent(err)
+		}
+		claims, _ := peekClaims(token)
+		return keycloak.WithClientAssertion(keycloak.ClientAssertionTypeJWTBearer, token), claims.Subject, nil
+	}
+
+	var svid *jwtsvid.SVID
+	err := withPhaseTimeout(ctx, phaseSVIDFetch, e.cfg.Timeouts.SVIDFetch, func(ctx context.Context) (err error) {
+		svid, err = fetchJWTSVID(ctx, e.jwtSource, audience)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return keycloak.WithClientAssertion(keycloak.ClientAssertionTypeSpiffe, svid.Marshal()), svid.ID.String(), nil
+}
+
+// revoke revokes the refresh token, when Keycloak issued one, and the
+// access token of token, obtained for audience.
+func (e *exchanger) revoke(ctx context.Context, audience string, token *keycloak.TokenResponse) error {
+	if token.RefreshToken != "" {
+		if err := e.revokeToken(ctx, audience, token.RefreshToken, keycloak.TokenTypeHintRefreshToken); err != nil {
+			return fmt.Errorf("revoking the refresh token: %w", err)
+		}
+	}
+	if err := e.revokeToken(ctx, audience, token.AccessToken, keycloak.TokenTypeHintAccessToken); err != nil {
+		return fmt.Errorf("revoking the access token: %w", err)
+	}
+	return nil
+}
+
+// revokeToken revokes token at the revocation endpoint of the realm,
+// authenticating as for the exchanges of audience.
+func (e *exchanger) revokeToken(ctx context.Context, audience, token, hint string) error {
+	if e.endpoints.RevocationEndpoint == "" {
+		return errors.New("the realm advertises no revocation endpoint")
+	}
+	auth, err := e.clientAuth(ctx, audience)
+	if err != nil {
+		return err
+	}
+	return keycloak.Revoke(ctx, e.client, e.endpoints.RevocationEndpoint, auth, token, hint)
+}
+
+// introspect asks the introspection endpoint of the realm whether token is
+// active, authenticating as for the exchanges of audience.
+func (e *exchanger) introspect(ctx context.Context, audience, token, hint string) (*keycloak.IntrospectionResponse, error) {
+	if e.endpoints.IntrospectionEndpoint == "" {
+		return nil, errors.New("the realm advertises no introspection endpoint")
+	}
+	auth, err := e.clientAuth(ctx, audience)
+	if err != nil {
+		return nil, err
+	}
+	return keycloak.Introspect(ctx, e.client, e.endpoints.IntrospectionEndpoint, auth, token, hint)
+}
+
+// signAssertion signs a private_key_jwt client assertion with the current
+// X509-SVID, so that SVID rotation is picked up on every exchange.
+func (e *exchanger) signAssertion() (string, error) {
+	svid, err := e.x509Source.GetX509SVID()
+	if err != nil {
+		return "", fmt.Errorf("getting X509-SVID: %w", err)
+	}
+
+	a := e.cfg.Assertion
+	params := keycloak.AssertionParams{
+		Issuer:       a.Issuer,
+		Subject:      a.Subject,
+		Audience:     a.Audience,
+		ID:           a.ID,
+		Lifetime:     a.Lifetime,
+		Certificates: svid.Certificates,
+	}
+	if params.Issuer == "" {
+		params.Issuer = e.clientID
+	}
+	if params.Subject == "" {
+		params.Subject = e.clientID
+	}
+	if params.Audience == "" {
+		params.Audience = e.cfg.realmURL()
+	}
+
+	assertion, err := keycloak.SignClientAssertion(svid.PrivateKey, params)
+	if err != nil {
+		return "", fmt.Errorf("signing client assertion: %w", err)
+	}
+	return assertion, nil
+}
+
+// discoverEndpoints returns the realm endpoints advertised by its discovery
+// document, falling back to the conventional Keycloak paths when discovery
+// is disabled or fails.
+func discoverEndpoints(ctx context.Context, cfg Config, client *http.Client) *keycloak.ProviderMetadata {
+	static := keycloak.StaticRealmMetadata(cfg.realmURL())
+	if !cfg.Discovery {
+		return static
+	}
+
+	var md *keycloak.ProviderMetadata
+	err := withPhaseTimeout(ctx, phaseDiscovery, cfg.Timeouts.Discovery, func(ctx context.Context) (err error) {
+		md, err = keycloak.Discover(ctx, client, static.Issuer)
+		return err
+	})
+	if err != nil {
+		slog.Warn("OIDC discovery failed, using default Keycloak paths", "error", err)
+		return static
+	}
+	return md
+}
@@ -0,0 +1,287 @@
+// exec.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	rotateNone    = "none"
+	rotateRestart = "restart"
+	rotateSignal  = "signal"
+
+	// childStopTimeout is how long a child has to exit before it is killed.
+	childStopTimeout = 10 * time.Second
+)
+
+// rotateSignals are the signals that can notify the child of a rotation.
+var rotateSignals = map[string]os.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGQUIT": syscall.SIGQUIT,
+}
+
+// exitCodeError carries the exit code of the child to the workload exit code.
+type exitCodeError struct {
+	code int
+}
+
+func (e *exitCodeError) Error() string {
+	return fmt.Sprintf("command exited with code %d", e.code)
+}
+
+// runExec implements the exec subcommand: it obtains a token, runs the
+// command given after "--" with ACCESS_TOKEN and JWT_SVID set, keeps the
+// token refreshed and exits with the code of the command.
+func runExec(args []string) error {
+	cfgArgs, argv := args, []string(nil)
+	for i, arg := range args {
+		if arg == "--" {
+			cfgArgs, argv = args[:i], args[i+1:]
+			break
+		}
+	}
+	if len(argv) == 0 {
+		return errors.New("usage: workload exec [flags] -- command [args...]")
+	}
+
+	cfg, err := loadConfig(cfgArgs)
+	if err != nil {
+		return err
+	}
+	setupLogging(cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		return err
+	}
+	defer flushTraces(shutdownTracing)
+
+	bootCtx, bootCancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer bootCancel()
+
+	s, err := openSession(bootCtx, &cfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	sinks, err := newSinks(cfg)
+	if err != nil {
+		return err
+	}
+	state := newDaemonState(cfg)
+	serveOps(ctx, cfg, state)
+	d := &daemon{
+		cfg:    cfg,
+		ex:     s.ex,
+		state:  state,
+		sinks:  sinks,
+		tokens: make(map[string]issuedToken, len(cfg.Audience)),
+	}
+	for _, audience := range cfg.Audience {
+		issuedAt := time.Now()
+		token, err := s.ex.exchangeAudience(bootCtx, audience)
+		if err != nil {
+			return fmt.Errorf("obtaining access token for %s: %w", audience, err)
+		}
+		d.setToken(bootCtx, audience, issuedToken{TokenResponse: token, issuedAt: issuedAt, reason: reasonInitial})
+	}
+
+	child := &childProcess{
+		argv:     argv,
+		audience: cfg.primaryAudience(),
+		onRotate: cfg.Exec.OnRotate,
+		signal:   rotateSignals[cfg.Exec.Signal],
+		exited:   make(chan int, 1),
+		env: func(ctx context.Context, token issuedToken) ([]string, error) {
+			env := append(os.Environ(), "ACCESS_TOKEN="+token.AccessToken)
+			if s.svids == nil {
+				// Nomad tasks have no JWT-SVID.
+				return env, nil
+			}
+			svid, err := fetchJWTSVID(ctx, s.svids, cfg.primaryAudience())
+			if err != nil {
+				return nil, err
+			}
+			return append(env, "JWT_SVID="+svid.Marshal()), nil
+		},
+	}
+	env, err := child.env(bootCtx, d.tokens[cfg.primaryAudience()])
+	if err != nil {
+		return err
+	}
+	if err := child.start(env); err != nil {
+		return err
+	}
+	bootCancel()
+
+	d.servers = append(d.servers, child)
+	d.rotations = watchRotations(ctx, cfg)
+	go runWatchdog(ctx, state)
+	daemonErr := make(chan error, 1)
+	go func() { daemonErr <- d.run(ctx) }()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case sig := <-sigs:
+			child.forward(sig)
+		case err := <-daemonErr:
+			// The command cannot get fresh tokens any more.
+			slog.Error("Stopping the command", "error", err)
+			child.forward(syscall.SIGTERM)
+			select {
+			case <-child.exited:
+			case <-time.After(childStopTimeout):
+				child.forward(os.Kill)
+			}
+			return err
+		case code := <-child.exited:
+			// Stop the daemon, revoking the tokens when configured.
+			cancel()
+			<-daemonErr
+			if code != 0 {
+				return &exitCodeError{code: code}
+			}
+			return nil
+		}
+	}
+}
+
+// childProcess runs the exec command and reacts to token rotations.
+type childProcess struct {
+	argv     []string
+	audience string
+	onRotate string
+	signal   os.Signal
+	env      func(ctx context.Context, token issuedToken) ([]string, error)
+	// exited receives the exit code of the child, unless it was stopped to
+	// be restarted.
+	exited chan int
+
+	mu      sync.Mutex
+	current *runningChild
+}
+
+type runningChild struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+// start runs the command with env.
+func (c *childProcess) start(env []string) error {
+	cmd := exec.Command(c.argv[0], c.argv[1:]...)
+	cmd.Env = env
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting %s: %w", c.argv[0], err)
+	}
+	slog.Info("Started command", "command", c.argv[0], "pid", cmd.Process.Pid)
+
+	r := &runningChild{cmd: cmd, done: make(chan struct{})}
+	c.mu.Lock()
+	c.current = r
+	c.mu.Unlock()
+
+	go func() {
+		err := cmd.Wait()
+		close(r.done)
+		c.mu.Lock()
+		current := c.current == r
+		c.mu.Unlock()
+		if current {
+			c.exited <- exitCode(err)
+		}
+	}()
+	return nil
+}
+
+// forward sends sig to the running child.
+func (c *childProcess) forward(sig os.Signal) {
+	c.mu.Lock()
+	r := c.current
+	c.mu.Unlock()
+	if r == nil {
+		return
+	}
+	if err := r.cmd.Process.Signal(sig); err != nil {
+		slog.Warn("Failed to signal the command", "signal", sig, "error", err)
+	}
+}
+
+// restart stops the running child and starts it again with env. When the
+// command cannot be started again, it is reported as exited with code 1 so
+// that the workload stops instead of waiting for it.
+func (c *childProcess) restart(env []string) error {
+	c.mu.Lock()
+	r := c.current
+	c.current = nil
+	c.mu.Unlock()
+
+	if r != nil {
+		r.cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-r.done:
+		case <-time.After(childStopTimeout):
+			r.cmd.Process.Kill()
+			<-r.done
+		}
+	}
+	if err := c.start(env); err != nil {
+		select {
+		case c.exited <- 1:
+		default:
+		}
+		return err
+	}
+	return nil
+}
+
+// writeToken implements tokenSink by applying the rotation policy when the
+// token of the primary audience is renewed.
+func (c *childProcess) writeToken(ctx context.Context, audience string, token issuedToken) error {
+	if audience != c.audience {
+		return nil
+	}
+	switch c.onRotate {
+	case rotateRestart:
+		env, err := c.env(ctx, token)
+		if err != nil {
+			return err
+		}
+		slog.Info("Token rotated, restarting the command")
+		return c.restart(env)
+	case rotateSignal:
+		slog.Info("Token rotated, signaling the command", "signal", c.signal)
+		c.forward(c.signal)
+	}
+	return nil
+}
+
+// exitCode returns the exit code reported by cmd.Wait.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+		return exitErr.ExitCode()
+	}
+	return 1
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+// exec_unix.go
+package main
+
+import "syscall"
+
+func init() {
+	rotateSignals["SIGUSR1"] = syscall.SIGUSR1
+	rotateSignals["SIGUSR2"] = syscall.SIGUSR2
+}
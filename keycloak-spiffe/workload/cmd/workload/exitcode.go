@@ -0,0 +1,142 @@
+// exitcode.go
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/spire"
+)
+
+// Exit codes of the workload by class of failure, so that orchestration
+// can tell an agent not started yet, which is worth a restart, from a
+// client Keycloak rejects, which needs an operator.
+const (
+	// exitFailure is any failure of no other class.
+	exitFailure = 1
+	// exitConfig is an invalid configuration or command line.
+	exitConfig = 2
+	// exitSPIRE is a SPIRE Agent Workload API that cannot be reached.
+	exitSPIRE = 3
+	// exitSVID is an agent issuing no SVID to the workload, or one of
+	// another identity than expected.
+	exitSVID = 4
+	// exitKeycloakClient is a request rejected by Keycloak with a 4xx
+	// status: unknown client, invalid assertion, missing permission.
+	exitKeycloakClient = 5
+	// exitKeycloakServer is a Keycloak failing with a 5xx status,
+	// rate limiting the workload, or unreachable.
+	exitKeycloakServer = 6
+	// exitTLS is a failed TLS handshake with Keycloak.
+	exitTLS = 7
+)
+
+// configError is an invalid configuration.
+type configError struct{ err error }
+
+func (e *configError) Error() string { return e.err.Error() }
+func (e *configError) Unwrap() error { return e.err }
+
+// spireError is a failure to reach the SPIRE Agent Workload API.
+type spireError struct{ err error }
+
+func (e *spireError) Error() string { return e.err.Error() }
+func (e *spireError) Unwrap() error { return e.err }
+
+// svidError is a failure of the SPIRE Agent to issue an SVID to the
+// workload, usually a missing or wrong registration entry.
+type svidError struct{ err error }
+
+func (e *svidError) Error() string { return e.err.Error() }
+func (e *svidError) Unwrap() error { return e.err }
+
+// failureExitCode returns the exit code of the class of err.
+func failureExitCode(err error) int {
+	var (
+		exitErr  *exitCodeError
+		cfgErr   *configError
+		spireErr *spireError
+		svidErr  *svidError
+		tokenErr *keycloak.TokenError
+		regErr   *keycloak.RegistrationError
+		urlErr   *url.Error
+	)
+	switch {
+	case errors.As(err, &exitErr):
+		return exitErr.code
+	case errors.As(err, &cfgErr):
+		return exitConfig
+	case errors.As(err, &spireErr):
+		return exitSPIRE
+	case errors.As(err, &svidErr):
+		return exitSVID
+	case errors.As(err, &tokenErr):
+		return keycloakExitCode(tokenErr.StatusCode)
+	case errors.As(err, &regErr):
+		return keycloakExitCode(regErr.StatusCode)
+	case isTLSError(err):
+		return exitTLS
+	case errors.As(err, &urlErr):
+		// The HTTP client only talks to Keycloak.
+		return exitKeycloakServer
+	}
+	return exitFailure
+}
+
+func keycloakExitCode(status int) int {
+	if status == http.StatusTooManyRequests || status >= 500 {
+		return exitKeycloakServer
+	}
+	return exitKeycloakClient
+}
+
+// isTLSError reports whether err is a failed TLS handshake: a certificate
+// not verified on either side, or a TLS alert or garbage from the server.
+func isTLSError(err error) bool {
+	var (
+		verifyErr    *tls.CertificateVerificationError
+		alertErr     tls.AlertError
+		recordErr    tls.RecordHeaderError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+	return errors.As(err, &verifyErr) || errors.As(err, &alertErr) || errors.As(err, &recordErr) ||
+		errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
+
+// sourceError classifies the failure to create a Workload API source. The
+// sources wait for the first SVIDs or bundles, so the agent issued none
+// when its socket accepts connections.
+func sourceError(cfg Config, err error) error {
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if spire.CheckSocket(ctx, cfg.SocketPath) != nil {
+		return &spireError{err}
+	}
+	return &svidError{err}
+}
+
+// fetchError classifies a failed SVID fetch: the Workload API client
+// reports an agent it cannot reach as Unavailable.
+func fetchError(err error) error {
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return err
+	case status.Code(err) == codes.Unavailable:
+		return &spireError{err}
+	}
+	return &svidError{err}
+}
@@ -0,0 +1,103 @@
+// expiry.go
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// SVID kinds of workload_svid_expiry_seconds.
+const (
+	svidKindX509 = "x509"
+	svidKindJWT  = "jwt"
+)
+
+var (
+	svidExpiryDesc = prometheus.NewDesc("workload_svid_expiry_seconds",
+		"Remaining lifetime of the SVIDs last obtained from the SPIRE Agent, negative once expired.",
+		[]string{"kind", "audience", "spiffe_id"}, nil)
+
+	tokenExpiryDesc = prometheus.NewDesc("workload_access_token_expiry_seconds",
+		"Remaining lifetime of the access tokens last obtained from Keycloak, negative once expired.",
+		[]string{"audience", "spiffe_id"}, nil)
+)
+
+// expiryKey identifies a credential of the process.
+type expiryKey struct {
+	audience string
+	spiffeID string
+}
+
+// expiryCollector exports the remaining lifetime of the credentials of the
+// process, computed at each scrape so that a credential that is not
+// renewed shows as running out.
+type expiryCollector struct {
+	mu     sync.Mutex
+	x509   x509svid.Source
+	svids  map[expiryKey]time.Time
+	tokens map[expiryKey]time.Time
+}
+
+// expiries holds the expiries of the whole process, recorded wherever the
+// SVIDs are fetched and the tokens obtained.
+var expiries = &expiryCollector{
+	svids:  make(map[expiryKey]time.Time),
+	tokens: make(map[expiryKey]time.Time),
+}
+
+func init() {
+	prometheus.MustRegister(expiries)
+}
+
+// setX509Source exports the expiry of the current X509-SVID of source,
+// which follows its rotations.
+func (c *expiryCollector) setX509Source(source x509svid.Source) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.x509 = source
+}
+
+// setSVID records the expiry of the JWT-SVID of spiffeID for audience.
+func (c *expiryCollector) setSVID(audience, spiffeID string, expiry time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.svids[expiryKey{audience, spiffeID}] = expiry
+}
+
+// setToken records the expiry of the access token of spiffeID for
+// audience, issued at issuedAt. Tokens without expiry are not exported.
+func (c *expiryCollector) setToken(audience, spiffeID string, issuedAt time.Time, expiresIn int) {
+	if expiresIn <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tokens[expiryKey{audience, spiffeID}] = issuedAt.Add(time.Duration(expiresIn) * time.Second)
+}
+
+func (c *expiryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- svidExpiryDesc
+	ch <- tokenExpiryDesc
+}
+
+func (c *expiryCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.x509 != nil {
+		if svid, err := c.x509.GetX509SVID(); err == nil && len(svid.Certificates) > 0 {
+			ch <- prometheus.MustNewConstMetric(svidExpiryDesc, prometheus.GaugeValue,
+				time.Until(svid.Certificates[0].NotAfter).Seconds(), svidKindX509, "", svid.ID.String())
+		}
+	}
+	for key, expiry := range c.svids {
+		ch <- prometheus.MustNewConstMetric(svidExpiryDesc, prometheus.GaugeValue,
+			time.Until(expiry).Seconds(), svidKindJWT, key.audience, key.spiffeID)
+	}
+	for key, expiry := range c.tokens {
+		ch <- prometheus.MustNewConstMetric(tokenExpiryDesc, prometheus.GaugeValue,
+			time.Until(expiry).Seconds(), key.audience, key.spiffeID)
+	}
+}
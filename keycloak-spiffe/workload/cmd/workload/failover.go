@@ -0,0 +1,183 @@
+// failover.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Failback policies of the Keycloak failover.
+const (
+	// failbackPrimary sends the requests to the first endpoint not cooling
+	// down, returning to the primary once it recovered.
+	failbackPrimary = "primary"
+	// failbackSticky keeps sending the requests to the endpoint in use until
+	// it fails, to avoid moving between zones.
+	failbackSticky = "sticky"
+)
+
+// failoverTransport sends the requests for KeycloakURL to the first healthy
+// entry point of the Keycloak cluster. An endpoint failing with a
+// connection error or a 5xx answer is marked down for the cooldown and the
+// request is sent again to the next one, as long as its body can be
+// replayed. When every endpoint is down they are all tried anyway.
+type failoverTransport struct {
+	next      http.RoundTripper
+	endpoints []*url.URL
+	sticky    bool
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	current   int
+	downUntil []time.Time
+}
+
+// newFailoverTransport returns the failover transport of cfg sending the
+// requests with next, next itself when no failover URL is configured.
+func newFailoverTransport(cfg Config, next http.RoundTripper) (http.RoundTripper, error) {
+	if len(cfg.Failover.URLs) == 0 {
+		return next, nil
+	}
+	t := &failoverTransport{
+		next:     next,
+		sticky:   cfg.Failover.Failback == failbackSticky,
+		cooldown: cfg.Failover.Cooldown,
+	}
+	for _, raw := range append([]string{cfg.KeycloakURL}, cfg.Failover.URLs...) {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("parsing Keycloak URL %s: %w", raw, err)
+		}
+		t.endpoints = append(t.endpoints, u)
+		keycloakEndpointUp.WithLabelValues(u.Redacted()).Set(1)
+	}
+	t.downUntil = make([]time.Time, len(t.endpoints))
+	return t, nil
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	primary := t.endpoints[0]
+	if req.URL.Scheme != primary.Scheme || req.URL.Host != primary.Host || !strings.HasPrefix(req.URL.Path, primary.Path) {
+		return t.next.RoundTrip(req)
+	}
+
+	order := t.order()
+	var resp *http.Response
+	var err error
+	for i, idx := range order {
+		if i > 0 {
+			if !replayable(req) {
+				break
+			}
+			if resp != nil {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		}
+		var out *http.Request
+		if out, err = t.rewrite(req, idx, i > 0); err != nil {
+			return nil, err
+		}
+		resp, err = t.next.RoundTrip(out)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			t.succeeded(idx)
+			return resp, nil
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return nil, err
+		}
+		reason := err
+		if reason == nil {
+			reason = fmt.Errorf("HTTP %d", resp.StatusCode)
+		}
+		t.failed(idx, reason)
+	}
+	return resp, err
+}
+
+// order returns the indexes of the endpoints in the order they are tried:
+// from the first one, or from the one in use when sticky, those cooling
+// down last.
+func (t *failoverTransport) order() []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	start := 0
+	if t.sticky {
+		start = t.current
+	}
+	now := time.Now()
+	var up, down []int
+	for i := range t.endpoints {
+		idx := (start + i) % len(t.endpoints)
+		if now.Before(t.downUntil[idx]) {
+			down = append(down, idx)
+		} else {
+			up = append(up, idx)
+		}
+	}
+	return append(up, down...)
+}
+
+// rewrite returns req sent to the endpoint idx, with a new copy of its body
+// when it is sent again.
+func (t *failoverTransport) rewrite(req *http.Request, idx int, again bool) (*http.Request, error) {
+	if idx == 0 && !again {
+		return req, nil
+	}
+	out := req.Clone(req.Context())
+	if again && req.Body != nil && req.Body != http.NoBody {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, fmt.Errorf("replaying the Keycloak request: %w", err)
+		}
+		out.Body = body
+	}
+	endpoint := t.endpoints[idx]
+	out.URL.Scheme = endpoint.Scheme
+	out.URL.Host = endpoint.Host
+	out.URL.Path = endpoint.Path + strings.TrimPrefix(req.URL.Path, t.endpoints[0].Path)
+	out.URL.RawPath = ""
+	out.Host = ""
+	return out, nil
+}
+
+// replayable reports whether req can be sent again.
+func replayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// succeeded records that the endpoint idx answered, and makes it the one in
+// use.
+func (t *failoverTransport) succeeded(idx int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.downUntil[idx].IsZero() {
+		t.downUntil[idx] = time.Time{}
+		slog.Info("Keycloak endpoint recovered", "endpoint", t.endpoints[idx].Redacted())
+		keycloakEndpointUp.WithLabelValues(t.endpoints[idx].Redacted()).Set(1)
+	}
+	if idx != t.current {
+		slog.Warn("Failing over to another Keycloak endpoint", "from", t.endpoints[t.current].Redacted(), "to", t.endpoints[idx].Redacted())
+		keycloakFailovers.Inc()
+		t.current = idx
+	}
+}
+
+// failed marks the endpoint idx down for the cooldown.
+func (t *failoverTransport) failed(idx int, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.downUntil[idx].IsZero() {
+		slog.Warn("Keycloak endpoint failed", "endpoint", t.endpoints[idx].Redacted(), "cooldown", t.cooldown, "error", err)
+	}
+	t.downUntil[idx] = time.Now().Add(t.cooldown)
+	keycloakEndpointUp.WithLabelValues(t.endpoints[idx].Redacted()).Set(0)
+}
@@ -0,0 +1,134 @@
+// gcp.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/gcp"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/retry"
+)
+
+// runGCPLogin implements the gcp-login subcommand: it exchanges the JWT-SVID
+// or the Keycloak access token at Google STS with workload identity
+// federation, impersonating the service account when one is set, and prints
+// the Google access token. With a credentials file it writes the external
+// account configuration of Application Default Credentials and the subject
+// token it reads instead, so that the client libraries get their tokens
+// themselves. In daemon mode the token is renewed before it expires.
+func runGCPLogin(args []string) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	setupLogging(cfg)
+	if cfg.GCP.Provider == "" {
+		return errors.New("missing workload identity provider: set GCP_WORKLOAD_IDENTITY_PROVIDER")
+	}
+	if err := checkOutput(cfg.Output, ""); err != nil {
+		return &configError{err}
+	}
+	if cfg.Output == "" {
+		cfg.Output = outputRaw
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		return err
+	}
+	defer flushTraces(shutdownTracing)
+	if cfg.Daemon {
+		serveOps(ctx, cfg, nil)
+	}
+
+	bootCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	s, err := openSession(bootCtx, &cfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	client, err := serviceClient(cfg, "")
+	if err != nil {
+		return err
+	}
+
+	g := cfg.GCP
+	if g.Audience == "" {
+		g.Audience = gcp.DefaultTokenAudience(g.Provider)
+	}
+	if g.CredentialsFile != "" && g.TokenFile == "" {
+		g.TokenFile = strings.TrimSuffix(g.CredentialsFile, filepath.Ext(g.CredentialsFile)) + ".jwt"
+	}
+	return keepLoggedIn(ctx, cfg, "GCP workload identity federation", func(ctx context.Context) (time.Duration, error) {
+		ctx, span := startSpan(ctx, "gcp.ExchangeToken")
+		var subject string
+		var token *gcp.Token
+		err := cfg.retryPolicyContext(ctx, "GCP token exchange").Do(ctx, func(ctx context.Context) error {
+			var err error
+			if subject, err = s.credential(ctx, g.Credential, g.Audience); err != nil {
+				return err
+			}
+			token, err = gcp.ExchangeToken(ctx, client, gcp.DefaultSTSEndpoint, gcp.ProviderAudience(g.Provider), subject, g.Scopes)
+			if err == nil && g.ServiceAccount != "" {
+				token, err = gcp.GenerateAccessToken(ctx, client, gcp.DefaultIAMEndpoint, token.AccessToken, g.ServiceAccount, g.Scopes, g.Lifetime)
+			}
+			if err != nil && !gcp.IsTransient(err) {
+				return retry.Permanent(err)
+			}
+			return err
+		})
+		endSpan(span, err)
+		if err != nil {
+			failures.WithLabelValues("gcp").Inc()
+			return 0, fmt.Errorf("GCP token exchange failed: %w", err)
+		}
+		slog.InfoContext(ctx, "Obtained a Google access token",
+			"provider", g.Provider,
+			"service_account", g.ServiceAccount,
+			"expiry", token.Expiry.UTC())
+
+		lifetime := time.Until(token.Expiry)
+		if g.CredentialsFile == "" {
+			return lifetime, writeCredential(os.Stdout, cfg.Output,
+				[][2]string{{"CLOUDSDK_AUTH_ACCESS_TOKEN", token.AccessToken}},
+				map[string]any{
+					"access_token": token.AccessToken,
+					"token_type":   "Bearer",
+					"expire_time":  token.Expiry.UTC().Format(time.RFC3339),
+				})
+		}
+		// The client libraries read the subject token again on each
+		// refresh: it must stay valid, not only the token obtained here.
+		return assertionLifetime(lifetime, subject), writeExternalAccount(g, subject)
+	})
+}
+
+// writeExternalAccount writes the subject token to the token file and the
+// external account configuration reading it to the credentials file.
+func writeExternalAccount(g GCPConfig, subject string) error {
+	tokenFile, err := filepath.Abs(g.TokenFile)
+	if err != nil {
+		return fmt.Errorf("resolving the GCP subject token file: %w", err)
+	}
+	if err := writeFileAtomic(tokenFile, []byte(subject), 0o600); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(gcp.NewExternalAccount(g.Provider, tokenFile, g.ServiceAccount, g.Lifetime), "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding the GCP credentials file: %w", err)
+	}
+	return writeFileAtomic(g.CredentialsFile, append(data, '\n'), 0o600)
+}
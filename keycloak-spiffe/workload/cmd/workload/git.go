@@ -0,0 +1,106 @@
+// git.go
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// runGitCredential implements the git-credential subcommand, a git
+// credential helper: git-credential <get|store|erase> with the attributes
+// of the credential on stdin, as key=value lines. get answers the
+// Keycloak access token, or a JWT-SVID, of the workload as the password of
+// the configured HTTPS hosts, and nothing for the others so that git asks
+// its next helper. The credentials come from the SPIFFE identity, so store
+// and erase keep nothing.
+func runGitCredential(args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return errors.New("missing git-credential action: get, store or erase")
+	}
+	action := args[0]
+	cfg, err := loadConfig(args[1:])
+	if err != nil {
+		return err
+	}
+	setupLogging(cfg)
+	gc := cfg.Git
+	// git asks its helpers about every host, submodules and redirects
+	// included: the token only goes to those named.
+	if len(gc.Hosts) == 0 {
+		return errors.New("missing hosts of the git credentials: set GIT_HOSTS")
+	}
+
+	attrs, err := readGitCredential(os.Stdin)
+	if err != nil {
+		return err
+	}
+	switch action {
+	case "store", "erase":
+		return nil
+	case "get":
+	default:
+		return fmt.Errorf("unknown git-credential action %q (available: get, store, erase)", action)
+	}
+	// The token is only sent over TLS.
+	host := strings.ToLower(attrs["host"])
+	if attrs["protocol"] != "https" || !hostAllowed(gc.Hosts, host) {
+		slog.Debug("Host not configured, no credentials", "protocol", attrs["protocol"], "host", host)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+	s, err := openSession(ctx, &cfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	token, err := s.credential(ctx, gc.Credential, gc.Audience)
+	if err != nil {
+		return err
+	}
+	out := fmt.Sprintf("username=%s\npassword=%s\n", gc.Username, token)
+	// git 2.41 and later do not reuse the password past its expiry.
+	if claims, ok := peekClaims(token); ok && claims.ExpiresAt > 0 {
+		out += fmt.Sprintf("password_expiry_utc=%d\n", claims.ExpiresAt)
+	}
+	_, err = io.WriteString(os.Stdout, out)
+	return err
+}
+
+// readGitCredential reads the attributes of a credential request up to a
+// blank line or the end of r. A url attribute sets the protocol and the
+// host.
+func readGitCredential(r io.Reader) (map[string]string, error) {
+	attrs := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid git credential attribute %q", line)
+		}
+		attrs[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if raw, ok := attrs["url"]; ok {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid git credential url: %w", err)
+		}
+		attrs["protocol"], attrs["host"] = u.Scheme, u.Host
+	}
+	return attrs, nil
+}
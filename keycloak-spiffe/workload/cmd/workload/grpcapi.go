@@ -0,0 +1,156 @@
+// grpcapi.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/tokenapi"
+)
+
+// tokenService serves the daemon tokens over the gRPC token API. As a
+// tokenSink it pushes every renewed token to the watching clients.
+type tokenService struct {
+	tokenapi.UnimplementedTokenServiceServer
+	audiences []string
+
+	mu       sync.Mutex
+	tokens   map[string]*tokenapi.Token
+	watchers map[string]map[chan *tokenapi.Token]bool
+}
+
+func newTokenService(audiences []string) *tokenService {
+	return &tokenService{
+		audiences: audiences,
+		tokens:    make(map[string]*tokenapi.Token, len(audiences)),
+		watchers:  make(map[string]map[chan *tokenapi.Token]bool, len(audiences)),
+	}
+}
+
+func (s *tokenService) writeToken(_ context.Context, audience string, token issuedToken) error {
+	t := &tokenapi.Token{
+		AccessToken: token.AccessToken,
+		TokenType:   token.TokenType,
+		Audience:    audience,
+		Scope:       token.Scope,
+		IssuedAt:    token.issuedAt.Unix(),
+	}
+	if token.ExpiresIn > 0 {
+		t.ExpiresAt = token.issuedAt.Unix() + int64(token.ExpiresIn)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[audience] = t
+	for ch := range s.watchers[audience] {
+		// A slow watcher only needs the latest token.
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- t
+	}
+	return nil
+}
+
+// audience resolves the audience of a request.
+func (s *tokenService) audience(requested string) (string, error) {
+	if requested == "" {
+		return s.audiences[0], nil
+	}
+	for _, a := range s.audiences {
+		if a == requested {
+			return a, nil
+		}
+	}
+	return "", status.Errorf(codes.NotFound, "audience %q is not served by this workload", requested)
+}
+
+func (s *tokenService) GetToken(_ context.Context, req *tokenapi.GetTokenRequest) (*tokenapi.Token, error) {
+	audience, err := s.audience(req.GetAudience())
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t := s.tokens[audience]; t != nil {
+		return t, nil
+	}
+	return nil, status.Errorf(codes.Unavailable, "no token obtained yet for %s", audience)
+}
+
+func (s *tokenService) WatchToken(req *tokenapi.WatchTokenRequest, stream grpc.ServerStreamingServer[tokenapi.Token]) error {
+	audience, err := s.audience(req.GetAudience())
+	if err != nil {
+		return err
+	}
+
+	ch := make(chan *tokenapi.Token, 1)
+	s.mu.Lock()
+	if s.watchers[audience] == nil {
+		s.watchers[audience] = map[chan *tokenapi.Token]bool{}
+	}
+	s.watchers[audience][ch] = true
+	if t := s.tokens[audience]; t != nil {
+		ch <- t
+	}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.watchers[audience], ch)
+		s.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case t := <-ch:
+			if err := stream.Send(t); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// serveTokenAPI serves s on the Unix socket addr until ctx is cancelled.
+func serveTokenAPI(ctx context.Context, addr string, s *tokenService) error {
+	path := strings.TrimPrefix(addr, "unix://")
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("removing stale token API socket: %w", err)
+	}
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("listening on token API socket: %w", err)
+	}
+	// Grant access to the group sharing the socket directory.
+	if err := os.Chmod(path, 0o660); err != nil {
+		lis.Close()
+		return fmt.Errorf("setting token API socket permissions: %w", err)
+	}
+
+	srv := grpc.NewServer()
+	tokenapi.RegisterTokenServiceServer(srv, s)
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+	}()
+	go func() {
+		slog.Info("Serving the token API", "addr", addr)
+		if err := srv.Serve(lis); err != nil {
+			slog.Error("Token API server failed", "error", err)
+		}
+	}()
+	return nil
+}
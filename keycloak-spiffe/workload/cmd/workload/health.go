@@ -0,0 +1,195 @@
+// health.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/spire"
+)
+
+// livenessGrace is added to the expected wake-up time of the refresh loop
+// before it is considered stuck.
+const livenessGrace = 30 * time.Second
+
+// daemonState is the daemon state reported by the health endpoints.
+type daemonState struct {
+	socketPath string
+	audiences  []string
+	grace      time.Duration
+
+	mu sync.Mutex
+	// expiry holds the expiry of the token held per audience, zero when the
+	// token does not expire.
+	expiry map[string]time.Time
+	// deadline is when the refresh loop must have completed its next
+	// iteration, zero until the loop starts.
+	deadline time.Time
+	// spireDownSince is when the SPIRE Agent was found unreachable, zero
+	// while it is reachable.
+	spireDownSince time.Time
+}
+
+func newDaemonState(cfg Config) *daemonState {
+	return &daemonState{
+		socketPath: cfg.SocketPath,
+		audiences:  cfg.Audience,
+		grace:      cfg.SPIREGracePeriod,
+		expiry:     make(map[string]time.Time),
+	}
+}
+
+// setToken records the token held for audience, issued at issuedAt.
+func (s *daemonState) setToken(audience string, token *keycloak.TokenResponse, issuedAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var expiry time.Time
+	if token.ExpiresIn > 0 {
+		expiry = issuedAt.Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	s.expiry[audience] = expiry
+}
+
+// setAudiences replaces the audiences a token must be held for, after a
+// configuration reload.
+func (s *daemonState) setAudiences(audiences []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.audiences = audiences
+	for audience := range s.expiry {
+		if !slices.Contains(audiences, audience) {
+			delete(s.expiry, audience)
+		}
+	}
+}
+
+// scheduled records that the refresh loop sleeps for wait and then runs a
+// refresh bounded by timeout.
+func (s *daemonState) scheduled(wait, timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deadline = time.Now().Add(wait + timeout + livenessGrace)
+}
+
+// ready reports whether a valid, unexpired access token is held for every
+// audience.
+func (s *daemonState) ready() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for _, audience := range s.audiences {
+		expiry, ok := s.expiry[audience]
+		switch {
+		case !ok:
+			errs = append(errs, fmt.Errorf("no access token obtained yet for %s", audience))
+		case !expiry.IsZero() && time.Now().After(expiry):
+			errs = append(errs, fmt.Errorf("access token for %s expired at %s", audience, expiry.UTC().Format(time.RFC3339)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkSPIRE checks that the SPIRE Agent socket accepts connections and
+// records the outage while it does not.
+func (s *daemonState) checkSPIRE(ctx context.Context) error {
+	err := spire.CheckSocket(ctx, s.socketPath)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case err == nil && !s.spireDownSince.IsZero():
+		slog.Info("SPIRE Agent reachable again", "down_for", time.Since(s.spireDownSince).Round(time.Second))
+		s.spireDownSince = time.Time{}
+		degraded.Set(0)
+	case err != nil && s.spireDownSince.IsZero():
+		slog.Warn("SPIRE Agent unreachable, serving the cached tokens", "grace_period", s.grace, "error", err)
+		s.spireDownSince = time.Now()
+		degraded.Set(1)
+	}
+	return err
+}
+
+// degradation returns why the daemon serves its cached tokens instead of
+// renewing them, nil while the SPIRE Agent is reachable.
+func (s *daemonState) degradation() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.spireDownSince.IsZero() {
+		return nil
+	}
+	return fmt.Errorf("SPIRE Agent unreachable since %s", s.spireDownSince.UTC().Format(time.RFC3339))
+}
+
+// failed returns an error once the SPIRE Agent has been unreachable for
+// longer than the grace period, or when no token of the outage is valid
+// any more.
+func (s *daemonState) failed() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.spireDownSince.IsZero() {
+		return nil
+	}
+	since := s.spireDownSince.UTC().Format(time.RFC3339)
+	if s.grace > 0 && time.Since(s.spireDownSince) > s.grace {
+		return &spireError{fmt.Errorf("SPIRE Agent unreachable since %s, longer than the %s grace period", since, s.grace)}
+	}
+	for _, audience := range s.audiences {
+		if expiry, ok := s.expiry[audience]; ok && (expiry.IsZero() || time.Now().Before(expiry)) {
+			return nil
+		}
+	}
+	return &spireError{fmt.Errorf("SPIRE Agent unreachable since %s and every cached token expired", since)}
+}
+
+// alive reports whether the refresh loop is running and the SPIRE Agent
+// socket accepts connections or, while it does not, the daemon still
+// serves valid tokens within the grace period.
+func (s *daemonState) alive(ctx context.Context) error {
+	s.mu.Lock()
+	deadline := s.deadline
+	s.mu.Unlock()
+	if !deadline.IsZero() && time.Now().After(deadline) {
+		return fmt.Errorf("refresh loop stuck since %s", deadline.UTC().Format(time.RFC3339))
+	}
+	if err := s.checkSPIRE(ctx); err != nil {
+		return s.failed()
+	}
+	return nil
+}
+
+// registerHealth adds the /healthz (liveness) and /readyz (readiness)
+// handlers for state to mux.
+func registerHealth(mux *http.ServeMux, state *daemonState) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+		err := state.alive(ctx)
+		if err == nil {
+			if d := errors.Join(state.degradation(), tokenBreaker.degradation()); d != nil {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				fmt.Fprintln(w, "degraded:", d)
+				return
+			}
+		}
+		writeHealth(w, err)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, state.ready())
+	})
+}
+
+func writeHealth(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,67 @@
+// hook.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// hookSink runs the renew hook command after each token is obtained, once
+// the token files are written.
+type hookSink struct {
+	command      string
+	timeout      time.Duration
+	tokenPath    string
+	responsePath string
+}
+
+func (h *hookSink) writeToken(ctx context.Context, audience string, token issuedToken) error {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", h.command)
+	} else {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", h.command)
+	}
+	cmd.Env = append(os.Environ(), h.env(audience, token)...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+
+	start := time.Now()
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("renew hook: %w", err)
+	}
+	slog.Debug("Renew hook completed", "audience", audience, "duration", time.Since(start))
+	return nil
+}
+
+// env returns the token metadata passed to the hook. The token itself is
+// only available through the token files.
+func (h *hookSink) env(audience string, token issuedToken) []string {
+	env := []string{
+		"TOKEN_AUDIENCE=" + audience,
+		"TOKEN_TYPE=" + token.TokenType,
+		"TOKEN_SCOPE=" + token.Scope,
+		"TOKEN_EXPIRES_IN=" + strconv.Itoa(token.ExpiresIn),
+		"TOKEN_ISSUED_AT=" + token.issuedAt.UTC().Format(time.RFC3339),
+		"TOKEN_REASON=" + token.reason,
+	}
+	if token.ExpiresIn > 0 {
+		expiry := token.issuedAt.Add(time.Duration(token.ExpiresIn) * time.Second)
+		env = append(env, "TOKEN_EXPIRES_AT="+expiry.UTC().Format(time.RFC3339))
+	}
+	if h.tokenPath != "" {
+		env = append(env, "TOKEN_FILE="+audiencePath(h.tokenPath, audience))
+	}
+	if h.responsePath != "" {
+		env = append(env, "TOKEN_RESPONSE_FILE="+audiencePath(h.responsePath, audience))
+	}
+	return env
+}
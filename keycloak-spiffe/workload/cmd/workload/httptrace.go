@@ -0,0 +1,242 @@
+// httptrace.go
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// traceBodyLimit bounds the request and response bodies logged by the HTTP
+// trace.
+const traceBodyLimit = 4096
+
+// secretHeaders are the headers whose values the HTTP trace never logs.
+var secretHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "Dpop", "X-Consul-Token", "X-Vault-Token", "X-Amz-Security-Token"}
+
+// traceSecretFields are the body fields the HTTP trace redacts besides
+// secretKeys, in the form compared by secretField: the client secrets and
+// the credentials of the services the workload logs in to.
+var traceSecretFields = map[string]bool{
+	"clientsecret":    true,
+	"clienttoken":     true,
+	"secretaccesskey": true,
+	"sessiontoken":    true,
+	"secretid":        true,
+}
+
+// traceTransport logs every request sent to Keycloak with the DNS lookup,
+// connection and TLS handshake it required and the response, as curl -v
+// does. Credentials are redacted from the headers and bodies.
+type traceTransport struct {
+	next http.RoundTripper
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	log := slog.With("method", req.Method, "url", req.URL.Redacted())
+	since := func() time.Duration { return time.Since(start).Round(time.Microsecond) }
+
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			log.Info("HTTP trace: DNS lookup", "host", info.Host)
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			addrs := make([]string, 0, len(info.Addrs))
+			for _, addr := range info.Addrs {
+				addrs = append(addrs, addr.String())
+			}
+			log.Info("HTTP trace: DNS resolved", "addrs", addrs, "error", info.Err, "elapsed", since())
+		},
+		ConnectDone: func(network, addr string, err error) {
+			log.Info("HTTP trace: connected", "network", network, "addr", addr, "error", err, "elapsed", since())
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			attrs := []any{
+				"version", tls.VersionName(state.Version),
+				"cipher_suite", tls.CipherSuiteName(state.CipherSuite),
+				"server_name", state.ServerName,
+				"alpn", state.NegotiatedProtocol,
+				"resumed", state.DidResume,
+				"error", err,
+				"elapsed", since(),
+			}
+			if len(state.PeerCertificates) > 0 {
+				cert := state.PeerCertificates[0]
+				uris := make([]string, 0, len(cert.URIs))
+				for _, u := range cert.URIs {
+					uris = append(uris, u.String())
+				}
+				attrs = append(attrs,
+					"peer_subject", cert.Subject.String(),
+					"peer_issuer", cert.Issuer.String(),
+					"peer_dns_names", cert.DNSNames,
+					"peer_uris", uris,
+					"peer_not_after", cert.NotAfter.UTC())
+			}
+			log.Info("HTTP trace: TLS handshake", attrs...)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				log.Info("HTTP trace: reusing connection", "addr", info.Conn.RemoteAddr().String(), "idle", info.IdleTime)
+			}
+		},
+	}
+
+	// The request is not modified: the traced copy gets the body read.
+	traced := req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	body, err := peekBody(&traced.Body)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("HTTP trace: request",
+		"headers", redactHeaders(req.Header),
+		"body", redactBody(req.Header.Get("Content-Type"), body))
+
+	resp, err := t.next.RoundTrip(traced)
+	if err != nil {
+		log.Info("HTTP trace: request failed", "error", err, "elapsed", since())
+		return nil, err
+	}
+	if body, err = peekBody(&resp.Body); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	log.Info("HTTP trace: response",
+		"status", resp.Status,
+		"proto", resp.Proto,
+		"headers", redactHeaders(resp.Header),
+		"body", redactBody(resp.Header.Get("Content-Type"), body),
+		"elapsed", since())
+	return resp, nil
+}
+
+// peekBody reads *body and replaces it with a reader of the same content.
+func peekBody(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil || *body == http.NoBody {
+		return nil, nil
+	}
+	data, err := io.ReadAll(*body)
+	(*body).Close()
+	*body = io.NopCloser(bytes.NewReader(data))
+	return data, err
+}
+
+// redactHeaders returns the headers as logged, credentials replaced by
+// their scheme.
+func redactHeaders(h http.Header) map[string]string {
+	out := make(map[string]string, len(h))
+	for name, values := range h {
+		out[name] = strings.Join(values, ", ")
+	}
+	for _, name := range secretHeaders {
+		if v := h.Get(name); v != "" {
+			scheme, _, found := strings.Cut(v, " ")
+			if !found {
+				scheme = ""
+			}
+			out[http.CanonicalHeaderKey(name)] = strings.TrimSpace(scheme + " [REDACTED]")
+		}
+	}
+	return out
+}
+
+// redactBody returns a request or response body as logged: the secret
+// fields of forms and JSON documents, at any depth, are replaced and the
+// JWTs elsewhere redacted. Other bodies, such as the XML of AWS STS, are
+// not logged.
+func redactBody(contentType string, body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return omittedBody(body)
+		}
+		keys := make([]string, 0, len(form))
+		for key := range form {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fields := make([]string, 0, len(keys))
+		for _, key := range keys {
+			value := form.Get(key)
+			if secretField(key) {
+				value = "[REDACTED]"
+			}
+			fields = append(fields, key+"="+value)
+		}
+		body = []byte(strings.Join(fields, "&"))
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var document any
+		if err := json.Unmarshal(body, &document); err != nil {
+			return omittedBody(body)
+		}
+		data, err := json.Marshal(redactJSON(document))
+		if err != nil {
+			return omittedBody(body)
+		}
+		body = data
+	default:
+		return omittedBody(body)
+	}
+	s := redact(string(body))
+	if len(s) > traceBodyLimit {
+		s = s[:traceBodyLimit] + "...[truncated]"
+	}
+	return s
+}
+
+// redactJSON replaces the secret fields of the objects of v, a decoded JSON
+// document.
+func redactJSON(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if secretField(key) {
+				v[key] = "[REDACTED]"
+			} else {
+				v[key] = redactJSON(value)
+			}
+		}
+	case []any:
+		for i, value := range v {
+			v[i] = redactJSON(value)
+		}
+	}
+	return v
+}
+
+// secretField reports whether a form or JSON field holds a secret, its
+// name compared without case, underscores and dashes so that client_token,
+// accessToken and SecretAccessKey all match.
+func secretField(name string) bool {
+	name = strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(name))
+	if traceSecretFields[name] {
+		return true
+	}
+	for key := range secretKeys {
+		if strings.ReplaceAll(key, "_", "") == name {
+			return true
+		}
+	}
+	return false
+}
+
+// omittedBody stands for a body the HTTP trace does not log.
+func omittedBody(body []byte) string {
+	return fmt.Sprintf("[%d bytes omitted]", len(body))
+}
@@ -0,0 +1,136 @@
+// inspect.go
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/tokenauth"
+)
+
+// runInspect implements the inspect subcommand: it decodes a JWT-SVID or a
+// Keycloak token and prints its header, claims and a summary of its
+// validity, audiences and roles. The signature is not verified: it is a
+// debugging aid for the claim mappings of a realm, not a validation.
+func runInspect(args []string) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	setupLogging(cfg)
+
+	data, err := readTokenInput(cfg.Inspect.File, "inspect")
+	if err != nil {
+		return err
+	}
+	token := string(data)
+	if data[0] == '{' {
+		response, err := keycloak.ParseTokenResponse(data)
+		if err != nil {
+			return err
+		}
+		token = response.AccessToken
+	}
+	return inspectToken(os.Stdout, token, time.Now())
+}
+
+// inspectToken writes the decoded token to w, the validity relative to now.
+func inspectToken(w io.Writer, token string, now time.Time) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("not a JWT: %d segments instead of 3", len(parts))
+	}
+	header, err := decodeSegment(parts[0])
+	if err != nil {
+		return fmt.Errorf("decoding the JWT header: %w", err)
+	}
+	payload, err := decodeSegment(parts[1])
+	if err != nil {
+		return fmt.Errorf("decoding the JWT claims: %w", err)
+	}
+	var claims tokenauth.Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return fmt.Errorf("decoding the JWT claims: %w", err)
+	}
+
+	fmt.Fprintln(w, "Header:")
+	writeIndented(w, header)
+	fmt.Fprintln(w, "Claims:")
+	writeIndented(w, payload)
+	fmt.Fprintln(w, "Summary (signature not verified):")
+	field := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(w, "  %-14s %s\n", name+":", value)
+		}
+	}
+	field("Issuer", claims.Issuer)
+	field("Subject", claims.Subject)
+	field("Audience", strings.Join(claims.Audience, ", "))
+	field("Client", firstNonEmpty(claims.AuthorizedParty, claims.ClientID))
+	field("Type", claims.Type)
+	field("Issued", timeClaim(claims.IssuedAt, now))
+	field("Not before", timeClaim(claims.NotBefore, now))
+	field("Expires", timeClaim(claims.ExpiresAt, now))
+	field("Scope", claims.Scope)
+	field("Actors", strings.Join(claims.Actor.Chain(), ", "))
+	field("Realm roles", strings.Join(claims.RealmAccess.Roles, ", "))
+	clients := make([]string, 0, len(claims.ResourceAccess))
+	for client := range claims.ResourceAccess {
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+	for _, client := range clients {
+		field("Roles "+client, strings.Join(claims.ResourceAccess[client].Roles, ", "))
+	}
+	return nil
+}
+
+// decodeSegment decodes a base64url JWT segment, tolerating padding.
+func decodeSegment(segment string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+}
+
+// writeIndented writes the JSON object data indented, as is when it is not
+// valid JSON.
+func writeIndented(w io.Writer, data []byte) {
+	var out bytes.Buffer
+	if err := json.Indent(&out, data, "  ", "  "); err != nil {
+		out.Reset()
+		out.Write(data)
+	}
+	fmt.Fprintf(w, "  %s\n", out.Bytes())
+}
+
+// timeClaim formats the NumericDate claim t relative to now, empty when it
+// is absent.
+func timeClaim(t int64, now time.Time) string {
+	if t == 0 {
+		return ""
+	}
+	at := time.Unix(t, 0)
+	d := at.Sub(now).Round(time.Second)
+	switch {
+	case d > 0:
+		return fmt.Sprintf("%s (in %s)", at.UTC().Format(time.RFC3339), d)
+	case d < 0:
+		return fmt.Sprintf("%s (%s ago)", at.UTC().Format(time.RFC3339), -d)
+	}
+	return at.UTC().Format(time.RFC3339) + " (now)"
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
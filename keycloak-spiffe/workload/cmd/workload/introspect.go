@@ -0,0 +1,80 @@
+// introspect.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+)
+
+// errInactiveToken is returned by the introspect subcommand for tokens
+// Keycloak reports as inactive, so that scripts can test its exit code.
+var errInactiveToken = errors.New("the token is not active")
+
+// runIntrospect implements the introspect subcommand: it asks the
+// introspection endpoint of the realm whether a token is active and prints
+// its claims as JSON on the standard output.
+func runIntrospect(args []string) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	setupLogging(cfg)
+
+	data, err := readTokenInput(cfg.Introspect.File, "introspect")
+	if err != nil {
+		return err
+	}
+	token := string(data)
+	if data[0] == '{' {
+		response, err := keycloak.ParseTokenResponse(data)
+		if err != nil {
+			return err
+		}
+		token = response.AccessToken
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		return err
+	}
+	defer flushTraces(shutdownTracing)
+
+	s, err := openSession(ctx, &cfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	audience := cfg.primaryAudience()
+	slog.Info("Introspecting the token", "introspection_endpoint", s.endpoints.IntrospectionEndpoint, "auth_method", cfg.AuthMethod)
+	ctx, span := startSpan(ctx, "keycloak.Introspect")
+	var resp *keycloak.IntrospectionResponse
+	err = cfg.retryPolicy("Token introspection").Do(ctx, func(ctx context.Context) error {
+		resp, err = s.ex.introspect(ctx, audience, token, cfg.Introspect.TokenTypeHint)
+		return keycloakRetry(err)
+	})
+	endSpan(span, err)
+	if err != nil {
+		return fmt.Errorf("token introspection failed: %w", err)
+	}
+
+	fmt.Fprintln(os.Stdout, string(resp.Raw))
+	if !resp.Active {
+		return errInactiveToken
+	}
+	slog.Info("Token is active",
+		"client_id", resp.ClientID,
+		"subject", resp.Subject,
+		"scope", resp.Scope,
+		"expires_at", time.Unix(resp.ExpiresAt, 0).UTC())
+	return nil
+}
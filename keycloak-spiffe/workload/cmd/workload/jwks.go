@@ -0,0 +1,149 @@
+// jwks.go
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/spire"
+)
+
+// jwksPublisher serves the JWT bundle of a trust domain, as the SPIRE Agent
+// currently holds it, as a JWKS document.
+type jwksPublisher struct {
+	bundles jwtbundle.Source
+	td      spiffeid.TrustDomain
+	maxAge  time.Duration
+
+	mu   sync.Mutex
+	etag string
+}
+
+// runJWKS implements the jwks subcommand: it serves the JWT bundle of
+// TRUST_DOMAIN at JWKS_PATH, so that Keycloak can validate the JWT-SVIDs
+// with a JWKS URL following the key rotations of the SPIRE Server.
+func runJWKS(args []string) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	setupLogging(cfg)
+	td, err := jwksTrustDomain(cfg)
+	if err != nil {
+		return err
+	}
+	activated, err := activatedListener("jwks")
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	serveOps(ctx, cfg, nil)
+
+	bootCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	if err := waitForSocket(bootCtx, cfg); err != nil {
+		return err
+	}
+	source, err := spire.NewBundleSource(bootCtx, cfg.SocketPath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	p := &jwksPublisher{bundles: source, td: td, maxAge: cfg.JWKS.MaxAge}
+	mux := http.NewServeMux()
+	mux.HandleFunc(cfg.JWKS.Path, p.handleJWKS)
+
+	lis := activated
+	if lis == nil {
+		if lis, err = net.Listen("tcp", cfg.JWKS.Addr); err != nil {
+			return fmt.Errorf("listening on JWKS address: %w", err)
+		}
+	}
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	slog.Info("Serving the JWT bundle as a JWKS", "addr", lis.Addr().String(), "path", cfg.JWKS.Path, "trust_domain", td.Name(), "activated", activated != nil)
+	if err := sdNotify("READY=1\nSTATUS=Serving the JWKS"); err != nil {
+		slog.Warn("Failed to notify systemd", "error", err)
+	}
+	return serveBroker(ctx, srv, lis)
+}
+
+// jwksTrustDomain returns the trust domain whose JWT bundle is published,
+// TRUST_DOMAIN.
+func jwksTrustDomain(cfg Config) (spiffeid.TrustDomain, error) {
+	if cfg.TrustDomain == "" {
+		return spiffeid.TrustDomain{}, errors.New("missing trust domain of the JWT bundle: set TRUST_DOMAIN")
+	}
+	td, err := spiffeid.TrustDomainFromString(cfg.TrustDomain)
+	if err != nil {
+		return spiffeid.TrustDomain{}, fmt.Errorf("invalid trust domain %q: %w", cfg.TrustDomain, err)
+	}
+	return td, nil
+}
+
+// handleJWKS serves the current JWT bundle. The ETag lets Keycloak and the
+// caches revalidate the document cheaply between key rotations.
+func (p *jwksPublisher) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	bundle, err := p.bundles.GetJWTBundleForTrustDomain(p.td)
+	if err != nil {
+		slog.Error("JWT bundle unavailable", "trust_domain", p.td.Name(), "error", err)
+		failures.WithLabelValues("spire").Inc()
+		http.Error(w, "JWT bundle unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	body, err := spire.JWKS(bundle)
+	if err != nil {
+		slog.Error("Failed to convert the JWT bundle", "trust_domain", p.td.Name(), "error", err)
+		http.Error(w, "JWT bundle conversion failed", http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	p.logRotation(etag, len(bundle.JWTAuthorities()))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(p.maxAge/time.Second)))
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(body)
+}
+
+// logRotation logs the first document served and each change of the keys.
+func (p *jwksPublisher) logRotation(etag string, keys int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if etag == p.etag {
+		return
+	}
+	slog.Info("JWKS updated", "trust_domain", p.td.Name(), "keys", keys, "etag", etag, "previous_etag", p.etag)
+	p.etag = etag
+}
@@ -0,0 +1,122 @@
+// kubesecret.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// serviceAccountNamespace holds the namespace of the pod in the cluster.
+	serviceAccountNamespace = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+	secretAnnotationPrefix = "keycloak-spiffe.idyatech.fr/"
+	secretTokenKey         = "token"
+)
+
+// secretSink stores the access token in a Kubernetes Secret, created or
+// updated on every refresh.
+type secretSink struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+}
+
+// newSecretSink connects to the API server with the in-cluster service
+// account.
+func newSecretSink(cfg KubeSecretConfig) (*secretSink, error) {
+	restCfg, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("loading in-cluster config: %w", err)
+	}
+	client, err := kubernetes.NewForConfig(restCfg)
+	if err != nil {
+		return nil, fmt.Errorf("creating Kubernetes client: %w", err)
+	}
+
+	namespace := cfg.Namespace
+	if namespace == "" {
+		data, err := os.ReadFile(serviceAccountNamespace)
+		if err != nil {
+			return nil, fmt.Errorf("reading pod namespace: %w", err)
+		}
+		namespace = strings.TrimSpace(string(data))
+	}
+	return &secretSink{client: client, namespace: namespace, name: cfg.Name}, nil
+}
+
+func (s *secretSink) writeToken(ctx context.Context, audience string, token issuedToken) error {
+	name := secretName(s.name, audience)
+	annotations := map[string]string{
+		secretAnnotationPrefix + "audience":  audience,
+		secretAnnotationPrefix + "issued-at": token.issuedAt.UTC().Format(time.RFC3339),
+	}
+	if token.ExpiresIn > 0 {
+		expiry := token.issuedAt.Add(time.Duration(token.ExpiresIn) * time.Second)
+		annotations[secretAnnotationPrefix+"expires-at"] = expiry.UTC().Format(time.RFC3339)
+	}
+	data := map[string][]byte{secretTokenKey: []byte(token.AccessToken)}
+
+	secrets := s.client.CoreV1().Secrets(s.namespace)
+	secret, err := secrets.Get(ctx, name, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   s.namespace,
+				Labels:      map[string]string{"app.kubernetes.io/managed-by": serviceName},
+				Annotations: annotations,
+			},
+			Type: corev1.SecretTypeOpaque,
+			Data: data,
+		}
+		if _, err := secrets.Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("creating secret %s/%s: %w", s.namespace, name, err)
+		}
+		return nil
+	case err != nil:
+		return fmt.Errorf("reading secret %s/%s: %w", s.namespace, name, err)
+	}
+
+	if secret.Annotations == nil {
+		secret.Annotations = make(map[string]string, len(annotations))
+	}
+	for k, v := range annotations {
+		secret.Annotations[k] = v
+	}
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte, len(data))
+	}
+	for k, v := range data {
+		secret.Data[k] = v
+	}
+	if _, err := secrets.Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("updating secret %s/%s: %w", s.namespace, name, err)
+	}
+	return nil
+}
+
+// unsafeNameChars matches the audience characters not allowed in a Secret
+// name.
+var unsafeNameChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// secretName replaces the audience placeholder of name with audience,
+// reduced to a valid Kubernetes object name.
+func secretName(name, audience string) string {
+	if !strings.Contains(name, audiencePlaceholder) {
+		return name
+	}
+	audience = strings.Trim(unsafeNameChars.ReplaceAllString(strings.ToLower(audience), "-"), "-.")
+	return strings.ReplaceAll(name, audiencePlaceholder, audience)
+}
@@ -0,0 +1,99 @@
+// logging.go
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// jwtPattern matches compact JWS / JWT strings such as JWT-SVIDs, client
+// assertions and Keycloak access tokens.
+var jwtPattern = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+
+// secretKeys are attribute keys whose values are never logged.
+var secretKeys = map[string]bool{
+	"access_token":       true,
+	"refresh_token":      true,
+	"id_token":           true,
+	"token":              true,
+	"assertion":          true,
+	"client_assertion":   true,
+	"subject_token":      true,
+	"software_statement": true,
+	"password":           true,
+}
+
+// redact replaces the JWTs found in s so that they cannot be replayed from
+// the logs. The header prefix is kept to help telling tokens apart.
+func redact(s string) string {
+	return jwtPattern.ReplaceAllStringFunc(s, func(jwt string) string {
+		return jwt[:min(10, len(jwt))] + "...[REDACTED]"
+	})
+}
+
+// redactAttr is a slog ReplaceAttr function hiding secrets from log records.
+func redactAttr(_ []string, a slog.Attr) slog.Attr {
+	if secretKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, "[REDACTED]")
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, redact(a.Value.String()))
+	case slog.KindAny:
+		switch v := a.Value.Any().(type) {
+		case error:
+			return slog.String(a.Key, redact(v.Error()))
+		case []byte:
+			return slog.String(a.Key, redact(string(v)))
+		case fmt.Stringer:
+			return slog.String(a.Key, redact(v.String()))
+		}
+	}
+	return a
+}
+
+// newLogger returns a logger writing records at level or above to w in the
+// given format, with tokens redacted and the request ID of the context.
+func newLogger(w io.Writer, level slog.Level, format string) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+	if format == logFormatJSON {
+		return slog.New(requestIDHandler{slog.NewJSONHandler(w, opts)})
+	}
+	return slog.New(requestIDHandler{slog.NewTextHandler(w, opts)})
+}
+
+// logLevel returns the configured log level.
+func logLevel(cfg Config) slog.Level {
+	var level slog.Level
+	// validate already rejected unknown levels.
+	_ = level.UnmarshalText([]byte(cfg.Log.Level))
+	return level
+}
+
+// setupLogging installs the configured logger as the default logger.
+func setupLogging(cfg Config) {
+	slog.SetDefault(newLogger(os.Stderr, logLevel(cfg), cfg.Log.Format))
+}
+
+// fatal logs msg at error level and exits with the exit code of the first
+// error among args, exitFailure without one.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	code := exitFailure
+	for _, arg := range args {
+		if err, ok := arg.(error); ok {
+			code = failureExitCode(err)
+			break
+		}
+	}
+	os.Exit(code)
+}
@@ -0,0 +1,369 @@
+// main.go
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+)
+
+// httpClient creates the HTTP client used to reach Keycloak over mutual TLS
+// with the workload X509-SVID.
+func httpClient(cfg Config, source *workloadapi.X509Source) (*http.Client, error) {
+	tlsConfig, err := keycloakTLSConfig(cfg.TLS, source)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := newDialer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	egress, err := newEgressProxy(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var transport http.RoundTripper = &http.Transport{
+		TLSClientConfig: tlsConfig,
+		Proxy:           egress.Proxy,
+		DialContext:     egress.dial(d.DialContext),
+	}
+	if cfg.TraceHTTP {
+		transport = &traceTransport{next: transport}
+	}
+	if transport, err = newFailoverTransport(cfg, transport); err != nil {
+		return nil, err
+	}
+	if header := cfg.requestIDHeader(); header != "" {
+		transport = &requestIDTransport{next: transport, header: header}
+	}
+	// otelhttp traces each request and sends the traceparent header.
+	return &http.Client{
+		Timeout:   cfg.HTTPTimeout,
+		Transport: otelhttp.NewTransport(transport),
+	}, nil
+}
+
+func main() {
+	name, args := "", os.Args[1:]
+	// Docker runs its credential helpers as docker-credential-<name> <action>.
+	if strings.HasPrefix(filepath.Base(os.Args[0]), dockerHelperPrefix) {
+		name = "docker-credential"
+	} else if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name != "" {
+		if err := runCommand(name, args); err != nil {
+			var exitErr *exitCodeError
+			if errors.As(err, &exitErr) {
+				os.Exit(exitErr.code)
+			}
+			fatal("Command failed", "command", name, "error", err)
+		}
+		return
+	}
+
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	setupLogging(cfg)
+
+	rootCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	runWorkload(rootCtx, cfg, os.Args[1:])
+}
+
+// runWorkload registers the client and obtains the tokens, then keeps
+// renewing them until rootCtx is cancelled in daemon mode. It exits the
+// process on failure. args are the flags cfg was loaded from, reloaded on
+// SIGHUP.
+func runWorkload(rootCtx context.Context, cfg Config, args []string) {
+	slog.Info("SPIFFE Dynamic Client Registration Test", "keycloak_url", cfg.KeycloakURL, "realm", cfg.Realm)
+	if cfg.AuthMethod == authMethodNomad {
+		// The registration presents the JWT-SVID as software statement.
+		fatal("The nomad auth method applies to the subcommands, such as exec, proxy and broker", "error", &configError{errors.New("nomad auth method without a subcommand")})
+	}
+
+	if err := checkOutput(cfg.Output, outputExecCredential); err != nil {
+		fatal("Invalid configuration", "error", &configError{err})
+	}
+
+	shutdownTracing, err := setupTracing(rootCtx)
+	if err != nil {
+		fatal("Failed to set up tracing", "error", err)
+	}
+	defer flushTraces(shutdownTracing)
+
+	state := newDaemonState(cfg)
+	serveOps(rootCtx, cfg, state)
+
+	var cache *tokenCache
+	if cfg.Daemon {
+		if cache, err = openTokenCache(cfg); err != nil {
+			fatal("Failed to load the token cache", "error", err)
+		}
+		// Report the cached tokens as ready before SPIRE and Keycloak are reached.
+		for _, audience := range cfg.Audience {
+			if cached, ok := cache.lookup(audience); ok {
+				state.setToken(audience, cached.TokenResponse, cached.issuedAt)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(rootCtx, cfg.Timeout)
+	defer cancel()
+
+	x509Source, err := newX509Source(ctx, cfg)
+	if err != nil {
+		fatal("Failed to fetch X509-SVID from SPIRE Agent", "error", err)
+	}
+	defer x509Source.Close()
+
+	client, err := httpClient(cfg, x509Source)
+	if err != nil {
+		fatal("Failed to create HTTP client", "error", err)
+	}
+	if !cfg.DryRun {
+		resolveKeycloakPath(ctx, &cfg, client)
+		state.setAudiences(cfg.Audience)
+	}
+
+	// =========================================================================
+	// Step 1: Fetch JWT-SVID from SPIRE Agent
+	// =========================================================================
+	slog.Info("Step 1: Fetching JWT-SVID from SPIRE Agent", "audience", cfg.primaryAudience())
+
+	source, err := newJWTSource(ctx, cfg)
+	if err != nil {
+		fatal("Failed to connect to SPIRE Agent", "error", err)
+	}
+	defer source.Close()
+	svids := jwtSVIDs(cfg, source)
+
+	var svid *jwtsvid.SVID
+	err = withPhaseTimeout(ctx, phaseSVIDFetch, cfg.Timeouts.SVIDFetch, func(ctx context.Context) error {
+		return cfg.retryPolicy("Fetching the JWT-SVID").Do(ctx, func(ctx context.Context) error {
+			svid, err = fetchJWTSVID(ctx, svids, cfg.primaryAudience())
+			return err
+		})
+	})
+	if err != nil {
+		fatal("Failed to fetch JWT-SVID", "error", err)
+	}
+
+	jwtToken := svid.Marshal()
+	slog.Info("JWT-SVID obtained", "spiffe_id", svid.ID.String(), "expiry", svid.Expiry.UTC())
+	slog.Debug("JWT-SVID", "jwt", jwtToken)
+
+	if cfg.DryRun {
+		slog.Info("Dry run: printing the token requests without registering the client or calling Keycloak")
+		if err := dryRun(ctx, os.Stdout, cfg, client, svids, x509Source); err != nil {
+			fatal("Dry run failed", "error", err)
+		}
+		return
+	}
+
+	// =========================================================================
+	// Step 2: Register client via Dynamic Client Registration
+	// =========================================================================
+	dcrEndpoint := keycloak.RealmRegistrationEndpoint(cfg.realmURL())
+	slog.Info("Step 2: Registering client via Dynamic Client Registration", "endpoint", dcrEndpoint)
+
+	reg := keycloak.RegistrationRequest{
+		Description:         "Client registered via SPIFFE DCR with JWT-SVID",
+		DefaultClientScopes: []string{"mcp:resources", "mcp:tools", "mcp:prompts"},
+		Attributes: map[string]string{
+			"software_statement": jwtToken,
+			"idp_alias":          cfg.IDPAlias,
+		},
+	}
+
+	bodyJSON, err := json.Marshal(reg)
+	if err != nil {
+		fatal("Failed to marshal DCR request", "error", err)
+	}
+	slog.Debug("DCR request", "payload", bodyJSON)
+
+	var registered *keycloak.RegisteredClient
+	err = withPhaseTimeout(ctx, phaseTokenRequest, cfg.Timeouts.TokenRequest, func(ctx context.Context) error {
+		return cfg.retryPolicy("Client registration").Do(ctx, func(ctx context.Context) error {
+			ctx, span := startSpan(ctx, "keycloak.RegisterClient")
+			registered, err = keycloak.RegisterClient(ctx, client, dcrEndpoint, reg)
+			endSpan(span, err)
+			if err != nil && !errors.Is(err, keycloak.ErrClientExists) {
+				failures.WithLabelValues(errorClass(err)).Inc()
+			}
+			return keycloakRetry(err)
+		})
+	})
+	var regErr *keycloak.RegistrationError
+	switch {
+	case errors.As(err, &regErr):
+		slog.Debug("DCR response", "status", regErr.StatusCode, "body", regErr.Body)
+		// If client already exists (409 Conflict), continue to step 3 anyway
+		if !errors.Is(err, keycloak.ErrClientExists) {
+			fatal("Client registration failed", "status", regErr.StatusCode, "body", regErr.Body, "error", err)
+		}
+		slog.Warn("Client already exists, continuing to authentication step")
+	case err != nil:
+		fatal("Failed to call DCR endpoint", "error", err)
+	default:
+		slog.Debug("DCR response", "status", http.StatusCreated, "body", registered.Raw)
+		slog.Info("Client registered",
+			"client_id", registered.ClientID,
+			"uuid", registered.ID,
+			"spiffe_id", registered.Attributes["jwt.credential.sub"])
+	}
+
+	// =========================================================================
+	// Step 3: Authenticate with the registered client using JWT-SVID
+	// =========================================================================
+	endpoints := discoverEndpoints(ctx, cfg, client)
+	slog.Info("Step 3: Testing authentication with registered client", "token_endpoint", endpoints.TokenEndpoint)
+
+	jwtSource := svids
+	if cfg.AuthMethod == authMethodJWTSpiffe {
+		// Fetch a truly fresh JWT-SVID for the token exchange (new source to avoid cache)
+		freshSource, err := newJWTSource(ctx, cfg)
+		if err != nil {
+			fatal("Failed to create fresh JWT source", "error", err)
+		}
+		defer freshSource.Close()
+		jwtSource = jwtSVIDs(cfg, freshSource)
+	}
+
+	ex, err := newExchanger(cfg, client, endpoints, jwtSource, x509Source)
+	if err != nil {
+		fatal("Failed to prepare client authentication", "error", err)
+	}
+
+	var svidCert *x509.Certificate
+	if cfg.AuthMethod == authMethodTLSClientAuth {
+		if x509SVID, err := x509Source.GetX509SVID(); err == nil {
+			svidCert = x509SVID.Certificates[0]
+		}
+	}
+	if ex.clientID != "" {
+		slog.Info("Sending token request", "auth_method", cfg.AuthMethod, "client_id", ex.clientID)
+	} else {
+		slog.Info("Sending token request", "auth_method", cfg.AuthMethod)
+	}
+
+	sinks, err := newSinks(cfg)
+	if err != nil {
+		fatal("Failed to set up the token outputs", "error", err)
+	}
+	d := &daemon{
+		cfg:    cfg,
+		ex:     ex,
+		state:  state,
+		cache:  cache,
+		sinks:  sinks,
+		tokens: make(map[string]issuedToken, len(cfg.Audience)),
+	}
+	if cfg.Output != "" {
+		d.servers = append(d.servers, newOutputSink(cfg, os.Stdout, svid.ID.String()))
+	}
+	if cfg.TokenAPIAddr != "" && cfg.Daemon {
+		api := newTokenService(cfg.Audience)
+		if err := serveTokenAPI(rootCtx, cfg.TokenAPIAddr, api); err != nil {
+			fatal("Failed to serve the token API", "error", err)
+		}
+		d.servers = append(d.servers, api)
+	}
+	if cfg.SDSAddr != "" && cfg.Daemon {
+		if err := serveSDS(rootCtx, cfg.SDSAddr, newSDSServer(x509Source)); err != nil {
+			fatal("Failed to serve the SDS API", "error", err)
+		}
+	}
+	if cfg.Sidecar.Dir != "" {
+		sidecar, err := newSidecarSink(cfg, svids, state)
+		if err != nil {
+			fatal("Failed to prepare the sidecar directory", "error", err)
+		}
+		defer sidecar.close()
+		d.servers = append(d.servers, sidecar)
+	}
+	for _, audience := range cfg.Audience {
+		if cached, ok := cache.lookup(audience); ok {
+			slog.Info("Resuming with the cached token", "audience", audience, "issued_at", cached.issuedAt.UTC())
+			d.setToken(ctx, audience, cached)
+			continue
+		}
+
+		issuedAt := time.Now()
+		actx, id := withRequestID(ctx)
+		token, err := ex.exchangeAudience(actx, audience)
+		var tokenErr *keycloak.TokenError
+		switch {
+		case errors.As(err, &tokenErr):
+			slog.DebugContext(actx, "Token response", "audience", audience, "status", tokenErr.StatusCode, "body", tokenErr.Body)
+			if !cfg.Daemon {
+				// The exit status tells the orchestration a rejected request.
+				fatal("Authentication failed", "audience", audience, "request_id", id, "error", tokenErr)
+			}
+			slog.WarnContext(actx, "Authentication failed", "audience", audience, "error", tokenErr)
+		case err != nil:
+			if !cfg.Daemon {
+				fatal("Token exchange failed", "audience", audience, "request_id", id, "error", err)
+			}
+			slog.WarnContext(actx, "Token exchange failed", "audience", audience, "error", err)
+		default:
+			slog.DebugContext(actx, "Token response", "audience", audience, "status", http.StatusOK, "body", token.Raw)
+			d.setToken(ctx, audience, issuedToken{TokenResponse: token, issuedAt: issuedAt, reason: reasonInitial})
+			slog.Info("Authentication successful",
+				"audience", audience,
+				"token_type", token.TokenType,
+				"expires_in", token.ExpiresIn,
+				"scope", token.Scope)
+			if svidCert != nil {
+				if token.Confirmation.BoundTo(svidCert) {
+					slog.Info("Access token bound to the X509-SVID", "x5t#S256", token.Confirmation.X5TS256)
+				} else {
+					slog.Warn("Access token is not bound to the X509-SVID (enable certificate-bound tokens on the client)")
+				}
+			}
+			if cfg.DPoP != "" {
+				if dpop, err := ex.dpopTransport(); err == nil && token.Confirmation.BoundToKey(dpop.Key()) {
+					slog.Info("Access token bound to the DPoP key", "jkt", token.Confirmation.JKT)
+				} else {
+					slog.Warn("Access token is not bound to the DPoP key (enable DPoP on the client)", "token_type", token.TokenType)
+				}
+			}
+		}
+	}
+
+	if cfg.Daemon {
+		d.rotations = watchRotations(rootCtx, cfg)
+		d.reloads = watchReloads(rootCtx, cfg, func() (Config, error) { return loadConfig(args) })
+		go runWatchdog(rootCtx, state)
+		if err := d.run(rootCtx); err != nil {
+			fatal("Daemon failed", "error", err)
+		}
+	}
+
+	slog.Info("Test completed")
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
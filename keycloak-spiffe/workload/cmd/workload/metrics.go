@@ -0,0 +1,180 @@
+// metrics.go
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/retry"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/spire"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/tokenauth"
+)
+
+const (
+	resultSuccess = "success"
+	resultFailure = "failure"
+)
+
+var (
+	svidFetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "workload_svid_fetches_total",
+		Help: "JWT-SVID fetches from the SPIRE Agent by result.",
+	}, []string{"result"})
+
+	svidRotations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "workload_svid_rotations_total",
+		Help: "SVID and trust bundle rotations pushed by the SPIRE Agent by kind.",
+	}, []string{"kind"})
+
+	configReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "workload_config_reloads_total",
+		Help: "Configuration reloads of the daemon by result: applied, invalid or failed.",
+	}, []string{"result"})
+
+	degraded = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "workload_degraded",
+		Help: "1 while the SPIRE Agent is unreachable and the daemon serves its cached tokens.",
+	})
+
+	tokenExchanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "workload_token_exchanges_total",
+		Help: "Token requests to Keycloak by authentication method and result.",
+	}, []string{"auth_method", "result"})
+
+	failures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "workload_failures_total",
+		Help: "Failed SPIRE and Keycloak calls by error class.",
+	}, []string{"class"})
+
+	exchangeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "workload_token_exchange_duration_seconds",
+		Help:    "Latency of the token requests to Keycloak.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"auth_method"})
+
+	keycloakEndpointUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "workload_keycloak_endpoint_up",
+		Help: "1 while a Keycloak failover endpoint answers, 0 while it cools down after a failure.",
+	}, []string{"endpoint"})
+
+	keycloakFailovers = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "workload_keycloak_failovers_total",
+		Help: "Switches of the Keycloak requests to another failover endpoint.",
+	})
+
+	keycloakCircuitState = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "workload_keycloak_circuit_state",
+		Help: "State of the Keycloak circuit breaker: 0 closed, 1 half-open (probing), 2 open (failing fast).",
+	})
+
+	keycloakCircuitOpens = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "workload_keycloak_circuit_opens_total",
+		Help: "Openings of the Keycloak circuit breaker after consecutive token request failures.",
+	})
+
+	alertsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "workload_alerts_sent_total",
+		Help: "Alerts delivered to the alert webhook, by alert and status (firing or resolved).",
+	}, []string{"alert", "status"})
+
+	bundleSyncs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "workload_bundle_syncs_total",
+		Help: "Pushes of the SPIRE JWT bundle to Keycloak by admin sync-bundle, by result (success or failure).",
+	}, []string{"result"})
+
+	tokenRequestsThrottled = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "workload_token_requests_throttled_total",
+		Help: "Token requests delayed by the client-side rate limit.",
+	})
+
+	phaseTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "workload_phase_timeouts_total",
+		Help: "Phases of the runs that exceeded their own timeout: svid_fetch, discovery or token_request.",
+	}, []string{"phase"})
+
+	tokenLifetime = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "workload_token_remaining_lifetime_seconds",
+		Help:    "Remaining lifetime of the access tokens when they are issued.",
+		Buckets: []float64{30, 60, 120, 300, 600, 1800, 3600, 7200, 86400},
+	})
+)
+
+// errorClass returns the metrics label describing err.
+func errorClass(err error) string {
+	var tokenErr *keycloak.TokenError
+	var regErr *keycloak.RegistrationError
+	var adminErr *keycloak.AdminError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, tokenauth.ErrInvalidToken):
+		return "invalid_token"
+	case errors.As(err, &tokenErr):
+		return statusClass(tokenErr.StatusCode)
+	case errors.As(err, &regErr):
+		return statusClass(regErr.StatusCode)
+	case errors.As(err, &adminErr):
+		return statusClass(adminErr.StatusCode)
+	case errors.As(err, &netErr):
+		return "network"
+	}
+	return "other"
+}
+
+func statusClass(code int) string {
+	switch {
+	case code == http.StatusTooManyRequests:
+		return "rate_limited"
+	case code >= 500:
+		return "server_error"
+	}
+	return "client_error"
+}
+
+// fetchJWTSVID fetches a JWT-SVID for audience, tracing and counting the fetch.
+func fetchJWTSVID(ctx context.Context, source spire.JWTSVIDSource, audience string) (*jwtsvid.SVID, error) {
+	if source == nil {
+		return nil, retry.Permanent(errors.New("no JWT-SVID without the SPIRE Agent, not used with the nomad auth method"))
+	}
+	ctx, span := startSpan(ctx, "spire.FetchJWTSVID", attribute.String("spiffe.audience", audience))
+	svid, err := spire.FetchJWTSVID(ctx, source, audience)
+	endSpan(span, err)
+	if err != nil {
+		svidFetches.WithLabelValues(resultFailure).Inc()
+		failures.WithLabelValues("spire").Inc()
+		if errors.Is(err, spire.ErrUnexpectedIdentity) {
+			// Retrying does not change the registration entries.
+			return nil, retry.Permanent(&svidError{err})
+		}
+		return nil, fetchError(err)
+	}
+	svidFetches.WithLabelValues(resultSuccess).Inc()
+	expiries.setSVID(audience, svid.ID.String(), svid.Expiry)
+	return svid, nil
+}
+
+// observeExchange records the outcome of a token request sent at start.
+func observeExchange(authMethod string, start time.Time, token *keycloak.TokenResponse, err error) {
+	exchangeDuration.WithLabelValues(authMethod).Observe(time.Since(start).Seconds())
+	if err != nil {
+		tokenExchanges.WithLabelValues(authMethod, resultFailure).Inc()
+		failures.WithLabelValues(errorClass(err)).Inc()
+		return
+	}
+	tokenExchanges.WithLabelValues(authMethod, resultSuccess).Inc()
+	if token.ExpiresIn > 0 {
+		tokenLifetime.Observe(float64(token.ExpiresIn))
+	}
+}
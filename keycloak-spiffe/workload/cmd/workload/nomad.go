@@ -0,0 +1,64 @@
+// nomad.go
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// nomadIdentityToken returns the workload identity token Nomad gives the
+// task: the one of TokenFile when set, otherwise the one of the identity
+// named Identity (the default identity when empty) that the identity block
+// exposes in the environment (env = true) or in the secrets directory
+// (file = true). The file is read on each call, Nomad rewriting it when it
+// renews the identity.
+func nomadIdentityToken(cfg NomadConfig) (string, error) {
+	name, variable := "nomad_token", "NOMAD_TOKEN"
+	if cfg.Identity != "" {
+		name, variable = "nomad_"+cfg.Identity+".jwt", "NOMAD_TOKEN_"+cfg.Identity
+	}
+	file := cfg.TokenFile
+	if file == "" {
+		if token := os.Getenv(variable); token != "" {
+			return checkNomadToken(token, variable)
+		}
+		dir := os.Getenv("NOMAD_SECRETS_DIR")
+		if dir == "" {
+			return "", fmt.Errorf("no Nomad workload identity: %s and NOMAD_SECRETS_DIR are unset, set NOMAD_IDENTITY_FILE outside a Nomad task", variable)
+		}
+		file = filepath.Join(dir, name)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("reading the Nomad workload identity: %w", err)
+	}
+	return checkNomadToken(strings.TrimSpace(string(data)), file)
+}
+
+// checkNomadToken returns token, the Nomad workload identity read from
+// source, unless it is not a JWT or expired.
+func checkNomadToken(token, source string) (string, error) {
+	claims, ok := peekClaims(token)
+	if !ok {
+		return "", fmt.Errorf("the Nomad workload identity of %s is not a JWT", source)
+	}
+	if claims.ExpiresAt > 0 && time.Now().After(time.Unix(claims.ExpiresAt, 0)) {
+		return "", fmt.Errorf("the Nomad workload identity of %s expired", source)
+	}
+	return token, nil
+}
+
+// nomadSubject returns the sub claim of the Nomad workload identity, such as
+// global:default:reports:api:server:default, the region, namespace, job,
+// group, task and identity name of the task.
+func nomadSubject(cfg NomadConfig) (string, error) {
+	token, err := nomadIdentityToken(cfg)
+	if err != nil {
+		return "", err
+	}
+	claims, _ := peekClaims(token)
+	return claims.Subject, nil
+}
@@ -0,0 +1,53 @@
+// ops.go
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// serveOps serves the Prometheus /metrics endpoint and, in daemon mode, the
+// /healthz and /readyz endpoints of state until ctx is cancelled. Endpoints
+// configured on the same address share one listener.
+func serveOps(ctx context.Context, cfg Config, state *daemonState) {
+	muxes := map[string]*http.ServeMux{}
+	mux := func(addr string) *http.ServeMux {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+
+	if cfg.MetricsAddr != "" {
+		mux(cfg.MetricsAddr).Handle("/metrics", promhttp.Handler())
+	}
+	if cfg.HealthAddr != "" && cfg.Daemon && state != nil {
+		registerHealth(mux(cfg.HealthAddr), state)
+	}
+
+	for addr, m := range muxes {
+		go serveHTTP(ctx, addr, m)
+	}
+}
+
+// serveHTTP serves handler on addr until ctx is cancelled.
+func serveHTTP(ctx context.Context, addr string, handler http.Handler) {
+	srv := &http.Server{Addr: addr, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("Serving operational endpoints", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Operational endpoint server failed", "addr", addr, "error", err)
+	}
+}
@@ -0,0 +1,191 @@
+// output.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Formats of the tokens printed on the standard output.
+const (
+	outputJSON = "json"
+	outputYAML = "yaml"
+	outputEnv  = "env"
+	outputRaw  = "raw"
+	// outputExecCredential prints the ExecCredential of a kubectl
+	// credential plugin.
+	outputExecCredential = "exec-credential"
+	// outputAWSCredentialProcess prints the temporary AWS credentials of
+	// aws-login and sts assume for the credential_process of the AWS SDKs.
+	outputAWSCredentialProcess = "aws-credential-process"
+)
+
+// commandOutputs are the formats printed by some commands only, with the
+// commands printing them: the others would print another format instead.
+var commandOutputs = map[string]string{
+	outputExecCredential:       "the token commands (the default one, downstream-token and rpt)",
+	outputAWSCredentialProcess: "aws-login and sts assume",
+}
+
+// checkOutput returns an error when format is one of commandOutputs other
+// than printed, the command-specific format of the command, if any.
+func checkOutput(format, printed string) error {
+	if commands, ok := commandOutputs[format]; ok && format != printed {
+		return fmt.Errorf("output %s is printed by %s only", format, commands)
+	}
+	return nil
+}
+
+// execCredentialVersion is the API version of the ExecCredential of
+// client-go 1.22 and later, printed when KUBERNETES_EXEC_INFO does not ask
+// for another one.
+const execCredentialVersion = "client.authentication.k8s.io/v1"
+
+// execCredential is the ExecCredential read by kubectl, and client-go, from
+// an exec plugin: the bearer token sent to the API server, cached until it
+// expires.
+type execCredential struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Status     struct {
+		Token               string `json:"token"`
+		ExpirationTimestamp string `json:"expirationTimestamp,omitempty"`
+	} `json:"status"`
+}
+
+// outputToken is the token printed by the json and yaml output formats.
+type outputToken struct {
+	Token     string `json:"token" yaml:"token"`
+	TokenType string `json:"token_type" yaml:"token_type"`
+	ExpiresIn int    `json:"expires_in,omitempty" yaml:"expires_in,omitempty"`
+	ExpiresAt string `json:"expiry,omitempty" yaml:"expiry,omitempty"`
+	IssuedAt  string `json:"issued_at" yaml:"issued_at"`
+	SPIFFEID  string `json:"spiffe_id" yaml:"spiffe_id"`
+	Audience  string `json:"audience" yaml:"audience"`
+	Scope     string `json:"scope,omitempty" yaml:"scope,omitempty"`
+	// DPoPJKT is the thumbprint of the DPoP key of a DPoP-bound token.
+	DPoPJKT string `json:"dpop_jkt,omitempty" yaml:"dpop_jkt,omitempty"`
+}
+
+// outputSink prints every access token obtained on w in the configured
+// format, for scripts and CI jobs reading the standard output. In daemon
+// mode each refresh prints the token again: a JSON object per line, a YAML
+// document, a block of variables or a line.
+type outputSink struct {
+	w        io.Writer
+	format   string
+	spiffeID string
+	// suffix appends the audience to the env variable names, so that the
+	// tokens of several audiences do not override each other.
+	suffix bool
+}
+
+// newOutputSink returns the sink printing the tokens of cfg on w, those of
+// the workload identity spiffeID.
+func newOutputSink(cfg Config, w io.Writer, spiffeID string) *outputSink {
+	return &outputSink{w: w, format: cfg.Output, spiffeID: spiffeID, suffix: len(cfg.Audience) > 1}
+}
+
+func (s *outputSink) writeToken(_ context.Context, audience string, token issuedToken) error {
+	out := outputToken{
+		Token:     token.AccessToken,
+		TokenType: token.TokenType,
+		ExpiresIn: token.ExpiresIn,
+		IssuedAt:  token.issuedAt.UTC().Format(time.RFC3339),
+		SPIFFEID:  s.spiffeID,
+		Audience:  audience,
+		Scope:     token.Scope,
+	}
+	if token.Confirmation != nil {
+		out.DPoPJKT = token.Confirmation.JKT
+	}
+	if token.ExpiresIn > 0 {
+		out.ExpiresAt = token.issuedAt.Add(time.Duration(token.ExpiresIn) * time.Second).UTC().Format(time.RFC3339)
+	}
+
+	var data []byte
+	switch s.format {
+	case outputJSON:
+		b, err := json.Marshal(out)
+		if err != nil {
+			return fmt.Errorf("encoding the token output: %w", err)
+		}
+		data = append(b, '\n')
+	case outputYAML:
+		b, err := yaml.Marshal(out)
+		if err != nil {
+			return fmt.Errorf("encoding the token output: %w", err)
+		}
+		data = append([]byte("---\n"), b...)
+	case outputEnv:
+		data = s.env(audience, out)
+	case outputExecCredential:
+		cred := execCredential{APIVersion: execCredentialAPIVersion(), Kind: "ExecCredential"}
+		cred.Status.Token = out.Token
+		cred.Status.ExpirationTimestamp = out.ExpiresAt
+		b, err := json.Marshal(cred)
+		if err != nil {
+			return fmt.Errorf("encoding the token output: %w", err)
+		}
+		data = append(b, '\n')
+	default:
+		data = []byte(out.Token + "\n")
+	}
+	if _, err := s.w.Write(data); err != nil {
+		return fmt.Errorf("writing the token output: %w", err)
+	}
+	return nil
+}
+
+// unsafeEnvChars matches the audience characters not kept in variable
+// names.
+var unsafeEnvChars = regexp.MustCompile(`[^A-Z0-9_]+`)
+
+// env formats out as dotenv variables, named as the ones of the exec
+// wrapper and the renew hook and quoted for a POSIX shell.
+func (s *outputSink) env(audience string, out outputToken) []byte {
+	suffix := ""
+	if s.suffix {
+		suffix = "_" + strings.Trim(unsafeEnvChars.ReplaceAllString(strings.ToUpper(audience), "_"), "_")
+	}
+	vars := [][2]string{
+		{"ACCESS_TOKEN", out.Token},
+		{"TOKEN_TYPE", out.TokenType},
+		{"TOKEN_EXPIRES_IN", strconv.Itoa(out.ExpiresIn)},
+		{"TOKEN_EXPIRES_AT", out.ExpiresAt},
+		{"TOKEN_ISSUED_AT", out.IssuedAt},
+		{"TOKEN_AUDIENCE", out.Audience},
+		{"TOKEN_SCOPE", out.Scope},
+		{"SPIFFE_ID", out.SPIFFEID},
+	}
+	if out.DPoPJKT != "" {
+		vars = append(vars, [2]string{"TOKEN_DPOP_JKT", out.DPoPJKT})
+	}
+	var b strings.Builder
+	for _, v := range vars {
+		fmt.Fprintf(&b, "%s%s='%s'\n", v[0], suffix, strings.ReplaceAll(v[1], "'", `'\''`))
+	}
+	return []byte(b.String())
+}
+
+// execCredentialAPIVersion returns the ExecCredential API version kubectl
+// asks for in KUBERNETES_EXEC_INFO, the apiVersion of the kubeconfig exec
+// block, v1 when unset.
+func execCredentialAPIVersion() string {
+	var info struct {
+		APIVersion string `json:"apiVersion"`
+	}
+	if json.Unmarshal([]byte(os.Getenv("KUBERNETES_EXEC_INFO")), &info) != nil || info.APIVersion == "" {
+		return execCredentialVersion
+	}
+	return info.APIVersion
+}
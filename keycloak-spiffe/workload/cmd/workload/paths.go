@@ -0,0 +1,104 @@
+// paths.go
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+)
+
+// legacyPathAuto detects whether Keycloak serves its endpoints under the
+// legacy /auth prefix.
+const legacyPathAuto = "auto"
+
+// detectedPathPrefixes caches the path prefix detected per Keycloak URL and
+// realm, so that the later sessions and reloads of the process reuse it.
+var detectedPathPrefixes sync.Map
+
+func pathPrefixKey(c Config) string {
+	return c.KeycloakURL + "\x00" + c.Realm
+}
+
+// pathPrefix returns the prefix of the Keycloak endpoints: the legacy /auth
+// with LegacyPath true, none with false and, with auto, the detected one,
+// the legacy prefix until the detection succeeds.
+func (c Config) pathPrefix() string {
+	switch c.LegacyPath {
+	case "false":
+		return ""
+	case legacyPathAuto:
+		if prefix, ok := detectedPathPrefixes.Load(pathPrefixKey(c)); ok {
+			return prefix.(string)
+		}
+	}
+	return keycloak.LegacyPathPrefix
+}
+
+// realmURL returns the URL of the realm, which is also the issuer of its
+// tokens.
+func (c Config) realmURL() string {
+	return keycloak.PrefixedRealmURL(c.KeycloakURL, c.pathPrefix(), c.Realm)
+}
+
+// resolveKeycloakPath detects the path prefix of the Keycloak endpoints when
+// LegacyPath is auto, trying the discovery document at both paths, and
+// updates the default audience to the detected realm URL. A failed
+// detection is logged and retried by the next session and the next refresh
+// of the daemon, the legacy prefix being used meanwhile.
+func resolveKeycloakPath(ctx context.Context, cfg *Config, client *http.Client) {
+	if cfg.LegacyPath != legacyPathAuto {
+		return
+	}
+	if _, ok := detectedPathPrefixes.Load(pathPrefixKey(*cfg)); !ok {
+		var prefix string
+		err := withPhaseTimeout(ctx, phaseDiscovery, cfg.Timeouts.Discovery, func(ctx context.Context) (err error) {
+			prefix, _, err = keycloak.DetectPathPrefix(ctx, client, cfg.KeycloakURL, cfg.Realm)
+			return err
+		})
+		if err != nil {
+			slog.Warn("Failed to detect the Keycloak paths, using the legacy /auth prefix (set LEGACY_PATH)", "error", err)
+			return
+		}
+		detectedPathPrefixes.Store(pathPrefixKey(*cfg), prefix)
+		slog.Info("Detected the Keycloak paths", "realm_url", cfg.realmURL(), "legacy", prefix != "")
+	}
+	if cfg.defaultAudience {
+		cfg.Audience = stringList{cfg.realmURL()}
+	}
+}
+
+// retryKeycloakPath retries the detection of the Keycloak paths that failed
+// when the daemon started and, once it succeeds, moves the daemon to the
+// endpoints and default audience of the detected realm URL.
+func (d *daemon) retryKeycloakPath(ctx context.Context) {
+	if d.cfg.LegacyPath != legacyPathAuto {
+		return
+	}
+	if _, ok := detectedPathPrefixes.Load(pathPrefixKey(d.cfg)); ok {
+		return
+	}
+	cfg := d.cfg
+	resolveKeycloakPath(ctx, &cfg, d.ex.client)
+	if cfg.realmURL() == d.cfg.realmURL() {
+		return
+	}
+	endpoints := discoverEndpoints(ctx, cfg, d.ex.client)
+	ex, err := newExchanger(cfg, d.ex.client, endpoints, d.ex.jwtSource, d.ex.x509Source)
+	if err != nil {
+		slog.Warn("Failed to use the detected Keycloak paths", "error", err)
+		return
+	}
+	// The tokens of the previous default audience are not renewed.
+	kept := make(map[string]issuedToken, len(cfg.Audience))
+	for _, audience := range cfg.Audience {
+		if token, ok := d.tokens[audience]; ok {
+			kept[audience] = token
+		}
+	}
+	d.cfg, d.ex, d.tokens = cfg, ex, kept
+	d.state.setAudiences(cfg.Audience)
+	slog.Info("Using the detected Keycloak token endpoint", "token_endpoint", endpoints.TokenEndpoint)
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+// paths_other.go
+package main
+
+import "os"
+
+const defaultBrokerSocket = "/run/keycloak-spiffe/broker.sock"
+
+// replaceFile renames tmp over path, atomically on POSIX systems.
+func replaceFile(tmp, path string) error {
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,40 @@
+//go:build windows
+
+// paths_windows.go
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// errorSharingViolation is ERROR_SHARING_VIOLATION, missing from syscall.
+const errorSharingViolation syscall.Errno = 32
+
+// defaultBrokerSocket is under ProgramData, Windows has no /run.
+var defaultBrokerSocket = filepath.Join(programData(), "keycloak-spiffe", "broker.sock")
+
+func programData() string {
+	if dir := os.Getenv("ProgramData"); dir != "" {
+		return dir
+	}
+	return `C:\ProgramData`
+}
+
+// replaceFile renames tmp over path. Windows refuses to replace a file
+// another process has open without delete sharing, as readers of the token
+// files usually do, so the rename is retried for a short while.
+func replaceFile(tmp, path string) error {
+	var err error
+	for attempt := 0; attempt < 10; attempt++ {
+		err = os.Rename(tmp, path)
+		if err == nil || !errors.Is(err, syscall.ERROR_ACCESS_DENIED) && !errors.Is(err, errorSharingViolation) {
+			return err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return err
+}
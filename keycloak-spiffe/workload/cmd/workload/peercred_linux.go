@@ -0,0 +1,32 @@
+// peercred_linux.go
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// unixPeerCred returns the SO_PEERCRED credentials of the process connected
+// to c.
+func unixPeerCred(c net.Conn) (peerCred, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return peerCred{}, fmt.Errorf("not a Unix socket connection")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return peerCred{}, err
+	}
+	var ucred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return peerCred{}, err
+	}
+	if credErr != nil {
+		return peerCred{}, fmt.Errorf("reading SO_PEERCRED: %w", credErr)
+	}
+	return peerCred{pid: int(ucred.Pid), uid: int(ucred.Uid), gid: int(ucred.Gid)}, nil
+}
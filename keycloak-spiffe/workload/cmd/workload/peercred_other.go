@@ -0,0 +1,15 @@
+//go:build !linux
+
+// peercred_other.go
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// unixPeerCred is only implemented on Linux, elsewhere every broker request
+// is denied.
+func unixPeerCred(net.Conn) (peerCred, error) {
+	return peerCred{}, errors.New("peer credentials are only supported on Linux")
+}
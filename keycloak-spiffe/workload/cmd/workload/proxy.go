@@ -0,0 +1,155 @@
+// proxy.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloakspiffe"
+)
+
+type proxyTokenKey struct{}
+
+// tokenProxy forwards the requests of a local application to the upstream
+// with the access token of the primary audience, for applications that
+// cannot be changed to obtain tokens themselves.
+type tokenProxy struct {
+	audience string
+	ex       *exchanger
+	cache    *keycloakspiffe.Cache
+	key      keycloakspiffe.CacheKey
+	proxy    *httputil.ReverseProxy
+
+	// dpop sends the proxied requests with DPoP proofs signed with the key
+	// of the tokens, nil until the first request with DPoP enabled.
+	dpopMu sync.Mutex
+	dpop   *keycloak.DPoPTransport
+}
+
+// runProxy implements the proxy subcommand.
+func runProxy(args []string) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	setupLogging(cfg)
+	if cfg.Proxy.Upstream == "" {
+		return errors.New("the proxy needs an upstream URL (-proxy-upstream)")
+	}
+	upstream, err := url.Parse(cfg.Proxy.Upstream)
+	if err != nil {
+		return fmt.Errorf("parsing proxy upstream: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		return err
+	}
+	defer flushTraces(shutdownTracing)
+	serveOps(ctx, cfg, nil)
+
+	bootCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	s, err := openSession(bootCtx, &cfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	audience := cfg.primaryAudience()
+	p := &tokenProxy{
+		audience: audience,
+		ex:       s.ex,
+		cache:    keycloakspiffe.NewCache(0),
+		key:      keycloakspiffe.CacheKey{Audience: audience, Realm: cfg.Realm, ClientID: s.ex.clientID, Scope: cfg.Scope, Resource: strings.Join(cfg.Resource, " ")},
+	}
+	p.proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(upstream)
+			pr.SetXForwarded()
+			// Replace any credentials sent by the application.
+			token := pr.In.Context().Value(proxyTokenKey{}).(*oauth2.Token)
+			pr.Out.Header.Set("Authorization", token.Type()+" "+token.AccessToken)
+		},
+		ModifyResponse: p.checkResponse,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.Warn("Proxy request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+			http.Error(w, "upstream unavailable", http.StatusBadGateway)
+		},
+	}
+	if cfg.DPoP != "" {
+		p.proxy.Transport = p
+	}
+
+	srv := &http.Server{Addr: cfg.Proxy.Listen, Handler: p, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("Proxying requests with the access token", "listen", cfg.Proxy.Listen, "upstream", cfg.Proxy.Upstream, "audience", audience)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// ServeHTTP obtains the current token, exchanging a fresh JWT-SVID when it
+// is about to expire, and forwards r with it.
+func (p *tokenProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, err := p.cache.Get(r.Context(), p.key, func(ctx context.Context) (*keycloak.TokenResponse, error) {
+		return p.ex.exchangeAudience(ctx, p.audience)
+	})
+	if err != nil {
+		slog.Warn("Proxy token exchange failed", "audience", p.audience, "error", err)
+		http.Error(w, "token unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	p.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyTokenKey{}, token)))
+}
+
+// RoundTrip sends a proxied request with a DPoP proof signed with the key
+// the tokens of the exchanger are bound to.
+func (p *tokenProxy) RoundTrip(req *http.Request) (*http.Response, error) {
+	current, err := p.ex.dpopTransport()
+	if err != nil {
+		return nil, err
+	}
+	// The exchanger transport is set up for Keycloak, not for the upstream.
+	p.dpopMu.Lock()
+	if p.dpop == nil || p.dpop.Key() != current.Key() {
+		p.dpop = keycloak.NewDPoPTransport(current.Key(), http.DefaultTransport)
+	}
+	dpop := p.dpop
+	p.dpopMu.Unlock()
+	return dpop.RoundTrip(req)
+}
+
+// checkResponse drops the cached token when the upstream rejects it, so
+// that the next request carries a fresh one.
+func (p *tokenProxy) checkResponse(resp *http.Response) error {
+	if resp.StatusCode == http.StatusUnauthorized {
+		slog.Warn("Upstream rejected the access token, renewing it", "path", resp.Request.URL.Path)
+		p.cache.Invalidate(p.key)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+// ratelimit.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// tokenLimiter paces the token requests of the whole process: the broker
+// and the reloads create several exchangers, which must share one budget.
+var tokenLimiter struct {
+	sync.Mutex
+	limiter *rate.Limiter
+}
+
+// waitTokenRequest waits for the turn of a token request under c. It fails
+// at once when the wait would outlast the deadline of ctx.
+func waitTokenRequest(ctx context.Context, c RateLimitConfig) error {
+	if c.RPS <= 0 {
+		return nil
+	}
+	tokenLimiter.Lock()
+	if tokenLimiter.limiter == nil {
+		tokenLimiter.limiter = rate.NewLimiter(rate.Limit(c.RPS), c.Burst)
+	} else if tokenLimiter.limiter.Limit() != rate.Limit(c.RPS) || tokenLimiter.limiter.Burst() != c.Burst {
+		tokenLimiter.limiter.SetLimit(rate.Limit(c.RPS))
+		tokenLimiter.limiter.SetBurst(c.Burst)
+	}
+	r := tokenLimiter.limiter.Reserve()
+	tokenLimiter.Unlock()
+
+	delay := r.Delay()
+	if delay == 0 {
+		return nil
+	}
+	tokenRequestsThrottled.Inc()
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		r.Cancel()
+		return fmt.Errorf("token request rate limit of %v/s: waiting %s would exceed the deadline: %w", c.RPS, delay.Round(time.Millisecond), context.DeadlineExceeded)
+	}
+	slog.Debug("Token request delayed by the rate limit", "delay", delay, "rate_limit", c.RPS)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,139 @@
+// reload.go
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+// reloadable returns cfg with the settings the daemon applies without a
+// restart taken from next: the audiences, the token outputs and the
+// Keycloak endpoints.
+func reloadable(cfg, next Config) Config {
+	cfg.KeycloakURL = next.KeycloakURL
+	cfg.Realm = next.Realm
+	cfg.Discovery = next.Discovery
+	cfg.LegacyPath = next.LegacyPath
+	cfg.Audience = next.Audience
+	cfg.defaultAudience = next.defaultAudience
+	cfg.TokenFile = next.TokenFile
+	cfg.KubeSecret = next.KubeSecret
+	cfg.RenewHook = next.RenewHook
+	return cfg
+}
+
+// watchReloads returns the configurations loaded by load on SIGHUP and,
+// every cfg.ReloadInterval when set, after the configuration file changed.
+// Invalid configurations are logged and skipped.
+func watchReloads(ctx context.Context, cfg Config, load func() (Config, error)) <-chan Config {
+	reloads := make(chan Config)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	var ticker *time.Ticker
+	var modTime time.Time
+	if cfg.ConfigFile != "" && cfg.ReloadInterval > 0 {
+		ticker = time.NewTicker(cfg.ReloadInterval)
+		tick = ticker.C
+		modTime = fileModTime(cfg.ConfigFile)
+	}
+
+	go func() {
+		defer signal.Stop(hup)
+		if ticker != nil {
+			defer ticker.Stop()
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				slog.Info("Reloading the configuration", "trigger", "SIGHUP")
+			case <-tick:
+				t := fileModTime(cfg.ConfigFile)
+				if t.Equal(modTime) {
+					continue
+				}
+				modTime = t
+				slog.Info("Reloading the configuration", "trigger", "file", "file", cfg.ConfigFile)
+			}
+			next, err := load()
+			if err != nil {
+				configReloads.WithLabelValues("invalid").Inc()
+				slog.Warn("Invalid configuration, keeping the current one", "error", err)
+				continue
+			}
+			select {
+			case reloads <- next:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return reloads
+}
+
+// fileModTime returns the modification time of path, zero when it cannot
+// be read.
+func fileModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// reload applies the reloadable settings of next. The tokens of the
+// remaining audiences are kept, and written to the new outputs when they
+// changed; the tokens of the added audiences are obtained by the caller.
+func (d *daemon) reload(ctx context.Context, next Config) error {
+	cfg := reloadable(d.cfg, next)
+	// next was validated with its own values for the other settings.
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(cfg, next) {
+		slog.Warn("The configuration changes other than the audiences, token outputs and Keycloak endpoints need a restart")
+	}
+
+	sinks := d.sinks
+	outputsChanged := cfg.TokenFile != d.cfg.TokenFile || cfg.KubeSecret != d.cfg.KubeSecret || cfg.RenewHook != d.cfg.RenewHook
+	if outputsChanged {
+		var err error
+		if sinks, err = newSinks(cfg); err != nil {
+			return err
+		}
+	}
+	endpoints := d.ex.endpoints
+	if cfg.KeycloakURL != d.cfg.KeycloakURL || cfg.Realm != d.cfg.Realm || cfg.Discovery != d.cfg.Discovery || cfg.LegacyPath != d.cfg.LegacyPath {
+		resolveKeycloakPath(ctx, &cfg, d.ex.client)
+		endpoints = discoverEndpoints(ctx, cfg, d.ex.client)
+		slog.Info("Using the reloaded Keycloak token endpoint", "token_endpoint", endpoints.TokenEndpoint)
+	}
+	ex, err := newExchanger(cfg, d.ex.client, endpoints, d.ex.jwtSource, d.ex.x509Source)
+	if err != nil {
+		return err
+	}
+
+	kept := make(map[string]issuedToken, len(cfg.Audience))
+	for _, audience := range cfg.Audience {
+		if token, ok := d.tokens[audience]; ok {
+			kept[audience] = token
+		}
+	}
+	d.cfg, d.ex, d.sinks, d.tokens = cfg, ex, sinks, kept
+	d.state.setAudiences(cfg.Audience)
+	if outputsChanged {
+		for audience, token := range kept {
+			d.writeToken(ctx, audience, token)
+		}
+	}
+	slog.Info("Configuration reloaded", "audiences", len(cfg.Audience))
+	return nil
+}
@@ -0,0 +1,103 @@
+// requestid.go
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+)
+
+// defaultRequestIDHeader is the header carrying the request ID to Keycloak.
+const defaultRequestIDHeader = "X-Request-ID"
+
+// requestIDHeaderNone does not send the request IDs to Keycloak.
+const requestIDHeaderNone = "none"
+
+// headerNamePattern matches the request ID header names.
+var headerNamePattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// requestIDPattern matches the request IDs accepted from the broker
+// clients, which are logged and forwarded to Keycloak.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// requestIDHeader returns the header carrying the request IDs, empty when
+// they are not sent.
+func (c Config) requestIDHeader() string {
+	if c.RequestIDHeader == requestIDHeaderNone {
+		return ""
+	}
+	return c.RequestIDHeader
+}
+
+// withRequestID returns ctx carrying a new request ID, or ctx itself when
+// it already carries one, and the ID.
+func withRequestID(ctx context.Context) (context.Context, string) {
+	if id := requestID(ctx); id != "" {
+		return ctx, id
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	return context.WithValue(ctx, requestIDKey{}, id), id
+}
+
+// withClientRequestID returns ctx carrying the request ID sent by a client
+// in header, or a new one when it sent none or an invalid one.
+func withClientRequestID(ctx context.Context, header string, r *http.Request) (context.Context, string) {
+	if header != "" {
+		if id := r.Header.Get(header); requestIDPattern.MatchString(id) {
+			return context.WithValue(ctx, requestIDKey{}, id), id
+		}
+	}
+	return withRequestID(ctx)
+}
+
+// requestID returns the request ID of ctx, empty when it has none.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDHandler adds the request ID of the context of each record, as
+// request_id, to the records of the *Context logging functions.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// requestIDTransport sends the request ID of the context of each request in
+// header, so that the Keycloak access logs can be correlated with the
+// workload logs.
+type requestIDTransport struct {
+	next   http.RoundTripper
+	header string
+}
+
+func (t *requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id := requestID(req.Context())
+	if id == "" || req.Header.Get(t.header) != "" {
+		return t.next.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set(t.header, id)
+	return t.next.RoundTrip(req)
+}
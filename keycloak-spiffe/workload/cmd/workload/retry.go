@@ -0,0 +1,127 @@
+// retry.go
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/retry"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/spire"
+)
+
+// retryPolicy returns the configured retry policy, reporting each retry of what.
+func (c Config) retryPolicy(what string) retry.Policy {
+	return c.retryPolicyContext(context.Background(), what)
+}
+
+// retryPolicyContext returns the retry policy of retryPolicy, logging the
+// retries with the request ID of ctx.
+func (c Config) retryPolicyContext(ctx context.Context, what string) retry.Policy {
+	return retry.Policy{
+		MaxAttempts:    c.Retry.MaxAttempts,
+		BaseDelay:      c.Retry.BaseDelay,
+		MaxDelay:       c.Retry.MaxDelay,
+		Jitter:         c.Retry.Jitter,
+		AttemptTimeout: c.Retry.AttemptTimeout,
+		OnRetry: func(attempt int, err error, delay time.Duration) {
+			slog.WarnContext(ctx, what+" failed, retrying",
+				"attempt", attempt,
+				"max_attempts", c.Retry.MaxAttempts,
+				"delay", delay.Round(time.Millisecond),
+				"error", err)
+		},
+	}
+}
+
+// keycloakRetry stops retrying on Keycloak errors that are not transient,
+// such as a rejected client assertion.
+func keycloakRetry(err error) error {
+	if err != nil && !keycloak.IsTransient(err) {
+		return retry.Permanent(err)
+	}
+	return err
+}
+
+// waitForSocket waits up to the configured socket wait timeout for the
+// SPIRE Agent socket to accept connections, returning at once when the
+// wait is disabled.
+func waitForSocket(ctx context.Context, cfg Config) error {
+	if cfg.SocketWait.Timeout <= 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.SocketWait.Timeout)
+	defer cancel()
+	start := time.Now()
+	err := spire.WaitForSocket(ctx, cfg.SocketPath, cfg.SocketWait.Interval, func(err error) {
+		slog.Info("Waiting for the SPIRE Agent socket", "socket", cfg.SocketPath, "timeout", cfg.SocketWait.Timeout, "error", err)
+	})
+	if err != nil {
+		failures.WithLabelValues("spire").Inc()
+		return &spireError{err}
+	}
+	if waited := time.Since(start); waited > cfg.SocketWait.Interval {
+		slog.Info("SPIRE Agent socket available", "waited", waited.Round(time.Second))
+	}
+	return nil
+}
+
+// newX509Source connects to the SPIRE Agent for X509-SVIDs, retrying until
+// the Workload API socket is available.
+func newX509Source(ctx context.Context, cfg Config) (*workloadapi.X509Source, error) {
+	if err := waitForSocket(ctx, cfg); err != nil {
+		return nil, err
+	}
+	var source *workloadapi.X509Source
+	err := withPhaseTimeout(ctx, phaseSVIDFetch, cfg.Timeouts.SVIDFetch, func(ctx context.Context) error {
+		return cfg.retryPolicy("Connecting to the SPIRE Agent").Do(ctx, func(ctx context.Context) error {
+			var err error
+			ctx, span := startSpan(ctx, "spire.NewX509Source")
+			source, err = spire.NewX509Source(ctx, cfg.SocketPath, cfg.SPIFFEID)
+			endSpan(span, err)
+			if err != nil {
+				failures.WithLabelValues("spire").Inc()
+			}
+			return err
+		})
+	})
+	if err != nil {
+		return nil, sourceError(cfg, err)
+	}
+	expiries.setX509Source(source)
+	return source, nil
+}
+
+// newJWTSource connects to the SPIRE Agent for JWT-SVIDs, retrying until
+// the Workload API socket is available.
+func newJWTSource(ctx context.Context, cfg Config) (*workloadapi.JWTSource, error) {
+	if err := waitForSocket(ctx, cfg); err != nil {
+		return nil, err
+	}
+	var source *workloadapi.JWTSource
+	err := withPhaseTimeout(ctx, phaseSVIDFetch, cfg.Timeouts.SVIDFetch, func(ctx context.Context) error {
+		return cfg.retryPolicy("Connecting to the SPIRE Agent").Do(ctx, func(ctx context.Context) error {
+			var err error
+			ctx, span := startSpan(ctx, "spire.NewJWTSource")
+			source, err = spire.NewJWTSource(ctx, cfg.SocketPath)
+			endSpan(span, err)
+			if err != nil {
+				failures.WithLabelValues("spire").Inc()
+			}
+			return err
+		})
+	})
+	if err != nil {
+		return nil, sourceError(cfg, err)
+	}
+	return source, nil
+}
+
+// jwtSVIDs returns the JWT-SVIDs of source the workload uses: the ones of
+// the selected identity, checked against the expected identity.
+func jwtSVIDs(cfg Config, source spire.MultiJWTSVIDSource) spire.JWTSVIDSource {
+	return spire.ExpectIdentity(spire.SelectIdentity(source, cfg.SPIFFEID), cfg.expectedIdentity())
+}
@@ -0,0 +1,88 @@
+// revoke.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+)
+
+// runRevoke implements the revoke subcommand: it revokes an access or
+// refresh token, or both tokens of a token response, at the revocation
+// endpoint of the realm.
+func runRevoke(args []string) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	setupLogging(cfg)
+
+	data, err := readTokenInput(cfg.Revoke.File, "revoke")
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		return err
+	}
+	defer flushTraces(shutdownTracing)
+
+	s, err := openSession(ctx, &cfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// A token response carries the refresh token along with the access token.
+	var response *keycloak.TokenResponse
+	if data[0] == '{' {
+		if response, err = keycloak.ParseTokenResponse(data); err != nil {
+			return err
+		}
+	}
+
+	audience := cfg.primaryAudience()
+	slog.Info("Revoking the token", "revocation_endpoint", s.endpoints.RevocationEndpoint, "auth_method", cfg.AuthMethod)
+	ctx, span := startSpan(ctx, "keycloak.Revoke")
+	err = cfg.retryPolicy("Token revocation").Do(ctx, func(ctx context.Context) error {
+		if response != nil {
+			return keycloakRetry(s.ex.revoke(ctx, audience, response))
+		}
+		return keycloakRetry(s.ex.revokeToken(ctx, audience, string(data), cfg.Revoke.TokenTypeHint))
+	})
+	endSpan(span, err)
+	if err != nil {
+		return fmt.Errorf("token revocation failed: %w", err)
+	}
+	slog.Info("Token revoked")
+	return nil
+}
+
+// readTokenInput reads the token the command works on from path, the
+// standard input for "-", so that it does not show in the process list.
+func readTokenInput(path, command string) ([]byte, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading the token to %s: %w", command, err)
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, fmt.Errorf("no token to %s (-%s-file)", command, command)
+	}
+	return data, nil
+}
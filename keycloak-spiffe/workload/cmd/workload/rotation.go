@@ -0,0 +1,56 @@
+// rotation.go
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/spire"
+)
+
+// Reasons for which a token is obtained, passed to the renew hook.
+const (
+	reasonInitial = "initial"
+	reasonCached  = "cached"
+	reasonRenewal = "renewal"
+	// reasonReload obtains the tokens of the audiences added by a
+	// configuration reload.
+	reasonReload = "reload"
+)
+
+// watchRotations streams the SVID and bundle rotations pushed by the SPIRE
+// Agent until ctx is cancelled. A nil channel, never ready, is returned
+// when the agent cannot be watched: the tokens are then only renewed on
+// schedule.
+func watchRotations(ctx context.Context, cfg Config) <-chan spire.Rotation {
+	w, err := spire.NewRotationWatcher(ctx, cfg.SocketPath, cfg.SPIFFEID, func(err error) {
+		if ctx.Err() == nil {
+			slog.Warn("SVID rotation watch interrupted", "error", err)
+		}
+	})
+	if err != nil {
+		slog.Warn("Failed to watch the SVID rotations", "error", err)
+		return nil
+	}
+
+	rotations := make(chan spire.Rotation)
+	go func() {
+		defer w.Close()
+		go w.Watch(ctx)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case r := <-w.Rotations():
+				svidRotations.WithLabelValues(r.Kind).Inc()
+				slog.Info("SPIRE Agent rotated credentials", "kind", r.Kind, "id", r.ID)
+				select {
+				case rotations <- r:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return rotations
+}
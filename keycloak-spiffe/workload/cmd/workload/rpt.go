@@ -0,0 +1,124 @@
+// rpt.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/retry"
+)
+
+// runRPT implements the rpt subcommand: it obtains the access token of the
+// workload and presents it to the UMA 2.0 grant of Keycloak Authorization
+// Services, which evaluates the policies of the resource server UMA_AUDIENCE
+// (or of a permission ticket) and issues a requesting party token (RPT)
+// carrying the permissions granted, printed on stdout.
+func runRPT(args []string) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	setupLogging(cfg)
+	if cfg.UMA.Audience == "" && cfg.UMA.Ticket == "" {
+		return errors.New("missing resource server of the RPT: set UMA_AUDIENCE or UMA_TICKET")
+	}
+	if cfg.DPoP != "" {
+		return errors.New("the rpt subcommand presents the access token as a bearer token: unset DPOP")
+	}
+	if err := checkOutput(cfg.Output, outputExecCredential); err != nil {
+		return &configError{err}
+	}
+	if cfg.Output == "" {
+		cfg.Output = outputRaw
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	ctx, _ = withRequestID(ctx)
+	defer cancel()
+
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		return err
+	}
+	defer flushTraces(shutdownTracing)
+
+	s, err := openSession(ctx, &cfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	subject, err := s.ex.exchange(ctx)
+	if err != nil {
+		return fmt.Errorf("obtaining the access token: %w", err)
+	}
+	var spiffeID string
+	if s.x509Source != nil {
+		if svid, err := s.x509Source.GetX509SVID(); err == nil {
+			spiffeID = svid.ID.String()
+		}
+	}
+
+	req := keycloak.RPTRequest{
+		Audience:      cfg.UMA.Audience,
+		Permissions:   cfg.UMA.Permissions,
+		Ticket:        cfg.UMA.Ticket,
+		SubmitRequest: cfg.UMA.SubmitRequest,
+	}
+	ctx, span := startSpan(ctx, "keycloak.RequestRPT", attribute.String("uma.audience", req.Audience))
+	var token *keycloak.TokenResponse
+	start := time.Now()
+	err = cfg.retryPolicyContext(ctx, "RPT request").Do(ctx, func(ctx context.Context) error {
+		if err := waitTokenRequest(ctx, cfg.RateLimit); err != nil {
+			return err
+		}
+		if err := tokenBreaker.allow(cfg.CircuitBreaker); err != nil {
+			return retry.Permanent(err)
+		}
+		token, err = keycloak.RequestRPT(ctx, s.client, s.ex.tokenEndpoint, subject.AccessToken, req)
+		tokenBreaker.record(cfg.CircuitBreaker, err)
+		return keycloakRetry(err)
+	})
+	endSpan(span, err)
+	audit(cfg.Audit, newAuditEvent(ctx, cfg, auditRPT, spiffeID, s.ex.clientID, req.Audience, start, token, err))
+	if err != nil {
+		return fmt.Errorf("rpt request failed: %w", err)
+	}
+
+	slog.InfoContext(ctx, "RPT issued",
+		"audience", req.Audience,
+		"permissions", rptPermissions(token.AccessToken),
+		"expires_in", token.ExpiresIn)
+	issued := issuedToken{TokenResponse: token, issuedAt: time.Now(), reason: reasonInitial}
+	return newOutputSink(cfg, os.Stdout, spiffeID).writeToken(ctx, req.Audience, issued)
+}
+
+// rptPermissions returns the permissions of the authorization claim of the
+// RPT, as resource#scope, without verifying it.
+func rptPermissions(rpt string) []string {
+	claims, ok := peekClaims(rpt)
+	if !ok || claims.Authorization == nil {
+		return nil
+	}
+	var permissions []string
+	for _, p := range claims.Authorization.Permissions {
+		resource := p.ResourceName
+		if resource == "" {
+			resource = p.ResourceID
+		}
+		if len(p.Scopes) == 0 {
+			permissions = append(permissions, resource)
+		}
+		for _, scope := range p.Scopes {
+			permissions = append(permissions, resource+"#"+scope)
+		}
+	}
+	return permissions
+}
@@ -0,0 +1,275 @@
+// sds.go
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	secretv3 "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	secretTypeURL = "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret"
+
+	// SDS resource names, the ones of the SPIRE Agent SDS API: the workload
+	// X509-SVID, and the bundle of its trust domain. The bundle of any trust
+	// domain, federated ones included, is also served under its ID.
+	sdsSVIDName   = "default"
+	sdsBundleName = "ROOTCA"
+)
+
+// sdsServer serves the X509-SVID and trust bundles of the workload to Envoy
+// with the Secret Discovery Service, pushing them again on every rotation.
+type sdsServer struct {
+	secretv3.UnimplementedSecretDiscoveryServiceServer
+	source *workloadapi.X509Source
+
+	mu       sync.Mutex
+	watchers map[chan struct{}]bool
+}
+
+func newSDSServer(source *workloadapi.X509Source) *sdsServer {
+	return &sdsServer{source: source, watchers: map[chan struct{}]bool{}}
+}
+
+// broadcast notifies the streams of the SVID and bundle updates until ctx
+// is cancelled. The source has a single update channel.
+func (s *sdsServer) broadcast(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.source.Updated():
+		}
+		s.mu.Lock()
+		for ch := range s.watchers {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *sdsServer) FetchSecrets(_ context.Context, req *discoveryv3.DiscoveryRequest) (*discoveryv3.DiscoveryResponse, error) {
+	resp, err := s.response(req.GetResourceNames())
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return resp, nil
+}
+
+// StreamSecrets implements the state of the world xDS protocol: a response
+// is sent when Envoy asks for resources at another version and after each
+// rotation, Envoy acknowledges it with its nonce.
+func (s *sdsServer) StreamSecrets(stream secretv3.SecretDiscoveryService_StreamSecretsServer) error {
+	updated := make(chan struct{}, 1)
+	s.mu.Lock()
+	s.watchers[updated] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.watchers, updated)
+		s.mu.Unlock()
+	}()
+
+	reqs := make(chan *discoveryv3.DiscoveryRequest)
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case reqs <- req:
+			case <-stream.Context().Done():
+				return
+			}
+		}
+	}()
+
+	var names, sentNames []string
+	var version, nonce string
+	var sent int
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case err := <-errc:
+			if status.Code(err) == codes.Canceled || errors.Is(err, context.Canceled) {
+				return nil
+			}
+			return err
+		case req := <-reqs:
+			if sent > 0 && req.GetResponseNonce() != nonce {
+				// Stale request, answered by a later response.
+				continue
+			}
+			if detail := req.GetErrorDetail(); detail != nil {
+				slog.Warn("Envoy rejected the SDS secrets", "version", version, "error", detail.GetMessage())
+			}
+			names = req.GetResourceNames()
+			if sent > 0 && req.GetVersionInfo() == version && slices.Equal(names, sentNames) {
+				continue
+			}
+		case <-updated:
+			if sent == 0 {
+				continue
+			}
+		}
+
+		resp, err := s.response(names)
+		if err != nil {
+			slog.Warn("Failed to build the SDS secrets", "error", err)
+			continue
+		}
+		if sent > 0 && resp.VersionInfo == version && slices.Equal(names, sentNames) {
+			continue
+		}
+		sent++
+		resp.Nonce = strconv.Itoa(sent)
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+		version, nonce, sentNames = resp.VersionInfo, resp.Nonce, names
+		slog.Debug("Sent SDS secrets", "names", names, "version", version)
+	}
+}
+
+// response returns the secrets named names, all of the workload secrets
+// when empty. The version is a digest of their content.
+func (s *sdsServer) response(names []string) (*discoveryv3.DiscoveryResponse, error) {
+	if len(names) == 0 {
+		names = []string{sdsSVIDName, sdsBundleName}
+	}
+	resp := &discoveryv3.DiscoveryResponse{TypeUrl: secretTypeURL}
+	digest := sha256.New()
+	for _, name := range names {
+		secret, err := s.secret(name)
+		if err != nil {
+			return nil, err
+		}
+		if secret == nil {
+			continue
+		}
+		data, err := proto.MarshalOptions{Deterministic: true}.Marshal(secret)
+		if err != nil {
+			return nil, fmt.Errorf("encoding secret %s: %w", name, err)
+		}
+		digest.Write(data)
+		res, err := anypb.New(secret)
+		if err != nil {
+			return nil, fmt.Errorf("encoding secret %s: %w", name, err)
+		}
+		resp.Resources = append(resp.Resources, res)
+	}
+	resp.VersionInfo = hex.EncodeToString(digest.Sum(nil))[:16]
+	return resp, nil
+}
+
+// secret returns the secret named name, nil for an unknown name.
+func (s *sdsServer) secret(name string) (*tlsv3.Secret, error) {
+	svid, err := s.source.GetX509SVID()
+	if err != nil {
+		return nil, fmt.Errorf("getting X509-SVID: %w", err)
+	}
+
+	switch {
+	case name == sdsSVIDName || name == svid.ID.String():
+		certs, key, err := svid.Marshal()
+		if err != nil {
+			return nil, fmt.Errorf("encoding X509-SVID: %w", err)
+		}
+		return &tlsv3.Secret{
+			Name: name,
+			Type: &tlsv3.Secret_TlsCertificate{TlsCertificate: &tlsv3.TlsCertificate{
+				CertificateChain: inlineBytes(certs),
+				PrivateKey:       inlineBytes(key),
+			}},
+		}, nil
+
+	case name == sdsBundleName || strings.HasPrefix(name, "spiffe://"):
+		td := svid.ID.TrustDomain()
+		if name != sdsBundleName {
+			if td, err = spiffeid.TrustDomainFromString(name); err != nil {
+				return nil, nil
+			}
+		}
+		bundle, err := s.source.GetX509BundleForTrustDomain(td)
+		if err != nil {
+			// Not a trust domain federated with ours.
+			return nil, nil
+		}
+		var roots []byte
+		for _, cert := range bundle.X509Authorities() {
+			roots = append(roots, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+		}
+		return &tlsv3.Secret{
+			Name: name,
+			Type: &tlsv3.Secret_ValidationContext{ValidationContext: &tlsv3.CertificateValidationContext{
+				TrustedCa: inlineBytes(roots),
+			}},
+		}, nil
+	}
+	return nil, nil
+}
+
+func inlineBytes(b []byte) *corev3.DataSource {
+	return &corev3.DataSource{Specifier: &corev3.DataSource_InlineBytes{InlineBytes: b}}
+}
+
+// serveSDS serves s on the Unix socket addr until ctx is cancelled.
+func serveSDS(ctx context.Context, addr string, s *sdsServer) error {
+	path := strings.TrimPrefix(addr, "unix://")
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("removing stale SDS socket: %w", err)
+	}
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("listening on SDS socket: %w", err)
+	}
+	// The socket hands out the SVID private key: owner and group only.
+	if err := os.Chmod(path, 0o660); err != nil {
+		lis.Close()
+		return fmt.Errorf("setting SDS socket permissions: %w", err)
+	}
+
+	srv := grpc.NewServer()
+	secretv3.RegisterSecretDiscoveryServiceServer(srv, s)
+	go s.broadcast(ctx)
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+	}()
+	go func() {
+		slog.Info("Serving the SDS API", "addr", addr)
+		if err := srv.Serve(lis); err != nil {
+			slog.Error("SDS server failed", "error", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+
+// service_other.go
+package main
+
+import "errors"
+
+// runService is only available on Windows: elsewhere run the daemon under
+// the init system, see systemd.go.
+func runService(args []string) error {
+	return errors.New("the service command manages Windows services, run the daemon as a systemd unit instead")
+}
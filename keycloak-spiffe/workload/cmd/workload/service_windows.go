@@ -0,0 +1,292 @@
+//go:build windows
+
+// service_windows.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// defaultServiceName is the name the service is installed under.
+const defaultServiceName = "keycloak-spiffe"
+
+// serviceStopTimeout bounds the wait for the service to stop.
+const serviceStopTimeout = 30 * time.Second
+
+// runService implements the service subcommand: it installs, removes,
+// starts and stops the daemon as a Windows service, and runs it under the
+// service control manager.
+func runService(args []string) error {
+	action, name, cfgArgs, err := parseServiceArgs(args)
+	if err != nil {
+		return err
+	}
+	switch action {
+	case "install":
+		return installService(name, cfgArgs)
+	case "uninstall":
+		return uninstallService(name)
+	case "start":
+		return startService(name)
+	case "stop":
+		return stopService(name)
+	case "run":
+		return runAsService(name, cfgArgs)
+	}
+	return fmt.Errorf("unknown service action %q (available: install, uninstall, start, stop, run)", action)
+}
+
+// parseServiceArgs splits "action [-name name] [-- workload flags]".
+func parseServiceArgs(args []string) (action, name string, cfgArgs []string, err error) {
+	const usage = "usage: workload service install|uninstall|start|stop|run [-name name] [-- flags]"
+	if len(args) == 0 {
+		return "", "", nil, errors.New(usage)
+	}
+	fs := flag.NewFlagSet("service", flag.ContinueOnError)
+	fs.StringVar(&name, "name", defaultServiceName, "Windows service name")
+	if err := fs.Parse(args[1:]); err != nil {
+		return "", "", nil, fmt.Errorf("%s: %w", usage, err)
+	}
+	return args[0], name, fs.Args(), nil
+}
+
+// installService registers the service running the daemon with cfgArgs,
+// restarted by the service control manager when it fails, and its event
+// log source.
+func installService(name string, cfgArgs []string) error {
+	// Catch configuration errors now rather than in the event log.
+	if _, err := loadConfig(cfgArgs); err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("locating the workload executable: %w", err)
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service control manager: %w", err)
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", name)
+	}
+
+	svcArgs := append([]string{"service", "run", "-name", name, "--"}, cfgArgs...)
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: "Keycloak SPIFFE token helper (" + name + ")",
+		Description: "Obtains Keycloak access tokens with the SPIFFE identity of the host and keeps them renewed.",
+		StartType:   mgr.StartAutomatic,
+	}, svcArgs...)
+	if err != nil {
+		return fmt.Errorf("creating service %s: %w", name, err)
+	}
+	defer s.Close()
+	if err := s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 30 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: time.Minute},
+	}, uint32((24 * time.Hour).Seconds())); err != nil {
+		slog.Warn("Failed to set the service recovery actions", "service", name, "error", err)
+	}
+	if err := eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("registering the event log source: %w", err)
+	}
+	slog.Info("Service installed", "service", name, "args", cfgArgs)
+	return nil
+}
+
+// uninstallService removes the service and its event log source.
+func uninstallService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service control manager: %w", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("opening service %s: %w", name, err)
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("deleting service %s: %w", name, err)
+	}
+	if err := eventlog.Remove(name); err != nil {
+		slog.Warn("Failed to remove the event log source", "service", name, "error", err)
+	}
+	slog.Info("Service removed", "service", name)
+	return nil
+}
+
+// startService asks the service control manager to start the service.
+func startService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service control manager: %w", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("opening service %s: %w", name, err)
+	}
+	defer s.Close()
+	if err := s.Start(); err != nil {
+		return fmt.Errorf("starting service %s: %w", name, err)
+	}
+	slog.Info("Service started", "service", name)
+	return nil
+}
+
+// stopService stops the service and waits until it has stopped.
+func stopService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service control manager: %w", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("opening service %s: %w", name, err)
+	}
+	defer s.Close()
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return fmt.Errorf("stopping service %s: %w", name, err)
+	}
+	deadline := time.Now().Add(serviceStopTimeout)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service %s did not stop within %s", name, serviceStopTimeout)
+		}
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return fmt.Errorf("querying service %s: %w", name, err)
+		}
+	}
+	slog.Info("Service stopped", "service", name)
+	return nil
+}
+
+// runAsService runs the daemon under the service control manager, logging
+// to the event log.
+func runAsService(name string, cfgArgs []string) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return fmt.Errorf("detecting the service control manager: %w", err)
+	}
+	if !isService {
+		return errors.New("service run is started by the service control manager, use service start")
+	}
+	elog, err := eventlog.Open(name)
+	if err != nil {
+		return fmt.Errorf("opening the event log: %w", err)
+	}
+	defer elog.Close()
+
+	// The service always runs the daemon, also after a reload.
+	cfgArgs = append(cfgArgs, "-daemon")
+	cfg, err := loadConfig(cfgArgs)
+	if err != nil {
+		elog.Error(1, "Invalid configuration: "+err.Error())
+		return err
+	}
+	slog.SetDefault(slog.New(newEventLogHandler(elog, logLevel(cfg), cfg.Log.Format)))
+	return svc.Run(name, &windowsService{cfg: cfg, args: cfgArgs})
+}
+
+// windowsService runs the daemon until the service is stopped.
+type windowsService struct {
+	cfg  Config
+	args []string
+}
+
+func (s *windowsService) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runWorkload(ctx, s.cfg, s.args)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case <-done:
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				cancel()
+				<-done
+				return false, 0
+			}
+		}
+	}
+}
+
+// eventLogHandler writes each log record to the event log, with the event
+// type of its level.
+type eventLogHandler struct {
+	slog.Handler
+	out *eventLogOutput
+}
+
+// eventLogOutput is shared by the handlers derived with WithAttrs and
+// WithGroup: the records are formatted in buf one at a time.
+type eventLogOutput struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+	log *eventlog.Log
+}
+
+// newEventLogHandler returns a handler formatting the records at level or
+// above as newLogger does and writing them to log.
+func newEventLogHandler(log *eventlog.Log, level slog.Level, format string) slog.Handler {
+	out := &eventLogOutput{log: log}
+	return &eventLogHandler{Handler: newLogger(&out.buf, level, format).Handler(), out: out}
+}
+
+func (h *eventLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.out.mu.Lock()
+	defer h.out.mu.Unlock()
+	h.out.buf.Reset()
+	if err := h.Handler.Handle(ctx, r); err != nil {
+		return err
+	}
+	msg := strings.TrimSpace(h.out.buf.String())
+	switch {
+	case r.Level >= slog.LevelError:
+		return h.out.log.Error(1, msg)
+	case r.Level >= slog.LevelWarn:
+		return h.out.log.Warning(1, msg)
+	default:
+		return h.out.log.Info(1, msg)
+	}
+}
+
+func (h *eventLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &eventLogHandler{Handler: h.Handler.WithAttrs(attrs), out: h.out}
+}
+
+func (h *eventLogHandler) WithGroup(name string) slog.Handler {
+	return &eventLogHandler{Handler: h.Handler.WithGroup(name), out: h.out}
+}
@@ -0,0 +1,89 @@
+// sidecar.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/spire"
+)
+
+// Files written to the sidecar directory. With several audiences the token
+// and JWT-SVID file names are prefixed with the audience.
+const (
+	sidecarTokenFile   = "token"
+	sidecarJWTSVIDFile = "jwt_svid"
+	sidecarReadyFile   = "ready"
+)
+
+// sidecarSink writes the access tokens and JWT-SVIDs to a directory shared
+// with the main container, typically an emptyDir volume, and creates the
+// ready file once every audience has a token.
+type sidecarSink struct {
+	dir    string
+	mode   os.FileMode
+	prefix bool
+	svids  spire.JWTSVIDSource
+	state  *daemonState
+}
+
+// newSidecarSink prepares the sidecar directory configured in cfg.
+func newSidecarSink(cfg Config, svids spire.JWTSVIDSource, state *daemonState) (*sidecarSink, error) {
+	if err := os.MkdirAll(cfg.Sidecar.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating sidecar directory: %w", err)
+	}
+	// validate already checked the mode.
+	mode, _ := parseFileMode(cfg.TokenFile.Mode)
+	s := &sidecarSink{
+		dir:    cfg.Sidecar.Dir,
+		mode:   mode,
+		prefix: len(cfg.Audience) > 1,
+		svids:  svids,
+		state:  state,
+	}
+	// A ready file left by a previous run must not announce stale tokens.
+	s.close()
+	return s, nil
+}
+
+func (s *sidecarSink) writeToken(ctx context.Context, audience string, token issuedToken) error {
+	if err := writeFileAtomic(s.path(audience, sidecarTokenFile), []byte(token.AccessToken), s.mode); err != nil {
+		return err
+	}
+	svid, err := fetchJWTSVID(ctx, s.svids, audience)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path(audience, sidecarJWTSVIDFile), []byte(svid.Marshal()), s.mode); err != nil {
+		return err
+	}
+
+	if s.state.ready() == nil {
+		ready := filepath.Join(s.dir, sidecarReadyFile)
+		if _, err := os.Stat(ready); os.IsNotExist(err) {
+			slog.Info("Tokens ready", "file", ready)
+		}
+		return writeFileAtomic(ready, []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), s.mode)
+	}
+	return nil
+}
+
+// path returns the path of the file name for audience.
+func (s *sidecarSink) path(audience, name string) string {
+	if s.prefix {
+		name = audiencePath(audiencePlaceholder, audience) + "." + name
+	}
+	return filepath.Join(s.dir, name)
+}
+
+// close removes the ready file, so the main container stops relying on the
+// tokens once the sidecar is gone.
+func (s *sidecarSink) close() {
+	if err := os.Remove(filepath.Join(s.dir, sidecarReadyFile)); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Failed to remove the ready file", "error", err)
+	}
+}
@@ -0,0 +1,125 @@
+// sink.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// audiencePlaceholder is replaced by the audience in token file paths.
+const audiencePlaceholder = "{audience}"
+
+// tokenSink receives every access token obtained by the workload.
+type tokenSink interface {
+	writeToken(ctx context.Context, audience string, token issuedToken) error
+}
+
+// fileSink writes the access token, and optionally the raw token response,
+// to files rewritten atomically on every refresh.
+type fileSink struct {
+	tokenPath    string
+	responsePath string
+	mode         os.FileMode
+}
+
+func (s *fileSink) writeToken(_ context.Context, audience string, token issuedToken) error {
+	if s.tokenPath != "" {
+		if err := writeFileAtomic(audiencePath(s.tokenPath, audience), []byte(token.AccessToken), s.mode); err != nil {
+			return err
+		}
+	}
+	if s.responsePath != "" {
+		if err := writeFileAtomic(audiencePath(s.responsePath, audience), token.Raw, s.mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unsafePathChars matches the audience characters not kept in file names.
+var unsafePathChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// audiencePath replaces the audience placeholder of path with audience,
+// reduced to characters safe in a file name.
+func audiencePath(path, audience string) string {
+	if !strings.Contains(path, audiencePlaceholder) {
+		return path
+	}
+	name := strings.Trim(unsafePathChars.ReplaceAllString(audience, "_"), "_")
+	return strings.ReplaceAll(path, audiencePlaceholder, name)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it over path, so readers never see a partially written file.
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return fmt.Errorf("setting permissions of %s: %w", path, err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	if err := replaceFile(tmp.Name(), path); err != nil {
+		return fmt.Errorf("replacing %s: %w", path, err)
+	}
+	return nil
+}
+
+// parseFileMode parses an octal permission string such as 0600.
+func parseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("file mode %q must be octal permissions such as 0600", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// newSinks returns the token sinks configured in cfg. The renew hook comes
+// last so that it sees the other outputs up to date.
+func newSinks(cfg Config) ([]tokenSink, error) {
+	var sinks []tokenSink
+	if cfg.TokenFile.Path != "" || cfg.TokenFile.ResponsePath != "" {
+		// validate already checked the mode.
+		mode, _ := parseFileMode(cfg.TokenFile.Mode)
+		sinks = append(sinks, &fileSink{
+			tokenPath:    cfg.TokenFile.Path,
+			responsePath: cfg.TokenFile.ResponsePath,
+			mode:         mode,
+		})
+	}
+	if cfg.KubeSecret.Name != "" {
+		sink, err := newSecretSink(cfg.KubeSecret)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if cfg.RenewHook != "" {
+		sinks = append(sinks, &hookSink{
+			command:      cfg.RenewHook,
+			timeout:      cfg.Timeout,
+			tokenPath:    cfg.TokenFile.Path,
+			responsePath: cfg.TokenFile.ResponsePath,
+		})
+	}
+	return sinks, nil
+}
@@ -0,0 +1,128 @@
+// sts.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/aws"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/retry"
+)
+
+// stsCommands maps the sts subcommands to their entry points.
+var stsCommands = map[string]func(args []string) error{
+	"assume": runSTSAssume,
+}
+
+// runSTS implements the sts subcommand, which obtains temporary S3
+// credentials from the STS of an S3-compatible store: sts <command> [flags].
+func runSTS(args []string) error {
+	names := make([]string, 0, len(stsCommands))
+	for n := range stsCommands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return fmt.Errorf("missing sts command (available: %s)", strings.Join(names, ", "))
+	}
+	cmd, ok := stsCommands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown sts command %q (available: %s)", args[0], strings.Join(names, ", "))
+	}
+	return cmd(args[1:])
+}
+
+// runSTSAssume implements sts assume: it calls AssumeRoleWithWebIdentity on
+// the STS endpoint of MinIO, or of another S3-compatible store, with the
+// Keycloak access token or the JWT-SVID, and writes the temporary
+// credentials as aws-login does. In daemon mode they are renewed before
+// they expire.
+func runSTSAssume(args []string) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	setupLogging(cfg)
+	if cfg.STS.Endpoint == "" {
+		return errors.New("missing STS endpoint: set STS_ENDPOINT")
+	}
+	if err := checkOutput(cfg.Output, outputAWSCredentialProcess); err != nil {
+		return &configError{err}
+	}
+	if cfg.Output == "" {
+		cfg.Output = outputEnv
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		return err
+	}
+	defer flushTraces(shutdownTracing)
+	if cfg.Daemon {
+		serveOps(ctx, cfg, nil)
+	}
+
+	bootCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	s, err := openSession(bootCtx, &cfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	client, err := serviceClient(cfg, cfg.STS.CACert)
+	if err != nil {
+		return err
+	}
+
+	st := cfg.STS
+	// Stores assuming roles, such as Ceph RGW, require a session name.
+	var sessionName string
+	if st.RoleARN != "" {
+		if sessionName, err = s.roleSessionName(); err != nil {
+			return err
+		}
+	}
+	return keepLoggedIn(ctx, cfg, "STS AssumeRoleWithWebIdentity", func(ctx context.Context) (time.Duration, error) {
+		ctx, span := startSpan(ctx, "sts.AssumeRoleWithWebIdentity")
+		var result *aws.AssumeRoleResult
+		err := cfg.retryPolicyContext(ctx, "STS AssumeRoleWithWebIdentity").Do(ctx, func(ctx context.Context) error {
+			token, err := s.credential(ctx, st.Credential, st.Audience)
+			if err != nil {
+				return err
+			}
+			result, err = aws.AssumeRoleWithWebIdentity(ctx, client, st.Endpoint, aws.AssumeRoleRequest{
+				RoleARN:          st.RoleARN,
+				RoleSessionName:  sessionName,
+				WebIdentityToken: token,
+				Duration:         st.Duration,
+				Policy:           st.Policy,
+			})
+			if err != nil && !aws.IsTransient(err) {
+				return retry.Permanent(err)
+			}
+			return err
+		})
+		endSpan(span, err)
+		if err != nil {
+			failures.WithLabelValues("sts").Inc()
+			return 0, fmt.Errorf("STS AssumeRoleWithWebIdentity at %s failed: %w", st.Endpoint, err)
+		}
+		expiration := result.Credentials.Expiration
+		slog.InfoContext(ctx, "Obtained temporary S3 credentials",
+			"endpoint", st.Endpoint,
+			"access_key_id", result.Credentials.AccessKeyID,
+			"expiration", expiration.UTC())
+		return time.Until(expiration), writeAWSCredentials(cfg, st.CredentialsFile, st.Profile, result.Credentials)
+	})
+}
@@ -0,0 +1,147 @@
+// systemd.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation.
+const listenFDsStart = 3
+
+// sdNotify sends state to the systemd notification socket. It does nothing
+// unless the workload runs in a Type=notify unit.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if strings.HasPrefix(addr, "@") {
+		// Abstract socket namespace.
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("connecting to the systemd notification socket: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("notifying systemd: %w", err)
+	}
+	return nil
+}
+
+// watchdogInterval returns the systemd watchdog timeout of this process,
+// zero when the watchdog is disabled.
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runWatchdog pings the systemd watchdog at half its timeout while the
+// daemon is alive, as reported by /healthz, so that systemd restarts a
+// stuck daemon or one the SPIRE Agent has been unreachable from for too
+// long.
+func runWatchdog(ctx context.Context, state *daemonState) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	slog.Debug("Pinging the systemd watchdog", "timeout", interval)
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		checkCtx, cancel := context.WithTimeout(ctx, interval/4)
+		err := state.alive(checkCtx)
+		cancel()
+		if err != nil {
+			slog.Warn("Skipping the systemd watchdog ping", "error", err)
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			slog.Warn("Failed to ping the systemd watchdog", "error", err)
+		}
+	}
+}
+
+var (
+	activatedOnce sync.Once
+	activated     map[string]net.Listener
+	activatedErr  error
+)
+
+// activatedListeners returns the sockets passed by systemd socket
+// activation by FileDescriptorName, "unknown" when unnamed. The environment
+// variables are cleared so that child processes do not inherit them.
+func activatedListeners() (map[string]net.Listener, error) {
+	activatedOnce.Do(func() {
+		activated, activatedErr = parseListenFDs()
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	})
+	return activated, activatedErr
+}
+
+func parseListenFDs() (map[string]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	listeners := make(map[string]net.Listener, n)
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		lis, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("using activated socket %s: %w", name, err)
+		}
+		listeners[name] = lis
+	}
+	return listeners, nil
+}
+
+// activatedListener returns the activated socket named name, or the only
+// activated socket when there is one.
+func activatedListener(name string) (net.Listener, error) {
+	listeners, err := activatedListeners()
+	if err != nil {
+		return nil, err
+	}
+	if lis, ok := listeners[name]; ok {
+		return lis, nil
+	}
+	if len(listeners) == 1 {
+		for _, lis := range listeners {
+			return lis, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,33 @@
+// timeouts.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Phases of a run bounded by their own timeout within the overall one.
+const (
+	phaseSVIDFetch    = "svid_fetch"
+	phaseDiscovery    = "discovery"
+	phaseTokenRequest = "token_request"
+)
+
+// withPhaseTimeout runs fn, bounded by timeout when positive. An error of
+// fn caused by the expiry of timeout, rather than of ctx, names the phase
+// so that a slow SPIRE Agent and a hung Keycloak are told apart.
+func withPhaseTimeout(ctx context.Context, phase string, timeout time.Duration, fn func(context.Context) error) error {
+	if timeout <= 0 {
+		return fn(ctx)
+	}
+	phaseCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := fn(phaseCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(phaseCtx.Err(), context.DeadlineExceeded) {
+		phaseTimeouts.WithLabelValues(phase).Inc()
+		return fmt.Errorf("%s timed out after %s: %w", phase, timeout, err)
+	}
+	return err
+}
@@ -0,0 +1,103 @@
+// tls.go
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/spire"
+)
+
+// keycloakTLSConfig returns the TLS configuration of the Keycloak
+// connections, presenting the X509-SVID of source. Without source, for the
+// admin commands, no client certificate is presented.
+func keycloakTLSConfig(c TLSConfig, source *workloadapi.X509Source) (*tls.Config, error) {
+	roots, err := keycloakRoots(c)
+	if err != nil {
+		return nil, err
+	}
+	var tlsConfig *tls.Config
+	switch {
+	case source != nil:
+		tlsConfig, err = spire.MTLSClientConfig(source, roots, c.KeycloakSPIFFEID)
+	case c.KeycloakSPIFFEID != "":
+		err = errors.New("the Keycloak SPIFFE ID (TLS_KEYCLOAK_SPIFFE_ID) is only verified with an X509-SVID")
+	default:
+		tlsConfig = &tls.Config{RootCAs: roots}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.ServerName != "" {
+		tlsConfig.ServerName = c.ServerName
+	}
+	if tlsConfig.MinVersion, err = tlsVersion(c.MinVersion); err != nil {
+		return nil, err
+	}
+	if c.InsecureSkipVerify {
+		slog.Warn("INSECURE: the Keycloak certificate is not verified (TLS_INSECURE_SKIP_VERIFY): anyone on the network path can impersonate Keycloak and steal the client assertions and tokens; never use it outside development")
+		tlsConfig.InsecureSkipVerify = true
+	}
+	return tlsConfig, nil
+}
+
+// keycloakRoots returns the CAs of CAFile and of the files of CADir, nil
+// for the system roots when neither is set.
+func keycloakRoots(c TLSConfig) (*x509.CertPool, error) {
+	if c.CAFile == "" && c.CADir == "" {
+		return nil, nil
+	}
+	roots := x509.NewCertPool()
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading TLS CA file: %w", err)
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", c.CAFile)
+		}
+	}
+	if c.CADir != "" {
+		entries, err := os.ReadDir(c.CADir)
+		if err != nil {
+			return nil, fmt.Errorf("reading TLS CA directory: %w", err)
+		}
+		found := false
+		for _, entry := range entries {
+			// Skips the subdirectories; the OpenSSL hash links of c_rehash
+			// are read too, adding the same certificates again.
+			if entry.IsDir() {
+				continue
+			}
+			pem, err := os.ReadFile(filepath.Join(c.CADir, entry.Name()))
+			if err != nil {
+				return nil, fmt.Errorf("reading TLS CA directory: %w", err)
+			}
+			if roots.AppendCertsFromPEM(pem) {
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no certificate found in %s", c.CADir)
+		}
+	}
+	return roots, nil
+}
+
+// tlsVersion returns the crypto/tls version of a 1.2 or 1.3 setting.
+func tlsVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("TLS min version %q must be 1.2 or 1.3", version)
+}
@@ -0,0 +1,113 @@
+// tokencache.go
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloakspiffe"
+)
+
+// tokenCache persists the daemon tokens to an encrypted file so that a
+// restarted daemon resumes with them. A nil *tokenCache persists nothing.
+type tokenCache struct {
+	cache *keycloakspiffe.Cache
+	path  string
+	key   []byte
+	realm string
+	// clientID is the configured client ID, the cache is loaded before the
+	// X509-SVID that may default it is available.
+	clientID string
+	scope    string
+	resource string
+}
+
+// openTokenCache loads the token cache file configured in cfg, or returns
+// nil when none is configured.
+func openTokenCache(cfg Config) (*tokenCache, error) {
+	if cfg.TokenCache.File == "" {
+		return nil, nil
+	}
+	key, err := loadCacheKey(cfg.TokenCache)
+	if err != nil {
+		return nil, err
+	}
+
+	tc := &tokenCache{
+		cache:    keycloakspiffe.NewCache(0),
+		path:     cfg.TokenCache.File,
+		key:      key,
+		realm:    cfg.Realm,
+		clientID: cfg.ClientID,
+		scope:    cfg.Scope,
+		resource: strings.Join(cfg.Resource, " "),
+	}
+	if err := tc.cache.LoadFile(tc.path, key); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+// loadCacheKey returns the AES key from TOKEN_CACHE_KEY or the key file,
+// either base64-encoded or raw.
+func loadCacheKey(cfg TokenCacheConfig) ([]byte, error) {
+	encoded := []byte(os.Getenv("TOKEN_CACHE_KEY"))
+	if len(encoded) == 0 {
+		data, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading token cache key: %w", err)
+		}
+		encoded = bytes.TrimSpace(data)
+	}
+
+	if key, err := base64.StdEncoding.DecodeString(string(encoded)); err == nil && validKeySize(len(key)) {
+		return key, nil
+	}
+	if validKeySize(len(encoded)) {
+		return encoded, nil
+	}
+	return nil, fmt.Errorf("token cache key must be a 16, 24 or 32 byte AES key, raw or base64-encoded")
+}
+
+func validKeySize(n int) bool {
+	return n == 16 || n == 24 || n == 32
+}
+
+func (t *tokenCache) cacheKey(audience string) keycloakspiffe.CacheKey {
+	return keycloakspiffe.CacheKey{Audience: audience, Realm: t.realm, ClientID: t.clientID, Scope: t.scope, Resource: t.resource}
+}
+
+// lookup returns the unexpired token cached for audience.
+func (t *tokenCache) lookup(audience string) (issuedToken, bool) {
+	if t == nil {
+		return issuedToken{}, false
+	}
+	resp, issuedAt, ok := t.cache.Lookup(t.cacheKey(audience))
+	return issuedToken{TokenResponse: resp, issuedAt: issuedAt, reason: reasonCached}, ok
+}
+
+// store caches token for audience and rewrites the cache file.
+func (t *tokenCache) store(audience string, token issuedToken) {
+	if t == nil {
+		return
+	}
+	t.cache.Put(t.cacheKey(audience), token.TokenResponse, token.issuedAt)
+	if err := t.cache.SaveFile(t.path, t.key); err != nil {
+		slog.Warn("Failed to save the token cache", "path", t.path, "error", err)
+	}
+}
+
+// remove drops the token of audience and rewrites the cache file.
+func (t *tokenCache) remove(audience string) {
+	if t == nil {
+		return
+	}
+	t.cache.Invalidate(t.cacheKey(audience))
+	if err := t.cache.SaveFile(t.path, t.key); err != nil {
+		slog.Warn("Failed to save the token cache", "path", t.path, "error", err)
+	}
+}
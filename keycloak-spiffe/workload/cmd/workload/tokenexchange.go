@@ -0,0 +1,202 @@
+// tokenexchange.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/retry"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/tokenauth"
+)
+
+const (
+	// subjectJWTSVID submits the JWT-SVID itself as subject token.
+	subjectJWTSVID = "jwt-svid"
+	// subjectAccessToken first obtains a Keycloak access token with the
+	// client_credentials grant and submits it as subject token.
+	subjectAccessToken = "access-token"
+	// subjectFile submits the token read from the token_exchange file, such
+	// as the access token of the end user a gateway acts on behalf of.
+	subjectFile = "file"
+	// subjectNomad submits the Nomad workload identity of the task, paired
+	// with the SPIFFE identity authenticating the client or exchanged alone
+	// with the nomad auth method.
+	subjectNomad = "nomad"
+)
+
+// runTokenExchange implements the token-exchange subcommand: it submits the
+// JWT-SVID, a Keycloak access token or the token of another subject to the
+// RFC 8693 token exchange grant, optionally with the workload identity as
+// actor token for a delegated token.
+func runTokenExchange(args []string) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	setupLogging(cfg)
+
+	var subjectToken, subjectTokenType string
+	switch cfg.TokenExchange.Subject {
+	case subjectFile:
+		data, err := readTokenInput(cfg.TokenExchange.File, "exchange")
+		if err != nil {
+			return err
+		}
+		subjectToken, subjectTokenType = string(data), keycloak.TokenTypeAccessToken
+		if data[0] == '{' {
+			response, err := keycloak.ParseTokenResponse(data)
+			if err != nil {
+				return err
+			}
+			subjectToken = response.AccessToken
+		}
+	case subjectNomad:
+		if subjectToken, err = nomadIdentityToken(cfg.Nomad); err != nil {
+			return err
+		}
+		subjectTokenType = keycloak.TokenTypeJWT
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	ctx, _ = withRequestID(ctx)
+	defer cancel()
+
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		return err
+	}
+	defer flushTraces(shutdownTracing)
+
+	s, err := openSession(ctx, &cfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	req := keycloak.TokenExchangeRequest{
+		RequestedTokenType: cfg.TokenExchange.RequestedTokenType,
+		Audience:           cfg.TokenExchange.Audience,
+		Scope:              cfg.TokenExchange.Scope,
+		SubjectIssuer:      cfg.TokenExchange.SubjectIssuer,
+	}
+
+	if subjectToken != "" {
+		req.SubjectToken = subjectToken
+		req.SubjectTokenType = subjectTokenType
+	} else if req.SubjectToken, req.SubjectTokenType, err = s.workloadToken(ctx, cfg, cfg.TokenExchange.Subject, "subject"); err != nil {
+		return err
+	}
+	if cfg.TokenExchange.Actor != "" {
+		if req.ActorToken, req.ActorTokenType, err = s.workloadToken(ctx, cfg, cfg.TokenExchange.Actor, "actor"); err != nil {
+			return err
+		}
+	}
+
+	token, _, err := s.tokenExchange(ctx, cfg, req)
+	if err != nil {
+		return err
+	}
+
+	actors := tokenActors(token.AccessToken)
+	slog.InfoContext(ctx, "Token exchanged",
+		"issued_token_type", token.IssuedTokenType,
+		"expires_in", token.ExpiresIn,
+		"scope", token.Scope,
+		"actors", actors)
+	if req.ActorToken != "" && len(actors) == 0 {
+		slog.WarnContext(ctx, "The exchanged token has no act claim: the token endpoint ignored the actor token")
+	}
+	slog.DebugContext(ctx, "Exchanged token", "access_token", token.AccessToken)
+	return nil
+}
+
+// workloadToken returns the token of the workload identity submitted as the
+// subject or actor token, as told by kind: the JWT-SVID, or a Keycloak access
+// token first obtained with the client_credentials grant.
+func (s *session) workloadToken(ctx context.Context, cfg Config, kind, role string) (string, string, error) {
+	if kind == subjectAccessToken {
+		token, err := s.ex.exchange(ctx)
+		if err != nil {
+			return "", "", fmt.Errorf("obtaining %s access token: %w", role, err)
+		}
+		return token.AccessToken, keycloak.TokenTypeAccessToken, nil
+	}
+	svid, err := fetchJWTSVID(ctx, s.svids, cfg.primaryAudience())
+	if err != nil {
+		return "", "", err
+	}
+	return svid.Marshal(), keycloak.TokenTypeJWT, nil
+}
+
+// tokenActors returns the actor chain of the act claim of token, without
+// verifying it, nil for a token that is not a JWT or not delegated.
+func tokenActors(token string) []string {
+	claims, ok := peekClaims(token)
+	if !ok {
+		return nil
+	}
+	return claims.Actor.Chain()
+}
+
+// peekClaims decodes the claims of the JWT token without verifying it.
+func peekClaims(token string) (*tokenauth.Claims, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	payload, err := decodeSegment(parts[1])
+	if err != nil {
+		return nil, false
+	}
+	var claims tokenauth.Claims
+	if json.Unmarshal(payload, &claims) != nil {
+		return nil, false
+	}
+	return &claims, true
+}
+
+// tokenExchange submits req to the RFC 8693 token exchange grant, retrying
+// transient failures with fresh client credentials, and returns the issued
+// token with the SPIFFE ID the client authenticated with.
+func (s *session) tokenExchange(ctx context.Context, cfg Config, req keycloak.TokenExchangeRequest) (*keycloak.TokenResponse, string, error) {
+	slog.InfoContext(ctx, "Token exchange (RFC 8693)",
+		"token_endpoint", s.ex.tokenEndpoint,
+		"subject_token_type", req.SubjectTokenType,
+		"audience", req.Audience)
+
+	ctx, span := startSpan(ctx, "keycloak.TokenExchange", attribute.String("oauth.subject_token_type", req.SubjectTokenType))
+	var token *keycloak.TokenResponse
+	var spiffeID string
+	exchangeStart := time.Now()
+	err := cfg.retryPolicyContext(ctx, "Token exchange").Do(ctx, func(ctx context.Context) error {
+		if err := waitTokenRequest(ctx, cfg.RateLimit); err != nil {
+			return err
+		}
+		auth, id, err := s.ex.clientAuthIdentity(ctx, cfg.primaryAudience())
+		if err != nil {
+			return err
+		}
+		spiffeID = id
+		if err := tokenBreaker.allow(cfg.CircuitBreaker); err != nil {
+			return retry.Permanent(err)
+		}
+		start := time.Now()
+		token, err = keycloak.TokenExchange(ctx, s.client, s.ex.tokenEndpoint, auth, req)
+		tokenBreaker.record(cfg.CircuitBreaker, err)
+		observeExchange(cfg.AuthMethod, start, token, err)
+		return keycloakRetry(err)
+	})
+	endSpan(span, err)
+	audit(cfg.Audit, newAuditEvent(ctx, cfg, auditTokenExchange, spiffeID, s.ex.clientID, strings.Join(req.Audience, " "), exchangeStart, token, err))
+	if err != nil {
+		return nil, spiffeID, fmt.Errorf("token exchange failed: %w", err)
+	}
+	return token, spiffeID, nil
+}
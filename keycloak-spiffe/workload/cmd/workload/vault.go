@@ -0,0 +1,107 @@
+// vault.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/retry"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/vault"
+)
+
+// runVaultLogin implements the vault-login subcommand: it logs in to the
+// JWT/OIDC auth method of Vault with the JWT-SVID or the Keycloak access
+// token, and prints the Vault token or writes it to VAULT_TOKEN_FILE. In
+// daemon mode it logs in again before the token expires.
+func runVaultLogin(args []string) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	setupLogging(cfg)
+	if cfg.Vault.Addr == "" {
+		return errors.New("missing Vault address: set VAULT_ADDR")
+	}
+	if cfg.Vault.Role == "" {
+		return errors.New("missing Vault role: set VAULT_ROLE")
+	}
+	if err := checkOutput(cfg.Output, ""); err != nil {
+		return &configError{err}
+	}
+	if cfg.Output == "" {
+		cfg.Output = outputRaw
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		return err
+	}
+	defer flushTraces(shutdownTracing)
+	if cfg.Daemon {
+		serveOps(ctx, cfg, nil)
+	}
+
+	bootCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	s, err := openSession(bootCtx, &cfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	client, err := serviceClient(cfg, cfg.Vault.CACert)
+	if err != nil {
+		return err
+	}
+
+	v := cfg.Vault
+	return keepLoggedIn(ctx, cfg, "Vault login", func(ctx context.Context) (time.Duration, error) {
+		ctx, span := startSpan(ctx, "vault.Login")
+		var auth *vault.Auth
+		err := cfg.retryPolicyContext(ctx, "Vault login").Do(ctx, func(ctx context.Context) error {
+			jwt, err := s.credential(ctx, v.Credential, v.Audience)
+			if err != nil {
+				return err
+			}
+			auth, err = vault.Login(ctx, client, v.Addr, v.Namespace, v.Mount, v.Role, jwt)
+			if err != nil && !vault.IsTransient(err) {
+				return retry.Permanent(err)
+			}
+			return err
+		})
+		endSpan(span, err)
+		if err != nil {
+			failures.WithLabelValues("vault").Inc()
+			return 0, fmt.Errorf("vault login failed: %w", err)
+		}
+		slog.InfoContext(ctx, "Logged in to Vault",
+			"addr", v.Addr,
+			"role", v.Role,
+			"policies", auth.TokenPolicies,
+			"lease", auth.Lease(),
+			"renewable", auth.Renewable)
+		return auth.Lease(), writeVaultToken(cfg, auth)
+	})
+}
+
+// writeVaultToken writes the Vault token to the token file, replaced
+// atomically, or prints it in the output format.
+func writeVaultToken(cfg Config, auth *vault.Auth) error {
+	if cfg.Vault.TokenFile != "" {
+		return writeFileAtomic(cfg.Vault.TokenFile, []byte(auth.ClientToken), 0o600)
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(auth.Raw, &doc); err != nil {
+		return fmt.Errorf("decoding the vault auth: %w", err)
+	}
+	return writeCredential(os.Stdout, cfg.Output, [][2]string{{"VAULT_TOKEN", auth.ClientToken}}, doc)
+}
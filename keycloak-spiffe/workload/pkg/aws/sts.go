@@ -0,0 +1,150 @@
+// Package aws exchanges the JWT-SVIDs and Keycloak access tokens of SPIFFE
+// workloads for temporary AWS credentials with AWS STS
+// AssumeRoleWithWebIdentity, which needs no AWS credentials. The STS of the
+// S3-compatible stores, such as MinIO, implement the same call.
+package aws
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSTSEndpoint is the global endpoint of AWS STS; RegionalSTSEndpoint
+// returns the endpoint of a region, which AWS recommends.
+const DefaultSTSEndpoint = "https://sts.amazonaws.com"
+
+// RegionalSTSEndpoint returns the STS endpoint of region.
+func RegionalSTSEndpoint(region string) string {
+	return "https://sts." + region + ".amazonaws.com"
+}
+
+// AssumeRoleRequest describes an AssumeRoleWithWebIdentity call. RoleARN
+// and RoleSessionName are required by AWS, optional for MinIO, which maps
+// the claims of the token to its policies without a role.
+type AssumeRoleRequest struct {
+	RoleARN         string
+	RoleSessionName string
+	// WebIdentityToken is the JWT validated by the IAM OIDC identity
+	// provider of its issuer.
+	WebIdentityToken string
+	// Duration of the credentials, the maximum session duration of the
+	// role when zero.
+	Duration time.Duration
+	// Policy is an optional session policy further restricting the role.
+	Policy string
+}
+
+// Credentials are temporary AWS credentials.
+type Credentials struct {
+	AccessKeyID     string    `xml:"AccessKeyId"`
+	SecretAccessKey string    `xml:"SecretAccessKey"`
+	SessionToken    string    `xml:"SessionToken"`
+	Expiration      time.Time `xml:"Expiration"`
+}
+
+// AssumeRoleResult is the result of AssumeRoleWithWebIdentity.
+type AssumeRoleResult struct {
+	Credentials Credentials `xml:"Credentials"`
+	// AssumedRoleARN is the ARN of the role session, such as
+	// arn:aws:sts::123456789012:assumed-role/role/session.
+	AssumedRoleARN string `xml:"AssumedRoleUser>Arn"`
+	// Subject is the sub claim of the web identity token.
+	Subject  string `xml:"SubjectFromWebIdentityToken"`
+	Provider string `xml:"Provider"`
+	Audience string `xml:"Audience"`
+}
+
+// Error is an error answered by AWS STS.
+type Error struct {
+	StatusCode int
+	Code       string `xml:"Error>Code"`
+	Message    string `xml:"Error>Message"`
+	RequestID  string `xml:"RequestId"`
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("AWS STS returned HTTP %d", e.StatusCode)
+	}
+	return fmt.Sprintf("AWS STS returned HTTP %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// IsTransient reports whether err may succeed on retry: network errors,
+// 5xx answers, throttling, and the failures of STS to reach the identity
+// provider keys.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var stsErr *Error
+	if !errors.As(err, &stsErr) {
+		return true
+	}
+	switch stsErr.Code {
+	case "Throttling", "IDPCommunicationError":
+		return true
+	}
+	return stsErr.StatusCode >= 500 || stsErr.StatusCode == http.StatusTooManyRequests
+}
+
+// AssumeRoleWithWebIdentity calls the STS endpoint to assume the role of req
+// with its web identity token.
+func AssumeRoleWithWebIdentity(ctx context.Context, client *http.Client, endpoint string, req AssumeRoleRequest) (*AssumeRoleResult, error) {
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"WebIdentityToken": {req.WebIdentityToken},
+	}
+	if req.RoleARN != "" {
+		form.Set("RoleArn", req.RoleARN)
+	}
+	if req.RoleSessionName != "" {
+		form.Set("RoleSessionName", req.RoleSessionName)
+	}
+	if req.Duration > 0 {
+		form.Set("DurationSeconds", strconv.Itoa(int(req.Duration/time.Second)))
+	}
+	if req.Policy != "" {
+		form.Set("Policy", req.Policy)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(endpoint, "/")+"/", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("creating STS request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("calling STS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading STS response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		stsErr := &Error{StatusCode: resp.StatusCode}
+		xml.Unmarshal(body, stsErr)
+		return nil, stsErr
+	}
+
+	var out struct {
+		Result AssumeRoleResult `xml:"AssumeRoleWithWebIdentityResult"`
+	}
+	if err := xml.Unmarshal(body, &out); err != nil {
+		return nil, fmt.Errorf("decoding STS response: %w", err)
+	}
+	if out.Result.Credentials.AccessKeyID == "" {
+		return nil, errors.New("STS response has no credentials")
+	}
+	return &out.Result, nil
+}
@@ -0,0 +1,125 @@
+// Package azure obtains Microsoft Entra ID access tokens for SPIFFE
+// workloads with workload identity federation: their JWT-SVID or Keycloak
+// access token is the client assertion of an app registration whose
+// federated identity credential trusts its issuer and subject, so the app
+// needs no client secret or certificate.
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultAuthorityHost is the Entra ID authority of the Azure public cloud.
+const DefaultAuthorityHost = "https://login.microsoftonline.com/"
+
+// DefaultAudience is the audience Entra ID expects in the federated
+// credentials by default.
+const DefaultAudience = "api://AzureADTokenExchange"
+
+// ManagementScope is the scope of the Azure Resource Manager API.
+const ManagementScope = "https://management.azure.com/.default"
+
+const assertionTypeJWTBearer = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// Token is an Entra ID access token.
+type Token struct {
+	AccessToken string
+	TokenType   string
+	Expiry      time.Time
+}
+
+// Error is an OAuth error answered by Entra ID.
+type Error struct {
+	StatusCode  int
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+	// ErrorCodes are the AADSTS codes of the error, such as 70021 for an
+	// assertion matching no federated credential.
+	ErrorCodes    []int  `json:"error_codes"`
+	CorrelationID string `json:"correlation_id"`
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("entra ID returned HTTP %d", e.StatusCode)
+	}
+	return fmt.Sprintf("entra ID returned HTTP %d: %s: %s", e.StatusCode, e.Code, e.Description)
+}
+
+// IsTransient reports whether err may succeed on retry: network errors,
+// 5xx answers, 429 and temporarily_unavailable.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var azErr *Error
+	if !errors.As(err, &azErr) {
+		return true
+	}
+	return azErr.Code == "temporarily_unavailable" ||
+		azErr.StatusCode >= 500 || azErr.StatusCode == http.StatusTooManyRequests
+}
+
+// TokenEndpoint returns the v2.0 token endpoint of tenant at authorityHost.
+func TokenEndpoint(authorityHost, tenant string) string {
+	return strings.TrimRight(authorityHost, "/") + "/" + url.PathEscape(tenant) + "/oauth2/v2.0/token"
+}
+
+// ClientAssertionToken obtains an access token with scopes for the app
+// registration clientID of tenant with the client credentials grant,
+// authenticating with the federated assertion.
+func ClientAssertionToken(ctx context.Context, client *http.Client, authorityHost, tenant, clientID, assertion string, scopes []string) (*Token, error) {
+	form := url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {clientID},
+		"scope":                 {strings.Join(scopes, " ")},
+		"client_assertion_type": {assertionTypeJWTBearer},
+		"client_assertion":      {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, TokenEndpoint(authorityHost, tenant), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("creating entra ID token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("calling entra ID token endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading entra ID token response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		azErr := &Error{StatusCode: resp.StatusCode}
+		json.Unmarshal(body, azErr)
+		return nil, azErr
+	}
+
+	var out struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return nil, fmt.Errorf("decoding entra ID token response: %w", err)
+	}
+	if out.AccessToken == "" {
+		return nil, errors.New("entra ID token response has no access token")
+	}
+	return &Token{
+		AccessToken: out.AccessToken,
+		TokenType:   out.TokenType,
+		Expiry:      time.Now().Add(time.Duration(out.ExpiresIn) * time.Second),
+	}, nil
+}
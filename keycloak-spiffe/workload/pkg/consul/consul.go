@@ -0,0 +1,176 @@
+// Package consul logs SPIFFE workloads in to HashiCorp Consul with a JWT or
+// OIDC auth method, presenting their JWT-SVID or a Keycloak access token,
+// and logs the ACL tokens out.
+package consul
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Token is the ACL token of a successful login.
+type Token struct {
+	AccessorID  string `json:"AccessorID"`
+	SecretID    string `json:"SecretID"`
+	Description string `json:"Description"`
+	Policies    []struct {
+		Name string `json:"Name"`
+	} `json:"Policies"`
+	Roles []struct {
+		Name string `json:"Name"`
+	} `json:"Roles"`
+	ServiceIdentities []struct {
+		ServiceName string `json:"ServiceName"`
+	} `json:"ServiceIdentities"`
+	// ExpirationTime is set when the auth method has a max token TTL.
+	ExpirationTime *time.Time `json:"ExpirationTime"`
+	Local          bool       `json:"Local"`
+	AuthMethod     string     `json:"AuthMethod"`
+
+	// Raw holds the undecoded token.
+	Raw json.RawMessage `json:"-"`
+}
+
+// Lifetime returns the time left before the ACL token expires, zero for a
+// token that does not expire.
+func (t *Token) Lifetime() time.Duration {
+	if t.ExpirationTime == nil {
+		return 0
+	}
+	return time.Until(*t.ExpirationTime)
+}
+
+// Names returns the names of the policies, roles and service identities
+// of the token.
+func (t *Token) Names() []string {
+	var names []string
+	for _, p := range t.Policies {
+		names = append(names, "policy:"+p.Name)
+	}
+	for _, r := range t.Roles {
+		names = append(names, "role:"+r.Name)
+	}
+	for _, s := range t.ServiceIdentities {
+		names = append(names, "service:"+s.ServiceName)
+	}
+	return names
+}
+
+// Error is returned when Consul rejects a request, with the text of its
+// answer.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("consul returned HTTP %d", e.StatusCode)
+	}
+	return fmt.Sprintf("consul returned HTTP %d: %s", e.StatusCode, e.Message)
+}
+
+// IsTransient reports whether err may succeed on retry: network errors,
+// 5xx answers (no cluster leader) and 429.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var consulErr *Error
+	if errors.As(err, &consulErr) {
+		return consulErr.StatusCode >= 500 || consulErr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// Scope selects the Consul Enterprise namespace and admin partition of the
+// requests, the default ones when empty.
+type Scope struct {
+	Namespace string
+	Partition string
+}
+
+// Login logs in to the Consul agent or server at addr with the auth method
+// named method, presenting the bearer token jwt, and returns the ACL token
+// issued for the bindings of the method.
+func Login(ctx context.Context, client *http.Client, addr string, scope Scope, method, jwt string) (*Token, error) {
+	body, err := json.Marshal(map[string]string{"AuthMethod": method, "BearerToken": jwt})
+	if err != nil {
+		return nil, fmt.Errorf("encoding consul login: %w", err)
+	}
+	respBody, err := do(ctx, client, addr, "/v1/acl/login", scope, "", body)
+	if err != nil {
+		return nil, fmt.Errorf("consul login: %w", err)
+	}
+	token := &Token{Raw: respBody}
+	if err := json.Unmarshal(respBody, token); err != nil {
+		return nil, fmt.Errorf("decoding consul login response: %w", err)
+	}
+	if token.SecretID == "" {
+		return nil, errors.New("consul login response has no secret ID")
+	}
+	return token, nil
+}
+
+// Logout deletes the ACL token secretID, issued by Login.
+func Logout(ctx context.Context, client *http.Client, addr string, scope Scope, secretID string) error {
+	if _, err := do(ctx, client, addr, "/v1/acl/logout", scope, secretID, nil); err != nil {
+		return fmt.Errorf("consul logout: %w", err)
+	}
+	return nil
+}
+
+// Address returns the URL of the Consul HTTP API at addr, given as for
+// CONSUL_HTTP_ADDR: a URL, or a host and port served over plain HTTP.
+func Address(addr string) string {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return strings.TrimRight(addr, "/")
+}
+
+// do posts body to path of the Consul API at addr with the ACL token
+// secretID, when set, and returns the answer.
+func do(ctx context.Context, client *http.Client, addr, path string, scope Scope, secretID string, body []byte) ([]byte, error) {
+	query := url.Values{}
+	if scope.Namespace != "" {
+		query.Set("ns", scope.Namespace)
+	}
+	if scope.Partition != "" {
+		query.Set("partition", scope.Partition)
+	}
+	endpoint := Address(addr) + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secretID != "" {
+		req.Header.Set("X-Consul-Token", secretID)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(respBody))}
+	}
+	return respBody, nil
+}
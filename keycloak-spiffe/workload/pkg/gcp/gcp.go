@@ -0,0 +1,254 @@
+// Package gcp exchanges the JWT-SVIDs and Keycloak access tokens of SPIFFE
+// workloads for Google Cloud access tokens with workload identity
+// federation: the Security Token Service trades the token for a federated
+// token, which may then impersonate a service account through the IAM
+// Credentials API. It also writes the external account configuration of
+// Application Default Credentials, with which the Google client libraries
+// run that exchange themselves.
+package gcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Endpoints of the Google APIs used for workload identity federation.
+const (
+	DefaultSTSEndpoint = "https://sts.googleapis.com/v1/token"
+	DefaultIAMEndpoint = "https://iamcredentials.googleapis.com"
+)
+
+// CloudPlatformScope is the OAuth scope of all the Google Cloud APIs, the
+// scope of the access tokens by default.
+const CloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// Token types of the STS token exchange.
+const (
+	tokenTypeJWT         = "urn:ietf:params:oauth:token-type:jwt"
+	tokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+	grantTypeExchange    = "urn:ietf:params:oauth:grant-type:token-exchange"
+)
+
+// ProviderAudience returns the STS audience of the workload identity pool
+// provider, the resource name
+// projects/NUMBER/locations/global/workloadIdentityPools/POOL/providers/PROVIDER.
+func ProviderAudience(provider string) string {
+	return "//iam.googleapis.com/" + strings.TrimPrefix(provider, "/")
+}
+
+// DefaultTokenAudience returns the audience a provider accepts in the aud
+// claim of the tokens when it has no allowed audiences configured.
+func DefaultTokenAudience(provider string) string {
+	return "https://iam.googleapis.com/" + strings.TrimPrefix(provider, "/")
+}
+
+// Token is a Google access token.
+type Token struct {
+	AccessToken string
+	Expiry      time.Time
+}
+
+// Error is returned when STS or the IAM Credentials API rejects a request.
+type Error struct {
+	StatusCode int
+	// Code is the OAuth error of STS or the status of the IAM error, such
+	// as invalid_grant or PERMISSION_DENIED.
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("google returned HTTP %d", e.StatusCode)
+	}
+	return fmt.Sprintf("google returned HTTP %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// IsTransient reports whether err may succeed on retry: network errors,
+// 5xx answers and 429.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var gcpErr *Error
+	if errors.As(err, &gcpErr) {
+		return gcpErr.StatusCode >= 500 || gcpErr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// ExchangeToken exchanges subjectToken, a JWT trusted by the workload
+// identity pool provider of audience (see ProviderAudience), for a federated
+// access token with scopes at the STS endpoint.
+func ExchangeToken(ctx context.Context, client *http.Client, endpoint, audience, subjectToken string, scopes []string) (*Token, error) {
+	form := url.Values{
+		"grant_type":           {grantTypeExchange},
+		"audience":             {audience},
+		"requested_token_type": {tokenTypeAccessToken},
+		"subject_token":        {subjectToken},
+		"subject_token_type":   {tokenTypeJWT},
+		"scope":                {strings.Join(scopes, " ")},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("creating STS request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var out struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := do(client, req, "STS token exchange", &out); err != nil {
+		return nil, err
+	}
+	if out.AccessToken == "" {
+		return nil, errors.New("STS response has no access token")
+	}
+	return &Token{
+		AccessToken: out.AccessToken,
+		Expiry:      time.Now().Add(time.Duration(out.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// GenerateAccessToken impersonates serviceAccount, by email, with the
+// federated token and returns an access token with scopes, valid for
+// lifetime (one hour when zero), from the IAM Credentials API at endpoint.
+// The federated principal needs roles/iam.workloadIdentityUser on the
+// service account.
+func GenerateAccessToken(ctx context.Context, client *http.Client, endpoint, federatedToken, serviceAccount string, scopes []string, lifetime time.Duration) (*Token, error) {
+	payload := map[string]any{"scope": scopes}
+	if lifetime > 0 {
+		payload["lifetime"] = fmt.Sprintf("%ds", int(lifetime/time.Second))
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("encoding generateAccessToken request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ImpersonationURL(endpoint, serviceAccount), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("creating generateAccessToken request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+federatedToken)
+
+	var out struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+	if err := do(client, req, "generateAccessToken", &out); err != nil {
+		return nil, err
+	}
+	if out.AccessToken == "" {
+		return nil, errors.New("generateAccessToken response has no access token")
+	}
+	return &Token{AccessToken: out.AccessToken, Expiry: out.ExpireTime}, nil
+}
+
+// ImpersonationURL returns the generateAccessToken URL of serviceAccount at
+// the IAM Credentials endpoint.
+func ImpersonationURL(endpoint, serviceAccount string) string {
+	return strings.TrimRight(endpoint, "/") + "/v1/projects/-/serviceAccounts/" + url.PathEscape(serviceAccount) + ":generateAccessToken"
+}
+
+// do sends req and decodes the JSON answer into out, or returns the Error of
+// a rejected request.
+func do(client *http.Client, req *http.Request, what string, out any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("calling %s: %w", what, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading %s response: %w", what, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return decodeError(resp.StatusCode, body)
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("decoding %s response: %w", what, err)
+	}
+	return nil
+}
+
+// decodeError decodes the OAuth error of STS ({"error": "invalid_grant",
+// "error_description": ...}) or the Google API error of IAM ({"error":
+// {"status": ..., "message": ...}}).
+func decodeError(status int, body []byte) *Error {
+	gcpErr := &Error{StatusCode: status}
+	var out struct {
+		Error            json.RawMessage `json:"error"`
+		ErrorDescription string          `json:"error_description"`
+	}
+	if json.Unmarshal(body, &out) != nil || len(out.Error) == 0 {
+		return gcpErr
+	}
+	var apiErr struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(out.Error, &gcpErr.Code) != nil && json.Unmarshal(out.Error, &apiErr) == nil {
+		gcpErr.Code, gcpErr.Message = apiErr.Status, apiErr.Message
+		return gcpErr
+	}
+	gcpErr.Message = out.ErrorDescription
+	return gcpErr
+}
+
+// ExternalAccount is the external account configuration of Application
+// Default Credentials, the file GOOGLE_APPLICATION_CREDENTIALS names: the
+// client libraries read the subject token from the credential source file,
+// exchange it at STS and impersonate the service account when set.
+type ExternalAccount struct {
+	Type                           string                `json:"type"`
+	Audience                       string                `json:"audience"`
+	SubjectTokenType               string                `json:"subject_token_type"`
+	TokenURL                       string                `json:"token_url"`
+	ServiceAccountImpersonationURL string                `json:"service_account_impersonation_url,omitempty"`
+	ServiceAccountImpersonation    *ImpersonationOptions `json:"service_account_impersonation,omitempty"`
+	CredentialSource               ExternalAccountSource `json:"credential_source"`
+}
+
+// ImpersonationOptions sets the lifetime of the impersonated tokens.
+type ImpersonationOptions struct {
+	TokenLifetimeSeconds int `json:"token_lifetime_seconds"`
+}
+
+// ExternalAccountSource is the file the subject token is read from, as text.
+type ExternalAccountSource struct {
+	File   string `json:"file"`
+	Format struct {
+		Type string `json:"type"`
+	} `json:"format"`
+}
+
+// NewExternalAccount returns the external account configuration of the
+// provider (see ProviderAudience) reading the subject token from tokenFile,
+// impersonating serviceAccount for lifetime when it is set.
+func NewExternalAccount(provider, tokenFile, serviceAccount string, lifetime time.Duration) *ExternalAccount {
+	a := &ExternalAccount{
+		Type:             "external_account",
+		Audience:         ProviderAudience(provider),
+		SubjectTokenType: tokenTypeJWT,
+		TokenURL:         DefaultSTSEndpoint,
+	}
+	a.CredentialSource.File = tokenFile
+	a.CredentialSource.Format.Type = "text"
+	if serviceAccount != "" {
+		a.ServiceAccountImpersonationURL = ImpersonationURL(DefaultIAMEndpoint, serviceAccount)
+		if lifetime > 0 {
+			a.ServiceAccountImpersonation = &ImpersonationOptions{TokenLifetimeSeconds: int(lifetime / time.Second)}
+		}
+	}
+	return a
+}
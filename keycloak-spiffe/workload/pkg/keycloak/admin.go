@@ -0,0 +1,290 @@
+// admin.go
+package keycloak
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Settings of the clients authenticating with a JWT-SVID through the
+// SPIFFE identity provider (Keycloak federated client authentication).
+const (
+	// ClientAuthenticatorFederatedJWT is the client authenticator of the
+	// clients authenticating with a JWT issued by an identity provider.
+	ClientAuthenticatorFederatedJWT = "federated-jwt"
+	// AttributeCredentialIssuer is the client attribute holding the alias of
+	// the identity provider issuing the JWT.
+	AttributeCredentialIssuer = "jwt.credential.issuer"
+	// AttributeCredentialSubject is the client attribute holding the
+	// expected sub of the JWT, the SPIFFE ID.
+	AttributeCredentialSubject = "jwt.credential.sub"
+)
+
+// Attributes of the clients whose signed JWTs Keycloak validates with a
+// JWKS held in the client rather than fetched from a URL.
+const (
+	AttributeUseJWKSString = "use.jwks.string"
+	AttributeJWKSString    = "jwks.string"
+	AttributeUseJWKSURL    = "use.jwks.url"
+)
+
+// AudienceMapper is the protocol mapper adding an audience to the tokens.
+const AudienceMapper = "oidc-audience-mapper"
+
+// Kinds of the client scopes of a client.
+const (
+	ScopeDefault  = "default"
+	ScopeOptional = "optional"
+)
+
+// AdminURL returns the Admin REST API URL of realm on the Keycloak server
+// at baseURL serving its endpoints under pathPrefix, as PrefixedRealmURL.
+func AdminURL(baseURL, pathPrefix, realm string) string {
+	return fmt.Sprintf("%s%s/admin/realms/%s", strings.TrimRight(baseURL, "/"), pathPrefix, realm)
+}
+
+// ClientRepresentation is the part of a Keycloak client handled by the
+// workload. Fields left empty keep their value on update.
+type ClientRepresentation struct {
+	ID                        string                         `json:"id,omitempty"`
+	ClientID                  string                         `json:"clientId"`
+	Name                      string                         `json:"name,omitempty"`
+	Description               string                         `json:"description,omitempty"`
+	Enabled                   *bool                          `json:"enabled,omitempty"`
+	Protocol                  string                         `json:"protocol,omitempty"`
+	PublicClient              *bool                          `json:"publicClient,omitempty"`
+	ServiceAccountsEnabled    *bool                          `json:"serviceAccountsEnabled,omitempty"`
+	StandardFlowEnabled       *bool                          `json:"standardFlowEnabled,omitempty"`
+	DirectAccessGrantsEnabled *bool                          `json:"directAccessGrantsEnabled,omitempty"`
+	ClientAuthenticatorType   string                         `json:"clientAuthenticatorType,omitempty"`
+	Attributes                map[string]string              `json:"attributes,omitempty"`
+	DefaultClientScopes       []string                       `json:"defaultClientScopes,omitempty"`
+	ProtocolMappers           []ProtocolMapperRepresentation `json:"protocolMappers,omitempty"`
+
+	// Raw holds the undecoded representation read from Keycloak, which
+	// carries the fields not mapped above.
+	Raw json.RawMessage `json:"-"`
+}
+
+// ClientScopeRepresentation identifies a client scope of the realm.
+type ClientScopeRepresentation struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// ProtocolMapperRepresentation is a protocol mapper of a client.
+type ProtocolMapperRepresentation struct {
+	ID             string            `json:"id,omitempty"`
+	Name           string            `json:"name"`
+	Protocol       string            `json:"protocol"`
+	ProtocolMapper string            `json:"protocolMapper"`
+	Config         map[string]string `json:"config"`
+}
+
+// AdminError is returned when the Admin REST API rejects a request.
+type AdminError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Body       []byte
+}
+
+func (e *AdminError) Error() string {
+	return fmt.Sprintf("admin API %s %s returned HTTP %d", e.Method, e.Path, e.StatusCode)
+}
+
+// AdminClient calls the Admin REST API of a realm with the access token of
+// an administrator, a user or service account holding the manage-clients
+// role of the realm-management client.
+type AdminClient struct {
+	client   *http.Client
+	adminURL string
+	token    string
+}
+
+// NewAdminClient returns a client of the Admin REST API at adminURL, as
+// returned by AdminURL, authenticated with the access token.
+func NewAdminClient(client *http.Client, adminURL, token string) *AdminClient {
+	return &AdminClient{client: client, adminURL: strings.TrimRight(adminURL, "/"), token: token}
+}
+
+// FindClient returns the client of the realm whose client ID is clientID,
+// nil when there is none.
+func (a *AdminClient) FindClient(ctx context.Context, clientID string) (*ClientRepresentation, error) {
+	var raw []json.RawMessage
+	if _, err := a.Do(ctx, http.MethodGet, "/clients?"+url.Values{"clientId": {clientID}}.Encode(), nil, &raw); err != nil {
+		return nil, err
+	}
+	for _, r := range raw {
+		c := &ClientRepresentation{Raw: r}
+		if err := json.Unmarshal(r, c); err != nil {
+			return nil, fmt.Errorf("decoding client: %w", err)
+		}
+		// The clientId query searches for a substring in old releases.
+		if c.ClientID == clientID {
+			return c, nil
+		}
+	}
+	return nil, nil
+}
+
+// CreateClient creates c and returns its ID.
+func (a *AdminClient) CreateClient(ctx context.Context, c ClientRepresentation) (string, error) {
+	resp, err := a.Do(ctx, http.MethodPost, "/clients", c, nil)
+	if err != nil {
+		return "", err
+	}
+	if location := resp.Header.Get("Location"); location != "" {
+		return path.Base(location), nil
+	}
+	created, err := a.FindClient(ctx, c.ClientID)
+	if err != nil {
+		return "", err
+	}
+	if created == nil {
+		return "", fmt.Errorf("client %s not found after its creation", c.ClientID)
+	}
+	return created.ID, nil
+}
+
+// UpdateClient replaces the client of ID c.ID with c. The fields of c.Raw
+// not mapped by ClientRepresentation are kept.
+func (a *AdminClient) UpdateClient(ctx context.Context, c ClientRepresentation) error {
+	body := map[string]any{}
+	if len(c.Raw) > 0 {
+		if err := json.Unmarshal(c.Raw, &body); err != nil {
+			return fmt.Errorf("decoding client: %w", err)
+		}
+	}
+	mapped, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("encoding client: %w", err)
+	}
+	if err := json.Unmarshal(mapped, &body); err != nil {
+		return fmt.Errorf("encoding client: %w", err)
+	}
+	_, err = a.Do(ctx, http.MethodPut, "/clients/"+url.PathEscape(c.ID), body, nil)
+	return err
+}
+
+// ClientScopes returns the client scopes of the realm.
+func (a *AdminClient) ClientScopes(ctx context.Context) ([]ClientScopeRepresentation, error) {
+	var scopes []ClientScopeRepresentation
+	_, err := a.Do(ctx, http.MethodGet, "/client-scopes", nil, &scopes)
+	return scopes, err
+}
+
+// ClientScopesOf returns the client scopes of kind, ScopeDefault or
+// ScopeOptional, of the client of ID id.
+func (a *AdminClient) ClientScopesOf(ctx context.Context, id, kind string) ([]ClientScopeRepresentation, error) {
+	var scopes []ClientScopeRepresentation
+	_, err := a.Do(ctx, http.MethodGet, "/clients/"+url.PathEscape(id)+"/"+kind+"-client-scopes", nil, &scopes)
+	return scopes, err
+}
+
+// AddClientScope adds the client scope of ID scopeID to the client scopes
+// of kind of the client of ID id. Keycloak ignores the client scopes of a
+// client representation on update.
+func (a *AdminClient) AddClientScope(ctx context.Context, id, kind, scopeID string) error {
+	_, err := a.Do(ctx, http.MethodPut, "/clients/"+url.PathEscape(id)+"/"+kind+"-client-scopes/"+url.PathEscape(scopeID), nil, nil)
+	return err
+}
+
+// RemoveClientScope removes the client scope of ID scopeID from the client
+// scopes of kind of the client of ID id.
+func (a *AdminClient) RemoveClientScope(ctx context.Context, id, kind, scopeID string) error {
+	_, err := a.Do(ctx, http.MethodDelete, "/clients/"+url.PathEscape(id)+"/"+kind+"-client-scopes/"+url.PathEscape(scopeID), nil, nil)
+	return err
+}
+
+// ProtocolMappers returns the protocol mappers of the client of ID id.
+func (a *AdminClient) ProtocolMappers(ctx context.Context, id string) ([]ProtocolMapperRepresentation, error) {
+	var mappers []ProtocolMapperRepresentation
+	_, err := a.Do(ctx, http.MethodGet, "/clients/"+url.PathEscape(id)+"/protocol-mappers/models", nil, &mappers)
+	return mappers, err
+}
+
+// CreateProtocolMapper adds mapper to the client of ID id.
+func (a *AdminClient) CreateProtocolMapper(ctx context.Context, id string, mapper ProtocolMapperRepresentation) error {
+	_, err := a.Do(ctx, http.MethodPost, "/clients/"+url.PathEscape(id)+"/protocol-mappers/models", mapper, nil)
+	return err
+}
+
+// DeleteProtocolMapper removes the protocol mapper of ID mapperID from the
+// client of ID id.
+func (a *AdminClient) DeleteProtocolMapper(ctx context.Context, id, mapperID string) error {
+	_, err := a.Do(ctx, http.MethodDelete, "/clients/"+url.PathEscape(id)+"/protocol-mappers/models/"+url.PathEscape(mapperID), nil, nil)
+	return err
+}
+
+// ClearKeysCache clears the public keys of the clients and identity
+// providers the realm cached, which it fetches again on their next use.
+func (a *AdminClient) ClearKeysCache(ctx context.Context) error {
+	_, err := a.Do(ctx, http.MethodPost, "/clear-keys-cache", nil, nil)
+	return err
+}
+
+// Do sends a request to the path of the Admin REST API, relative to the
+// realm, with in encoded as the JSON body when not nil, and decodes the
+// JSON answer into out when not nil. A non-2xx answer is reported as an
+// *AdminError.
+func (a *AdminClient) Do(ctx context.Context, method, path string, in, out any) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, fmt.Errorf("encoding admin request: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, a.adminURL+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("creating admin request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("calling admin API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading admin response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &AdminError{Method: method, Path: strings.SplitN(path, "?", 2)[0], StatusCode: resp.StatusCode, Body: respBody}
+	}
+	if out != nil && len(respBody) > 0 {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return nil, fmt.Errorf("decoding admin response: %w", err)
+		}
+	}
+	return resp, nil
+}
+
+// PasswordToken requests an access token for the user username with the
+// resource owner password grant, authenticating the client with auth. It
+// is meant for the administrators of the master realm, whose admin-cli
+// client only allows this grant.
+func PasswordToken(ctx context.Context, client *http.Client, tokenEndpoint string, auth ClientAuthentication, username, password string) (*TokenResponse, error) {
+	form := url.Values{
+		"grant_type": {"password"},
+		"username":   {username},
+		"password":   {password},
+	}
+	auth(form)
+	return postToken(ctx, client, tokenEndpoint, form)
+}
@@ -0,0 +1,165 @@
+// assertion.go
+package keycloak
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256" // SHA-256 for ES256 and RS256
+	_ "crypto/sha512" // SHA-384 and SHA-512 for ES384 and ES512
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+const (
+	// ClientAssertionTypeJWTBearer is the RFC 7523 client assertion type used
+	// by the private_key_jwt client authentication method.
+	ClientAssertionTypeJWTBearer = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+	defaultAssertionLifetime = time.Minute
+)
+
+// AssertionParams are the claims of an RFC 7523 client assertion.
+type AssertionParams struct {
+	// Issuer and Subject are both the client ID for client authentication.
+	Issuer  string
+	Subject string
+	// Audience is the realm issuer URL or the token endpoint.
+	Audience string
+	// ID is the jti claim. A random value is used when empty, which is what
+	// Keycloak expects since it rejects replayed assertions.
+	ID string
+	// Lifetime sets the exp claim relative to now, one minute when zero.
+	Lifetime time.Duration
+	// Certificates, when set, are added to the header as x5c so the
+	// verifier can match the signing key against the client certificate.
+	Certificates []*x509.Certificate
+}
+
+// SignClientAssertion builds an RFC 7523 client assertion and signs it with
+// key, an ECDSA (ES256/ES384/ES512) or RSA (RS256) private key such as the
+// private key of an X509-SVID.
+func SignClientAssertion(key crypto.Signer, p AssertionParams) (string, error) {
+	alg, hash, err := signingAlgorithm(key)
+	if err != nil {
+		return "", err
+	}
+
+	jti := p.ID
+	if jti == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return "", fmt.Errorf("generating jti: %w", err)
+		}
+		jti = hex.EncodeToString(b)
+	}
+	lifetime := p.Lifetime
+	if lifetime <= 0 {
+		lifetime = defaultAssertionLifetime
+	}
+
+	header := map[string]interface{}{
+		"alg": alg,
+		"typ": "JWT",
+	}
+	if len(p.Certificates) > 0 {
+		chain := make([]string, 0, len(p.Certificates))
+		for _, cert := range p.Certificates {
+			chain = append(chain, base64.StdEncoding.EncodeToString(cert.Raw))
+		}
+		header["x5c"] = chain
+		header["kid"] = CertificateThumbprint(p.Certificates[0])
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": p.Issuer,
+		"sub": p.Subject,
+		"aud": p.Audience,
+		"jti": jti,
+		"iat": now.Unix(),
+		"exp": now.Add(lifetime).Unix(),
+	}
+
+	return signJWT(key, alg, hash, header, claims)
+}
+
+// ExchangeClientAssertion authenticates to the token endpoint with assertion
+// of type assertionType using the client_credentials grant.
+func ExchangeClientAssertion(ctx context.Context, client *http.Client, tokenEndpoint, assertionType, assertion string, params ...TokenParameter) (*TokenResponse, error) {
+	return ClientCredentials(ctx, client, tokenEndpoint, WithClientAssertion(assertionType, assertion), params...)
+}
+
+// signJWT encodes header and claims and signs them with key.
+func signJWT(key crypto.Signer, alg string, hash crypto.Hash, header, claims map[string]interface{}) (string, error) {
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", fmt.Errorf("encoding JWT header: %w", err)
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("encoding JWT claims: %w", err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	h := hash.New()
+	h.Write([]byte(signingInput))
+	sig, err := key.Sign(rand.Reader, h.Sum(nil), hash)
+	if err != nil {
+		return "", fmt.Errorf("signing JWT: %w", err)
+	}
+
+	if pub, ok := key.Public().(*ecdsa.PublicKey); ok {
+		// JWS uses the fixed-size R || S encoding instead of ASN.1.
+		if sig, err = ecdsaJOSESignature(sig, pub.Curve); err != nil {
+			return "", err
+		}
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// signingAlgorithm returns the JWS algorithm matching the type of key.
+func signingAlgorithm(key crypto.Signer) (string, crypto.Hash, error) {
+	switch pub := key.Public().(type) {
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			return "ES256", crypto.SHA256, nil
+		case elliptic.P384():
+			return "ES384", crypto.SHA384, nil
+		case elliptic.P521():
+			return "ES512", crypto.SHA512, nil
+		}
+		return "", 0, fmt.Errorf("unsupported ECDSA curve %s", pub.Curve.Params().Name)
+	case *rsa.PublicKey:
+		return "RS256", crypto.SHA256, nil
+	}
+	return "", 0, errors.New("unsupported private key type")
+}
+
+// ecdsaJOSESignature converts an ASN.1 ECDSA signature to R || S.
+func ecdsaJOSESignature(der []byte, curve elliptic.Curve) ([]byte, error) {
+	var sig struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(der, &sig); err != nil {
+		return nil, fmt.Errorf("decoding ECDSA signature: %w", err)
+	}
+	size := (curve.Params().BitSize + 7) / 8
+	out := make([]byte, 2*size)
+	sig.R.FillBytes(out[:size])
+	sig.S.FillBytes(out[size:])
+	return out, nil
+}
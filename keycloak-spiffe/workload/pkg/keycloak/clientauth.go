@@ -0,0 +1,85 @@
+// clientauth.go
+package keycloak
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// ClientAuthentication adds the client credentials of a workload to a
+// request sent to a Keycloak OAuth2 endpoint.
+type ClientAuthentication func(form url.Values)
+
+// WithClientAssertion authenticates with a client assertion of
+// assertionType, such as ClientAssertionTypeSpiffe for a JWT-SVID or
+// ClientAssertionTypeJWTBearer for private_key_jwt.
+func WithClientAssertion(assertionType, assertion string) ClientAuthentication {
+	return func(form url.Values) {
+		form.Set("client_assertion_type", assertionType)
+		form.Set("client_assertion", assertion)
+	}
+}
+
+// WithClientID identifies the client without a secret, the credentials
+// being carried by the mutual TLS connection (tls_client_auth).
+func WithClientID(clientID string) ClientAuthentication {
+	return func(form url.Values) {
+		form.Set("client_id", clientID)
+	}
+}
+
+// WithClientSecret authenticates a confidential client with its secret
+// (client_secret_post), as the administration clients do.
+func WithClientSecret(clientID, secret string) ClientAuthentication {
+	return func(form url.Values) {
+		form.Set("client_id", clientID)
+		if secret != "" {
+			form.Set("client_secret", secret)
+		}
+	}
+}
+
+// TokenParameter adds an optional parameter to a token request.
+type TokenParameter func(form url.Values)
+
+// WithScope requests the space-separated scope values, such as
+// "profile email custom:read", instead of the default client scopes.
+// Keycloak still adds the default scopes of the client to the token.
+func WithScope(scope string) TokenParameter {
+	return func(form url.Values) {
+		if scope != "" {
+			form.Set("scope", scope)
+		}
+	}
+}
+
+// WithResource adds an RFC 8707 resource parameter per resource, the
+// absolute URIs of the resource servers the token is restricted to by a
+// Keycloak configured for resource indicators.
+func WithResource(resources ...string) TokenParameter {
+	return func(form url.Values) {
+		for _, resource := range resources {
+			form.Add("resource", resource)
+		}
+	}
+}
+
+// ClientCredentials requests an access token for the client itself using
+// the client_credentials grant.
+func ClientCredentials(ctx context.Context, client *http.Client, tokenEndpoint string, auth ClientAuthentication, params ...TokenParameter) (*TokenResponse, error) {
+	return postToken(ctx, client, tokenEndpoint, ClientCredentialsForm(auth, params...))
+}
+
+// ClientCredentialsForm returns the form ClientCredentials posts to the
+// token endpoint, to show the request without sending it.
+func ClientCredentialsForm(auth ClientAuthentication, params ...TokenParameter) url.Values {
+	form := url.Values{
+		"grant_type": {"client_credentials"},
+	}
+	for _, param := range params {
+		param(form)
+	}
+	auth(form)
+	return form
+}
@@ -0,0 +1,204 @@
+// discovery.go
+package keycloak
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProviderMetadata is the subset of the OpenID Connect discovery document
+// used by SPIFFE workloads.
+type ProviderMetadata struct {
+	Issuer                string `json:"issuer"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	IntrospectionEndpoint string `json:"introspection_endpoint,omitempty"`
+	RevocationEndpoint    string `json:"revocation_endpoint,omitempty"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	// Raw holds the undecoded discovery document.
+	Raw json.RawMessage `json:"-"`
+}
+
+// DiscoveryURL returns the OpenID Connect discovery document URL of issuer.
+func DiscoveryURL(issuer string) string {
+	return strings.TrimRight(issuer, "/") + "/.well-known/openid-configuration"
+}
+
+// StaticMetadata returns the endpoints Keycloak serves for realm by
+// convention, for use when discovery is disabled or unavailable.
+func StaticMetadata(baseURL, realm string) *ProviderMetadata {
+	return StaticRealmMetadata(RealmURL(baseURL, realm))
+}
+
+// StaticRealmMetadata is like StaticMetadata for the realm at issuer, as
+// returned by PrefixedRealmURL.
+func StaticRealmMetadata(issuer string) *ProviderMetadata {
+	return &ProviderMetadata{
+		Issuer:                issuer,
+		TokenEndpoint:         issuer + "/protocol/openid-connect/token",
+		IntrospectionEndpoint: issuer + "/protocol/openid-connect/token/introspect",
+		RevocationEndpoint:    issuer + "/protocol/openid-connect/revoke",
+		JWKSURI:               issuer + "/protocol/openid-connect/certs",
+	}
+}
+
+// DetectPathPrefix finds whether the Keycloak server at baseURL serves
+// realm at the root, as Keycloak 17+ does by default, or under
+// LegacyPathPrefix, by fetching the discovery document at both paths. It
+// returns the prefix and the discovery document found.
+func DetectPathPrefix(ctx context.Context, client *http.Client, baseURL, realm string) (string, *ProviderMetadata, error) {
+	var errs []error
+	for _, prefix := range []string{"", LegacyPathPrefix} {
+		md, err := Discover(ctx, client, PrefixedRealmURL(baseURL, prefix, realm))
+		if err == nil {
+			return prefix, md, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", PrefixedRealmURL(baseURL, prefix, realm), err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return "", nil, fmt.Errorf("detecting the Keycloak path of realm %s: %w", realm, errors.Join(errs...))
+}
+
+// PathResolver returns the URLs of the realms of a Keycloak server whose
+// path prefix is configured or, when not, detected with DetectPathPrefix on
+// the first use of each realm. It is safe for concurrent use.
+type PathResolver struct {
+	client  *http.Client
+	baseURL string
+	// fixed is the configured prefix, nil to detect it.
+	fixed *string
+
+	detected sync.Map
+}
+
+// NewPathResolver returns a PathResolver of the Keycloak server at baseURL.
+// legacy takes the values of the LEGACY_PATH setting of the workload: true
+// for LegacyPathPrefix, false for the Keycloak 17+ root paths, auto to
+// detect them with client.
+func NewPathResolver(client *http.Client, baseURL, legacy string) (*PathResolver, error) {
+	r := &PathResolver{client: client, baseURL: strings.TrimRight(baseURL, "/")}
+	switch legacy {
+	case "auto":
+	case "true":
+		prefix := LegacyPathPrefix
+		r.fixed = &prefix
+	case "false":
+		prefix := ""
+		r.fixed = &prefix
+	default:
+		return nil, fmt.Errorf("legacy path %q must be auto, true or false", legacy)
+	}
+	return r, nil
+}
+
+// RealmURL returns the URL of realm, which is also the issuer of its
+// tokens. A failed detection is returned and retried by the next call.
+func (r *PathResolver) RealmURL(ctx context.Context, realm string) (string, error) {
+	if r.fixed != nil {
+		return PrefixedRealmURL(r.baseURL, *r.fixed, realm), nil
+	}
+	if prefix, ok := r.detected.Load(realm); ok {
+		return PrefixedRealmURL(r.baseURL, prefix.(string), realm), nil
+	}
+	prefix, _, err := DetectPathPrefix(ctx, r.client, r.baseURL, realm)
+	if err != nil {
+		return "", err
+	}
+	r.detected.Store(realm, prefix)
+	return PrefixedRealmURL(r.baseURL, prefix, realm), nil
+}
+
+// TokenEndpoint returns the OpenID Connect token endpoint of realm, as
+// RealmURL.
+func (r *PathResolver) TokenEndpoint(ctx context.Context, realm string) (string, error) {
+	realmURL, err := r.RealmURL(ctx, realm)
+	if err != nil {
+		return "", err
+	}
+	return StaticRealmMetadata(realmURL).TokenEndpoint, nil
+}
+
+// Discover fetches the OpenID Connect discovery document of issuer.
+func Discover(ctx context.Context, client *http.Client, issuer string) (*ProviderMetadata, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, DiscoveryURL(issuer), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating discovery request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("calling discovery endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading discovery document: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery endpoint returned HTTP %d", resp.StatusCode)
+	}
+
+	md := &ProviderMetadata{Raw: body}
+	if err := json.Unmarshal(body, md); err != nil {
+		return nil, fmt.Errorf("decoding discovery document: %w", err)
+	}
+	if md.TokenEndpoint == "" {
+		return nil, fmt.Errorf("discovery document has no token_endpoint")
+	}
+	return md, nil
+}
+
+// Provider caches the discovery document of a realm. It is safe for
+// concurrent use.
+type Provider struct {
+	client *http.Client
+	issuer string
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	md      *ProviderMetadata
+	fetched time.Time
+}
+
+// NewProvider returns a Provider for issuer that refetches the discovery
+// document once it is older than ttl, or never when ttl is zero.
+func NewProvider(client *http.Client, issuer string, ttl time.Duration) *Provider {
+	return &Provider{
+		client: client,
+		issuer: issuer,
+		ttl:    ttl,
+	}
+}
+
+// Metadata returns the cached discovery document, fetching it when needed.
+// A stale document is kept if refetching it fails.
+func (p *Provider) Metadata(ctx context.Context) (*ProviderMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.md != nil && (p.ttl == 0 || time.Since(p.fetched) < p.ttl) {
+		return p.md, nil
+	}
+
+	md, err := Discover(ctx, p.client, p.issuer)
+	if err != nil {
+		if p.md != nil {
+			return p.md, nil
+		}
+		return nil, err
+	}
+	p.md = md
+	p.fetched = time.Now()
+	return md, nil
+}
@@ -0,0 +1,255 @@
+// dpop.go
+package keycloak
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DPoPKey is the proof-of-possession key of RFC 9449 DPoP: Keycloak binds
+// the access tokens requested with its proofs to it, and the resource
+// servers only accept them along with a fresh proof signed with the same
+// key. It is safe for concurrent use.
+type DPoPKey struct {
+	signer     crypto.Signer
+	alg        string
+	hash       crypto.Hash
+	jwk        map[string]string
+	thumbprint string
+}
+
+// NewDPoPKey returns the DPoP key of signer, an ECDSA or RSA private key
+// such as the private key of an X509-SVID.
+func NewDPoPKey(signer crypto.Signer) (*DPoPKey, error) {
+	alg, hash, err := signingAlgorithm(signer)
+	if err != nil {
+		return nil, err
+	}
+	jwk, err := publicJWK(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	// The members of the map are marshaled in lexicographic order, which is
+	// the canonical form hashed by the RFC 7638 thumbprint.
+	canonical, err := json.Marshal(jwk)
+	if err != nil {
+		return nil, fmt.Errorf("encoding DPoP key: %w", err)
+	}
+	sum := sha256.Sum256(canonical)
+	return &DPoPKey{
+		signer:     signer,
+		alg:        alg,
+		hash:       hash,
+		jwk:        jwk,
+		thumbprint: base64.RawURLEncoding.EncodeToString(sum[:]),
+	}, nil
+}
+
+// GenerateDPoPKey returns a new in-memory P-256 DPoP key. The tokens bound
+// to it can only be used by the process holding it.
+func GenerateDPoPKey() (*DPoPKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating DPoP key: %w", err)
+	}
+	return NewDPoPKey(key)
+}
+
+// Thumbprint returns the RFC 7638 JWK SHA-256 thumbprint of the public key,
+// the jkt confirmation of the tokens bound to it.
+func (k *DPoPKey) Thumbprint() string {
+	return k.thumbprint
+}
+
+// Proof returns a DPoP proof of a method request to target. accessToken,
+// when set, is the DPoP-bound token sent with the request to a resource
+// server, hashed into the ath claim; nonce is the last DPoP-Nonce of the
+// server, if any.
+func (k *DPoPKey) Proof(method, target, accessToken, nonce string) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", fmt.Errorf("parsing DPoP target: %w", err)
+	}
+	// htu is the target without query and fragment.
+	htu := url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path, RawPath: u.RawPath}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating jti: %w", err)
+	}
+	header := map[string]interface{}{
+		"typ": "dpop+jwt",
+		"alg": k.alg,
+		"jwk": k.jwk,
+	}
+	claims := map[string]interface{}{
+		"jti": hex.EncodeToString(b),
+		"htm": method,
+		"htu": htu.String(),
+		"iat": time.Now().Unix(),
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		claims["ath"] = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	return signJWT(k.signer, k.alg, k.hash, header, claims)
+}
+
+// BoundToKey reports whether the confirmation binds the token to key.
+func (c *Confirmation) BoundToKey(key *DPoPKey) bool {
+	if c == nil || c.JKT == "" || key == nil {
+		return false
+	}
+	return c.JKT == key.Thumbprint()
+}
+
+// publicJWK returns the required members of the JWK of pub.
+func publicJWK(pub crypto.PublicKey) (map[string]string, error) {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		return map[string]string{
+			"kty": "EC",
+			"crv": pub.Curve.Params().Name,
+			"x":   base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, size))),
+			"y":   base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, size))),
+		}, nil
+	case *rsa.PublicKey:
+		return map[string]string{
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}, nil
+	}
+	return nil, errors.New("unsupported public key type")
+}
+
+// DPoPTransport is an http.RoundTripper adding a DPoP proof to each request:
+// a client using it to call the token endpoint obtains tokens bound to the
+// key, and the same transport under a keycloakspiffe.Transport sends them to
+// the resource servers with the "DPoP" authorization scheme and matching
+// proofs. The nonces the servers require are remembered per host and the
+// request answered use_dpop_nonce is retried once.
+type DPoPTransport struct {
+	key  *DPoPKey
+	base http.RoundTripper
+
+	mu     sync.Mutex
+	nonces map[string]string
+}
+
+var _ http.RoundTripper = (*DPoPTransport)(nil)
+
+// NewDPoPTransport returns a DPoPTransport signing the proofs with key and
+// sending the requests with base, http.DefaultTransport when nil.
+func NewDPoPTransport(key *DPoPKey, base http.RoundTripper) *DPoPTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &DPoPTransport{key: key, base: base, nonces: map[string]string{}}
+}
+
+// Key returns the key signing the proofs.
+func (t *DPoPTransport) Key() *DPoPKey {
+	return t.key
+}
+
+// RoundTrip sends a clone of req carrying a DPoP proof.
+func (t *DPoPTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.send(req)
+	if err != nil || !nonceRequired(resp) {
+		return resp, err
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return resp, nil
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return t.send(req)
+}
+
+// send sends a clone of req with a proof using the known nonce of its host
+// and records the nonce of the answer.
+func (t *DPoPTransport) send(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(req.URL.Host)
+	t.mu.Lock()
+	nonce := t.nonces[host]
+	t.mu.Unlock()
+
+	var accessToken string
+	if scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "DPoP") {
+		accessToken = token
+	}
+	proof, err := t.key.Proof(req.Method, req.URL.String(), accessToken, nonce)
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	proofReq := req.Clone(req.Context())
+	proofReq.Header.Set("DPoP", proof)
+	resp, err := t.base.RoundTrip(proofReq)
+	if err != nil {
+		return nil, err
+	}
+	if v := resp.Header.Get("DPoP-Nonce"); v != "" {
+		t.mu.Lock()
+		t.nonces[host] = v
+		t.mu.Unlock()
+	}
+	return resp, nil
+}
+
+// nonceRequired reports whether resp asks for the request to be sent again
+// with a new nonce: a use_dpop_nonce error of the token endpoint (400) or
+// of a resource server (401 challenge).
+func nonceRequired(resp *http.Response) bool {
+	if resp.Header.Get("DPoP-Nonce") == "" {
+		return false
+	}
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		return strings.Contains(resp.Header.Get("WWW-Authenticate"), "use_dpop_nonce")
+	case http.StatusBadRequest:
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return false
+		}
+		var oauthErr struct {
+			Error string `json:"error"`
+		}
+		return json.Unmarshal(body, &oauthErr) == nil && oauthErr.Error == "use_dpop_nonce"
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+// errors.go
+package keycloak
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// IsTransient reports whether err is worth retrying: connection failures,
+// rate limiting and 5xx answers. Client errors such as an invalid assertion
+// (4xx) are not transient.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var tokenErr *TokenError
+	if errors.As(err, &tokenErr) {
+		return transientStatus(tokenErr.StatusCode)
+	}
+	var regErr *RegistrationError
+	if errors.As(err, &regErr) {
+		return transientStatus(regErr.StatusCode)
+	}
+	var adminErr *AdminError
+	if errors.As(err, &adminErr) {
+		return transientStatus(adminErr.StatusCode)
+	}
+	return true
+}
+
+func transientStatus(code int) bool {
+	return code >= 500 || code == http.StatusTooManyRequests
+}
@@ -0,0 +1,140 @@
+// exchange.go
+package keycloak
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// ClientAssertionTypeSpiffe is the Keycloak client assertion type for JWT-SVIDs.
+	ClientAssertionTypeSpiffe = "urn:ietf:params:oauth:client-assertion-type:jwt-spiffe"
+)
+
+// TokenResponse represents a successful Keycloak token endpoint response.
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	TokenType    string `json:"token_type"`
+	Scope        string `json:"scope,omitempty"`
+
+	// IssuedTokenType is set by RFC 8693 token exchange responses.
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
+
+	// Confirmation is the cnf claim of the access token when it is bound to
+	// a key or certificate (RFC 8705, RFC 9449), nil otherwise.
+	Confirmation *Confirmation `json:"-"`
+
+	// Raw holds the undecoded response body, including fields not mapped above.
+	Raw json.RawMessage `json:"-"`
+}
+
+// TokenError is returned when the Keycloak token endpoint rejects a request.
+type TokenError struct {
+	StatusCode  int
+	Code        string
+	Description string
+	Body        []byte
+}
+
+func (e *TokenError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("token endpoint returned HTTP %d", e.StatusCode)
+	}
+	if e.Description == "" {
+		return fmt.Sprintf("token endpoint returned HTTP %d: %s", e.StatusCode, e.Code)
+	}
+	return fmt.Sprintf("token endpoint returned HTTP %d: %s (%s)", e.StatusCode, e.Code, e.Description)
+}
+
+// Exchange sends the JWT-SVID as a client assertion to the token endpoint
+// using the client_credentials grant and returns the parsed token response.
+// A non-2xx answer is reported as a *TokenError.
+func Exchange(ctx context.Context, client *http.Client, tokenEndpoint, assertion string, params ...TokenParameter) (*TokenResponse, error) {
+	return ExchangeClientAssertion(ctx, client, tokenEndpoint, ClientAssertionTypeSpiffe, assertion, params...)
+}
+
+// postToken sends form to the token endpoint and decodes the response.
+func postToken(ctx context.Context, client *http.Client, tokenEndpoint string, form url.Values) (*TokenResponse, error) {
+	body, err := postForm(ctx, client, "token", tokenEndpoint, form)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTokenResponse(body)
+}
+
+// postForm sends form to the endpoint named name and returns the body of a
+// 2xx answer. Other answers are reported as a *TokenError.
+func postForm(ctx context.Context, client *http.Client, name, endpoint string, form url.Values) ([]byte, error) {
+	return postFormBearer(ctx, client, name, endpoint, "", form)
+}
+
+// postFormBearer is postForm authorized by the bearer token, when set.
+func postFormBearer(ctx context.Context, client *http.Client, name, endpoint, bearer string, form url.Values) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("creating %s request: %w", name, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("calling %s endpoint: %w", name, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s response: %w", name, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, newTokenError(resp.StatusCode, body)
+	}
+	return body, nil
+}
+
+// newTokenError decodes the OAuth 2.0 error of a rejected request.
+func newTokenError(statusCode int, body []byte) *TokenError {
+	tokenErr := &TokenError{StatusCode: statusCode, Body: body}
+	var oauthErr struct {
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if json.Unmarshal(body, &oauthErr) == nil {
+		tokenErr.Code = oauthErr.Error
+		tokenErr.Description = oauthErr.Description
+	}
+	return tokenErr
+}
+
+// ParseTokenResponse decodes a successful token endpoint response body, such
+// as TokenResponse.Raw of a previously issued token.
+func ParseTokenResponse(body []byte) (*TokenResponse, error) {
+	token := &TokenResponse{Raw: body}
+	if err := json.Unmarshal(body, token); err != nil {
+		return nil, fmt.Errorf("decoding token response: %w", err)
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("token response has no access_token")
+	}
+
+	var claims struct {
+		Confirmation *Confirmation `json:"cnf"`
+	}
+	if decodeClaims(token.AccessToken, &claims) == nil {
+		token.Confirmation = claims.Confirmation
+	}
+
+	return token, nil
+}
@@ -0,0 +1,52 @@
+// introspection.go
+package keycloak
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// IntrospectionResponse is the RFC 7662 answer of the introspection
+// endpoint. Only Active is set for invalid, expired or revoked tokens.
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+	ID        string `json:"jti,omitempty"`
+
+	// Claims holds every member of the response, including the claims not
+	// mapped above such as aud, realm_access and the custom mapper claims.
+	Claims map[string]any `json:"-"`
+
+	// Raw holds the undecoded response body.
+	Raw json.RawMessage `json:"-"`
+}
+
+// Introspect asks the RFC 7662 introspection endpoint whether token is
+// active and for its claims, authenticating the client with auth. hint is
+// the optional type of the token as for Revoke. Keycloak only introspects
+// for authenticated confidential clients. A non-2xx answer is reported as a
+// *TokenError.
+func Introspect(ctx context.Context, client *http.Client, introspectionEndpoint string, auth ClientAuthentication, token, hint string) (*IntrospectionResponse, error) {
+	body, err := postForm(ctx, client, "introspection", introspectionEndpoint, tokenForm(token, hint, auth))
+	if err != nil {
+		return nil, err
+	}
+	resp := &IntrospectionResponse{Raw: body}
+	if err := json.Unmarshal(body, resp); err != nil {
+		return nil, fmt.Errorf("decoding introspection response: %w", err)
+	}
+	if err := json.Unmarshal(body, &resp.Claims); err != nil {
+		return nil, fmt.Errorf("decoding introspection response: %w", err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,58 @@
+// Package keycloak implements the Keycloak endpoints used by SPIFFE workloads:
+// Dynamic Client Registration and the token endpoint with JWT-SVID client
+// assertions, and the parts of the Admin REST API configuring their clients.
+package keycloak
+
+import (
+	"fmt"
+	"strings"
+)
+
+// LegacyPathPrefix is the path prefix of the Keycloak endpoints up to
+// Keycloak 16 (WildFly distribution). Keycloak 17 and later (Quarkus) serve
+// them at the root, unless started with --http-relative-path=/auth.
+const LegacyPathPrefix = "/auth"
+
+// RealmURL returns the URL of realm on the Keycloak server at baseURL
+// under LegacyPathPrefix, which is also the issuer of the tokens the realm
+// delivers. The other endpoint functions taking a base URL use the same
+// prefix.
+func RealmURL(baseURL, realm string) string {
+	return PrefixedRealmURL(baseURL, LegacyPathPrefix, realm)
+}
+
+// PrefixedRealmURL returns the URL of realm on a Keycloak server at
+// baseURL serving its endpoints under pathPrefix, empty for the Keycloak
+// 17+ default.
+func PrefixedRealmURL(baseURL, pathPrefix, realm string) string {
+	return fmt.Sprintf("%s%s/realms/%s", strings.TrimRight(baseURL, "/"), pathPrefix, realm)
+}
+
+// TokenEndpoint returns the OpenID Connect token endpoint of realm.
+func TokenEndpoint(baseURL, realm string) string {
+	return RealmURL(baseURL, realm) + "/protocol/openid-connect/token"
+}
+
+// RevocationEndpoint returns the RFC 7009 token revocation endpoint of
+// realm.
+func RevocationEndpoint(baseURL, realm string) string {
+	return RealmURL(baseURL, realm) + "/protocol/openid-connect/revoke"
+}
+
+// IntrospectionEndpoint returns the RFC 7662 token introspection endpoint
+// of realm.
+func IntrospectionEndpoint(baseURL, realm string) string {
+	return TokenEndpoint(baseURL, realm) + "/introspect"
+}
+
+// RegistrationEndpoint returns the SPIFFE Dynamic Client Registration
+// endpoint of realm, served by the keycloak-spiffe-dcr extension.
+func RegistrationEndpoint(baseURL, realm string) string {
+	return RealmRegistrationEndpoint(RealmURL(baseURL, realm))
+}
+
+// RealmRegistrationEndpoint is like RegistrationEndpoint for the realm at
+// realmURL, as returned by PrefixedRealmURL.
+func RealmRegistrationEndpoint(realmURL string) string {
+	return realmURL + "/clients-registrations/spiffe-dcr/register"
+}
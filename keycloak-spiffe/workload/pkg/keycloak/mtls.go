@@ -0,0 +1,62 @@
+// mtls.go
+package keycloak
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Confirmation is the cnf claim binding an access token to a proof of
+// possession key.
+type Confirmation struct {
+	// X5TS256 is the SHA-256 thumbprint of the client certificate (RFC 8705).
+	X5TS256 string `json:"x5t#S256,omitempty"`
+	// JKT is the SHA-256 thumbprint of the DPoP public key (RFC 9449).
+	JKT string `json:"jkt,omitempty"`
+}
+
+// BoundTo reports whether the confirmation binds the token to cert.
+func (c *Confirmation) BoundTo(cert *x509.Certificate) bool {
+	if c == nil || c.X5TS256 == "" || cert == nil {
+		return false
+	}
+	return c.X5TS256 == CertificateThumbprint(cert)
+}
+
+// CertificateThumbprint returns the base64url-encoded SHA-256 thumbprint of
+// cert, as used in the x5t#S256 confirmation method.
+func CertificateThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// ExchangeTLSClientAuth authenticates clientID to the token endpoint with
+// the client certificate of the mutual TLS connection (RFC 8705
+// tls_client_auth) using the client_credentials grant. client must be
+// configured to present the certificate registered for clientID.
+//
+// When the Keycloak client has certificate-bound access tokens enabled, the
+// returned token carries the certificate thumbprint in Confirmation.
+func ExchangeTLSClientAuth(ctx context.Context, client *http.Client, tokenEndpoint, clientID string, params ...TokenParameter) (*TokenResponse, error) {
+	return ClientCredentials(ctx, client, tokenEndpoint, WithClientID(clientID), params...)
+}
+
+// decodeClaims decodes the payload of the JWT token into v without verifying
+// its signature.
+func decodeClaims(token string, v interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("decoding JWT payload: %w", err)
+	}
+	return json.Unmarshal(payload, v)
+}
@@ -0,0 +1,85 @@
+// registration.go
+package keycloak
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ErrClientExists is returned by RegisterClient when Keycloak answers
+// 409 Conflict because the client is already registered.
+var ErrClientExists = errors.New("client already registered")
+
+// RegistrationRequest represents the Dynamic Client Registration request payload.
+type RegistrationRequest struct {
+	ClientID            string            `json:"clientId,omitempty"`
+	Description         string            `json:"description,omitempty"`
+	DefaultClientScopes []string          `json:"defaultClientScopes,omitempty"`
+	Attributes          map[string]string `json:"attributes,omitempty"`
+}
+
+// RegisteredClient represents the client returned by a successful registration.
+type RegisteredClient struct {
+	ID         string            `json:"id"`
+	ClientID   string            `json:"clientId"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+
+	// Raw holds the undecoded response body.
+	Raw json.RawMessage `json:"-"`
+}
+
+// RegistrationError is returned when the registration endpoint rejects a request.
+type RegistrationError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (e *RegistrationError) Error() string {
+	return fmt.Sprintf("client registration failed with status %d", e.StatusCode)
+}
+
+// Is reports a 409 Conflict as ErrClientExists.
+func (e *RegistrationError) Is(target error) bool {
+	return target == ErrClientExists && e.StatusCode == http.StatusConflict
+}
+
+// RegisterClient registers a client at the SPIFFE Dynamic Client Registration
+// endpoint. A non-2xx answer is reported as a *RegistrationError.
+func RegisterClient(ctx context.Context, client *http.Client, endpoint string, reg RegistrationRequest) (*RegisteredClient, error) {
+	body, err := json.Marshal(reg)
+	if err != nil {
+		return nil, fmt.Errorf("marshalling registration request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("creating registration request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("calling registration endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading registration response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return nil, &RegistrationError{StatusCode: resp.StatusCode, Body: respBody}
+	}
+
+	registered := &RegisteredClient{Raw: respBody}
+	if err := json.Unmarshal(respBody, registered); err != nil {
+		return nil, fmt.Errorf("decoding registration response: %w", err)
+	}
+	return registered, nil
+}
@@ -0,0 +1,35 @@
+// revocation.go
+package keycloak
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// Token type hints defined by RFC 7009.
+const (
+	TokenTypeHintAccessToken  = "access_token"
+	TokenTypeHintRefreshToken = "refresh_token"
+)
+
+// Revoke invalidates token at the RFC 7009 revocation endpoint,
+// authenticating the client with auth. hint is the optional type of the
+// token, TokenTypeHintAccessToken or TokenTypeHintRefreshToken. Keycloak
+// also answers 200 for tokens already expired or unknown. A non-2xx answer
+// is reported as a *TokenError.
+func Revoke(ctx context.Context, client *http.Client, revocationEndpoint string, auth ClientAuthentication, token, hint string) error {
+	_, err := postForm(ctx, client, "revocation", revocationEndpoint, tokenForm(token, hint, auth))
+	return err
+}
+
+// tokenForm returns the form submitting token to the revocation or
+// introspection endpoint.
+func tokenForm(token, hint string, auth ClientAuthentication) url.Values {
+	form := url.Values{"token": {token}}
+	if hint != "" {
+		form.Set("token_type_hint", hint)
+	}
+	auth(form)
+	return form
+}
@@ -0,0 +1,87 @@
+// tokenexchange.go
+package keycloak
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+const (
+	// GrantTypeTokenExchange is the RFC 8693 token exchange grant.
+	GrantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+
+	// Token type identifiers defined by RFC 8693.
+	TokenTypeAccessToken  = "urn:ietf:params:oauth:token-type:access_token"
+	TokenTypeRefreshToken = "urn:ietf:params:oauth:token-type:refresh_token"
+	TokenTypeIDToken      = "urn:ietf:params:oauth:token-type:id_token"
+	TokenTypeJWT          = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// TokenExchangeRequest describes an RFC 8693 token exchange.
+type TokenExchangeRequest struct {
+	// SubjectToken is the token to exchange, such as a JWT-SVID or a
+	// Keycloak access token.
+	SubjectToken string
+	// SubjectTokenType defaults to TokenTypeAccessToken.
+	SubjectTokenType string
+	// SubjectIssuer is the alias of the identity provider of a subject
+	// token issued outside the realm, such as a Nomad workload identity,
+	// for the external to internal exchange of Keycloak.
+	SubjectIssuer string
+	// RequestedTokenType is left to Keycloak when empty.
+	RequestedTokenType string
+	// Audience lists the clients the issued token is intended for.
+	Audience []string
+	Scope    string
+	// ActorToken identifies the party acting on behalf of the subject, such
+	// as the JWT-SVID of a gateway presenting the token of an end user. The
+	// issued token then names it in its act claim when the authorization
+	// server supports delegation.
+	ActorToken string
+	// ActorTokenType is required with ActorToken and defaults to
+	// TokenTypeAccessToken.
+	ActorTokenType string
+}
+
+// TokenExchange exchanges the subject token of req for a new token using
+// the RFC 8693 token exchange grant, authenticating the client with auth.
+func TokenExchange(ctx context.Context, client *http.Client, tokenEndpoint string, auth ClientAuthentication, req TokenExchangeRequest) (*TokenResponse, error) {
+	if req.SubjectToken == "" {
+		return nil, errors.New("token exchange requires a subject token")
+	}
+	subjectTokenType := req.SubjectTokenType
+	if subjectTokenType == "" {
+		subjectTokenType = TokenTypeAccessToken
+	}
+
+	form := url.Values{
+		"grant_type":         {GrantTypeTokenExchange},
+		"subject_token":      {req.SubjectToken},
+		"subject_token_type": {subjectTokenType},
+	}
+	if req.SubjectIssuer != "" {
+		form.Set("subject_issuer", req.SubjectIssuer)
+	}
+	if req.RequestedTokenType != "" {
+		form.Set("requested_token_type", req.RequestedTokenType)
+	}
+	for _, aud := range req.Audience {
+		form.Add("audience", aud)
+	}
+	if req.Scope != "" {
+		form.Set("scope", req.Scope)
+	}
+	if req.ActorToken != "" {
+		actorTokenType := req.ActorTokenType
+		if actorTokenType == "" {
+			actorTokenType = TokenTypeAccessToken
+		}
+		form.Set("actor_token", req.ActorToken)
+		form.Set("actor_token_type", actorTokenType)
+	}
+	auth(form)
+
+	return postToken(ctx, client, tokenEndpoint, form)
+}
@@ -0,0 +1,69 @@
+// uma.go
+package keycloak
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+// GrantTypeUMATicket is the UMA 2.0 grant of Keycloak Authorization
+// Services, issuing requesting party tokens (RPT).
+const GrantTypeUMATicket = "urn:ietf:params:oauth:grant-type:uma-ticket"
+
+// RPTRequest describes the permissions asked for a requesting party token.
+type RPTRequest struct {
+	// Audience is the client ID of the resource server whose permissions
+	// are evaluated, required without Ticket.
+	Audience string
+	// Permissions are the resources and scopes asked for, as
+	// resource#scope, a resource alone or #scope, by ID or name. All the
+	// permissions granted on the resource server are asked for when empty.
+	Permissions []string
+	// Ticket is the permission ticket a resource server answered in the
+	// WWW-Authenticate: UMA header of a request without the permissions.
+	Ticket string
+	// RPT is a previous RPT whose permissions are added to the new one.
+	RPT string
+	// SubmitRequest asks the resource owners for the permissions of
+	// Ticket that the policies deny.
+	SubmitRequest bool
+}
+
+// RequestRPT asks the token endpoint for an RPT granting the permissions
+// of req to the holder of accessToken, evaluated by the policies of the
+// resource server. The RPT is returned as the access token of the
+// response, its permissions in the authorization claim. A denial is a
+// *TokenError with code access_denied.
+func RequestRPT(ctx context.Context, client *http.Client, tokenEndpoint, accessToken string, req RPTRequest) (*TokenResponse, error) {
+	if accessToken == "" {
+		return nil, errors.New("rpt request requires an access token")
+	}
+	if req.Audience == "" && req.Ticket == "" {
+		return nil, errors.New("rpt request requires an audience or a permission ticket")
+	}
+
+	form := url.Values{"grant_type": {GrantTypeUMATicket}}
+	if req.Audience != "" {
+		form.Set("audience", req.Audience)
+	}
+	for _, permission := range req.Permissions {
+		form.Add("permission", permission)
+	}
+	if req.Ticket != "" {
+		form.Set("ticket", req.Ticket)
+	}
+	if req.RPT != "" {
+		form.Set("rpt", req.RPT)
+	}
+	if req.SubmitRequest {
+		form.Set("submit_request", "true")
+	}
+
+	body, err := postFormBearer(ctx, client, "token", tokenEndpoint, accessToken, form)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTokenResponse(body)
+}
@@ -0,0 +1,34 @@
+// audiences.go
+package keycloakspiffe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/spire"
+)
+
+// ExchangeAudiences fetches a JWT-SVID per audience from svids and exchanges
+// each of them at tokenEndpoint. The tokens are keyed by audience; the ones
+// obtained before a failure are returned along with the joined errors.
+func ExchangeAudiences(ctx context.Context, client *http.Client, svids spire.JWTSVIDSource, tokenEndpoint string, audiences []string) (map[string]*keycloak.TokenResponse, error) {
+	tokens := make(map[string]*keycloak.TokenResponse, len(audiences))
+	var errs []error
+	for _, audience := range audiences {
+		svid, err := spire.FetchJWTSVID(ctx, svids, audience)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("audience %s: %w", audience, err))
+			continue
+		}
+		token, err := keycloak.Exchange(ctx, client, tokenEndpoint, svid.Marshal())
+		if err != nil {
+			errs = append(errs, fmt.Errorf("audience %s: %w", audience, err))
+			continue
+		}
+		tokens[audience] = token
+	}
+	return tokens, errors.Join(errs...)
+}
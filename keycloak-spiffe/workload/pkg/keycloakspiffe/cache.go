@@ -0,0 +1,152 @@
+// cache.go
+package keycloakspiffe
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+)
+
+// CacheKey identifies a cached access token.
+type CacheKey struct {
+	Audience string `json:"audience"`
+	Realm    string `json:"realm"`
+	ClientID string `json:"client_id"`
+	// Scope is the scope requested, the tokens of another scope being
+	// distinct.
+	Scope string `json:"scope,omitempty"`
+	// Resource is the space-separated RFC 8707 resources requested.
+	Resource string `json:"resource,omitempty"`
+}
+
+func (k CacheKey) String() string {
+	return k.Audience + "\x00" + k.Realm + "\x00" + k.ClientID + "\x00" + k.Scope + "\x00" + k.Resource
+}
+
+// FetchFunc obtains a new token response from Keycloak.
+type FetchFunc func(ctx context.Context) (*keycloak.TokenResponse, error)
+
+// cacheEntry is a token response and the time it was issued.
+type cacheEntry struct {
+	resp     *keycloak.TokenResponse
+	issuedAt time.Time
+	token    *oauth2.Token
+}
+
+// Cache holds access tokens until they are about to expire and collapses
+// concurrent fetches of the same key into a single Keycloak call. It is safe
+// for concurrent use.
+type Cache struct {
+	expiryDelta time.Duration
+
+	mu      sync.Mutex
+	entries map[CacheKey]*cacheEntry
+	group   singleflight.Group
+}
+
+// NewCache returns an empty cache renewing tokens expiryDelta before they
+// expire, 30 seconds when zero.
+func NewCache(expiryDelta time.Duration) *Cache {
+	if expiryDelta <= 0 {
+		expiryDelta = defaultExpiryDelta
+	}
+	return &Cache{
+		expiryDelta: expiryDelta,
+		entries:     make(map[CacheKey]*cacheEntry),
+	}
+}
+
+// Get returns the cached token for key, calling fetch when there is none or
+// it is about to expire. Callers arriving while a fetch for key is in flight
+// wait for its result instead of calling Keycloak again. The fetch runs with
+// the context of the caller that started it; the other callers stop waiting
+// when their own ctx is done.
+func (c *Cache) Get(ctx context.Context, key CacheKey, fetch FetchFunc) (*oauth2.Token, error) {
+	if e := c.lookup(key); e != nil {
+		return e.token, nil
+	}
+
+	ch := c.group.DoChan(key.String(), func() (interface{}, error) {
+		// Another flight may have stored a token since the lookup.
+		if e := c.lookup(key); e != nil {
+			return e.token, nil
+		}
+		resp, err := fetch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return c.Put(key, resp, time.Now()), nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*oauth2.Token), nil
+	}
+}
+
+// Put stores resp, issued at issuedAt, under key and returns it as an
+// oauth2.Token.
+func (c *Cache) Put(key CacheKey, resp *keycloak.TokenResponse, issuedAt time.Time) *oauth2.Token {
+	e := &cacheEntry{resp: resp, issuedAt: issuedAt, token: OAuth2Token(resp, issuedAt)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = e
+	return e.token
+}
+
+// Lookup returns the token response cached for key and the time it was
+// issued, if it is not about to expire.
+func (c *Cache) Lookup(key CacheKey) (*keycloak.TokenResponse, time.Time, bool) {
+	e := c.lookup(key)
+	if e == nil {
+		return nil, time.Time{}, false
+	}
+	return e.resp, e.issuedAt, true
+}
+
+// Unexpired returns the token cached for key while it has not expired, even
+// when it is about to, for the callers that cannot renew it, such as while
+// Keycloak is unavailable.
+func (c *Cache) Unexpired(key CacheKey) (*oauth2.Token, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[key]
+	if e == nil || (!e.token.Expiry.IsZero() && !time.Now().Before(e.token.Expiry)) {
+		return nil, false
+	}
+	return e.token, true
+}
+
+// Invalidate drops the cached token for key, for instance after a resource
+// server rejected it.
+func (c *Cache) Invalidate(key CacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// lookup returns the entry for key if it is still fresh.
+func (c *Cache) lookup(key CacheKey) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[key]
+	if e == nil || !c.fresh(e) {
+		return nil
+	}
+	return e
+}
+
+// fresh reports whether e is not about to expire.
+func (c *Cache) fresh(e *cacheEntry) bool {
+	return e.token.Expiry.IsZero() || time.Until(e.token.Expiry) > c.expiryDelta
+}
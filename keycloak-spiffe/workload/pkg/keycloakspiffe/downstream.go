@@ -0,0 +1,109 @@
+// downstream.go
+package keycloakspiffe
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/retry"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/spire"
+)
+
+// ExchangeForAudience exchanges accessToken, a Keycloak access token of the
+// workload, for a token intended for the clients audience with the Keycloak
+// token exchange (RFC 8693), so that service A calls service B with a token
+// whose aud is B. The client authenticates with a JWT-SVID for svidAudience
+// fetched from svids, as for the initial exchange.
+func ExchangeForAudience(ctx context.Context, client *http.Client, svids spire.JWTSVIDSource, tokenEndpoint, svidAudience, accessToken string, audience ...string) (*keycloak.TokenResponse, error) {
+	svid, err := spire.FetchJWTSVID(ctx, svids, svidAudience)
+	if err != nil {
+		return nil, err
+	}
+	auth := keycloak.WithClientAssertion(keycloak.ClientAssertionTypeSpiffe, svid.Marshal())
+	return keycloak.TokenExchange(ctx, client, tokenEndpoint, auth, keycloak.TokenExchangeRequest{
+		SubjectToken:       accessToken,
+		SubjectTokenType:   keycloak.TokenTypeAccessToken,
+		RequestedTokenType: keycloak.TokenTypeAccessToken,
+		Audience:           audience,
+	})
+}
+
+// DownstreamTokenSource is an oauth2.TokenSource of the tokens for other
+// clients of the realm, exchanged for the access tokens of a TokenSource.
+// Tokens are cached and only renewed when they are about to expire. It is
+// safe for concurrent use.
+type DownstreamTokenSource struct {
+	upstream *TokenSource
+	audience []string
+
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+var _ oauth2.TokenSource = (*DownstreamTokenSource)(nil)
+
+// Downstream returns a DownstreamTokenSource exchanging the access tokens of
+// s for tokens intended for the clients audience, with the HTTP client,
+// timeout and retry policy of s.
+func (s *TokenSource) Downstream(audience ...string) *DownstreamTokenSource {
+	return &DownstreamTokenSource{upstream: s, audience: audience}
+}
+
+// Token returns the cached downstream token, exchanging the current access
+// token of the upstream TokenSource when there is none or it is about to
+// expire.
+func (d *DownstreamTokenSource) Token() (*oauth2.Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.upstream.timeout)
+	defer cancel()
+	return d.TokenContext(ctx)
+}
+
+// TokenContext is like Token but uses ctx for the exchanges.
+func (d *DownstreamTokenSource) TokenContext(ctx context.Context) (*oauth2.Token, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.token != nil && (d.token.Expiry.IsZero() || time.Until(d.token.Expiry) > d.upstream.expiryDelta) {
+		return d.token, nil
+	}
+
+	subject, err := d.upstream.TokenContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.upstream.exchangeFor(ctx, subject.AccessToken, d.audience)
+	if err != nil {
+		return nil, err
+	}
+
+	d.token = OAuth2Token(resp, time.Now())
+	return d.token, nil
+}
+
+// Invalidate drops the cached downstream token, for instance after the
+// downstream service rejected it. The upstream token is kept.
+func (d *DownstreamTokenSource) Invalidate() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.token = nil
+}
+
+// exchangeFor exchanges accessToken for a token intended for audience,
+// authenticating with the JWT-SVIDs of s and retrying with its policy.
+func (s *TokenSource) exchangeFor(ctx context.Context, accessToken string, audience []string) (*keycloak.TokenResponse, error) {
+	var resp *keycloak.TokenResponse
+	err := s.retry.Do(ctx, func(ctx context.Context) error {
+		var err error
+		resp, err = ExchangeForAudience(ctx, s.client, s.svids, s.tokenEndpoint, s.audience, accessToken, audience...)
+		if err != nil && !keycloak.IsTransient(err) {
+			return retry.Permanent(err)
+		}
+		return err
+	})
+	return resp, err
+}
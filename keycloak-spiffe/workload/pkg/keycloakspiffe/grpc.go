@@ -0,0 +1,73 @@
+// grpc.go
+package keycloakspiffe
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc/credentials"
+)
+
+// PerRPCCredentials is a gRPC credentials.PerRPCCredentials that sends the
+// access token of a TokenSource in the authorization metadata of every
+// call. The token is renewed by the TokenSource when it is about to expire.
+type PerRPCCredentials struct {
+	source        *TokenSource
+	allowInsecure bool
+}
+
+var _ credentials.PerRPCCredentials = (*PerRPCCredentials)(nil)
+
+// PerRPCOption configures a PerRPCCredentials.
+type PerRPCOption func(*PerRPCCredentials)
+
+// WithInsecureTransport allows sending the token over connections without
+// transport security, such as a Unix socket or a service mesh sidecar on
+// loopback. The token is otherwise only sent over TLS.
+func WithInsecureTransport() PerRPCOption {
+	return func(c *PerRPCCredentials) {
+		c.allowInsecure = true
+	}
+}
+
+// NewPerRPCCredentials returns credentials attaching the tokens of source,
+// for use with grpc.WithPerRPCCredentials:
+//
+//	conn, err := grpc.NewClient(target,
+//		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+//		grpc.WithPerRPCCredentials(keycloakspiffe.NewPerRPCCredentials(ts)))
+func NewPerRPCCredentials(source *TokenSource, opts ...PerRPCOption) *PerRPCCredentials {
+	c := &PerRPCCredentials{source: source}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// GetRequestMetadata returns the authorization metadata of a call, within
+// the deadline of the call.
+func (c *PerRPCCredentials) GetRequestMetadata(ctx context.Context, _ ...string) (map[string]string, error) {
+	if !c.allowInsecure {
+		ri, _ := credentials.RequestInfoFromContext(ctx)
+		if err := credentials.CheckSecurityLevel(ri.AuthInfo, credentials.PrivacyAndIntegrity); err != nil {
+			return nil, fmt.Errorf("refusing to send the access token over an insecure connection: %w", err)
+		}
+	}
+
+	token, err := c.source.TokenContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"authorization": authorization(token)}, nil
+}
+
+// RequireTransportSecurity reports whether the token is only sent over TLS.
+func (c *PerRPCCredentials) RequireTransportSecurity() bool {
+	return !c.allowInsecure
+}
+
+// authorization returns the authorization header value of token.
+func authorization(token *oauth2.Token) string {
+	return token.Type() + " " + token.AccessToken
+}
@@ -0,0 +1,23 @@
+// introspect.go
+package keycloakspiffe
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/spire"
+)
+
+// Introspect asks introspectionEndpoint whether token is active and for its
+// claims (see keycloak.Introspect), for resource servers preferring
+// introspection to the local JWKS validation of tokenauth. The client
+// authenticates with a JWT-SVID for audience fetched from svids.
+func Introspect(ctx context.Context, client *http.Client, svids spire.JWTSVIDSource, introspectionEndpoint, audience, token, hint string) (*keycloak.IntrospectionResponse, error) {
+	svid, err := spire.FetchJWTSVID(ctx, svids, audience)
+	if err != nil {
+		return nil, err
+	}
+	auth := keycloak.WithClientAssertion(keycloak.ClientAssertionTypeSpiffe, svid.Marshal())
+	return keycloak.Introspect(ctx, client, introspectionEndpoint, auth, token, hint)
+}
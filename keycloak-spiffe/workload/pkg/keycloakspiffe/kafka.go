@@ -0,0 +1,78 @@
+// kafka.go
+package keycloakspiffe
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// saslExtensionKey matches the SASL extension keys of RFC 7628.
+var saslExtensionKey = regexp.MustCompile(`^[A-Za-z]+$`)
+
+// OAuthBearer provides the SASL/OAUTHBEARER tokens (RFC 7628, KIP-255) of
+// the Kafka clients from a TokenSource. Its Token method is bridged to the
+// callback of each client: the AccessTokenProvider of sarama, or the
+// oauth.Auth function of franz-go.
+// The clients ask for a token for each connection and re-authentication,
+// and the TokenSource renews it when it is about to expire.
+type OAuthBearer struct {
+	source     *TokenSource
+	extensions map[string]string
+}
+
+// OAuthBearerOption configures an OAuthBearer.
+type OAuthBearerOption func(*OAuthBearer)
+
+// WithSASLExtensions sends extensions (KIP-342) with the token, such as the
+// logicalCluster and identityPoolId of Confluent Cloud.
+func WithSASLExtensions(extensions map[string]string) OAuthBearerOption {
+	return func(b *OAuthBearer) {
+		b.extensions = extensions
+	}
+}
+
+// NewOAuthBearer returns the OAUTHBEARER token provider of source. With
+// sarama:
+//
+//	type kafkaTokens struct{ b *keycloakspiffe.OAuthBearer }
+//
+//	func (t kafkaTokens) Token() (*sarama.AccessToken, error) {
+//		token, ext, err := t.b.Token(context.Background())
+//		return &sarama.AccessToken{Token: token, Extensions: ext}, err
+//	}
+//
+//	cfg.Net.SASL.Enable = true
+//	cfg.Net.SASL.Mechanism = sarama.SASLTypeOAuth
+//	cfg.Net.SASL.TokenProvider = kafkaTokens{keycloakspiffe.NewOAuthBearer(ts)}
+//
+// With franz-go:
+//
+//	b := keycloakspiffe.NewOAuthBearer(ts)
+//	kgo.SASL(oauth.Oauth(func(ctx context.Context) (oauth.Auth, error) {
+//		token, ext, err := b.Token(ctx)
+//		return oauth.Auth{Token: token, Extensions: ext}, err
+//	}))
+func NewOAuthBearer(source *TokenSource, opts ...OAuthBearerOption) *OAuthBearer {
+	b := &OAuthBearer{source: source}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// Token returns the access token and the SASL extensions to authenticate
+// with, within ctx.
+func (b *OAuthBearer) Token(ctx context.Context) (string, map[string]string, error) {
+	for k, v := range b.extensions {
+		if !saslExtensionKey.MatchString(k) || k == "auth" || strings.ContainsRune(v, '\x01') {
+			return "", nil, fmt.Errorf("invalid SASL extension %q", k)
+		}
+	}
+	token, err := b.source.TokenContext(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	return token.AccessToken, b.extensions, nil
+}
@@ -0,0 +1,45 @@
+// mongodb.go
+package keycloakspiffe
+
+import (
+	"context"
+	"time"
+)
+
+// MongoDBOIDC provides the access tokens of the MONGODB-OIDC mechanism of
+// MongoDB 7 and later, for the machine (workload identity) flow, from a
+// TokenSource. Its Token method is bridged to the OIDCMachineCallback of
+// the Go driver. The driver caches
+// the token and calls the callback again when the server asks it to
+// re-authenticate.
+type MongoDBOIDC struct {
+	source *TokenSource
+}
+
+// NewMongoDBOIDC returns the OIDC callback of source:
+//
+//	m := keycloakspiffe.NewMongoDBOIDC(ts)
+//	opts := options.Client().ApplyURI(uri).SetAuth(options.Credential{
+//		AuthMechanism: "MONGODB-OIDC",
+//		OIDCMachineCallback: func(ctx context.Context, _ *options.OIDCArgs) (*options.OIDCCredential, error) {
+//			token, expiry, err := m.Token(ctx)
+//			if err != nil {
+//				return nil, err
+//			}
+//			return &options.OIDCCredential{AccessToken: token, ExpiresAt: &expiry}, nil
+//		},
+//	})
+func NewMongoDBOIDC(source *TokenSource) *MongoDBOIDC {
+	return &MongoDBOIDC{source: source}
+}
+
+// Token returns the access token and its expiry, zero when Keycloak did
+// not give one, within ctx. The driver bounds the callback with a one
+// minute timeout.
+func (m *MongoDBOIDC) Token(ctx context.Context) (string, time.Time, error) {
+	token, err := m.source.TokenContext(ctx)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token.AccessToken, token.Expiry, nil
+}
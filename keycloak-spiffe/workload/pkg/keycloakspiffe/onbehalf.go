@@ -0,0 +1,169 @@
+// onbehalf.go
+package keycloakspiffe
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/tokenauth"
+)
+
+// ErrNoInboundToken is returned by the OnBehalfOf transport for requests
+// whose context carries no inbound token, see OnBehalfOf.Middleware.
+var ErrNoInboundToken = errors.New("no inbound token to act on behalf of")
+
+// OnBehalfOf carries the subject of the access tokens received by a service
+// to the next hop of the call graph: it validates the inbound token,
+// exchanges it for a token intended for the next service, with the same
+// subject, and attaches it to the outbound requests. The exchanged tokens
+// are cached per inbound token until they are about to expire. It is safe
+// for concurrent use.
+type OnBehalfOf struct {
+	source   *TokenSource
+	verifier *tokenauth.Verifier
+	opts     []tokenauth.Option
+	audience []string
+
+	mu     sync.Mutex
+	tokens map[[sha256.Size]byte]*oauth2.Token
+}
+
+type inboundTokenKey struct{}
+
+// OnBehalfOf returns an OnBehalfOf accepting the inbound tokens verified by
+// v that meet the requirements of opts, and exchanging them for tokens
+// intended for the clients audience of the next hop. The workload
+// authenticates the exchanges with the JWT-SVIDs, HTTP client and retry
+// policy of s.
+func (s *TokenSource) OnBehalfOf(v *tokenauth.Verifier, audience []string, opts ...tokenauth.Option) *OnBehalfOf {
+	return &OnBehalfOf{
+		source:   s,
+		verifier: v,
+		opts:     opts,
+		audience: audience,
+		tokens:   map[[sha256.Size]byte]*oauth2.Token{},
+	}
+}
+
+// Exchange validates inbound and returns the token for the next hop with
+// its claims. The validation errors wrap tokenauth.ErrInvalidToken or
+// tokenauth.ErrForbidden. With policies among the options it fails, the
+// policies deciding on a request: use ExchangeRequest or Middleware.
+func (o *OnBehalfOf) Exchange(ctx context.Context, inbound string) (*oauth2.Token, *tokenauth.Claims, error) {
+	claims, err := tokenauth.Authenticate(ctx, o.verifier, inbound, o.opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	token, err := o.outbound(ctx, inbound)
+	if err != nil {
+		return nil, nil, err
+	}
+	return token, claims, nil
+}
+
+// ExchangeRequest is Exchange for the request described by input, also
+// asking the policies of the options.
+func (o *OnBehalfOf) ExchangeRequest(ctx context.Context, inbound string, input tokenauth.PolicyInput) (*oauth2.Token, *tokenauth.Claims, error) {
+	claims, err := tokenauth.AuthenticateRequest(ctx, o.verifier, inbound, input, o.opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	token, err := o.outbound(ctx, inbound)
+	if err != nil {
+		return nil, nil, err
+	}
+	return token, claims, nil
+}
+
+// Middleware validates the bearer token of the requests as
+// tokenauth.Middleware and passes it, along with its claims, to next in the
+// request context, for the Transport to exchange it when next calls the
+// following hop.
+func (o *OnBehalfOf) Middleware(next http.Handler) http.Handler {
+	keep := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inbound, _ := tokenauth.BearerToken(r.Header.Get("Authorization"))
+		next.ServeHTTP(w, r.WithContext(WithInboundToken(r.Context(), inbound)))
+	})
+	return tokenauth.Middleware(o.verifier, o.opts...)(keep)
+}
+
+// WithInboundToken returns a copy of ctx carrying inbound, an access token
+// already validated by the caller, for the Transport.
+func WithInboundToken(ctx context.Context, inbound string) context.Context {
+	return context.WithValue(ctx, inboundTokenKey{}, inbound)
+}
+
+// Transport returns an http.RoundTripper sending the requests with the
+// token exchanged for the inbound token of their context through base,
+// http.DefaultTransport when nil. Requests without an inbound token fail
+// with ErrNoInboundToken rather than leave unauthenticated.
+func (o *OnBehalfOf) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		inbound, _ := req.Context().Value(inboundTokenKey{}).(string)
+		if inbound == "" {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, ErrNoInboundToken
+		}
+		token, err := o.outbound(req.Context(), inbound)
+		if err != nil {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, err
+		}
+		authReq := req.Clone(req.Context())
+		authReq.Header.Set("Authorization", authorization(token))
+		return base.RoundTrip(authReq)
+	})
+}
+
+// outbound returns the cached token exchanged for inbound, exchanging it
+// when there is none or it is about to expire. The lock is not held during
+// the exchange, so that a slow exchange does not delay the requests of the
+// other callers. The expired tokens of the other inbound tokens are dropped
+// when a new one is stored.
+func (o *OnBehalfOf) outbound(ctx context.Context, inbound string) (*oauth2.Token, error) {
+	key := sha256.Sum256([]byte(inbound))
+	delta := o.source.expiryDelta
+
+	o.mu.Lock()
+	token, ok := o.tokens[key]
+	o.mu.Unlock()
+	if ok && (token.Expiry.IsZero() || time.Until(token.Expiry) > delta) {
+		return token, nil
+	}
+
+	resp, err := o.source.exchangeFor(ctx, inbound, o.audience)
+	if err != nil {
+		return nil, err
+	}
+	token = OAuth2Token(resp, time.Now())
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for k, t := range o.tokens {
+		if !t.Expiry.IsZero() && time.Until(t.Expiry) <= delta {
+			delete(o.tokens, k)
+		}
+	}
+	o.tokens[key] = token
+	return token, nil
+}
+
+// roundTripperFunc adapts a function to http.RoundTripper.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,123 @@
+// persist.go
+package keycloakspiffe
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+)
+
+// cacheFileAAD binds the ciphertext to the cache file format.
+var cacheFileAAD = []byte("keycloak-spiffe token cache v1")
+
+// persistedToken is the on-disk form of a cache entry.
+type persistedToken struct {
+	Key      CacheKey        `json:"key"`
+	IssuedAt time.Time       `json:"issued_at"`
+	Response json.RawMessage `json:"response"`
+}
+
+// SaveFile writes the unexpired tokens of the cache to path, encrypted with
+// AES-GCM under key (16, 24 or 32 bytes). The file is replaced atomically
+// and only readable by its owner.
+func (c *Cache) SaveFile(path string, key []byte) error {
+	c.mu.Lock()
+	records := make([]persistedToken, 0, len(c.entries))
+	for k, e := range c.entries {
+		if c.fresh(e) {
+			records = append(records, persistedToken{Key: k, IssuedAt: e.issuedAt, Response: e.resp.Raw})
+		}
+	}
+	c.mu.Unlock()
+
+	plaintext, err := json.Marshal(records)
+	if err != nil {
+		return fmt.Errorf("encoding token cache: %w", err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("generating nonce: %w", err)
+	}
+	data := aead.Seal(nonce, nonce, plaintext, cacheFileAAD)
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("creating token cache file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing token cache file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing token cache file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("replacing token cache file: %w", err)
+	}
+	return nil
+}
+
+// LoadFile restores the tokens saved by SaveFile at path that are not about
+// to expire. A missing file leaves the cache empty.
+func (c *Cache) LoadFile(path string, key []byte) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading token cache file: %w", err)
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	if len(data) < aead.NonceSize() {
+		return errors.New("token cache file is truncated")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, cacheFileAAD)
+	if err != nil {
+		return fmt.Errorf("decrypting token cache file: %w", err)
+	}
+
+	var records []persistedToken
+	if err := json.Unmarshal(plaintext, &records); err != nil {
+		return fmt.Errorf("decoding token cache: %w", err)
+	}
+	for _, r := range records {
+		resp, err := keycloak.ParseTokenResponse(r.Response)
+		if err != nil {
+			continue
+		}
+		e := &cacheEntry{resp: resp, issuedAt: r.IssuedAt, token: OAuth2Token(resp, r.IssuedAt)}
+		if !c.fresh(e) {
+			continue
+		}
+		c.mu.Lock()
+		c.entries[r.Key] = e
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("token cache key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
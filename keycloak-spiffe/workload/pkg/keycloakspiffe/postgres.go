@@ -0,0 +1,73 @@
+// postgres.go
+package keycloakspiffe
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// PostgresPassword supplies the access tokens of a TokenSource as the
+// passwords of PostgreSQL connections, for PgBouncer or PostgreSQL setups
+// validating OAuth tokens (an auth_query or PAM module checking the token,
+// or the OAuth validators of PostgreSQL 18). The server checks the token
+// once, when the connection opens, so Fresh tells the pool which
+// connections were opened with a token about to expire.
+type PostgresPassword struct {
+	source *TokenSource
+
+	mu sync.Mutex
+	// expiry holds the expiry of the tokens handed out and not expired,
+	// zero for the tokens that do not expire.
+	expiry map[string]time.Time
+}
+
+// NewPostgresPassword returns the password helper of source. With a pgx
+// pool:
+//
+//	pw := keycloakspiffe.NewPostgresPassword(ts)
+//	cfg, err := pgxpool.ParseConfig("postgres://pgbouncer:6432/reports?sslmode=verify-full")
+//	cfg.ConnConfig.User = "spiffe://localhost.idyatech.fr/mcp-client"
+//	cfg.BeforeConnect = func(ctx context.Context, cc *pgx.ConnConfig) (err error) {
+//		cc.Password, err = pw.Password(ctx)
+//		return err
+//	}
+//	cfg.BeforeAcquire = func(_ context.Context, c *pgx.Conn) bool {
+//		return pw.Fresh(c.Config().Password)
+//	}
+//	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+//
+// With pgconn alone, set the Password of the pgconn.Config before each
+// pgconn.ConnectConfig.
+func NewPostgresPassword(source *TokenSource) *PostgresPassword {
+	return &PostgresPassword{source: source, expiry: make(map[string]time.Time)}
+}
+
+// Password returns the access token to open a connection with, within ctx.
+func (p *PostgresPassword) Password(ctx context.Context) (string, error) {
+	token, err := p.source.TokenContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for t, expiry := range p.expiry {
+		if !expiry.IsZero() && now.After(expiry) {
+			delete(p.expiry, t)
+		}
+	}
+	p.expiry[token.AccessToken] = token.Expiry
+	return token.AccessToken, nil
+}
+
+// Fresh reports whether a connection opened with password, a token of
+// Password, may still be used: its token does not expire within the
+// expiry delta of the TokenSource, after which the TokenSource renews it.
+// Connections with another password are not fresh.
+func (p *PostgresPassword) Fresh(password string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	expiry, ok := p.expiry[password]
+	return ok && (expiry.IsZero() || time.Until(expiry) > p.source.expiryDelta)
+}
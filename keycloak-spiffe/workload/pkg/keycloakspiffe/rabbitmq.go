@@ -0,0 +1,92 @@
+// rabbitmq.go
+package keycloakspiffe
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// rabbitMQRetryInterval is how long Refresh waits after a failed renewal,
+// or when the TokenSource still returns the current token.
+const rabbitMQRetryInterval = 5 * time.Second
+
+// RabbitMQCredentials supplies the access tokens of the OAuth 2.0 plugin of
+// RabbitMQ from a TokenSource: the token is the password of the PLAIN
+// mechanism, the username being ignored. RabbitMQ closes the connections
+// whose token expired unless a new one is sent with update-secret, which
+// Refresh does.
+type RabbitMQCredentials struct {
+	source *TokenSource
+}
+
+// NewRabbitMQCredentials returns the credentials of source. With amqp091-go:
+//
+//	r := keycloakspiffe.NewRabbitMQCredentials(ts)
+//	token, err := r.Token(ctx)
+//	conn, err := amqp.DialConfig(uri, amqp.Config{
+//		SASL: []amqp.Authentication{&amqp.PlainAuth{Password: token}},
+//	})
+//	go r.Refresh(ctx, func(token string) error {
+//		return conn.UpdateSecret(token, "token renewed")
+//	})
+//
+// The stream client takes the token as the password of its environment.
+func NewRabbitMQCredentials(source *TokenSource) *RabbitMQCredentials {
+	return &RabbitMQCredentials{source: source}
+}
+
+// Token returns the access token to connect with, within ctx.
+func (r *RabbitMQCredentials) Token(ctx context.Context) (string, error) {
+	token, err := r.source.TokenContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+// Refresh calls update with each new access token until ctx is cancelled,
+// so that a connection opened with the current token of the TokenSource is
+// re-authenticated before the token expires. Renewal failures are retried
+// every few seconds; an update failure, usually a closed connection, is
+// returned.
+func (r *RabbitMQCredentials) Refresh(ctx context.Context, update func(token string) error) error {
+	token, err := r.source.TokenContext(ctx)
+	if err != nil {
+		return err
+	}
+	current := token.AccessToken
+	for {
+		if token.Expiry.IsZero() {
+			<-ctx.Done()
+			return nil
+		}
+		// The TokenSource renews the token once it expires within its
+		// expiry delta.
+		wait := time.Until(token.Expiry) - r.source.expiryDelta + time.Second
+		if err != nil || wait < rabbitMQRetryInterval {
+			wait = rabbitMQRetryInterval
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+
+		var next *oauth2.Token
+		if next, err = r.source.TokenContext(ctx); err != nil {
+			continue
+		}
+		if token = next; token.AccessToken == current {
+			continue
+		}
+		if err := update(token.AccessToken); err != nil {
+			return fmt.Errorf("updating the RabbitMQ secret: %w", err)
+		}
+		current = token.AccessToken
+	}
+}
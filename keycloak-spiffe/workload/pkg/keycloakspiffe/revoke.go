@@ -0,0 +1,22 @@
+// revoke.go
+package keycloakspiffe
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/spire"
+)
+
+// Revoke revokes token, an access or refresh token as told by hint (see
+// keycloak.Revoke), at revocationEndpoint. The client authenticates with a
+// JWT-SVID for audience fetched from svids, as for the token exchange.
+func Revoke(ctx context.Context, client *http.Client, svids spire.JWTSVIDSource, revocationEndpoint, audience, token, hint string) error {
+	svid, err := spire.FetchJWTSVID(ctx, svids, audience)
+	if err != nil {
+		return err
+	}
+	auth := keycloak.WithClientAssertion(keycloak.ClientAssertionTypeSpiffe, svid.Marshal())
+	return keycloak.Revoke(ctx, client, revocationEndpoint, auth, token, hint)
+}
@@ -0,0 +1,192 @@
+// Package keycloakspiffe plugs the SPIRE JWT-SVID fetch and the Keycloak
+// token exchange into standard Go client interfaces.
+//
+// The providers of the Kafka, PostgreSQL, MongoDB and RabbitMQ clients
+// import none of them, so that the package adds no driver to the
+// applications: the application bridges their methods to the callback of
+// its client.
+package keycloakspiffe
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/keycloak"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/retry"
+	"github.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/spire"
+)
+
+// defaultExpiryDelta is how long before expiry a cached token is renewed.
+const defaultExpiryDelta = 30 * time.Second
+
+// TokenSource is an oauth2.TokenSource that exchanges JWT-SVIDs obtained from
+// the SPIRE Agent for Keycloak access tokens. Tokens are cached and only
+// renewed when they are about to expire. It is safe for concurrent use.
+type TokenSource struct {
+	svids         spire.JWTSVIDSource
+	tokenEndpoint string
+	audience      string
+	client        *http.Client
+	expiryDelta   time.Duration
+	timeout       time.Duration
+	retry         retry.Policy
+	cache         *Cache
+	cacheKey      CacheKey
+	params        []keycloak.TokenParameter
+
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+var _ oauth2.TokenSource = (*TokenSource)(nil)
+
+// Option configures a TokenSource.
+type Option func(*TokenSource)
+
+// WithHTTPClient sets the HTTP client used to call the token endpoint.
+func WithHTTPClient(client *http.Client) Option {
+	return func(s *TokenSource) {
+		s.client = client
+	}
+}
+
+// WithExpiryDelta sets how long before expiry a cached token is renewed.
+func WithExpiryDelta(d time.Duration) Option {
+	return func(s *TokenSource) {
+		s.expiryDelta = d
+	}
+}
+
+// WithTimeout bounds the SVID fetch and exchange performed by Token.
+func WithTimeout(d time.Duration) Option {
+	return func(s *TokenSource) {
+		s.timeout = d
+	}
+}
+
+// WithRetry retries transient SVID fetch and exchange failures with policy.
+// Keycloak 4xx answers are returned without retrying.
+func WithRetry(policy retry.Policy) Option {
+	return func(s *TokenSource) {
+		s.retry = policy
+	}
+}
+
+// WithCache stores the tokens in cache under key instead of a cache private
+// to the TokenSource, so that token sources sharing cache and key share
+// their tokens and concurrent renewals result in a single exchange.
+func WithCache(cache *Cache, key CacheKey) Option {
+	return func(s *TokenSource) {
+		s.cache = cache
+		s.cacheKey = key
+	}
+}
+
+// WithTokenParameters adds params, such as keycloak.WithScope, to the token
+// requests. Token sources sharing a cache must then use distinct keys, for
+// instance with CacheKey.Scope or CacheKey.Resource.
+func WithTokenParameters(params ...keycloak.TokenParameter) Option {
+	return func(s *TokenSource) {
+		s.params = append(s.params, params...)
+	}
+}
+
+// NewTokenSource returns a TokenSource that requests JWT-SVIDs for audience
+// from svids and exchanges them at tokenEndpoint.
+func NewTokenSource(svids spire.JWTSVIDSource, tokenEndpoint, audience string, opts ...Option) *TokenSource {
+	s := &TokenSource{
+		svids:         svids,
+		tokenEndpoint: tokenEndpoint,
+		audience:      audience,
+		client:        http.DefaultClient,
+		expiryDelta:   defaultExpiryDelta,
+		timeout:       time.Minute,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Token returns the cached access token, exchanging a fresh JWT-SVID when
+// there is none or it is about to expire.
+func (s *TokenSource) Token() (*oauth2.Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	return s.TokenContext(ctx)
+}
+
+// TokenContext is like Token but uses ctx for the SVID fetch and exchange.
+func (s *TokenSource) TokenContext(ctx context.Context) (*oauth2.Token, error) {
+	if s.cache != nil {
+		return s.cache.Get(ctx, s.cacheKey, s.fetch)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != nil && (s.token.Expiry.IsZero() || time.Until(s.token.Expiry) > s.expiryDelta) {
+		return s.token, nil
+	}
+
+	resp, err := s.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.token = OAuth2Token(resp, time.Now())
+	return s.token, nil
+}
+
+// Invalidate drops the cached token so that the next call exchanges a fresh
+// JWT-SVID, for instance after a resource server rejected the token.
+func (s *TokenSource) Invalidate() {
+	if s.cache != nil {
+		s.cache.Invalidate(s.cacheKey)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = nil
+}
+
+// fetch exchanges a fresh JWT-SVID for a token response.
+func (s *TokenSource) fetch(ctx context.Context) (*keycloak.TokenResponse, error) {
+	var resp *keycloak.TokenResponse
+	err := s.retry.Do(ctx, func(ctx context.Context) error {
+		svid, err := spire.FetchJWTSVID(ctx, s.svids, s.audience)
+		if err != nil {
+			return err
+		}
+		resp, err = keycloak.Exchange(ctx, s.client, s.tokenEndpoint, svid.Marshal(), s.params...)
+		if err != nil && !keycloak.IsTransient(err) {
+			return retry.Permanent(err)
+		}
+		return err
+	})
+	return resp, err
+}
+
+// OAuth2Token converts a Keycloak token response issued at issuedAt to an
+// oauth2.Token. The raw response fields are available through Token.Extra.
+func OAuth2Token(r *keycloak.TokenResponse, issuedAt time.Time) *oauth2.Token {
+	token := &oauth2.Token{
+		AccessToken:  r.AccessToken,
+		TokenType:    r.TokenType,
+		RefreshToken: r.RefreshToken,
+	}
+	if r.ExpiresIn > 0 {
+		token.Expiry = issuedAt.Add(time.Duration(r.ExpiresIn) * time.Second)
+	}
+
+	var extra map[string]interface{}
+	if json.Unmarshal(r.Raw, &extra) == nil {
+		token = token.WithExtra(extra)
+	}
+	return token
+}
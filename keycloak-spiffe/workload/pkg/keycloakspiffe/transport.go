@@ -0,0 +1,153 @@
+// transport.go
+package keycloakspiffe
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Transport is an http.RoundTripper that sets the Authorization header of
+// the outgoing requests to the access token of a TokenSource, renewed when
+// it is about to expire. Unlike oauth2.Transport it can be limited to some
+// target hosts and retry once with a fresh token when a host answers 401.
+type Transport struct {
+	source *TokenSource
+	base   http.RoundTripper
+	// hosts limits the token to these hosts, all hosts when nil.
+	hosts map[string]bool
+	// retryAll and retryHosts select the hosts retried on 401.
+	retryAll   bool
+	retryHosts map[string]bool
+}
+
+var _ http.RoundTripper = (*Transport)(nil)
+
+// TransportOption configures a Transport.
+type TransportOption func(*Transport)
+
+// WithBaseTransport sets the RoundTripper sending the requests,
+// http.DefaultTransport by default.
+func WithBaseTransport(base http.RoundTripper) TransportOption {
+	return func(t *Transport) {
+		t.base = base
+	}
+}
+
+// WithHosts only sends the token to the given hosts, written host or
+// host:port; requests to other hosts, such as redirects to a third party,
+// are sent without it.
+func WithHosts(hosts ...string) TransportOption {
+	return func(t *Transport) {
+		if t.hosts == nil {
+			t.hosts = map[string]bool{}
+		}
+		for _, h := range hosts {
+			t.hosts[strings.ToLower(h)] = true
+		}
+	}
+}
+
+// WithRetryOnUnauthorized retries the requests answered 401 once with a
+// freshly exchanged token, for the given hosts or for every host receiving
+// the token when none is given. Only requests whose body can be replayed
+// are retried.
+func WithRetryOnUnauthorized(hosts ...string) TransportOption {
+	return func(t *Transport) {
+		if len(hosts) == 0 {
+			t.retryAll = true
+			return
+		}
+		if t.retryHosts == nil {
+			t.retryHosts = map[string]bool{}
+		}
+		for _, h := range hosts {
+			t.retryHosts[strings.ToLower(h)] = true
+		}
+	}
+}
+
+// NewTransport returns a Transport sending the tokens of source:
+//
+//	client := &http.Client{Transport: keycloakspiffe.NewTransport(ts,
+//		keycloakspiffe.WithHosts("api.example.com"),
+//		keycloakspiffe.WithRetryOnUnauthorized())}
+func NewTransport(source *TokenSource, opts ...TransportOption) *Transport {
+	t := &Transport{source: source, base: http.DefaultTransport}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// RoundTrip sends req with the access token when its host is selected. req
+// is not modified, a clone carries the header.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !matchHost(t.hosts, req.URL) {
+		return t.base.RoundTrip(req)
+	}
+
+	resp, err := t.send(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || !t.retries(req) {
+		return resp, err
+	}
+
+	body, err := replayBody(req)
+	if err != nil {
+		// The first answer is still valid, return it rather than failing.
+		return resp, nil
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	t.source.Invalidate()
+	retry := req.Clone(req.Context())
+	retry.Body = body
+	return t.send(retry)
+}
+
+// send sends a clone of req carrying the current token.
+func (t *Transport) send(req *http.Request) (*http.Response, error) {
+	token, err := t.source.TokenContext(req.Context())
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	authReq := req.Clone(req.Context())
+	authReq.Header.Set("Authorization", authorization(token))
+	return t.base.RoundTrip(authReq)
+}
+
+// retries reports whether req is retried on 401.
+func (t *Transport) retries(req *http.Request) bool {
+	if t.retryAll {
+		return true
+	}
+	return len(t.retryHosts) > 0 && matchHost(t.retryHosts, req.URL)
+}
+
+// replayBody returns a new copy of the body of req, http.NoBody when empty.
+func replayBody(req *http.Request) (io.ReadCloser, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return http.NoBody, nil
+	}
+	if req.GetBody == nil {
+		return nil, errors.New("request body cannot be replayed")
+	}
+	return req.GetBody()
+}
+
+// matchHost reports whether the host of u is in hosts, as host:port or
+// host alone. A nil set matches every host.
+func matchHost(hosts map[string]bool, u *url.URL) bool {
+	if hosts == nil {
+		return true
+	}
+	host := strings.ToLower(u.Hostname())
+	return hosts[host] || (u.Port() != "" && hosts[net.JoinHostPort(host, u.Port())])
+}
@@ -0,0 +1,24 @@
+// addr.go
+package spire
+
+import "strings"
+
+// namedPipeName returns the name of the Windows named pipe of a Workload
+// API address given as npipe://name or npipe:name, the name being relative
+// to \\.\pipe\ and slashes standing for backslashes.
+func namedPipeName(addr string) (string, bool) {
+	for _, prefix := range []string{"npipe://", "npipe:"} {
+		if name, ok := strings.CutPrefix(addr, prefix); ok {
+			name = strings.ReplaceAll(name, "/", `\`)
+			name = strings.TrimPrefix(name, `\\.\pipe\`)
+			return strings.TrimLeft(name, `\`), true
+		}
+	}
+	return "", false
+}
+
+// IsNamedPipe reports whether addr is a Windows named pipe address.
+func IsNamedPipe(addr string) bool {
+	_, ok := namedPipeName(addr)
+	return ok
+}
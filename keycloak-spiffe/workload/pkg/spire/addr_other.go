@@ -0,0 +1,29 @@
+//go:build !windows
+
+// addr_other.go
+package spire
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// DefaultSocketPath is the Workload API address exposed by the SPIRE Agent in this POC.
+const DefaultSocketPath = "unix:///opt/spire/sockets/agent.sock"
+
+var errNamedPipe = errors.New("named pipe addresses are only supported on Windows")
+
+// clientOptions returns the Workload API client options of addr.
+func clientOptions(addr string) ([]workloadapi.ClientOption, error) {
+	if IsNamedPipe(addr) {
+		return nil, errNamedPipe
+	}
+	return []workloadapi.ClientOption{workloadapi.WithAddr(addr)}, nil
+}
+
+func dialNamedPipe(context.Context, string) (net.Conn, error) {
+	return nil, errNamedPipe
+}
@@ -0,0 +1,27 @@
+//go:build windows
+
+// addr_windows.go
+package spire
+
+import (
+	"context"
+	"net"
+
+	"github.com/Microsoft/go-winio"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// DefaultSocketPath is the named pipe of the SPIRE Agent on Windows.
+const DefaultSocketPath = "npipe://spire-agent/public/api"
+
+// clientOptions returns the Workload API client options of addr.
+func clientOptions(addr string) ([]workloadapi.ClientOption, error) {
+	if name, ok := namedPipeName(addr); ok {
+		return []workloadapi.ClientOption{workloadapi.WithNamedPipeName(name)}, nil
+	}
+	return []workloadapi.ClientOption{workloadapi.WithAddr(addr)}, nil
+}
+
+func dialNamedPipe(ctx context.Context, name string) (net.Conn, error) {
+	return winio.DialPipeContext(ctx, `\\.\pipe\`+name)
+}
@@ -0,0 +1,115 @@
+// entry.go
+package spire
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	entryv1 "github.com/spiffe/spire-api-sdk/proto/spire/api/server/entry/v1"
+	"github.com/spiffe/spire-api-sdk/proto/spire/api/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// DefaultServerSocketPath is the SPIRE Server API socket of the default
+// server configuration.
+const DefaultServerSocketPath = "unix:///tmp/spire-server/private/api.sock"
+
+// Entry is a registration entry of the SPIRE Server: the workloads matching
+// Selectors, attested by the agent or node ParentID, get SPIFFEID.
+type Entry struct {
+	ID       string
+	SPIFFEID string
+	ParentID string
+	// Selectors are written type:value, such as docker:label:app:billing.
+	Selectors []string
+	// X509SVIDTTL and JWTSVIDTTL are the SVID lifetimes, the server
+	// defaults when zero.
+	X509SVIDTTL time.Duration
+	JWTSVIDTTL  time.Duration
+}
+
+// EntryClient manages the registration entries through the SPIRE Server
+// API, served without authentication to the local users of its socket.
+type EntryClient struct {
+	conn   *grpc.ClientConn
+	client entryv1.EntryClient
+}
+
+// NewEntryClient connects to the SPIRE Server API socket at socketPath, a
+// unix:// address: the API is not served over TCP without mTLS. The caller
+// must close the returned client.
+func NewEntryClient(socketPath string) (*EntryClient, error) {
+	if !strings.HasPrefix(socketPath, "unix://") {
+		return nil, fmt.Errorf("SPIRE Server API socket %q must start with unix://", socketPath)
+	}
+	conn, err := grpc.NewClient(socketPath, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to SPIRE Server API socket: %w", err)
+	}
+	return &EntryClient{conn: conn, client: entryv1.NewEntryClient(conn)}, nil
+}
+
+// CreateEntry registers e and returns the ID of its entry. When an entry
+// with the same SPIFFE ID, parent ID and selectors exists, its ID is
+// returned with created false and the entry is left unchanged.
+func (c *EntryClient) CreateEntry(ctx context.Context, e Entry) (id string, created bool, err error) {
+	spiffeID, err := entryID(e.SPIFFEID)
+	if err != nil {
+		return "", false, err
+	}
+	parentID, err := entryID(e.ParentID)
+	if err != nil {
+		return "", false, err
+	}
+	if len(e.Selectors) == 0 {
+		return "", false, fmt.Errorf("entry %s has no selector", e.SPIFFEID)
+	}
+	selectors, err := parseSelectors(e.Selectors)
+	if err != nil {
+		return "", false, err
+	}
+
+	resp, err := c.client.BatchCreateEntry(ctx, &entryv1.BatchCreateEntryRequest{
+		Entries: []*types.Entry{{
+			SpiffeId:    spiffeID,
+			ParentId:    parentID,
+			Selectors:   selectors,
+			X509SvidTtl: int32(e.X509SVIDTTL / time.Second),
+			JwtSvidTtl:  int32(e.JWTSVIDTTL / time.Second),
+		}},
+	})
+	if err != nil {
+		return "", false, fmt.Errorf("creating registration entry: %w", err)
+	}
+	if len(resp.GetResults()) == 0 {
+		return "", false, errors.New("creating registration entry: empty answer")
+	}
+	result := resp.GetResults()[0]
+	switch codes.Code(result.GetStatus().GetCode()) {
+	case codes.OK:
+		return result.GetEntry().GetId(), true, nil
+	case codes.AlreadyExists:
+		return result.GetEntry().GetId(), false, nil
+	default:
+		return "", false, fmt.Errorf("creating registration entry: %s: %s", codes.Code(result.GetStatus().GetCode()), result.GetStatus().GetMessage())
+	}
+}
+
+// Close closes the connection to the server socket.
+func (c *EntryClient) Close() error {
+	return c.conn.Close()
+}
+
+func entryID(s string) (*types.SPIFFEID, error) {
+	id, err := spiffeid.FromString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SPIFFE ID %q: %w", s, err)
+	}
+	return &types.SPIFFEID{TrustDomain: id.TrustDomain().Name(), Path: id.Path()}, nil
+}
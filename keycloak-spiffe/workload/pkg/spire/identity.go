@@ -0,0 +1,73 @@
+// identity.go
+package spire
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+)
+
+// ErrUnexpectedIdentity is wrapped by the errors of the SVIDs whose SPIFFE
+// ID is not the expected one.
+var ErrUnexpectedIdentity = errors.New("unexpected SPIFFE identity")
+
+// ExpectedIdentity is the identity the workload must have: an exact SPIFFE
+// ID, a trust domain, or both. The zero value accepts any identity.
+type ExpectedIdentity struct {
+	ID          string
+	TrustDomain string
+}
+
+// Check returns an error wrapping ErrUnexpectedIdentity when id does not
+// match e.
+func (e ExpectedIdentity) Check(id spiffeid.ID) error {
+	if e.TrustDomain != "" {
+		td, err := spiffeid.TrustDomainFromString(e.TrustDomain)
+		if err != nil {
+			return fmt.Errorf("invalid expected trust domain %q: %w", e.TrustDomain, err)
+		}
+		if !id.MemberOf(td) {
+			return fmt.Errorf("%w: %s is not in trust domain %s, check the registration entries of this workload", ErrUnexpectedIdentity, id, td)
+		}
+	}
+	if e.ID != "" {
+		want, err := spiffeid.FromString(e.ID)
+		if err != nil {
+			return fmt.Errorf("invalid expected SPIFFE ID %q: %w", e.ID, err)
+		}
+		if id != want {
+			return fmt.Errorf("%w: got %s, want %s, check the registration entries of this workload", ErrUnexpectedIdentity, id, want)
+		}
+	}
+	return nil
+}
+
+// checkedSource rejects the JWT-SVIDs of another identity.
+type checkedSource struct {
+	source   JWTSVIDSource
+	expected ExpectedIdentity
+}
+
+// ExpectIdentity returns a JWTSVIDSource failing with ErrUnexpectedIdentity
+// when source returns a JWT-SVID of another identity than expected, so that
+// a wrong registration entry is caught before the SVID is sent to Keycloak.
+func ExpectIdentity(source JWTSVIDSource, expected ExpectedIdentity) JWTSVIDSource {
+	if expected == (ExpectedIdentity{}) {
+		return source
+	}
+	return &checkedSource{source: source, expected: expected}
+}
+
+func (s *checkedSource) FetchJWTSVID(ctx context.Context, params jwtsvid.Params) (*jwtsvid.SVID, error) {
+	svid, err := s.source.FetchJWTSVID(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.expected.Check(svid.ID); err != nil {
+		return nil, err
+	}
+	return svid, nil
+}
@@ -0,0 +1,80 @@
+// jwks.go
+package spire
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+)
+
+// jsonWebKey is a public signing key of a JWKS (RFC 7517).
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS returns the JWT authorities of bundle as a standard JWKS document.
+// Unlike the SPIFFE bundle format, whose keys have the jwt-svid use that
+// OIDC libraries skip, the keys are signing keys with their algorithm, in
+// key ID order so that the document only changes with the keys.
+func JWKS(bundle *jwtbundle.Bundle) ([]byte, error) {
+	authorities := bundle.JWTAuthorities()
+	kids := make([]string, 0, len(authorities))
+	for kid := range authorities {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	set := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{Keys: make([]jsonWebKey, 0, len(kids))}
+	for _, kid := range kids {
+		jwk := jsonWebKey{Kid: kid, Use: "sig"}
+		switch key := authorities[kid].(type) {
+		case *rsa.PublicKey:
+			jwk.Kty, jwk.Alg = "RSA", "RS256"
+			jwk.N = encodeInt(key.N, 0)
+			jwk.E = encodeInt(big.NewInt(int64(key.E)), 0)
+		case *ecdsa.PublicKey:
+			size := (key.Curve.Params().BitSize + 7) / 8
+			jwk.Kty, jwk.Crv = "EC", key.Curve.Params().Name
+			switch jwk.Crv {
+			case "P-256":
+				jwk.Alg = "ES256"
+			case "P-384":
+				jwk.Alg = "ES384"
+			case "P-521":
+				jwk.Alg = "ES512"
+			default:
+				return nil, fmt.Errorf("JWT authority %s: unsupported curve %s", kid, jwk.Crv)
+			}
+			jwk.X = encodeInt(key.X, size)
+			jwk.Y = encodeInt(key.Y, size)
+		default:
+			return nil, fmt.Errorf("JWT authority %s: unsupported key type %T", kid, key)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return json.Marshal(set)
+}
+
+// encodeInt encodes n big-endian on size bytes, its minimal size when 0.
+func encodeInt(n *big.Int, size int) string {
+	if size == 0 {
+		return base64.RawURLEncoding.EncodeToString(n.Bytes())
+	}
+	return base64.RawURLEncoding.EncodeToString(n.FillBytes(make([]byte, size)))
+}
@@ -0,0 +1,89 @@
+// selection.go
+package spire
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// ErrNoMatchingSVID is wrapped by the errors of the fetches finding no SVID
+// with the selected SPIFFE ID.
+var ErrNoMatchingSVID = errors.New("no SVID matches the selected SPIFFE ID")
+
+// MultiJWTSVIDSource fetches the JWT-SVIDs of every identity of the
+// workload. It is satisfied by *workloadapi.JWTSource.
+type MultiJWTSVIDSource interface {
+	JWTSVIDSource
+	FetchJWTSVIDs(ctx context.Context, params jwtsvid.Params) ([]*jwtsvid.SVID, error)
+}
+
+// MatchID reports whether id matches pattern, an exact SPIFFE ID, a
+// path.Match glob such as spiffe://example.org/ns/apps/*, or the ID of a
+// trust domain such as spiffe://example.org, matching all its members, to
+// select the identity of a workload registered in several trust domains.
+func MatchID(pattern string, id spiffeid.ID) bool {
+	if rest, ok := strings.CutPrefix(pattern, "spiffe://"); ok && rest != "" && !strings.ContainsAny(rest, "/*?[") {
+		return id.TrustDomain().Name() == rest
+	}
+	ok, _ := path.Match(pattern, id.String())
+	return ok
+}
+
+// selectedSource returns the JWT-SVID matching a pattern among the ones of
+// the workload.
+type selectedSource struct {
+	source  MultiJWTSVIDSource
+	pattern string
+}
+
+// SelectIdentity returns a JWTSVIDSource returning the first JWT-SVID of
+// source whose SPIFFE ID matches pattern, for workloads registered under
+// several identities. An empty pattern keeps the default SVID of the agent.
+func SelectIdentity(source MultiJWTSVIDSource, pattern string) JWTSVIDSource {
+	if pattern == "" {
+		return source
+	}
+	return &selectedSource{source: source, pattern: pattern}
+}
+
+func (s *selectedSource) FetchJWTSVID(ctx context.Context, params jwtsvid.Params) (*jwtsvid.SVID, error) {
+	svids, err := s.source.FetchJWTSVIDs(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	for _, svid := range svids {
+		if MatchID(s.pattern, svid.ID) {
+			return svid, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s among %s", ErrNoMatchingSVID, s.pattern, jwtSVIDIDs(svids))
+}
+
+func jwtSVIDIDs(svids []*jwtsvid.SVID) []string {
+	ids := make([]string, 0, len(svids))
+	for _, svid := range svids {
+		ids = append(ids, svid.ID.String())
+	}
+	return ids
+}
+
+// x509SVIDPicker returns the X509Source picker choosing the first X509-SVID
+// whose SPIFFE ID matches pattern. The source reports a missing SVID when
+// none matches.
+func x509SVIDPicker(pattern string) func([]*x509svid.SVID) *x509svid.SVID {
+	return func(svids []*x509svid.SVID) *x509svid.SVID {
+		for _, svid := range svids {
+			if MatchID(pattern, svid.ID) {
+				return svid
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,69 @@
+// socket.go
+package spire
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// CheckSocket reports whether the Workload API at socketPath (unix://,
+// tcp:// or, on Windows, npipe://) accepts connections.
+func CheckSocket(ctx context.Context, socketPath string) error {
+	if name, ok := namedPipeName(socketPath); ok {
+		conn, err := dialNamedPipe(ctx, name)
+		if err != nil {
+			return fmt.Errorf("dialing SPIRE Agent: %w", err)
+		}
+		return conn.Close()
+	}
+	u, err := url.Parse(socketPath)
+	if err != nil {
+		return fmt.Errorf("parsing socket path: %w", err)
+	}
+
+	var network, addr string
+	switch u.Scheme {
+	case "unix":
+		network, addr = "unix", u.Path
+		if addr == "" {
+			addr = u.Opaque
+		}
+	case "tcp":
+		network, addr = "tcp", u.Host
+	default:
+		return fmt.Errorf("unsupported socket scheme %q", u.Scheme)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return fmt.Errorf("dialing SPIRE Agent: %w", err)
+	}
+	return conn.Close()
+}
+
+// WaitForSocket polls the Workload API at socketPath every interval until
+// it accepts connections, for agents started after the workload. It
+// returns the last dial error once ctx is done. onWait, when set, is
+// called with the error of the first failed attempt.
+func WaitForSocket(ctx context.Context, socketPath string, interval time.Duration, onWait func(error)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for attempt := 0; ; attempt++ {
+		err := CheckSocket(ctx, socketPath)
+		if err == nil {
+			return nil
+		}
+		if attempt == 0 && onWait != nil {
+			onWait(err)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for the SPIRE Agent socket: %w", err)
+		case <-ticker.C:
+		}
+	}
+}
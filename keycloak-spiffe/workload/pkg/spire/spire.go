@@ -0,0 +1,56 @@
+// Package spire fetches SVIDs from the SPIRE Agent Workload API, and
+// registers workloads with the SPIRE Server API.
+package spire
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// JWTSVIDSource fetches JWT-SVIDs. It is satisfied by *workloadapi.JWTSource.
+type JWTSVIDSource interface {
+	FetchJWTSVID(ctx context.Context, params jwtsvid.Params) (*jwtsvid.SVID, error)
+}
+
+// NewJWTSource connects to the SPIRE Agent Workload API at socketPath.
+// The caller must close the returned source.
+func NewJWTSource(ctx context.Context, socketPath string) (*workloadapi.JWTSource, error) {
+	opts, err := clientOptions(socketPath)
+	if err != nil {
+		return nil, err
+	}
+	source, err := workloadapi.NewJWTSource(ctx, workloadapi.WithClientOptions(opts...))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to SPIRE Agent: %w", err)
+	}
+	return source, nil
+}
+
+// FetchJWTSVID fetches a JWT-SVID for audience from source.
+func FetchJWTSVID(ctx context.Context, source JWTSVIDSource, audience string) (*jwtsvid.SVID, error) {
+	svid, err := source.FetchJWTSVID(ctx, jwtsvid.Params{
+		Audience: audience,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetching JWT-SVID: %w", err)
+	}
+	return svid, nil
+}
+
+// NewBundleSource connects to the SPIRE Agent Workload API at socketPath
+// for the trust bundles, kept current through their rotations. The caller
+// must close the returned source.
+func NewBundleSource(ctx context.Context, socketPath string) (*workloadapi.BundleSource, error) {
+	opts, err := clientOptions(socketPath)
+	if err != nil {
+		return nil, err
+	}
+	source, err := workloadapi.NewBundleSource(ctx, workloadapi.WithClientOptions(opts...))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to SPIRE Agent: %w", err)
+	}
+	return source, nil
+}
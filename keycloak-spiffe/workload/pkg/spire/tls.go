@@ -0,0 +1,52 @@
+// tls.go
+package spire
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// NewX509Source connects to the SPIRE Agent Workload API at socketPath and
+// keeps the workload X509-SVID and trust bundles up to date. When spiffeID
+// is set, the X509-SVID is the first one matching it (see MatchID) instead
+// of the default one of the agent.
+// The caller must close the returned source.
+func NewX509Source(ctx context.Context, socketPath, spiffeID string) (*workloadapi.X509Source, error) {
+	clientOpts, err := clientOptions(socketPath)
+	if err != nil {
+		return nil, err
+	}
+	opts := []workloadapi.X509SourceOption{workloadapi.WithClientOptions(clientOpts...)}
+	if spiffeID != "" {
+		opts = append(opts, workloadapi.WithDefaultX509SVIDPicker(x509SVIDPicker(spiffeID)))
+	}
+	source, err := workloadapi.NewX509Source(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to SPIRE Agent: %w", err)
+	}
+	return source, nil
+}
+
+// MTLSClientConfig returns a TLS client configuration presenting the workload
+// X509-SVID from source.
+//
+// When serverID is set, the server must present an X509-SVID with that SPIFFE
+// ID, verified against the SPIFFE trust bundle. Otherwise the server
+// certificate is verified against roots, or the system roots when nil.
+func MTLSClientConfig(source *workloadapi.X509Source, roots *x509.CertPool, serverID string) (*tls.Config, error) {
+	if serverID == "" {
+		return tlsconfig.MTLSWebClientConfig(source, roots), nil
+	}
+
+	id, err := spiffeid.FromString(serverID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server SPIFFE ID %q: %w", serverID, err)
+	}
+	return tlsconfig.MTLSClientConfig(source, source, tlsconfig.AuthorizeID(id)), nil
+}
@@ -0,0 +1,182 @@
+// watcher.go
+package spire
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// Kinds of credentials reported by RotationWatcher.
+const (
+	RotationX509SVID   = "x509-svid"
+	RotationX509Bundle = "x509-bundle"
+	RotationJWTBundle  = "jwt-bundle"
+)
+
+// Rotation reports that the Workload API pushed new credentials.
+type Rotation struct {
+	// Kind is RotationX509SVID, RotationX509Bundle or RotationJWTBundle.
+	Kind string
+	// ID is the SPIFFE ID of the rotated X509-SVID, or the trust domain of
+	// the rotated bundle.
+	ID string
+}
+
+// RotationWatcher streams the X509 context and JWT bundles of the workload
+// and reports their rotations. Bundles are compared by content, the
+// X509-SVID by its leaf certificate, so that updates pushed by the agent
+// without a change are not reported.
+type RotationWatcher struct {
+	client   *workloadapi.Client
+	spiffeID string
+	onError  func(error)
+
+	mu          sync.Mutex
+	svid        []byte
+	x509Bundles map[spiffeid.TrustDomain][]byte
+	jwtBundles  map[spiffeid.TrustDomain][]byte
+	rotations   chan Rotation
+}
+
+// NewRotationWatcher connects to the Workload API at socketPath. spiffeID
+// selects the X509-SVID watched as in NewX509Source. onError is called
+// with the stream errors, the client reconnects by itself.
+// The caller must close the returned watcher.
+func NewRotationWatcher(ctx context.Context, socketPath, spiffeID string, onError func(error)) (*RotationWatcher, error) {
+	opts, err := clientOptions(socketPath)
+	if err != nil {
+		return nil, err
+	}
+	client, err := workloadapi.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to SPIRE Agent: %w", err)
+	}
+	return &RotationWatcher{
+		client:      client,
+		spiffeID:    spiffeID,
+		onError:     onError,
+		x509Bundles: map[spiffeid.TrustDomain][]byte{},
+		jwtBundles:  map[spiffeid.TrustDomain][]byte{},
+		rotations:   make(chan Rotation, 8),
+	}, nil
+}
+
+// Rotations returns the channel receiving the rotations. The first
+// credentials received are the initial state and are not reported.
+func (w *RotationWatcher) Rotations() <-chan Rotation {
+	return w.rotations
+}
+
+// Watch streams the updates until ctx is cancelled.
+func (w *RotationWatcher) Watch(ctx context.Context) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		w.client.WatchX509Context(ctx, x509Watcher{w})
+	}()
+	go func() {
+		defer wg.Done()
+		w.client.WatchJWTBundles(ctx, jwtWatcher{w})
+	}()
+	wg.Wait()
+}
+
+// Close closes the Workload API connection.
+func (w *RotationWatcher) Close() error {
+	return w.client.Close()
+}
+
+// notify reports a rotation, dropping it when the receiver lags behind:
+// the pending rotations already trigger a renewal.
+func (w *RotationWatcher) notify(r Rotation) {
+	select {
+	case w.rotations <- r:
+	default:
+	}
+}
+
+type x509Watcher struct{ w *RotationWatcher }
+
+func (x x509Watcher) OnX509ContextUpdate(c *workloadapi.X509Context) {
+	w := x.w
+	svid := c.DefaultSVID()
+	if w.spiffeID != "" {
+		svid = x509SVIDPicker(w.spiffeID)(c.SVIDs)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if svid != nil && len(svid.Certificates) > 0 {
+		leaf := svid.Certificates[0].Raw
+		if w.svid != nil && !bytes.Equal(w.svid, leaf) {
+			w.notify(Rotation{Kind: RotationX509SVID, ID: svid.ID.String()})
+		}
+		w.svid = leaf
+	}
+	if c.Bundles != nil {
+		for _, bundle := range c.Bundles.Bundles() {
+			w.compareBundle(w.x509Bundles, RotationX509Bundle, bundle.TrustDomain(), x509BundleBytes(bundle))
+		}
+	}
+}
+
+func (x x509Watcher) OnX509ContextWatchError(err error) {
+	if x.w.onError != nil {
+		x.w.onError(fmt.Errorf("watching X509 context: %w", err))
+	}
+}
+
+type jwtWatcher struct{ w *RotationWatcher }
+
+func (j jwtWatcher) OnJWTBundlesUpdate(set *jwtbundle.Set) {
+	w := j.w
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, bundle := range set.Bundles() {
+		w.compareBundle(w.jwtBundles, RotationJWTBundle, bundle.TrustDomain(), jwtBundleBytes(bundle))
+	}
+}
+
+func (j jwtWatcher) OnJWTBundlesWatchError(err error) {
+	if j.w.onError != nil {
+		j.w.onError(fmt.Errorf("watching JWT bundles: %w", err))
+	}
+}
+
+// compareBundle records the content of the bundle of td in seen and
+// reports a rotation when it changed. The caller holds w.mu.
+func (w *RotationWatcher) compareBundle(seen map[spiffeid.TrustDomain][]byte, kind string, td spiffeid.TrustDomain, data []byte) {
+	if previous, ok := seen[td]; ok && !bytes.Equal(previous, data) {
+		w.notify(Rotation{Kind: kind, ID: td.String()})
+	}
+	seen[td] = data
+}
+
+// jwtBundleBytes returns the sorted key IDs of bundle: SPIRE rotates its
+// JWT signing keys under new key IDs.
+func jwtBundleBytes(bundle *jwtbundle.Bundle) []byte {
+	kids := make([]string, 0, len(bundle.JWTAuthorities()))
+	for kid := range bundle.JWTAuthorities() {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	return []byte(strings.Join(kids, ","))
+}
+
+func x509BundleBytes(bundle *x509bundle.Bundle) []byte {
+	var data []byte
+	for _, cert := range bundle.X509Authorities() {
+		data = append(data, cert.Raw...)
+	}
+	return data
+}
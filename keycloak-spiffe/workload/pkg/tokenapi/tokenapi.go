@@ -0,0 +1,5 @@
+// Package tokenapi holds the generated client and server of the gRPC token
+// API served by the workload daemon on TOKEN_API_ADDR.
+package tokenapi
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative tokenapi.proto
@@ -0,0 +1,279 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.10
+// 	protoc        v5.29.3
+// source: tokenapi.proto
+
+// The token API vends the Keycloak access tokens held by the workload
+// daemon, mirroring the SPIFFE Workload API: a client gets the current token
+// and, with WatchToken, every renewed one.
+
+package tokenapi
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type GetTokenRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Audience of the token, the first audience of the daemon when empty.
+	Audience      string `protobuf:"bytes,1,opt,name=audience,proto3" json:"audience,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetTokenRequest) Reset() {
+	*x = GetTokenRequest{}
+	mi := &file_tokenapi_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetTokenRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetTokenRequest) ProtoMessage() {}
+
+func (x *GetTokenRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tokenapi_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetTokenRequest.ProtoReflect.Descriptor instead.
+func (*GetTokenRequest) Descriptor() ([]byte, []int) {
+	return file_tokenapi_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *GetTokenRequest) GetAudience() string {
+	if x != nil {
+		return x.Audience
+	}
+	return ""
+}
+
+type WatchTokenRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Audience of the token, the first audience of the daemon when empty.
+	Audience      string `protobuf:"bytes,1,opt,name=audience,proto3" json:"audience,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WatchTokenRequest) Reset() {
+	*x = WatchTokenRequest{}
+	mi := &file_tokenapi_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WatchTokenRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchTokenRequest) ProtoMessage() {}
+
+func (x *WatchTokenRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tokenapi_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchTokenRequest.ProtoReflect.Descriptor instead.
+func (*WatchTokenRequest) Descriptor() ([]byte, []int) {
+	return file_tokenapi_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *WatchTokenRequest) GetAudience() string {
+	if x != nil {
+		return x.Audience
+	}
+	return ""
+}
+
+type Token struct {
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	AccessToken string                 `protobuf:"bytes,1,opt,name=access_token,json=accessToken,proto3" json:"access_token,omitempty"`
+	TokenType   string                 `protobuf:"bytes,2,opt,name=token_type,json=tokenType,proto3" json:"token_type,omitempty"`
+	Audience    string                 `protobuf:"bytes,3,opt,name=audience,proto3" json:"audience,omitempty"`
+	Scope       string                 `protobuf:"bytes,4,opt,name=scope,proto3" json:"scope,omitempty"`
+	// Issuance and expiration timestamps, in seconds since the Unix epoch.
+	// expires_at is zero when Keycloak did not report a lifetime.
+	IssuedAt      int64 `protobuf:"varint,5,opt,name=issued_at,json=issuedAt,proto3" json:"issued_at,omitempty"`
+	ExpiresAt     int64 `protobuf:"varint,6,opt,name=expires_at,json=expiresAt,proto3" json:"expires_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Token) Reset() {
+	*x = Token{}
+	mi := &file_tokenapi_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Token) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Token) ProtoMessage() {}
+
+func (x *Token) ProtoReflect() protoreflect.Message {
+	mi := &file_tokenapi_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Token.ProtoReflect.Descriptor instead.
+func (*Token) Descriptor() ([]byte, []int) {
+	return file_tokenapi_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Token) GetAccessToken() string {
+	if x != nil {
+		return x.AccessToken
+	}
+	return ""
+}
+
+func (x *Token) GetTokenType() string {
+	if x != nil {
+		return x.TokenType
+	}
+	return ""
+}
+
+func (x *Token) GetAudience() string {
+	if x != nil {
+		return x.Audience
+	}
+	return ""
+}
+
+func (x *Token) GetScope() string {
+	if x != nil {
+		return x.Scope
+	}
+	return ""
+}
+
+func (x *Token) GetIssuedAt() int64 {
+	if x != nil {
+		return x.IssuedAt
+	}
+	return 0
+}
+
+func (x *Token) GetExpiresAt() int64 {
+	if x != nil {
+		return x.ExpiresAt
+	}
+	return 0
+}
+
+var File_tokenapi_proto protoreflect.FileDescriptor
+
+const file_tokenapi_proto_rawDesc = "" +
+	"\n" +
+	"\x0etokenapi.proto\x12\x1akeycloakspiffe.tokenapi.v1\"-\n" +
+	"\x0fGetTokenRequest\x12\x1a\n" +
+	"\baudience\x18\x01 \x01(\tR\baudience\"/\n" +
+	"\x11WatchTokenRequest\x12\x1a\n" +
+	"\baudience\x18\x01 \x01(\tR\baudience\"\xb7\x01\n" +
+	"\x05Token\x12!\n" +
+	"\faccess_token\x18\x01 \x01(\tR\vaccessToken\x12\x1d\n" +
+	"\n" +
+	"token_type\x18\x02 \x01(\tR\ttokenType\x12\x1a\n" +
+	"\baudience\x18\x03 \x01(\tR\baudience\x12\x14\n" +
+	"\x05scope\x18\x04 \x01(\tR\x05scope\x12\x1b\n" +
+	"\tissued_at\x18\x05 \x01(\x03R\bissuedAt\x12\x1d\n" +
+	"\n" +
+	"expires_at\x18\x06 \x01(\x03R\texpiresAt2\xcc\x01\n" +
+	"\fTokenService\x12Z\n" +
+	"\bGetToken\x12+.keycloakspiffe.tokenapi.v1.GetTokenRequest\x1a!.keycloakspiffe.tokenapi.v1.Token\x12`\n" +
+	"\n" +
+	"WatchToken\x12-.keycloakspiffe.tokenapi.v1.WatchTokenRequest\x1a!.keycloakspiffe.tokenapi.v1.Token0\x01BEZCgithub.com/ayatb/keycloak-poc/keycloak-spiffe/workload/pkg/tokenapib\x06proto3"
+
+var (
+	file_tokenapi_proto_rawDescOnce sync.Once
+	file_tokenapi_proto_rawDescData []byte
+)
+
+func file_tokenapi_proto_rawDescGZIP() []byte {
+	file_tokenapi_proto_rawDescOnce.Do(func() {
+		file_tokenapi_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_tokenapi_proto_rawDesc), len(file_tokenapi_proto_rawDesc)))
+	})
+	return file_tokenapi_proto_rawDescData
+}
+
+var file_tokenapi_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_tokenapi_proto_goTypes = []any{
+	(*GetTokenRequest)(nil),   // 0: keycloakspiffe.tokenapi.v1.GetTokenRequest
+	(*WatchTokenRequest)(nil), // 1: keycloakspiffe.tokenapi.v1.WatchTokenRequest
+	(*Token)(nil),             // 2: keycloakspiffe.tokenapi.v1.Token
+}
+var file_tokenapi_proto_depIdxs = []int32{
+	0, // 0: keycloakspiffe.tokenapi.v1.TokenService.GetToken:input_type -> keycloakspiffe.tokenapi.v1.GetTokenRequest
+	1, // 1: keycloakspiffe.tokenapi.v1.TokenService.WatchToken:input_type -> keycloakspiffe.tokenapi.v1.WatchTokenRequest
+	2, // 2: keycloakspiffe.tokenapi.v1.TokenService.GetToken:output_type -> keycloakspiffe.tokenapi.v1.Token
+	2, // 3: keycloakspiffe.tokenapi.v1.TokenService.WatchToken:output_type -> keycloakspiffe.tokenapi.v1.Token
+	2, // [2:4] is the sub-list for method output_type
+	0, // [0:2] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_tokenapi_proto_init() }
+func file_tokenapi_proto_init() {
+	if File_tokenapi_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_tokenapi_proto_rawDesc), len(file_tokenapi_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   3,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_tokenapi_proto_goTypes,
+		DependencyIndexes: file_tokenapi_proto_depIdxs,
+		MessageInfos:      file_tokenapi_proto_msgTypes,
+	}.Build()
+	File_tokenapi_proto = out.File
+	file_tokenapi_proto_goTypes = nil
+	file_tokenapi_proto_depIdxs = nil
+}
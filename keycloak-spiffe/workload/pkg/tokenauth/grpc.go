@@ -0,0 +1,103 @@
+// grpc.go
+package tokenauth
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryServerInterceptor returns a gRPC interceptor rejecting the calls
+// without a valid bearer token in their authorization metadata, as sent by
+// keycloakspiffe.PerRPCCredentials. The handlers get the claims with
+// FromContext.
+func UnaryServerInterceptor(v *Verifier, opts ...Option) grpc.UnaryServerInterceptor {
+	req := newRequirements(opts)
+	return func(ctx context.Context, r interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authenticateRPC(ctx, v, req, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, r)
+	}
+}
+
+// StreamServerInterceptor is the streaming counterpart of
+// UnaryServerInterceptor. The token is checked once, when the stream opens.
+func StreamServerInterceptor(v *Verifier, opts ...Option) grpc.StreamServerInterceptor {
+	req := newRequirements(opts)
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticateRPC(ss.Context(), v, req, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// authenticatedStream overrides the context of a stream with the claims.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// authenticateRPC verifies the bearer token of the incoming call and
+// returns ctx with its claims, or a gRPC status error.
+func authenticateRPC(ctx context.Context, v *Verifier, req requirements, method string) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) != 1 {
+		return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+	token, ok := BearerToken(values[0])
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+
+	claims, err := v.Verify(ctx, token)
+	if err == nil {
+		err = req.authorize(ctx, claims, func() PolicyInput { return rpcPolicyInput(ctx, md, method) })
+	}
+	switch {
+	case errors.Is(err, ErrInvalidToken):
+		slog.Debug("Rejected bearer token", "method", method, "error", err)
+		return nil, status.Error(codes.Unauthenticated, "invalid bearer token")
+	case errors.Is(err, ErrForbidden):
+		slog.Debug("Rejected bearer token", "method", method, "subject", claims.Subject, "error", err)
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	case err != nil:
+		slog.Warn("Bearer token validation failed", "method", method, "error", err)
+		return nil, status.Error(codes.Unavailable, "token validation unavailable")
+	}
+	return NewContext(ctx, claims), nil
+}
+
+// rpcPolicyInput describes the call of method to the policies, as a gRPC
+// request over HTTP/2.
+func rpcPolicyInput(ctx context.Context, md metadata.MD, method string) PolicyInput {
+	headers := make(map[string]string, len(md))
+	for name, values := range md {
+		if len(values) > 0 && !SecretHeader(name) {
+			headers[name] = values[0]
+		}
+	}
+	in := PolicyInput{Method: http.MethodPost, Path: method, Headers: headers}
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			in.PeerSPIFFEID = peerSPIFFEID(&info.State)
+		}
+	}
+	return in
+}
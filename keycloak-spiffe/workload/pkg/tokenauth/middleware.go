@@ -0,0 +1,203 @@
+// middleware.go
+package tokenauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+type claimsKey struct{}
+
+// NewContext returns a copy of ctx carrying the verified claims.
+func NewContext(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// FromContext returns the claims of the caller authenticated by the
+// middleware.
+func FromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*Claims)
+	return claims, ok
+}
+
+// ErrForbidden is wrapped by the errors of valid tokens lacking a role,
+// scope or permission required by the options, or denied by a policy.
+var ErrForbidden = errors.New("insufficient permissions")
+
+// Option adds a requirement on the claims of the verified tokens.
+type Option func(*requirements)
+
+type requirements struct {
+	realmRoles  []string
+	clientRoles map[string][]string
+	scopes      []string
+	permissions [][2]string
+	policies    []Policy
+}
+
+// RequireRealmRoles requires the tokens to grant all the realm roles.
+func RequireRealmRoles(roles ...string) Option {
+	return func(r *requirements) {
+		r.realmRoles = append(r.realmRoles, roles...)
+	}
+}
+
+// RequireClientRoles requires the tokens to grant all the roles of client,
+// from the resource_access claim.
+func RequireClientRoles(client string, roles ...string) Option {
+	return func(r *requirements) {
+		if r.clientRoles == nil {
+			r.clientRoles = map[string][]string{}
+		}
+		r.clientRoles[client] = append(r.clientRoles[client], roles...)
+	}
+}
+
+// RequireScopes requires the tokens to grant all the scopes.
+func RequireScopes(scopes ...string) Option {
+	return func(r *requirements) {
+		r.scopes = append(r.scopes, scopes...)
+	}
+}
+
+// RequirePermissions requires the tokens to be RPTs granting all the
+// scopes on resource, given by ID or name, or the resource alone without
+// scopes.
+func RequirePermissions(resource string, scopes ...string) Option {
+	return func(r *requirements) {
+		if len(scopes) == 0 {
+			scopes = []string{""}
+		}
+		for _, scope := range scopes {
+			r.permissions = append(r.permissions, [2]string{resource, scope})
+		}
+	}
+}
+
+func newRequirements(opts []Option) requirements {
+	var r requirements
+	for _, opt := range opts {
+		opt(&r)
+	}
+	return r
+}
+
+// check returns an error wrapping ErrForbidden when claims miss a
+// requirement.
+func (r requirements) check(claims *Claims) error {
+	for _, role := range r.realmRoles {
+		if !claims.HasRealmRole(role) {
+			return fmt.Errorf("%w: missing realm role %s", ErrForbidden, role)
+		}
+	}
+	for client, roles := range r.clientRoles {
+		for _, role := range roles {
+			if !claims.HasClientRole(client, role) {
+				return fmt.Errorf("%w: missing role %s of client %s", ErrForbidden, role, client)
+			}
+		}
+	}
+	for _, scope := range r.scopes {
+		if !claims.HasScope(scope) {
+			return fmt.Errorf("%w: missing scope %s", ErrForbidden, scope)
+		}
+	}
+	for _, p := range r.permissions {
+		if !claims.HasPermission(p[0], p[1]) {
+			if p[1] == "" {
+				return fmt.Errorf("%w: missing permission on %s", ErrForbidden, p[0])
+			}
+			return fmt.Errorf("%w: missing permission %s#%s", ErrForbidden, p[0], p[1])
+		}
+	}
+	return nil
+}
+
+// Authenticate verifies token with v and checks the requirements of opts,
+// which must not include policies: they need the request given to
+// AuthenticateRequest. The errors wrap ErrInvalidToken or ErrForbidden,
+// other errors mean the keys of the realm could not be fetched or opts
+// include policies.
+func Authenticate(ctx context.Context, v *Verifier, token string, opts ...Option) (*Claims, error) {
+	req := newRequirements(opts)
+	if len(req.policies) > 0 {
+		return nil, errPolicyRequest
+	}
+	claims, err := v.Verify(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.check(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// AuthenticateRequest is Authenticate for the request described by input,
+// also asking the policies of opts. Other errors also mean a policy could
+// not decide.
+func AuthenticateRequest(ctx context.Context, v *Verifier, token string, input PolicyInput, opts ...Option) (*Claims, error) {
+	claims, err := v.Verify(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if err := newRequirements(opts).authorize(ctx, claims, func() PolicyInput { return input }); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// BearerToken returns the token of an Authorization header value.
+func BearerToken(header string) (string, bool) {
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// Middleware returns an HTTP middleware answering 401 to the requests
+// without a valid bearer token, 403 to the ones missing a requirement of
+// opts or denied by its policies, 503 when the keys or a policy decision
+// are unavailable, and passing the claims of the others to next (see
+// FromContext).
+func Middleware(v *Verifier, opts ...Option) func(http.Handler) http.Handler {
+	req := newRequirements(opts)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := BearerToken(r.Header.Get("Authorization"))
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer`)
+				http.Error(w, "missing bearer token", http.StatusUnauthorized)
+				return
+			}
+
+			claims, err := v.Verify(r.Context(), token)
+			if err == nil {
+				err = req.authorize(r.Context(), claims, func() PolicyInput { return httpPolicyInput(r) })
+			}
+			switch {
+			case errors.Is(err, ErrInvalidToken):
+				slog.Debug("Rejected bearer token", "error", err)
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, "invalid bearer token", http.StatusUnauthorized)
+				return
+			case errors.Is(err, ErrForbidden):
+				slog.Debug("Rejected bearer token", "subject", claims.Subject, "error", err)
+				w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			case err != nil:
+				slog.Warn("Bearer token validation failed", "error", err)
+				http.Error(w, "token validation unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), claims)))
+		})
+	}
+}
@@ -0,0 +1,215 @@
+// policy.go
+package tokenauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// PolicyInput describes a request with a valid token to a Policy.
+type PolicyInput struct {
+	Claims *Claims
+	// Method and Path are the HTTP method and path of the request, POST
+	// and the full method name for a gRPC call.
+	Method string
+	Path   string
+	// Headers holds the first value of the request headers or metadata,
+	// by lowercase name, without the credentials (see SecretHeader).
+	Headers map[string]string
+	// PeerSPIFFEID is the SPIFFE ID of the mTLS client certificate, empty
+	// without one.
+	PeerSPIFFEID string
+}
+
+// Document returns the input document of the policy: the claims of the
+// token, as issued with the custom mapper claims, and the request.
+func (in PolicyInput) Document() map[string]any {
+	doc := map[string]any{
+		"method":         in.Method,
+		"path":           in.Path,
+		"headers":        in.Headers,
+		"peer_spiffe_id": in.PeerSPIFFEID,
+	}
+	if in.Claims != nil {
+		doc["subject"] = in.Claims.Subject
+		doc["claims"] = in.Claims.Raw
+	}
+	return doc
+}
+
+// Policy decides whether a request with a valid token is allowed, after
+// the role and scope requirements are met. An error denies the request as
+// unavailable rather than forbidden.
+type Policy interface {
+	Allow(ctx context.Context, input PolicyInput) (bool, error)
+}
+
+// PolicyFunc adapts a function to a Policy, such as a query of a Rego
+// engine embedded with github.com/open-policy-agent/opa/rego:
+//
+//	query, err := rego.New(rego.Query("data.httpapi.authz.allow"),
+//	    rego.Load([]string{"policy.rego"}, nil)).PrepareForEval(ctx)
+//	policy := tokenauth.PolicyFunc(func(ctx context.Context, in tokenauth.PolicyInput) (bool, error) {
+//	    rs, err := query.Eval(ctx, rego.EvalInput(in.Document()))
+//	    return rs.Allowed(), err
+//	})
+type PolicyFunc func(ctx context.Context, input PolicyInput) (bool, error)
+
+// Allow calls f(ctx, input).
+func (f PolicyFunc) Allow(ctx context.Context, input PolicyInput) (bool, error) {
+	return f(ctx, input)
+}
+
+// RequirePolicy requires the requests to be allowed by policy. It is only
+// evaluated by Middleware, the gRPC interceptors and AuthenticateRequest,
+// which know the request.
+func RequirePolicy(policy Policy) Option {
+	return func(r *requirements) {
+		r.policies = append(r.policies, policy)
+	}
+}
+
+// authorize checks the requirements on claims, then asks the policies
+// about the request described by input.
+func (r requirements) authorize(ctx context.Context, claims *Claims, input func() PolicyInput) error {
+	if err := r.check(claims); err != nil {
+		return err
+	}
+	if len(r.policies) == 0 {
+		return nil
+	}
+	in := input()
+	in.Claims = claims
+	for _, policy := range r.policies {
+		allowed, err := policy.Allow(ctx, in)
+		if err != nil {
+			return fmt.Errorf("policy decision: %w", err)
+		}
+		if !allowed {
+			return fmt.Errorf("%w: denied by policy", ErrForbidden)
+		}
+	}
+	return nil
+}
+
+// OPA is a Policy asking an Open Policy Agent, usually a sidecar, through
+// its Data API. It is safe for concurrent use.
+type OPA struct {
+	client *http.Client
+	url    string
+}
+
+// NewOPA returns an OPA policy evaluating the rule of decisionURL, such as
+// http://127.0.0.1:8181/v1/data/httpapi/authz/allow. The rule allows the
+// request when it is true, or an object with allow set to true; an
+// undefined rule denies it.
+func NewOPA(client *http.Client, decisionURL string) *OPA {
+	return &OPA{client: client, url: decisionURL}
+}
+
+// Allow posts the input document to OPA and returns its decision.
+func (o *OPA) Allow(ctx context.Context, input PolicyInput) (bool, error) {
+	body, err := json.Marshal(map[string]any{"input": input.Document()})
+	if err != nil {
+		return false, fmt.Errorf("encoding opa input: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.url, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("creating opa request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("opa request: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, fmt.Errorf("reading opa response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("opa returned HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	var decision struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(respBody, &decision); err != nil {
+		return false, fmt.Errorf("decoding opa response: %w", err)
+	}
+	if len(decision.Result) == 0 {
+		return false, nil
+	}
+	var result struct {
+		Allow bool `json:"allow"`
+	}
+	if err := json.Unmarshal(decision.Result, &result.Allow); err == nil {
+		return result.Allow, nil
+	}
+	if err := json.Unmarshal(decision.Result, &result); err != nil {
+		return false, errors.New("opa decision is neither a boolean nor an object with allow")
+	}
+	return result.Allow, nil
+}
+
+// errPolicyRequest fails the authentications without a request when the
+// requirements include policies, rather than allow them unasked.
+var errPolicyRequest = errors.New("the policies decide on a request: use AuthenticateRequest")
+
+// secretHeaders are the lowercase names of the credential headers kept
+// from the policies, whose decision logs would record them.
+var secretHeaders = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+	"cookie":              true,
+	"set-cookie":          true,
+	"dpop":                true,
+	"x-consul-token":      true,
+	"x-vault-token":       true,
+}
+
+// SecretHeader reports whether the header name, in any case, carries a
+// credential and is left out of PolicyInput.Headers: the Authorization,
+// cookie and DPoP headers, and the X- headers naming a token, such as
+// X-Vault-Token or X-Forwarded-Access-Token.
+func SecretHeader(name string) bool {
+	name = strings.ToLower(name)
+	return secretHeaders[name] || strings.HasPrefix(name, "x-") && strings.Contains(name, "token")
+}
+
+// httpPolicyInput describes r to the policies.
+func httpPolicyInput(r *http.Request) PolicyInput {
+	headers := make(map[string]string, len(r.Header))
+	for name, values := range r.Header {
+		if len(values) > 0 && !SecretHeader(name) {
+			headers[strings.ToLower(name)] = values[0]
+		}
+	}
+	return PolicyInput{
+		Method:       r.Method,
+		Path:         r.URL.Path,
+		Headers:      headers,
+		PeerSPIFFEID: peerSPIFFEID(r.TLS),
+	}
+}
+
+// peerSPIFFEID returns the SPIFFE ID of the client certificate of state.
+func peerSPIFFEID(state *tls.ConnectionState) string {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	for _, uri := range state.PeerCertificates[0].URIs {
+		if uri.Scheme == "spiffe" {
+			return uri.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,307 @@
+// Package tokenauth validates the Keycloak access tokens received by the
+// services called by SPIFFE workloads, against the JWKS of the realm.
+package tokenauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	_ "crypto/sha256" // SHA-256 for ES256, RS256 and PS256
+	_ "crypto/sha512" // SHA-384 and SHA-512 for the other algorithms
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken is wrapped by the errors of the tokens failing
+// validation, as opposed to the failures to fetch the realm keys.
+var ErrInvalidToken = errors.New("invalid token")
+
+// Claims are the claims of a Keycloak access token.
+type Claims struct {
+	Issuer          string       `json:"iss"`
+	Subject         string       `json:"sub"`
+	Audience        audienceList `json:"aud"`
+	ExpiresAt       int64        `json:"exp"`
+	IssuedAt        int64        `json:"iat"`
+	NotBefore       int64        `json:"nbf,omitempty"`
+	ID              string       `json:"jti,omitempty"`
+	Type            string       `json:"typ,omitempty"`
+	AuthorizedParty string       `json:"azp,omitempty"`
+	ClientID        string       `json:"client_id,omitempty"`
+	Scope           string       `json:"scope,omitempty"`
+	Actor           *Actor       `json:"act,omitempty"`
+	RealmAccess     struct {
+		Roles []string `json:"roles"`
+	} `json:"realm_access"`
+	ResourceAccess map[string]struct {
+		Roles []string `json:"roles"`
+	} `json:"resource_access"`
+	// Authorization holds the permissions of a requesting party token
+	// (RPT) of Keycloak Authorization Services, nil for other tokens.
+	Authorization *struct {
+		Permissions []Permission `json:"permissions"`
+	} `json:"authorization,omitempty"`
+
+	// Raw holds the undecoded claims, for the custom mapper claims.
+	Raw json.RawMessage `json:"-"`
+}
+
+// Actor is the act claim of a delegated token (RFC 8693): the party acting
+// on behalf of the subject, itself nesting the previous actor of a chain.
+type Actor struct {
+	Subject  string `json:"sub"`
+	Issuer   string `json:"iss,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+	Actor    *Actor `json:"act,omitempty"`
+}
+
+// Permission is a permission granted by an RPT: a resource and the scopes
+// granted on it, or scopes alone.
+type Permission struct {
+	ResourceID   string   `json:"rsid,omitempty"`
+	ResourceName string   `json:"rsname,omitempty"`
+	Scopes       []string `json:"scopes,omitempty"`
+}
+
+// Chain returns the subjects of the actors, the current actor first.
+func (a *Actor) Chain() []string {
+	var chain []string
+	for ; a != nil; a = a.Actor {
+		chain = append(chain, a.Subject)
+	}
+	return chain
+}
+
+// HasRealmRole reports whether the token grants the realm role.
+func (c *Claims) HasRealmRole(role string) bool {
+	return contains(c.RealmAccess.Roles, role)
+}
+
+// HasClientRole reports whether the token grants the role of client.
+func (c *Claims) HasClientRole(client, role string) bool {
+	return contains(c.ResourceAccess[client].Roles, role)
+}
+
+// HasScope reports whether the token grants scope.
+func (c *Claims) HasScope(scope string) bool {
+	return contains(strings.Fields(c.Scope), scope)
+}
+
+// HasPermission reports whether the token is an RPT granting scope on
+// resource, given by ID or name. An empty scope asks for the resource
+// alone, an empty resource for the scope on any resource.
+func (c *Claims) HasPermission(resource, scope string) bool {
+	if c.Authorization == nil {
+		return false
+	}
+	for _, p := range c.Authorization.Permissions {
+		if resource != "" && resource != p.ResourceID && resource != p.ResourceName {
+			continue
+		}
+		if scope == "" || contains(p.Scopes, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// audienceList decodes the aud claim, a string or an array of strings.
+type audienceList []string
+
+func (a *audienceList) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = audienceList{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// Verifier validates access tokens issued by a realm. It is safe for
+// concurrent use.
+type Verifier struct {
+	keys      *KeySet
+	issuer    string
+	audiences []string
+	leeway    time.Duration
+}
+
+// VerifierOption configures a Verifier.
+type VerifierOption func(*Verifier)
+
+// WithAudience requires the tokens to have one of audiences in their aud
+// claim. Keycloak only sets it with an audience mapper on the client scope.
+func WithAudience(audiences ...string) VerifierOption {
+	return func(v *Verifier) {
+		v.audiences = append(v.audiences, audiences...)
+	}
+}
+
+// WithLeeway tolerates clock skew of up to d on the exp and nbf claims.
+func WithLeeway(d time.Duration) VerifierOption {
+	return func(v *Verifier) {
+		v.leeway = d
+	}
+}
+
+// NewVerifier returns a Verifier accepting the tokens signed by keys and
+// issued by issuer, the realm URL.
+func NewVerifier(keys *KeySet, issuer string, opts ...VerifierOption) *Verifier {
+	v := &Verifier{keys: keys, issuer: strings.TrimRight(issuer, "/")}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// Verify checks the signature, issuer, audience and validity period of
+// token and returns its claims.
+func (v *Verifier) Verify(ctx context.Context, token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a signed JWT", ErrInvalidToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: decoding header: %v", ErrInvalidToken, err)
+	}
+	hash, err := algorithmHash(header.Alg)
+	if err != nil {
+		return nil, err
+	}
+	key, err := v.keys.Key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: decoding signature: %v", ErrInvalidToken, err)
+	}
+	if err := verifySignature(header.Alg, hash, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: decoding claims: %v", ErrInvalidToken, err)
+	}
+	claims := &Claims{Raw: payload}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, fmt.Errorf("%w: decoding claims: %v", ErrInvalidToken, err)
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// checkClaims validates the registered claims of an authentic token.
+func (v *Verifier) checkClaims(c *Claims) error {
+	now := time.Now()
+	switch {
+	case c.Issuer != v.issuer:
+		return fmt.Errorf("%w: issuer %q, want %q", ErrInvalidToken, c.Issuer, v.issuer)
+	case c.Type != "" && !strings.EqualFold(c.Type, "Bearer"):
+		// ID and refresh tokens are signed with the same keys.
+		return fmt.Errorf("%w: %s token is not an access token", ErrInvalidToken, c.Type)
+	case c.ExpiresAt == 0:
+		return fmt.Errorf("%w: no exp claim", ErrInvalidToken)
+	case now.After(time.Unix(c.ExpiresAt, 0).Add(v.leeway)):
+		return fmt.Errorf("%w: expired at %s", ErrInvalidToken, time.Unix(c.ExpiresAt, 0).UTC().Format(time.RFC3339))
+	case c.NotBefore != 0 && now.Add(v.leeway).Before(time.Unix(c.NotBefore, 0)):
+		return fmt.Errorf("%w: not valid before %s", ErrInvalidToken, time.Unix(c.NotBefore, 0).UTC().Format(time.RFC3339))
+	}
+	if len(v.audiences) > 0 {
+		for _, want := range v.audiences {
+			if contains(c.Audience, want) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: audience %v, want one of %v", ErrInvalidToken, []string(c.Audience), v.audiences)
+	}
+	return nil
+}
+
+// algorithmHash returns the hash of a supported JWS algorithm. The none
+// and HMAC algorithms are rejected.
+func algorithmHash(alg string) (crypto.Hash, error) {
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		return crypto.SHA256, nil
+	case "RS384", "PS384", "ES384":
+		return crypto.SHA384, nil
+	case "RS512", "PS512", "ES512":
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, alg)
+}
+
+// verifySignature checks the JWS signature sig of signingInput.
+func verifySignature(alg string, hash crypto.Hash, key crypto.PublicKey, signingInput string, sig []byte) error {
+	h := hash.New()
+	h.Write([]byte(signingInput))
+	digest := h.Sum(nil)
+
+	var err error
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+		case "PS":
+			err = rsa.VerifyPSS(pub, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		default:
+			err = fmt.Errorf("algorithm %s does not match an RSA key", alg)
+		}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(sig) != 2*size {
+			err = fmt.Errorf("algorithm %s does not match a %s key", alg, pub.Curve.Params().Name)
+			break
+		}
+		// JWS uses the fixed-size R || S encoding instead of ASN.1.
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			err = errors.New("ECDSA verification failed")
+		}
+	default:
+		err = fmt.Errorf("unsupported key type %T", key)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: bad signature: %v", ErrInvalidToken, err)
+	}
+	return nil
+}
+
+// decodeSegment decodes a base64url JSON segment of a JWT into v.
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+// Package vault logs SPIFFE workloads in to HashiCorp Vault with the JWT/OIDC
+// auth method, presenting their JWT-SVID or a Keycloak access token.
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultMount is the path the JWT/OIDC auth method is enabled at by
+// default, vault auth enable jwt.
+const DefaultMount = "jwt"
+
+// Auth is the auth block of a successful login.
+type Auth struct {
+	ClientToken   string   `json:"client_token"`
+	Accessor      string   `json:"accessor"`
+	Policies      []string `json:"policies"`
+	TokenPolicies []string `json:"token_policies"`
+	LeaseDuration int      `json:"lease_duration"`
+	Renewable     bool     `json:"renewable"`
+	EntityID      string   `json:"entity_id"`
+
+	// Raw holds the undecoded auth block.
+	Raw json.RawMessage `json:"-"`
+}
+
+// Lease returns the lifetime of the Vault token, zero for a token that does
+// not expire.
+func (a *Auth) Lease() time.Duration {
+	return time.Duration(a.LeaseDuration) * time.Second
+}
+
+// Error is returned when Vault rejects a request, with the messages of its
+// errors field.
+type Error struct {
+	StatusCode int
+	Errors     []string
+}
+
+func (e *Error) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("vault returned HTTP %d", e.StatusCode)
+	}
+	return fmt.Sprintf("vault returned HTTP %d: %s", e.StatusCode, strings.Join(e.Errors, "; "))
+}
+
+// IsTransient reports whether err may succeed on retry: network errors,
+// 5xx answers (a sealed or standby Vault) and 429.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var vaultErr *Error
+	if errors.As(err, &vaultErr) {
+		return vaultErr.StatusCode >= 500 || vaultErr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// Login logs in to the Vault server at addr with the JWT/OIDC auth method
+// enabled at mount, as role, presenting jwt. namespace is the Vault
+// Enterprise namespace, empty for the root namespace.
+func Login(ctx context.Context, client *http.Client, addr, namespace, mount, role, jwt string) (*Auth, error) {
+	body, err := json.Marshal(map[string]string{"role": role, "jwt": jwt})
+	if err != nil {
+		return nil, fmt.Errorf("encoding vault login: %w", err)
+	}
+	endpoint := strings.TrimRight(addr, "/") + "/v1/auth/" + strings.Trim(mount, "/") + "/login"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("creating vault login request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("calling vault login: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading vault login response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		vaultErr := &Error{StatusCode: resp.StatusCode}
+		var errBody struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(respBody, &errBody) == nil {
+			vaultErr.Errors = errBody.Errors
+		}
+		return nil, vaultErr
+	}
+
+	var out struct {
+		Auth json.RawMessage `json:"auth"`
+	}
+	if err := json.Unmarshal(respBody, &out); err != nil {
+		return nil, fmt.Errorf("decoding vault login response: %w", err)
+	}
+	auth := &Auth{Raw: out.Auth}
+	if len(out.Auth) == 0 || json.Unmarshal(out.Auth, auth) != nil || auth.ClientToken == "" {
+		return nil, errors.New("vault login response has no client token")
+	}
+	return auth, nil
+}